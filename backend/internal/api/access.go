@@ -0,0 +1,99 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SubscriptionAuthorizer answers "has this client paid?" for the DNS
+// server. It maps the client IP to a MAC and looks for an active,
+// unexpired subscription.
+type SubscriptionAuthorizer struct {
+	DB     *sql.DB
+	Router interface {
+		FindMACbyIP(ip string) (string, error)
+	}
+}
+
+func (a *SubscriptionAuthorizer) IsAuthorized(ip string) bool {
+	// Queries from the host itself are never captured
+	if ip == "127.0.0.1" || ip == "::1" {
+		return true
+	}
+	if a.Router == nil {
+		return false
+	}
+
+	mac, err := a.Router.FindMACbyIP(ip)
+	if err != nil {
+		return false
+	}
+	return HasActiveSubscription(a.DB, mac)
+}
+
+// HasActiveSubscription reports whether mac has an active subscription
+// that has not reached its end time yet.
+func HasActiveSubscription(db *sql.DB, mac string) bool {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*)
+		FROM subscriptions
+		WHERE mac_address = ? AND status = 'active' AND end_time > ?`, mac, time.Now()).Scan(&count)
+	return err == nil && count > 0
+}
+
+var (
+	errDeviceUnknown = errors.New("could not identify your device")
+	errNotYourDevice = errors.New("you can only act on your own device")
+)
+
+// ownMAC returns the MAC of the device making the request, found with the
+// same IP-to-MAC lookup as WhoAmI. Portal clients can only act on their
+// own device: a MAC they claim must be that one.
+func ownMAC(lookup interface {
+	FindMACbyIP(ip string) (string, error)
+}, r *http.Request, claimed string) (string, error) {
+	if lookup == nil {
+		return "", errDeviceUnknown
+	}
+	mac, err := lookup.FindMACbyIP(requestIP(r))
+	if err != nil || mac == "" {
+		return "", errDeviceUnknown
+	}
+	if claimed != "" && !strings.EqualFold(claimed, mac) {
+		return "", errNotYourDevice
+	}
+	return strings.ToLower(mac), nil
+}
+
+// parseMAC checks a MAC address sent by a client and returns it in the
+// canonical lower-case, colon-separated form. Nothing else may reach the
+// router, which puts MACs into shell commands.
+func parseMAC(s string) (string, error) {
+	hw, err := net.ParseMAC(strings.TrimSpace(s))
+	if err != nil || len(hw) != 6 {
+		return "", &clientError{http.StatusBadRequest, "Invalid MAC address"}
+	}
+	return hw.String(), nil
+}
+
+// clientError is a failure the portal user should be told about, with the
+// status to answer with. Other errors are answered with 500.
+type clientError struct {
+	status  int
+	message string
+}
+
+func (e *clientError) Error() string { return e.message }
+
+func writeError(w http.ResponseWriter, err error) {
+	if ce, ok := err.(*clientError); ok {
+		http.Error(w, ce.message, ce.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	testClientIP = "192.168.1.50"
+	testOtherMAC = "aa:bb:cc:dd:ee:99"
+)
+
+// portalRequest is a request from the test client's address.
+func portalRequest(method, target, body string) *http.Request {
+	r := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+	r.RemoteAddr = testClientIP + ":40000"
+	return r
+}
+
+func TestOwnMAC(t *testing.T) {
+	router := newFakeRouter(map[string]string{testClientIP: "AA:BB:CC:DD:EE:01"})
+	r := portalRequest("GET", "/", "")
+
+	cases := []struct {
+		lookup  *fakeRouter
+		claimed string
+		mac     string
+		err     error
+	}{
+		{router, "", testClientMAC, nil},
+		{router, "aa:bb:cc:dd:ee:01", testClientMAC, nil},
+		{router, testOtherMAC, "", errNotYourDevice},
+		{newFakeRouter(map[string]string{}), "", "", errDeviceUnknown},
+		{newFakeRouter(map[string]string{}), testClientMAC, "", errDeviceUnknown},
+	}
+	for _, c := range cases {
+		mac, err := ownMAC(c.lookup, r, c.claimed)
+		if mac != c.mac || err != c.err {
+			t.Errorf("ownMAC(claimed %q) = %q, %v; want %q, %v", c.claimed, mac, err, c.mac, c.err)
+		}
+	}
+	if _, err := ownMAC(nil, r, ""); err != errDeviceUnknown {
+		t.Errorf("ownMAC without a router = %v", err)
+	}
+}
+
+func TestLogoutOnlyBlocksCaller(t *testing.T) {
+	router := newFakeRouter(map[string]string{testClientIP: testClientMAC})
+	h := &AuthHandler{Router: router}
+
+	w := httptest.NewRecorder()
+	h.Logout(w, portalRequest("POST", "/api/auth/logout?mac="+testOtherMAC, ""))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("logout of another device: %d, want 403", w.Code)
+	}
+	if blocked := router.blockedMACs(); len(blocked) != 0 {
+		t.Fatalf("blocked %v for another caller", blocked)
+	}
+
+	w = httptest.NewRecorder()
+	h.Logout(w, portalRequest("POST", "/api/auth/logout?mac="+testClientMAC, ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("own logout: %d %s", w.Code, w.Body)
+	}
+	if blocked := router.blockedMACs(); len(blocked) != 1 || blocked[0] != testClientMAC {
+		t.Errorf("blocked %v, want %s", blocked, testClientMAC)
+	}
+
+	// A caller the router cannot place cannot log anyone out
+	unknown := portalRequest("POST", "/api/auth/logout?mac="+testClientMAC, "")
+	unknown.RemoteAddr = "192.168.1.77:40000"
+	w = httptest.NewRecorder()
+	h.Logout(w, unknown)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("logout from an unknown address: %d, want 403", w.Code)
+	}
+}
+
+func TestPortalRejectsOtherMACInBody(t *testing.T) {
+	h, _, router := newTestPayments(t)
+	subs := h.Subscriptions
+	vouchers := &VouchersHandler{DB: subs.DB, Subscriptions: subs}
+	body := `{"plan_id": 1, "code": "ABCD-EFGH", "transaction_id": "UTR123456789", "mac_address": "` + testOtherMAC + `"}`
+
+	for name, handler := range map[string]http.HandlerFunc{
+		"request-plan":   subs.RequestPlan,
+		"redeem-voucher": vouchers.Redeem,
+		"payment order":  h.CreateOrder,
+	} {
+		w := httptest.NewRecorder()
+		handler(w, portalRequest("POST", "/", body))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s for another device: %d %s, want 403", name, w.Code, w.Body)
+		}
+	}
+	w := httptest.NewRecorder()
+	subs.CheckStatus(w, portalRequest("GET", "/api/auth/status?mac="+testOtherMAC, ""))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status of another device: %d, want 403", w.Code)
+	}
+
+	var n int
+	subs.DB.QueryRow("SELECT COUNT(*) FROM subscriptions").Scan(&n)
+	if n != 0 || router.isAllowed(testOtherMAC) {
+		t.Errorf("request for another device was acted on (%d subscriptions)", n)
+	}
+}
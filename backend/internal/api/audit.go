@@ -0,0 +1,171 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/user/wifi-control-system/internal/audit"
+	"github.com/user/wifi-control-system/internal/db"
+)
+
+const (
+	auditPageSize    = 50
+	auditMaxPageSize = 500
+	auditExportLimit = 100000
+)
+
+type AuditHandler struct {
+	DB *sql.DB
+}
+
+// GetEntries lists audit entries, newest first. Filters: actor, action
+// (prefix), mac, subscription_id, from, to (RFC 3339 or YYYY-MM-DD), with
+// page and limit for pagination.
+func (h *AuditHandler) GetEntries(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 1 {
+		limit = auditPageSize
+	}
+	if limit > auditMaxPageSize {
+		limit = auditMaxPageSize
+	}
+
+	total, err := audit.Count(h.DB, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entries, err := audit.Query(h.DB, filter, limit, (page-1)*limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries": entries,
+		"total":   total,
+		"page":    page,
+		"limit":   limit,
+	})
+}
+
+// ExportEntries downloads the entries matching the same filters as CSV.
+func (h *AuditHandler) ExportEntries(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := audit.Query(h.DB, filter, auditExportLimit, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit.From(r).Action = "audit.export"
+	audit.From(r).Details = fmt.Sprintf("%d entries", len(entries))
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=audit-%s.csv", time.Now().Format("20060102-150405")))
+	out := csv.NewWriter(w)
+	out.Write([]string{"id", "time", "actor", "action", "target_mac", "subscription_id", "before", "after", "source_ip", "status", "details"})
+	for _, e := range entries {
+		subID := ""
+		if e.SubscriptionID != 0 {
+			subID = strconv.Itoa(e.SubscriptionID)
+		}
+		out.Write([]string{
+			strconv.FormatInt(e.ID, 10), e.CreatedAt.Format(time.RFC3339), e.Actor, e.Action, e.TargetMAC, subID,
+			stateString(e.Before), stateString(e.After), e.SourceIP, strconv.Itoa(e.Status), e.Details,
+		})
+	}
+	out.Flush()
+}
+
+func auditFilter(r *http.Request) (audit.Filter, error) {
+	q := r.URL.Query()
+	f := audit.Filter{
+		Actor:     q.Get("actor"),
+		Action:    q.Get("action"),
+		TargetMAC: q.Get("mac"),
+	}
+	if v := q.Get("subscription_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid subscription_id")
+		}
+		f.SubscriptionID = id
+	}
+	var err error
+	if f.From, err = parseAuditTime(q.Get("from"), false); err != nil {
+		return f, err
+	}
+	if f.To, err = parseAuditTime(q.Get("to"), true); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// parseAuditTime accepts RFC 3339 or a date; a bare "to" date includes
+// that whole day.
+func parseAuditTime(v string, endOfDay bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q", v)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func stateString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// subscriptionState is the before/after snapshot the audit log keeps for a
+// subscription.
+func subscriptionState(subs db.Subscriptions, id int) map[string]interface{} {
+	sub, err := subs.Get(id)
+	if err != nil {
+		return nil
+	}
+	state := map[string]interface{}{"mac_address": sub.MacAddress, "plan_id": sub.PlanID, "status": sub.Status}
+	if !sub.EndTime.IsZero() {
+		state["end_time"] = sub.EndTime
+	}
+	return state
+}
+
+// describe fills in the audit entry for a request acting on a subscription.
+func describe(r *http.Request, action string, subID int, mac string) *audit.Entry {
+	e := audit.From(r)
+	e.Action = action
+	e.SubscriptionID = subID
+	e.TargetMAC = mac
+	return e
+}
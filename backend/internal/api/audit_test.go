@@ -0,0 +1,101 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/user/wifi-control-system/internal/audit"
+)
+
+func newTestAudit(t *testing.T) *AuditHandler {
+	t.Helper()
+	h := &AuditHandler{DB: newTestStore(t).DB}
+	day := time.Date(2026, 10, 1, 12, 0, 0, 0, time.Local)
+	for _, e := range []audit.Entry{
+		{CreatedAt: day, Actor: "alice", Action: "subscription.approve", TargetMAC: testClientMAC, SubscriptionID: 3,
+			After: map[string]string{"status": "active"}},
+		{CreatedAt: day.Add(time.Hour), Actor: "bob", Action: "subscription.revoke", TargetMAC: testClientMAC, SubscriptionID: 3},
+		{CreatedAt: day.AddDate(0, 0, 1), Actor: "alice", Action: "device.block", TargetMAC: testOtherMAC, Details: "by hand, again"},
+	} {
+		audit.Record(h.DB, e)
+	}
+	return h
+}
+
+func TestGetAuditEntriesFilters(t *testing.T) {
+	h := newTestAudit(t)
+	for query, want := range map[string]int{
+		"":                               3,
+		"?actor=alice":                   2,
+		"?action=subscription.":          2,
+		"?mac=AA:BB:CC:DD:EE:01":         2,
+		"?subscription_id=3&actor=bob":   1,
+		"?from=2026-10-02":               1,
+		"?to=2026-10-01":                 2,
+		"?from=2026-10-01&to=2026-10-01": 2,
+		"?from=2026-09-30T00:00:00Z":     3,
+	} {
+		w := httptest.NewRecorder()
+		h.GetEntries(w, httptest.NewRequest("GET", "/api/admin/audit"+query, nil))
+		var resp struct {
+			Entries []audit.Entry `json:"entries"`
+			Total   int           `json:"total"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("%q: %v", query, err)
+		}
+		if resp.Total != want || len(resp.Entries) != want {
+			t.Errorf("%q: total %d, %d entries; want %d", query, resp.Total, len(resp.Entries), want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.GetEntries(w, httptest.NewRequest("GET", "/api/admin/audit?limit=1&page=2", nil))
+	var page struct {
+		Entries []audit.Entry `json:"entries"`
+		Total   int           `json:"total"`
+	}
+	json.NewDecoder(w.Body).Decode(&page)
+	if page.Total != 3 || len(page.Entries) != 1 || page.Entries[0].Actor != "bob" {
+		t.Errorf("page 2 of 1 = %+v", page)
+	}
+
+	for _, query := range []string{"?from=yesterday", "?subscription_id=three"} {
+		w := httptest.NewRecorder()
+		h.GetEntries(w, httptest.NewRequest("GET", "/api/admin/audit"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestExportAuditEntries(t *testing.T) {
+	h := newTestAudit(t)
+	w := httptest.NewRecorder()
+	h.ExportEntries(w, httptest.NewRequest("GET", "/api/admin/audit/export?actor=alice", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("ExportEntries: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("got %d rows, want a header and 2 entries", len(rows))
+	}
+	if rows[0][0] != "id" || rows[0][2] != "actor" || rows[0][10] != "details" {
+		t.Errorf("header = %q", rows[0])
+	}
+	block, approve := rows[1], rows[2]
+	if block[3] != "device.block" || block[4] != testOtherMAC || block[5] != "" || block[10] != "by hand, again" {
+		t.Errorf("device.block row = %q", block)
+	}
+	if approve[3] != "subscription.approve" || approve[5] != "3" || approve[7] != `{"status":"active"}` {
+		t.Errorf("subscription.approve row = %q", approve)
+	}
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// CaptivePortalHandler serves the RFC 8908 Captive Portal API. Clients learn
+// its URL from DHCP option 114 or the IPv6 RA option (RFC 8910) and query
+// it instead of guessing from probe URLs, so iOS/Android can show the
+// portal and the remaining session time natively.
+type CaptivePortalHandler struct {
+	DB     *sql.DB
+	Router interface {
+		FindMACbyIP(ip string) (string, error)
+	}
+	// PortalURL is the login page sent to captive clients.
+	PortalURL string
+}
+
+// CaptivePortalStatus is the RFC 8908 JSON document.
+type CaptivePortalStatus struct {
+	Captive          bool   `json:"captive"`
+	UserPortalURL    string `json:"user-portal-url,omitempty"`
+	SecondsRemaining *int64 `json:"seconds-remaining,omitempty"`
+	BytesRemaining   *int64 `json:"bytes-remaining,omitempty"`
+	CanExtendSession bool   `json:"can-extend-session,omitempty"`
+}
+
+func (h *CaptivePortalHandler) GetStatus(w http.ResponseWriter, r *http.Request) {
+	status := CaptivePortalStatus{Captive: true, UserPortalURL: h.PortalURL}
+
+	mac := ""
+	if h.Router != nil {
+		if m, err := h.Router.FindMACbyIP(requestIP(r)); err == nil {
+			mac = m
+		}
+	}
+
+	if mac != "" {
+		var end sql.NullTime
+		var rootID int
+		var dataLimitMB int64
+		err := h.DB.QueryRow(`
+			SELECT s.end_time, COALESCE(s.parent_subscription_id, s.id), COALESCE(p.data_limit_mb, 0)
+			FROM subscriptions s
+			LEFT JOIN plans p ON s.plan_id = p.id
+			WHERE s.mac_address = ? AND s.status = 'active' AND s.end_time > ?
+			ORDER BY s.end_time DESC
+			LIMIT 1`, mac, time.Now()).Scan(&end, &rootID, &dataLimitMB)
+		if err == nil && end.Valid {
+			bytesUsed := familyBytesUsed(h.DB, rootID)
+			seconds := int64(time.Until(end.Time).Seconds())
+			status.Captive = false
+			status.SecondsRemaining = &seconds
+			status.CanExtendSession = true
+			if dataLimitMB > 0 {
+				bytes := dataLimitMB*1024*1024 - bytesUsed
+				if bytes < 0 {
+					bytes = 0
+				}
+				status.BytesRemaining = &bytes
+			}
+		}
+	}
+
+	// RFC 8908: the response is per-client and must not be shared by caches
+	w.Header().Set("Content-Type", "application/captive+json")
+	w.Header().Set("Cache-Control", "private")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,21 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestIPIgnoresForwardedForFromClients(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/captive-portal", nil)
+	r.RemoteAddr = "192.168.1.50:41000"
+	r.Header.Set("X-Forwarded-For", "192.168.1.77")
+	if ip := requestIP(r); ip != "192.168.1.50" {
+		t.Errorf("client-supplied X-Forwarded-For was believed: %s", ip)
+	}
+
+	// A local reverse proxy (TLS terminator, dev server) passes the client on
+	r.RemoteAddr = "127.0.0.1:52000"
+	if ip := requestIP(r); ip != "192.168.1.77" {
+		t.Errorf("requestIP behind a local proxy = %s, want 192.168.1.77", ip)
+	}
+}
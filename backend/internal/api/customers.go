@@ -0,0 +1,619 @@
+package api
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/user/wifi-control-system/internal/audit"
+	"github.com/user/wifi-control-system/internal/auth"
+	"github.com/user/wifi-control-system/internal/router"
+	"github.com/user/wifi-control-system/internal/sms"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	otpTTL            = 5 * time.Minute
+	otpResendInterval = 30 * time.Second
+	otpMaxAttempts    = 5
+	// One client IP may have this many codes sent per window, whatever
+	// the numbers, so the portal cannot be used to text-bomb phones or
+	// run up the SMS bill
+	otpPerIPLimit  = 5
+	otpPerIPWindow = 15 * time.Minute
+)
+
+type Customer struct {
+	ID        int       `json:"id"`
+	Mobile    string    `json:"mobile"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Entitlement is an active plan of a customer and the devices using it.
+type Entitlement struct {
+	SubscriptionID int       `json:"subscription_id"`
+	PlanName       string    `json:"plan_name"`
+	EndTime        time.Time `json:"end_time"`
+	MaxDevices     int       `json:"max_devices"`
+	Devices        []string  `json:"devices"`
+	BytesUsed      int64     `json:"bytes_used"`
+	DataLimitMB    int       `json:"data_limit_mb"`
+}
+
+// CustomersHandler gives paying customers an account keyed by their mobile
+// number, so access follows the person rather than one MAC. A plan's
+// subscription is the parent; each extra device gets a child subscription
+// that shares the parent's end time and data allowance, up to the plan's
+// max_devices.
+type CustomersHandler struct {
+	DB            *sql.DB
+	SMS           sms.Sender
+	Auth          *auth.AuthService
+	Subscriptions *SubscriptionsHandler
+
+	otpSends otpLimiter
+}
+
+// otpLimiter counts the codes sent to each client IP in the last
+// otpPerIPWindow. The zero value is ready to use.
+type otpLimiter struct {
+	mu   sync.Mutex
+	sent map[string][]time.Time
+}
+
+// allow records a send for ip and reports whether it is within the limit.
+func (l *otpLimiter) allow(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sent == nil {
+		l.sent = make(map[string][]time.Time)
+	}
+	for key, times := range l.sent {
+		recent := times[:0]
+		for _, t := range times {
+			if now.Sub(t) < otpPerIPWindow {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) == 0 {
+			delete(l.sent, key)
+		} else {
+			l.sent[key] = recent
+		}
+	}
+	if len(l.sent[ip]) >= otpPerIPLimit {
+		return false
+	}
+	l.sent[ip] = append(l.sent[ip], now)
+	return true
+}
+
+// RequestOTP texts a one-time login code to a mobile number.
+func (h *CustomersHandler) RequestOTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Mobile string `json:"mobile"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mobile, err := normalizeMobile(req.Mobile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var sentAt sql.NullTime
+	h.DB.QueryRow("SELECT sent_at FROM otp_codes WHERE mobile = ?", mobile).Scan(&sentAt)
+	if sentAt.Valid && time.Since(sentAt.Time) < otpResendInterval {
+		http.Error(w, "Please wait before requesting another code", http.StatusTooManyRequests)
+		return
+	}
+	if !h.otpSends.allow(requestIP(r), time.Now()) {
+		fmt.Printf("[CUSTOMER] Too many login codes requested from %s\n", requestIP(r))
+		http.Error(w, "Too many codes requested, please try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	code, err := generateOTP()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = h.DB.Exec(`
+		INSERT INTO otp_codes (mobile, code_hash, expires_at, attempts, sent_at)
+		VALUES (?, ?, ?, 0, ?)
+		ON CONFLICT(mobile) DO UPDATE SET
+			code_hash = excluded.code_hash,
+			expires_at = excluded.expires_at,
+			attempts = 0,
+			sent_at = excluded.sent_at`, mobile, string(hash), time.Now().Add(otpTTL), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	message := fmt.Sprintf("Your WiFiMint login code is %s. It expires in %d minutes.", code, int(otpTTL.Minutes()))
+	if err := h.SMS.Send(mobile, message); err != nil {
+		fmt.Printf("[CUSTOMER] Failed to send OTP to %s: %v\n", mobile, err)
+		http.Error(w, "Could not send the code, please try again", http.StatusBadGateway)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Code sent"})
+}
+
+// VerifyOTP signs the customer in and links the device's subscriptions to
+// the account.
+func (h *CustomersHandler) VerifyOTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Mobile     string `json:"mobile"`
+		Code       string `json:"code"`
+		MacAddress string `json:"mac_address"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mobile, err := normalizeMobile(req.Mobile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Signing in works from anywhere, but only the caller's own device is
+	// linked to the account
+	mac, err := ownMAC(h.Subscriptions.Router, r, req.MacAddress)
+	if err != nil && (req.MacAddress != "" || err == errNotYourDevice) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	customer, err := h.checkOTP(mobile, req.Code)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if mac != "" {
+		h.claimDevice(customer.ID, mac)
+		h.DB.Exec("UPDATE devices SET device_name = ? WHERE mac_address = ? AND COALESCE(device_name, '') IN ('', 'Unknown')", mobile, mac)
+	}
+
+	token, err := h.signIn(w, customer)
+	if err != nil {
+		http.Error(w, "Could not create token", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "customer": customer})
+}
+
+// checkOTP consumes the login code sent to mobile and returns the
+// customer, creating the account on first sign-in.
+func (h *CustomersHandler) checkOTP(mobile, code string) (*Customer, error) {
+	var hash string
+	var expiresAt time.Time
+	var attempts int
+	err := h.DB.QueryRow("SELECT code_hash, expires_at, attempts FROM otp_codes WHERE mobile = ?", mobile).Scan(&hash, &expiresAt, &attempts)
+	if err != nil || time.Now().After(expiresAt) {
+		return nil, &clientError{http.StatusUnauthorized, "Code expired, please request a new one"}
+	}
+	if attempts >= otpMaxAttempts {
+		return nil, &clientError{http.StatusTooManyRequests, "Too many attempts, please request a new code"}
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(strings.TrimSpace(code))) != nil {
+		h.DB.Exec("UPDATE otp_codes SET attempts = attempts + 1 WHERE mobile = ?", mobile)
+		return nil, &clientError{http.StatusUnauthorized, "Incorrect code"}
+	}
+	h.DB.Exec("DELETE FROM otp_codes WHERE mobile = ?", mobile)
+
+	_, err = h.DB.Exec(`
+		INSERT INTO customers (mobile, last_login) VALUES (?, ?)
+		ON CONFLICT(mobile) DO UPDATE SET last_login = excluded.last_login`, mobile, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return h.loadCustomer("mobile = ?", mobile)
+}
+
+// signIn issues the customer's token and sets it as a cookie.
+func (h *CustomersHandler) signIn(w http.ResponseWriter, customer *Customer) (string, error) {
+	token, expires, err := h.Auth.IssueCustomerToken(customer.ID, customer.Mobile)
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "customer_token",
+		Value:    token,
+		Expires:  expires,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	fmt.Printf("[CUSTOMER] %s signed in\n", customer.Mobile)
+	return token, nil
+}
+
+// GetMe returns the signed-in customer and their active plans.
+func (h *CustomersHandler) GetMe(w http.ResponseWriter, r *http.Request) {
+	customerID := r.Context().Value("customer_id").(int)
+	customer, err := h.loadCustomer("id = ?", customerID)
+	if err != nil {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return
+	}
+
+	// Plans bought on this device since the last sign-in
+	mac, err := ownMAC(h.Subscriptions.Router, r, "")
+	if err == nil {
+		h.claimDevice(customerID, mac)
+	}
+
+	entitlements, err := h.entitlements(customerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"customer":     customer,
+		"current_mac":  mac,
+		"entitlements": entitlements,
+	})
+}
+
+// AddDevice puts another device on one of the customer's plans. Without a
+// MAC in the body it adds the device making the request.
+func (h *CustomersHandler) AddDevice(w http.ResponseWriter, r *http.Request) {
+	customerID := r.Context().Value("customer_id").(int)
+	var req struct {
+		SubscriptionID int    `json:"subscription_id"`
+		MacAddress     string `json:"mac_address"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var mac string
+	var err error
+	if req.MacAddress == "" {
+		if mac, err = ownMAC(h.Subscriptions.Router, r, ""); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	} else if mac, err = parseMAC(req.MacAddress); err != nil {
+		writeError(w, err)
+		return
+	}
+	if _, err := h.addDevice(customerID, req.SubscriptionID, mac, requestIP(r)); err != nil {
+		writeError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Device added to your plan"})
+}
+
+// addDevice puts mac on one of the customer's active plans as an extra
+// device; subscriptionID 0 picks the first plan.
+func (h *CustomersHandler) addDevice(customerID, subscriptionID int, mac, ip string) (int64, error) {
+	if HasActiveSubscription(h.DB, mac) {
+		return 0, &clientError{http.StatusConflict, "This device already has an active plan"}
+	}
+
+	entitlements, err := h.entitlements(customerID)
+	if err != nil {
+		return 0, err
+	}
+	var target *Entitlement
+	for i := range entitlements {
+		if subscriptionID == 0 || entitlements[i].SubscriptionID == subscriptionID {
+			target = &entitlements[i]
+			break
+		}
+	}
+	if target == nil {
+		return 0, &clientError{http.StatusNotFound, "No active plan to add the device to"}
+	}
+	if len(target.Devices) >= target.MaxDevices {
+		return 0, &clientError{http.StatusConflict, fmt.Sprintf("Your plan allows %d device(s) at a time", target.MaxDevices)}
+	}
+
+	var planID int
+	h.DB.QueryRow("SELECT plan_id FROM subscriptions WHERE id = ?", target.SubscriptionID).Scan(&planID)
+	h.Subscriptions.Devices.Ensure(mac, router.IsRandomizedMAC(mac))
+	zero := 0.0
+	subID, err := h.Subscriptions.activatePlan(activation{
+		MAC:           mac,
+		PlanID:        planID,
+		EndTime:       target.EndTime,
+		PaymentMethod: "shared",
+		AmountPaid:    &zero, // paid for by the parent subscription
+		CustomerID:    customerID,
+		ParentID:      target.SubscriptionID,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to add device: %v", err)
+	}
+	audit.Record(h.DB, audit.Entry{
+		Actor: customerActor(customerID), Action: "device.add", TargetMAC: mac, SubscriptionID: int(subID),
+		After: subscriptionState(h.Subscriptions.Subscriptions, int(subID)), SourceIP: ip,
+		Details: fmt.Sprintf("shares subscription %d", target.SubscriptionID),
+	})
+	return subID, nil
+}
+
+// RemoveDevice takes an extra device off a plan. The device that bought
+// the plan stays; use Transfer to move it.
+func (h *CustomersHandler) RemoveDevice(w http.ResponseWriter, r *http.Request) {
+	customerID := r.Context().Value("customer_id").(int)
+	mac, err := parseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var subID int
+	err = h.DB.QueryRow(`
+		SELECT id FROM subscriptions
+		WHERE customer_id = ? AND mac_address = ? AND parent_subscription_id IS NOT NULL AND status = 'active'`,
+		customerID, mac).Scan(&subID)
+	if err != nil {
+		http.Error(w, "Device is not an extra device on your plans", http.StatusNotFound)
+		return
+	}
+	before := subscriptionState(h.Subscriptions.Subscriptions, subID)
+	h.DB.Exec("UPDATE subscriptions SET status = 'expired' WHERE id = ?", subID)
+	h.Subscriptions.blockDevice(mac)
+	audit.Record(h.DB, audit.Entry{
+		Actor: customerActor(customerID), Action: "device.remove", TargetMAC: mac, SubscriptionID: subID,
+		Before: before, After: subscriptionState(h.Subscriptions.Subscriptions, subID), SourceIP: requestIP(r),
+	})
+	json.NewEncoder(w).Encode(map[string]string{"message": "Device removed"})
+}
+
+// Transfer moves the remaining time of a device's subscription to another
+// MAC, e.g. a new phone or one that randomized its address. Without a
+// target MAC the device making the request receives it.
+func (h *CustomersHandler) Transfer(w http.ResponseWriter, r *http.Request) {
+	customerID := r.Context().Value("customer_id").(int)
+	var req struct {
+		FromMAC string `json:"from_mac"`
+		ToMAC   string `json:"to_mac"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.FromMAC == "" {
+		http.Error(w, "Both the old and the new device are required", http.StatusBadRequest)
+		return
+	}
+	from, err := parseMAC(req.FromMAC)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var to string
+	if req.ToMAC == "" {
+		to, _ = ownMAC(h.Subscriptions.Router, r, "")
+	} else if to, err = parseMAC(req.ToMAC); err != nil {
+		writeError(w, err)
+		return
+	}
+	if to == "" || from == to {
+		http.Error(w, "Both the old and the new device are required", http.StatusBadRequest)
+		return
+	}
+
+	var subID, planID int
+	err = h.DB.QueryRow(`
+		SELECT id, plan_id FROM subscriptions
+		WHERE customer_id = ? AND mac_address = ? AND status = 'active' AND end_time > ?`,
+		customerID, from, time.Now()).Scan(&subID, &planID)
+	if err != nil {
+		http.Error(w, "No active plan on that device", http.StatusNotFound)
+		return
+	}
+	if HasActiveSubscription(h.DB, to) {
+		http.Error(w, "The new device already has an active plan", http.StatusConflict)
+		return
+	}
+
+	before := subscriptionState(h.Subscriptions.Subscriptions, subID)
+	if err := h.Subscriptions.moveSubscription(subID, planID, from, to); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit.Record(h.DB, audit.Entry{
+		Actor: customerActor(customerID), Action: "subscription.transfer", TargetMAC: to, SubscriptionID: subID,
+		Before: before, After: subscriptionState(h.Subscriptions.Subscriptions, subID), SourceIP: requestIP(r),
+	})
+
+	fmt.Printf("[CUSTOMER] Subscription %d moved from %s to %s\n", subID, from, to)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Plan moved to the new device"})
+}
+
+// GetCustomers lists customer accounts for the admin.
+func (h *CustomersHandler) GetCustomers(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.DB.Query(`
+		SELECT c.id, c.mobile, COALESCE(c.name, ''), c.created_at,
+		       (SELECT COUNT(*) FROM subscriptions s WHERE s.customer_id = c.id AND s.status = 'active')
+		FROM customers c
+		ORDER BY c.id DESC`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	customers := []map[string]interface{}{}
+	for rows.Next() {
+		var c Customer
+		var created sql.NullTime
+		var active int
+		if err := rows.Scan(&c.ID, &c.Mobile, &c.Name, &created, &active); err != nil {
+			continue
+		}
+		if created.Valid {
+			c.CreatedAt = created.Time
+		}
+		customers = append(customers, map[string]interface{}{
+			"id":             c.ID,
+			"mobile":         c.Mobile,
+			"name":           c.Name,
+			"created_at":     c.CreatedAt,
+			"active_devices": active,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(customers)
+}
+
+// RevokeSessions signs a customer account out on every device, e.g. after
+// a lost phone. Plans stay on their devices.
+func (h *CustomersHandler) RevokeSessions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		return
+	}
+	if _, err := h.loadCustomer("id = ?", id); err != nil {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return
+	}
+	n := h.Auth.RevokeCustomerSessions(id)
+	e := audit.From(r)
+	e.Action = "customer.revoke_sessions"
+	e.Details = fmt.Sprintf("%s: %d sessions", customerActor(id), n)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Sessions revoked", "revoked": n})
+}
+
+// LogoutEverywhere signs the customer out on all their devices, including
+// this one.
+func (h *CustomersHandler) LogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	customerID := r.Context().Value("customer_id").(int)
+	n := h.Auth.RevokeCustomerSessions(customerID)
+	audit.Record(h.DB, audit.Entry{
+		Actor: customerActor(customerID), Action: "customer.revoke_sessions", SourceIP: requestIP(r),
+		Details: fmt.Sprintf("%d sessions", n),
+	})
+	http.SetCookie(w, &http.Cookie{Name: "customer_token", Value: "", Expires: time.Unix(0, 0), Path: "/", HttpOnly: true})
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Signed out everywhere", "revoked": n})
+}
+
+// entitlements returns the customer's active parent subscriptions with
+// their devices and shared usage.
+func (h *CustomersHandler) entitlements(customerID int) ([]Entitlement, error) {
+	rows, err := h.DB.Query(`
+		SELECT s.id, p.name, s.end_time, COALESCE(p.max_devices, 1), COALESCE(p.data_limit_mb, 0)
+		FROM subscriptions s
+		JOIN plans p ON s.plan_id = p.id
+		WHERE s.customer_id = ? AND s.parent_subscription_id IS NULL
+		AND s.status = 'active' AND s.end_time > ?
+		ORDER BY s.end_time DESC`, customerID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	entitlements := []Entitlement{}
+	for rows.Next() {
+		var e Entitlement
+		if err := rows.Scan(&e.SubscriptionID, &e.PlanName, &e.EndTime, &e.MaxDevices, &e.DataLimitMB); err == nil {
+			entitlements = append(entitlements, e)
+		}
+	}
+	rows.Close()
+
+	for i := range entitlements {
+		e := &entitlements[i]
+		e.Devices = []string{}
+		devices, err := h.DB.Query(`
+			SELECT mac_address FROM subscriptions
+			WHERE (id = ? OR parent_subscription_id = ?) AND status = 'active'
+			ORDER BY id`, e.SubscriptionID, e.SubscriptionID)
+		if err != nil {
+			return nil, err
+		}
+		for devices.Next() {
+			var mac string
+			if devices.Scan(&mac) == nil {
+				e.Devices = append(e.Devices, mac)
+			}
+		}
+		devices.Close()
+		e.BytesUsed = familyBytesUsed(h.DB, e.SubscriptionID)
+	}
+	return entitlements, nil
+}
+
+// claimDevice links the device's unowned subscriptions to the customer.
+// mac must come from ownMAC: whoever signs in on a device gets its plans.
+func (h *CustomersHandler) claimDevice(customerID int, mac string) {
+	h.DB.Exec(`
+		UPDATE subscriptions SET customer_id = ?
+		WHERE mac_address = ? AND customer_id IS NULL AND status IN ('active', 'pending')`, customerID, mac)
+}
+
+func (h *CustomersHandler) loadCustomer(where string, arg interface{}) (*Customer, error) {
+	var c Customer
+	var created sql.NullTime
+	err := h.DB.QueryRow("SELECT id, mobile, COALESCE(name, ''), created_at FROM customers WHERE "+where, arg).
+		Scan(&c.ID, &c.Mobile, &c.Name, &created)
+	if err != nil {
+		return nil, err
+	}
+	if created.Valid {
+		c.CreatedAt = created.Time
+	}
+	return &c, nil
+}
+
+// familyBytesUsed is the data used by a subscription and the extra
+// devices sharing it.
+func familyBytesUsed(db *sql.DB, rootID int) int64 {
+	var used int64
+	db.QueryRow(`
+		SELECT COALESCE(SUM(COALESCE(bytes_used, 0)), 0) FROM subscriptions
+		WHERE id = ? OR parent_subscription_id = ?`, rootID, rootID).Scan(&used)
+	return used
+}
+
+func customerActor(customerID int) string {
+	return fmt.Sprintf("customer:%d", customerID)
+}
+
+// normalizeMobile keeps the digits of a mobile number; Indian numbers
+// entered with the 91 prefix are stored as the 10-digit number.
+func normalizeMobile(mobile string) (string, error) {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, mobile)
+	if len(digits) == 12 && strings.HasPrefix(digits, "91") {
+		digits = digits[2:]
+	}
+	if len(digits) < 10 || len(digits) > 15 {
+		return "", fmt.Errorf("invalid mobile number")
+	}
+	return digits, nil
+}
+
+func generateOTP() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/user/wifi-control-system/internal/auth"
+)
+
+// fakeSMS keeps the last message sent to each number.
+type fakeSMS struct {
+	mu   sync.Mutex
+	last map[string]string
+}
+
+func (s *fakeSMS) Send(to, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last[to] = message
+	return nil
+}
+
+var otpPattern = regexp.MustCompile(`\d{6}`)
+
+func (s *fakeSMS) code(to string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return otpPattern.FindString(s.last[to])
+}
+
+func newTestCustomers(t *testing.T) (*CustomersHandler, *fakeSMS) {
+	t.Helper()
+	h, _, _ := newTestPayments(t)
+	authService, err := auth.NewAuthService(h.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	texts := &fakeSMS{last: map[string]string{}}
+	return &CustomersHandler{DB: h.DB, SMS: texts, Auth: authService, Subscriptions: h.Subscriptions}, texts
+}
+
+func requestOTP(h *CustomersHandler, mobile, ip string) int {
+	r := portalRequest("POST", "/api/customer/otp", `{"mobile": "`+mobile+`"}`)
+	r.RemoteAddr = ip + ":40000"
+	w := httptest.NewRecorder()
+	h.RequestOTP(w, r)
+	return w.Code
+}
+
+func TestRequestOTPLimitedPerIP(t *testing.T) {
+	h, _ := newTestCustomers(t)
+	for i := 0; i < otpPerIPLimit; i++ {
+		if code := requestOTP(h, fmt.Sprintf("98765%05d", i), testClientIP); code != http.StatusOK {
+			t.Fatalf("code %d: status %d", i+1, code)
+		}
+	}
+	if code := requestOTP(h, "9876599999", testClientIP); code != http.StatusTooManyRequests {
+		t.Errorf("code past the per-IP limit: status %d, want 429", code)
+	}
+	if code := requestOTP(h, "9876599999", "192.168.1.51"); code != http.StatusOK {
+		t.Errorf("another client was limited: status %d", code)
+	}
+}
+
+func TestVerifyOTPClaimsOnlyOwnDevice(t *testing.T) {
+	h, texts := newTestCustomers(t)
+	for _, mac := range []string{testClientMAC, testOtherMAC} {
+		if _, err := h.DB.Exec("INSERT INTO subscriptions (mac_address, plan_id, status) VALUES (?, 1, 'pending')", mac); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if code := requestOTP(h, "9876543210", testClientIP); code != http.StatusOK {
+		t.Fatalf("RequestOTP: %d", code)
+	}
+
+	verify := func(mac string) int {
+		body := fmt.Sprintf(`{"mobile": "9876543210", "code": %q, "mac_address": %q}`, texts.code("9876543210"), mac)
+		w := httptest.NewRecorder()
+		h.VerifyOTP(w, portalRequest("POST", "/api/customer/verify", body))
+		return w.Code
+	}
+	if code := verify(testOtherMAC); code != http.StatusForbidden {
+		t.Errorf("sign-in claiming another device: %d, want 403", code)
+	}
+	if code := verify(""); code != http.StatusOK {
+		t.Fatalf("sign-in: %d", code)
+	}
+
+	owners := map[string]bool{}
+	rows, err := h.DB.Query("SELECT mac_address, customer_id IS NOT NULL FROM subscriptions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mac string
+		var owned bool
+		rows.Scan(&mac, &owned)
+		owners[mac] = owned
+	}
+	if !owners[testClientMAC] || owners[testOtherMAC] {
+		t.Errorf("claimed subscriptions: %v, want only %s", owners, testClientMAC)
+	}
+}
+
+func TestDeviceRoutesRejectMalformedMACs(t *testing.T) {
+	h, _ := newTestCustomers(t)
+	const bad = "aa:bb:cc:dd:ee:01; reboot"
+	signedIn := func(r *http.Request) *http.Request {
+		return r.WithContext(context.WithValue(r.Context(), "customer_id", 1))
+	}
+
+	w := httptest.NewRecorder()
+	h.AddDevice(w, signedIn(portalRequest("POST", "/api/customer/devices", fmt.Sprintf(`{"mac_address": %q}`, bad))))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("AddDevice: %d, want 400", w.Code)
+	}
+
+	for _, body := range []string{
+		fmt.Sprintf(`{"from_mac": %q, "to_mac": %q}`, bad, testOtherMAC),
+		fmt.Sprintf(`{"from_mac": %q, "to_mac": %q}`, testClientMAC, bad),
+	} {
+		w = httptest.NewRecorder()
+		h.Transfer(w, signedIn(portalRequest("POST", "/api/customer/transfer", body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Transfer %s: %d, want 400", body, w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	r := mux.SetURLVars(portalRequest("DELETE", "/api/customer/devices/x", ""), map[string]string{"mac": bad})
+	h.RemoveDevice(w, signedIn(r))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("RemoveDevice: %d, want 400", w.Code)
+	}
+
+	if mac, err := parseMAC("AA-BB-CC-DD-EE-01"); err != nil || mac != testClientMAC {
+		t.Errorf("parseMAC = %q, %v; want %s", mac, err, testClientMAC)
+	}
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/user/wifi-control-system/internal/db"
+)
+
+// newTestStore returns a migrated SQLite database in a temporary directory.
+func newTestStore(t *testing.T) *db.DBStore {
+	t.Helper()
+	store, err := db.InitDB(filepath.Join(t.TempDir(), "test.db") + "?_parse_time=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.DB.Close() })
+	if _, err := store.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// newTestSubscriptions returns a SubscriptionsHandler on store with a fake
+// router.
+func newTestSubscriptions(store *db.DBStore, router *fakeRouter) *SubscriptionsHandler {
+	return &SubscriptionsHandler{
+		Devices: store.Devices(), Plans: store.Plans(), Subscriptions: store.Subscriptions(), Sessions: store.Sessions(),
+		DB: store.DB, Router: router,
+	}
+}
+
+// newMemorySubscriptions returns a SubscriptionsHandler on the in-memory
+// repositories with plan 1 (a day for ₹20) and a fake router that maps the
+// test client's IP to testClientMAC.
+func newMemorySubscriptions(t *testing.T) (*SubscriptionsHandler, *fakeRouter) {
+	t.Helper()
+	mem := db.NewMemory()
+	plan := db.Plan{Name: "Day", DurationMinutes: 1440, Price: 20}
+	if err := mem.Plans().Create(&plan); err != nil || plan.ID != 1 {
+		t.Fatalf("creating plan: %v (id %d)", err, plan.ID)
+	}
+	router := newFakeRouter(map[string]string{testClientIP: testClientMAC})
+	return &SubscriptionsHandler{
+		Devices: mem.Devices(), Plans: mem.Plans(), Subscriptions: mem.Subscriptions(),
+		Sessions: mem.Sessions(), Router: router,
+	}, router
+}
+
+// fakeRouter resolves client IPs from a fixed table and remembers which
+// MACs it was told to allow or block.
+type fakeRouter struct {
+	lock    sync.Mutex
+	macs    map[string]string // IP -> MAC
+	allowed map[string]bool
+	blocked []string
+}
+
+func newFakeRouter(ipToMAC map[string]string) *fakeRouter {
+	return &fakeRouter{macs: ipToMAC, allowed: map[string]bool{}}
+}
+
+var errUnknownIP = errors.New("no neighbor with that IP")
+
+func (r *fakeRouter) FindMACbyIP(ip string) (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if mac, ok := r.macs[ip]; ok {
+		return mac, nil
+	}
+	return "", errUnknownIP
+}
+
+func (r *fakeRouter) FindIPbyMAC(mac string) (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for ip, m := range r.macs {
+		if strings.EqualFold(m, mac) {
+			return ip, nil
+		}
+	}
+	return "", errUnknownIP
+}
+
+func (r *fakeRouter) AllowMAC(mac string) (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.allowed[strings.ToLower(mac)] = true
+	return "", nil
+}
+
+func (r *fakeRouter) BlockMAC(mac, ip string) (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.allowed, strings.ToLower(mac))
+	r.blocked = append(r.blocked, mac)
+	return "", nil
+}
+
+func (r *fakeRouter) isAllowed(mac string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.allowed[mac]
+}
+
+func (r *fakeRouter) blockedMACs() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.blocked...)
+}
+
+func (r *fakeRouter) GetSystemInfo() map[string]interface{} { return map[string]interface{}{} }
+
+func (r *fakeRouter) SetSpeedLimit(mac string, downKbps, upKbps int) error { return nil }
@@ -4,16 +4,30 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"github.com/user/wifi-control-system/internal/router"
+	"github.com/user/wifi-control-system/internal/audit"
 )
 
+// AuthHandler is the portal's sign-in for a device. A device gets online
+// by redeeming a voucher or by signing in to a customer account; either way
+// access comes from a subscription, so the monitor expires it like any
+// other plan.
 type AuthHandler struct {
-	Router *router.RouterClient
+	Router interface {
+		BlockMAC(mac string, ip string) (string, error)
+		FindMACbyIP(ip string) (string, error)
+	}
+	Subscriptions *SubscriptionsHandler
+	Vouchers      *VouchersHandler
+	Customers     *CustomersHandler
 }
 
+// LoginRequest carries a voucher code, or a customer's mobile number and
+// the one-time code texted to it (see /api/customer/otp). MacAddress is
+// optional and must be the caller's own device.
 type LoginRequest struct {
-	Username   string `json:"username"`
-	Password   string `json:"password"`
+	Voucher    string `json:"voucher"`
+	Mobile     string `json:"mobile"`
+	Code       string `json:"code"`
 	MacAddress string `json:"mac_address"`
 }
 
@@ -24,28 +38,77 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 1. Validate User (Dummy check for now)
-	if req.Username == "admin" && req.Password == "password" {
-		// 2. Success - Tell router to allow MAC
-		fmt.Printf("[API] Login SUCCESS: Allowing MAC %s\n", req.MacAddress)
-		output, err := h.Router.AllowMAC(req.MacAddress)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to allow user on router: %v", err), http.StatusInternalServerError)
-			return
-		}
+	// Only the device making the request can be let through
+	mac, err := ownMAC(h.Router, r, req.MacAddress)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	e := audit.From(r)
+	e.Action, e.TargetMAC = "device.login", mac
 
-		fmt.Printf("Router Output: %s\n", output)
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"message": "Login successful, internet access granted"})
-	} else {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	resp := map[string]interface{}{"message": "Login successful, internet access granted"}
+	var subID int64
+	switch {
+	case req.Voucher != "":
+		subID, err = h.Vouchers.redeem(req.Voucher, mac, requestIP(r))
+		e.Details = "voucher"
+	case req.Mobile != "" && req.Code != "":
+		var token string
+		subID, token, err = h.customerLogin(w, req, mac, requestIP(r))
+		resp["token"] = token
+		e.Details = "customer account"
+	default:
+		http.Error(w, "Enter a voucher code, or your mobile number and login code", http.StatusBadRequest)
+		return
 	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	e.SubscriptionID = int(subID)
+	e.After = subscriptionState(h.Subscriptions.Subscriptions, int(subID))
+	fmt.Printf("[API] Login SUCCESS: Allowing MAC %s (subscription %d)\n", mac, subID)
+	resp["subscription_id"] = subID
+	json.NewEncoder(w).Encode(resp)
 }
 
+// customerLogin signs a customer in and puts the device on their plan: a
+// plan it already holds is re-allowed, otherwise it joins one of the
+// account's plans as an extra device.
+func (h *AuthHandler) customerLogin(w http.ResponseWriter, req LoginRequest, mac, ip string) (int64, string, error) {
+	mobile, err := normalizeMobile(req.Mobile)
+	if err != nil {
+		return 0, "", &clientError{http.StatusBadRequest, err.Error()}
+	}
+	customer, err := h.Customers.checkOTP(mobile, req.Code)
+	if err != nil {
+		return 0, "", err
+	}
+	h.Customers.claimDevice(customer.ID, mac)
+
+	var subID int64
+	if sub, err := h.Subscriptions.Subscriptions.ActiveForCustomer(mac, customer.ID); err == nil {
+		subID = int64(sub.ID)
+		h.Subscriptions.allowDevice(mac, sub.PlanID)
+	} else if subID, err = h.Customers.addDevice(customer.ID, 0, mac, ip); err != nil {
+		return 0, "", err
+	}
+
+	token, err := h.Customers.signIn(w, customer)
+	if err != nil {
+		return 0, "", err
+	}
+	return subID, token, nil
+}
+
+// Logout blocks the device making the request. The ?mac= parameter is
+// optional and must name that same device.
 func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
-	mac := r.URL.Query().Get("mac")
-	if mac == "" {
-		http.Error(w, "MAC address required", http.StatusBadRequest)
+	mac, err := ownMAC(h.Router, r, r.URL.Query().Get("mac"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
 
@@ -56,6 +119,8 @@ func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
 	}
 
 	fmt.Printf("Router Output: %s\n", output)
+	e := audit.From(r)
+	e.Action, e.TargetMAC = "device.logout", mac
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Logout successful, access revoked"})
 }
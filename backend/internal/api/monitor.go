@@ -6,6 +6,8 @@ import (
 	"log"
 	"time"
 
+	"github.com/user/wifi-control-system/internal/audit"
+	"github.com/user/wifi-control-system/internal/db"
 	"github.com/user/wifi-control-system/internal/router"
 )
 
@@ -15,17 +17,33 @@ type Router interface {
 	AllowMAC(mac string) (string, error)
 }
 
+// UsageReader is implemented by routers that keep per-client byte counters.
+type UsageReader interface {
+	ReadUsage() (map[string]uint64, error)
+}
+
 type SubscriptionMonitor struct {
+	Devices       db.Devices
+	Plans         db.Plans
+	Subscriptions db.Subscriptions
+	// DB is where expiries are written to the audit log
 	DB     *sql.DB
 	Router Router
+
+	lastUsage map[string]uint64 // MAC -> last counter value seen
+	lastPrune time.Time
 }
 
+// Randomized MACs rotate, so their blocked leftovers are dropped once unseen for this long
+const randomizedDeviceTTL = 24 * time.Hour
+
 func (m *SubscriptionMonitor) Start() {
 	fmt.Println("[MONITOR] Subscription Expiry Monitor Started.")
 	// Run every 3 seconds for fast detection
 	ticker := time.NewTicker(3 * time.Second)
 	go func() {
 		for range ticker.C {
+			m.RecordUsage()
 			m.CheckExpirations()
 			m.AutoSyncDevices()
 		}
@@ -35,23 +53,18 @@ func (m *SubscriptionMonitor) Start() {
 // SyncAllowedDevices restores firewall bypass rules for currently active subscriptions
 func (m *SubscriptionMonitor) SyncAllowedDevices() {
 	fmt.Println("[MONITOR] Syncing Allowed Devices to Router...")
-	rows, err := m.DB.Query(`
-		SELECT mac_address 
-		FROM subscriptions 
-		WHERE status = 'active' AND end_time > ?`, time.Now())
+	subs, err := m.Subscriptions.Active()
 	if err != nil {
 		log.Printf("[MONITOR] Sync failed: %v\n", err)
 		return
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var mac string
-		if err := rows.Scan(&mac); err == nil {
-			// Using type assertion to call AllowMAC if the router supports it
-			if r, ok := m.Router.(*router.RouterClient); ok {
-				r.AllowMAC(mac)
-			}
+	for _, s := range subs {
+		// Using type assertion to call AllowMAC if the router supports it
+		if r, ok := m.Router.(*router.RouterClient); ok {
+			down, up := planRate(m.Plans, s.PlanID)
+			r.SetSpeedLimit(s.MacAddress, down, up)
+			r.AllowMAC(s.MacAddress)
 		}
 	}
 }
@@ -83,53 +96,95 @@ func (m *SubscriptionMonitor) AutoSyncDevices() {
 			continue
 		}
 
-		// Only insert if not exists, to preserve status
-		var exists int
-		m.DB.QueryRow("SELECT COUNT(*) FROM devices WHERE mac_address = ?", d.MAC).Scan(&exists)
-		if exists == 0 {
-			fmt.Printf("[MONITOR] New Device Detected: %s (%s). Storing as blocked.\n", d.MAC, d.IP)
-			_, err = m.DB.Exec(`
-				INSERT INTO devices (mac_address, ip_address, device_name, status)
-				VALUES (?, ?, ?, 'blocked')`,
-				d.MAC, d.IP, d.Name)
-			if err != nil {
-				log.Printf("[MONITOR] Failed to store new device: %v\n", err)
+		// New devices are stored as blocked; known ones keep their status
+		randomized := router.IsRandomizedMAC(d.MAC)
+		created, err := m.Devices.Seen(d.MAC, d.IP, d.Name, randomized)
+		if err != nil {
+			log.Printf("[MONITOR] Failed to store device %s: %v\n", d.MAC, err)
+		} else if created {
+			kind := ""
+			if randomized {
+				kind = "randomized "
 			}
-		} else {
-			// Update IP if it changed
-			m.DB.Exec("UPDATE devices SET ip_address = ?, last_seen = CURRENT_TIMESTAMP WHERE mac_address = ?", d.IP, d.MAC)
+			fmt.Printf("[MONITOR] New Device Detected: %s (%s, %sMAC). Storing as blocked.\n", d.MAC, d.IP, kind)
 		}
 
 		// REINFORCE: If device is marked as 'blocked' in DB, ensure it's blocked in Router
-		var status string
-		m.DB.QueryRow("SELECT status FROM devices WHERE mac_address = ?", d.MAC).Scan(&status)
-		if status == "blocked" {
+		if stored, err := m.Devices.Get(d.MAC); err == nil && stored.Status == "blocked" {
 			m.Router.BlockMAC(d.MAC, d.IP)
 		}
 	}
+
+	if time.Since(m.lastPrune) > time.Hour {
+		m.lastPrune = time.Now()
+		m.pruneRandomizedDevices()
+	}
+}
+
+// pruneRandomizedDevices forgets blocked randomized MACs that never bought
+// anything and have not been seen for a day; every address rotation would
+// otherwise leave one behind.
+func (m *SubscriptionMonitor) pruneRandomizedDevices() {
+	n, err := m.Devices.PruneRandomized(time.Now().Add(-randomizedDeviceTTL))
+	if err != nil {
+		log.Printf("[MONITOR] Failed to prune randomized devices: %v\n", err)
+		return
+	}
+	if n > 0 {
+		fmt.Printf("[MONITOR] Pruned %d stale randomized device(s)\n", n)
+	}
 }
 
 // Removed ReinforceBlocking as separate long-loop function to avoid heavy locking
 
-func (m *SubscriptionMonitor) CheckExpirations() {
-	// Query for active subscriptions that have passed their end time
-	rows, err := m.DB.Query(`
-		SELECT id, mac_address 
-		FROM subscriptions 
-		WHERE status = 'active' AND end_time < ?`, time.Now())
-	
+// RecordUsage adds the bytes forwarded since the last tick to each
+// client's active subscription.
+func (m *SubscriptionMonitor) RecordUsage() {
+	reader, ok := m.Router.(UsageReader)
+	if !ok {
+		return
+	}
+	usage, err := reader.ReadUsage()
 	if err != nil {
-		log.Printf("[MONITOR] Error querying expirations: %v\n", err)
+		log.Printf("[MONITOR] Reading byte counters failed: %v\n", err)
 		return
 	}
-	defer rows.Close()
+	if m.lastUsage == nil {
+		m.lastUsage = make(map[string]uint64)
+	}
 
-	for rows.Next() {
-		var subID int
-		var mac string
-		if err := rows.Scan(&subID, &mac); err != nil {
+	for mac, total := range usage {
+		delta := total
+		if last, ok := m.lastUsage[mac]; ok && total >= last {
+			delta = total - last
+		}
+		m.lastUsage[mac] = total
+		if delta == 0 {
 			continue
 		}
+		if err := m.Subscriptions.AddUsage(mac, delta); err != nil {
+			log.Printf("[MONITOR] Failed to record usage for %s: %v\n", mac, err)
+		}
+	}
+
+	// Counters of blocked clients are gone; start over if they come back
+	for mac := range m.lastUsage {
+		if _, ok := usage[mac]; !ok {
+			delete(m.lastUsage, mac)
+		}
+	}
+}
+
+func (m *SubscriptionMonitor) CheckExpirations() {
+	// Active subscriptions that have passed their end time or used up their data
+	due, err := m.Subscriptions.DueForExpiry(time.Now())
+	if err != nil {
+		log.Printf("[MONITOR] Error querying expirations: %v\n", err)
+		return
+	}
+
+	for _, exp := range due {
+		subID, mac, reason := exp.SubscriptionID, exp.MacAddress, exp.Reason
 
 		// Host Protection: NEVER block the host laptop
 		hostMAC := ""
@@ -139,15 +194,15 @@ func (m *SubscriptionMonitor) CheckExpirations() {
 		if hostMAC != "" && mac == hostMAC {
 			fmt.Printf("[MONITOR] Host protection: Skipping expiry block for host MAC %s\n", mac)
 			// Still mark as expired in DB but don't call router block
-			m.DB.Exec("UPDATE subscriptions SET status = 'expired' WHERE id = ?", subID)
+			m.Subscriptions.SetStatus(subID, "expired")
 			continue
 		}
 
 		// Try to find IP in database first
-		var ip string
-		m.DB.QueryRow("SELECT ip_address FROM devices WHERE mac_address = ?", mac).Scan(&ip)
+		device, _ := m.Devices.Get(mac)
+		ip := device.IP
 
-		fmt.Printf("[MONITOR] Subscription %d expired for MAC %s (IP: %s). Blocking device...\n", subID, mac, ip)
+		fmt.Printf("[MONITOR] Subscription %d expired (%s limit) for MAC %s (IP: %s). Blocking device...\n", subID, reason, mac, ip)
 		
 		// 1. Call Router to block the MAC
 		if m.Router != nil {
@@ -158,14 +213,17 @@ func (m *SubscriptionMonitor) CheckExpirations() {
 		}
 
 		// 2. Update status to 'expired'
-		_, err = m.DB.Exec("UPDATE subscriptions SET status = 'expired' WHERE id = ?", subID)
-		if err != nil {
+		if err := m.Subscriptions.SetStatus(subID, "expired"); err != nil {
 			log.Printf("[MONITOR] Failed to update subscription %d to expired: %v\n", subID, err)
 		}
+		audit.Record(m.DB, audit.Entry{
+			Action: "subscription.expire", TargetMAC: mac, SubscriptionID: subID,
+			Before: map[string]string{"status": "active"}, After: map[string]string{"status": "expired"},
+			Details: reason + " limit reached",
+		})
 
 		// 3. Update device status in devices table
-		_, err = m.DB.Exec("UPDATE devices SET status = 'blocked' WHERE mac_address = ?", mac)
-		if err != nil {
+		if err := m.Devices.SetStatus(mac, "blocked"); err != nil {
 			log.Printf("[MONITOR] Failed to update device status for MAC %s: %v\n", mac, err)
 		}
 	}
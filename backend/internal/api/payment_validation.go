@@ -0,0 +1,191 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/user/wifi-control-system/internal/audit"
+	"github.com/user/wifi-control-system/internal/db"
+)
+
+// transactionIDPattern is what UPI apps show as the reference: the 12-digit
+// UTR/RRN, or an app-specific alphanumeric ID.
+var transactionIDPattern = regexp.MustCompile(`^[A-Z0-9]{10,35}$`)
+
+// Column names seen in bank and UPI app statement exports.
+var (
+	statementIDColumns     = []string{"utr", "rrn", "upi ref", "upi ref no", "upi transaction id", "transaction id", "transaction_id", "txn id", "reference", "reference no", "ref no"}
+	statementAmountColumns = []string{"amount", "credit", "credit amount", "cr amount", "deposit", "deposit amount"}
+)
+
+// normalizeTransactionID upper-cases the ID and drops the spaces and
+// dashes people type or copy along with it.
+func normalizeTransactionID(id string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' || r == '#' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimSpace(id)))
+}
+
+// transactionIDInUse reports whether another non-rejected subscription
+// already claimed txID.
+func transactionIDInUse(subs db.Subscriptions, txID string, excludeID int) bool {
+	inUse, err := subs.TransactionIDInUse(txID, excludeID)
+	return err == nil && inUse
+}
+
+// pendingRequestFlags lists why an admin should look twice at a request.
+func pendingRequestFlags(subs db.Subscriptions, id int, txID string, amountPaid, price float64) []string {
+	flags := []string{}
+	normalized := normalizeTransactionID(txID)
+	switch {
+	case normalized == "":
+		flags = append(flags, "No transaction ID")
+	case !transactionIDPattern.MatchString(normalized):
+		flags = append(flags, "Transaction ID does not look like a UPI reference")
+	}
+	if normalized != "" && transactionIDInUse(subs, normalized, id) {
+		flags = append(flags, "Transaction ID already used by another request")
+	}
+	if amountPaid < price {
+		flags = append(flags, fmt.Sprintf("Amount paid ₹%.2f is less than the plan price ₹%.2f", amountPaid, price))
+	}
+	return flags
+}
+
+// ImportStatement matches a bank/UPI statement CSV against the pending
+// requests and approves those whose transaction ID is on the statement
+// with at least the plan price. The CSV is the request body or a
+// multipart "file" field.
+func (h *SubscriptionsHandler) ImportStatement(w http.ResponseWriter, r *http.Request) {
+	var src io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Missing statement file", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		src = file
+	}
+
+	credits, err := parseStatement(io.LimitReader(src, 10<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	requests, err := h.Subscriptions.Pending()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	approved := []map[string]interface{}{}
+	mismatched := []map[string]interface{}{}
+	for _, p := range requests {
+		txID := normalizeTransactionID(p.TransactionID)
+		amount, ok := credits[txID]
+		if txID == "" || !ok {
+			continue
+		}
+		if amount < p.Price {
+			mismatched = append(mismatched, map[string]interface{}{
+				"id": p.ID, "mac_address": p.MacAddress, "transaction_id": p.TransactionID,
+				"statement_amount": amount, "price": p.Price,
+			})
+			continue
+		}
+		if transactionIDInUse(h.Subscriptions, txID, p.ID) {
+			mismatched = append(mismatched, map[string]interface{}{
+				"id": p.ID, "mac_address": p.MacAddress, "transaction_id": p.TransactionID,
+				"reason": "transaction ID already used by another request",
+			})
+			continue
+		}
+		before := subscriptionState(h.Subscriptions, p.ID)
+		if err := h.approve(p.ID); err != nil {
+			fmt.Printf("[API] Statement import: failed to approve %d: %v\n", p.ID, err)
+			continue
+		}
+		actor, _ := r.Context().Value("username").(string)
+		audit.Record(h.DB, audit.Entry{
+			Actor: actor, Action: "subscription.approve", TargetMAC: p.MacAddress, SubscriptionID: p.ID,
+			Before: before, After: subscriptionState(h.Subscriptions, p.ID),
+			SourceIP: audit.ClientIP(r), Details: fmt.Sprintf("statement import, transaction %s", txID),
+		})
+		approved = append(approved, map[string]interface{}{
+			"id": p.ID, "mac_address": p.MacAddress, "transaction_id": p.TransactionID, "amount": amount,
+		})
+	}
+
+	fmt.Printf("[API] Statement import: %d credits, %d approved, %d mismatched\n", len(credits), len(approved), len(mismatched))
+	e := audit.From(r)
+	e.Action = "subscription.import_statement"
+	e.Details = fmt.Sprintf("%d statement rows, %d approved, %d mismatched", len(credits), len(approved), len(mismatched))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"statement_rows": len(credits),
+		"approved":       approved,
+		"mismatched":     mismatched,
+	})
+}
+
+// parseStatement reads transaction ID -> credited amount from a statement
+// CSV, finding the columns by their header names.
+func parseStatement(src io.Reader) (map[string]float64, error) {
+	reader := csv.NewReader(src)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %v", err)
+	}
+
+	// Banks often put account details above the header row
+	idCol, amountCol, header := -1, -1, -1
+	for i, record := range records {
+		idCol, amountCol = findColumn(record, statementIDColumns), findColumn(record, statementAmountColumns)
+		if idCol >= 0 && amountCol >= 0 {
+			header = i
+			break
+		}
+	}
+	if header < 0 {
+		return nil, fmt.Errorf("could not find transaction ID and amount columns in the statement")
+	}
+
+	credits := make(map[string]float64)
+	for _, record := range records[header+1:] {
+		if idCol >= len(record) || amountCol >= len(record) {
+			continue
+		}
+		txID := normalizeTransactionID(record[idCol])
+		amount, err := strconv.ParseFloat(strings.NewReplacer(",", "", "₹", "", "INR", "", " ", "").Replace(record[amountCol]), 64)
+		if txID == "" || err != nil || amount <= 0 {
+			continue
+		}
+		credits[txID] += amount
+	}
+	return credits, nil
+}
+
+func findColumn(header []string, names []string) int {
+	for i, col := range header {
+		col = strings.ToLower(strings.TrimSpace(strings.Trim(col, ".:")))
+		for _, name := range names {
+			if col == name {
+				return i
+			}
+		}
+	}
+	return -1
+}
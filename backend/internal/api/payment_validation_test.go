@@ -0,0 +1,112 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/user/wifi-control-system/internal/db"
+)
+
+// testStatement is a bank export with account details above the header.
+const testStatement = `Account Statement,,,
+Account No: 00012345678,,,
+Period: 01/10/2026 - 07/10/2026,,,
+,,,
+Date,Narration,UPI Ref No.,Credit Amount
+01/10/2026,UPI/ALICE,412356789012,"₹1,020.00"
+01/10/2026,UPI/BOB,4123-5678-9013,INR 5
+02/10/2026,UPI/BOB,412356789013,INR 10
+02/10/2026,UPI/CAROL,998877665544,20
+03/10/2026,ATM WITHDRAWAL,,500
+03/10/2026,UPI/DAVE,112233445566,
+`
+
+func TestParseStatement(t *testing.T) {
+	credits, err := parseStatement(strings.NewReader(testStatement))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"412356789012": 1020, "412356789013": 15, "998877665544": 20}
+	if !reflect.DeepEqual(credits, want) {
+		t.Errorf("credits = %v, want %v", credits, want)
+	}
+
+	if _, err := parseStatement(strings.NewReader("Date,Narration\n01/10/2026,UPI/ALICE\n")); err == nil {
+		t.Error("statement without ID and amount columns accepted")
+	}
+}
+
+func TestImportStatement(t *testing.T) {
+	p, _, router := newTestPayments(t)
+	h := p.Subscriptions
+	paid := 20.0
+	for _, n := range []db.NewSubscription{
+		// On the statement with the full price
+		{MacAddress: testClientMAC, PlanID: 1, Status: "pending", AmountPaid: &paid, TransactionID: "412356789012"},
+		// On the statement with ₹15 for a ₹20 plan
+		{MacAddress: testOtherMAC, PlanID: 1, Status: "pending", AmountPaid: &paid, TransactionID: "412356789013"},
+		// Paid for a plan that already ran out
+		{MacAddress: testNewMAC, PlanID: 1, Status: "expired", TransactionID: "998877665544"},
+		{MacAddress: testThirdMAC, PlanID: 1, Status: "pending", AmountPaid: &paid, TransactionID: "998877665544"},
+	} {
+		if _, err := h.Subscriptions.Create(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ImportStatement(w, httptest.NewRequest("POST", "/api/admin/import-statement", strings.NewReader(testStatement)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("ImportStatement: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		StatementRows int `json:"statement_rows"`
+		Approved      []struct {
+			MacAddress string `json:"mac_address"`
+		} `json:"approved"`
+		Mismatched []struct {
+			MacAddress      string  `json:"mac_address"`
+			StatementAmount float64 `json:"statement_amount"`
+			Reason          string  `json:"reason"`
+		} `json:"mismatched"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatementRows != 3 {
+		t.Errorf("statement_rows = %d, want 3", resp.StatementRows)
+	}
+	if len(resp.Approved) != 1 || resp.Approved[0].MacAddress != testClientMAC {
+		t.Errorf("approved = %+v, want only %s", resp.Approved, testClientMAC)
+	}
+	if !router.isAllowed(testClientMAC) {
+		t.Error("approved device not let through")
+	}
+	mismatched := map[string]string{}
+	for _, m := range resp.Mismatched {
+		mismatched[m.MacAddress] = m.Reason
+		if m.MacAddress == testOtherMAC && m.StatementAmount != 15 {
+			t.Errorf("underpaid row reported with %.2f, want 15", m.StatementAmount)
+		}
+	}
+	if reason, ok := mismatched[testOtherMAC]; !ok || reason != "" {
+		t.Errorf("underpaid request not reported as mismatched: %v", mismatched)
+	}
+	if !strings.Contains(mismatched[testThirdMAC], "already used") {
+		t.Errorf("reused transaction ID not refused: %v", mismatched)
+	}
+
+	for _, mac := range []string{testOtherMAC, testThirdMAC} {
+		if router.isAllowed(mac) {
+			t.Errorf("%s let through", mac)
+		}
+	}
+	if pending, _ := h.Subscriptions.Pending(); len(pending) != 2 {
+		t.Errorf("%d requests still pending, want 2", len(pending))
+	}
+}
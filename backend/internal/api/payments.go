@@ -0,0 +1,187 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/user/wifi-control-system/internal/audit"
+	"github.com/user/wifi-control-system/internal/payment"
+)
+
+// PaymentsHandler replaces the typed-in transaction ID with a real payment:
+// the portal creates an order with the provider, the customer pays, and the
+// provider's signed webhook activates the plan through the same path as
+// AssignPlan. Nobody has to reconcile the payment by hand.
+type PaymentsHandler struct {
+	DB            *sql.DB
+	Provider      payment.Provider
+	Subscriptions *SubscriptionsHandler
+	Currency      string
+}
+
+// CreateOrder starts a payment for a plan on the caller's device.
+func (h *PaymentsHandler) CreateOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PlanID     int    `json:"plan_id"`
+		MacAddress string `json:"mac_address"`
+		Mobile     string `json:"mobile"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ip := requestIP(r)
+	mac, err := ownMAC(h.Subscriptions.Router, r, req.MacAddress)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var price float64
+	if err := h.DB.QueryRow("SELECT price FROM plans WHERE id = ?", req.PlanID).Scan(&price); err != nil {
+		http.Error(w, "Plan not found", http.StatusNotFound)
+		return
+	}
+	amount := int64(math.Round(price * 100))
+	if amount <= 0 {
+		http.Error(w, "Free plans do not need a payment", http.StatusBadRequest)
+		return
+	}
+
+	receipt := fmt.Sprintf("wm-%d-%s", req.PlanID, strings.ReplaceAll(mac, ":", ""))
+	order, err := h.Provider.CreateOrder(amount, h.Currency, receipt)
+	if err != nil {
+		fmt.Printf("[PAYMENT] Create order failed: %v\n", err)
+		http.Error(w, "Payment provider unavailable, please try again", http.StatusBadGateway)
+		return
+	}
+
+	_, err = h.DB.Exec(`
+		INSERT INTO payment_orders (provider, order_id, mac_address, plan_id, amount, currency)
+		VALUES (?, ?, ?, ?, ?, ?)`, h.Provider.Name(), order.ID, mac, req.PlanID, order.Amount, order.Currency)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.DB.Exec(`
+		INSERT INTO devices (mac_address, ip_address, status) VALUES (?, ?, 'blocked')
+		ON CONFLICT(mac_address) DO UPDATE SET ip_address = excluded.ip_address, last_seen = CURRENT_TIMESTAMP`, mac, ip)
+	if req.Mobile != "" {
+		h.DB.Exec("UPDATE devices SET device_name = ? WHERE mac_address = ?", req.Mobile, mac)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"provider": h.Provider.Name(),
+		"order":    order,
+	})
+}
+
+// GetOrderStatus lets the portal poll until the webhook has arrived.
+func (h *PaymentsHandler) GetOrderStatus(w http.ResponseWriter, r *http.Request) {
+	var status string
+	err := h.DB.QueryRow("SELECT status FROM payment_orders WHERE order_id = ?", mux.Vars(r)["order_id"]).Scan(&status)
+	if err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
+
+// Webhook receives the provider's payment notifications. Only requests
+// with a valid signature are acted on, and each order activates once even
+// if the provider retries.
+func (h *PaymentsHandler) Webhook(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	event, err := h.Provider.VerifyWebhook(body, r.Header)
+	if err != nil {
+		fmt.Printf("[PAYMENT] Rejected webhook from %s: %v\n", requestIP(r), err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if event == nil {
+		w.WriteHeader(http.StatusOK) // not a payment event
+		return
+	}
+
+	var mac, status string
+	var planID int
+	var amount int64
+	err = h.DB.QueryRow("SELECT mac_address, plan_id, amount, status FROM payment_orders WHERE order_id = ?", event.OrderID).
+		Scan(&mac, &planID, &amount, &status)
+	if err != nil {
+		// Unknown orders are acknowledged so the provider stops retrying
+		fmt.Printf("[PAYMENT] Webhook for unknown order %s\n", event.OrderID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if event.Status != "captured" {
+		h.DB.Exec("UPDATE payment_orders SET status = 'failed', payment_id = ? WHERE order_id = ? AND status = 'created'", event.PaymentID, event.OrderID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if event.Amount < amount {
+		// Retrying will not change the amount; the order fails and the
+		// payment is left for staff to refund
+		fmt.Printf("[PAYMENT] Order %s underpaid: %d < %d\n", event.OrderID, event.Amount, amount)
+		h.DB.Exec("UPDATE payment_orders SET status = 'failed', payment_id = ? WHERE order_id = ? AND status = 'created'", event.PaymentID, event.OrderID)
+		audit.Record(h.DB, audit.Entry{
+			Actor: "payment:" + h.Provider.Name(), Action: "payment.underpaid", TargetMAC: mac, SourceIP: requestIP(r),
+			Details: fmt.Sprintf("order %s, payment %s: paid %d of %d", event.OrderID, event.PaymentID, event.Amount, amount),
+		})
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Claim the order; a retried webhook finds it already paid
+	result, err := h.DB.Exec(`
+		UPDATE payment_orders SET status = 'paid', payment_id = ?, paid_at = ?
+		WHERE order_id = ? AND status != 'paid'`, event.PaymentID, time.Now(), event.OrderID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	paid := float64(event.Amount) / 100
+	subID, err := h.Subscriptions.activatePlan(activation{
+		MAC:           mac,
+		PlanID:        planID,
+		PaymentMethod: h.Provider.Name(),
+		AmountPaid:    &paid,
+		TransactionID: event.PaymentID,
+	})
+	if err != nil {
+		// Let the provider retry the webhook
+		h.DB.Exec("UPDATE payment_orders SET status = 'created' WHERE order_id = ?", event.OrderID)
+		http.Error(w, fmt.Sprintf("Failed to activate plan: %v", err), http.StatusInternalServerError)
+		return
+	}
+	h.DB.Exec("UPDATE payment_orders SET subscription_id = ? WHERE order_id = ?", subID, event.OrderID)
+
+	fmt.Printf("[PAYMENT] Order %s paid (%s), plan %d active for %s\n", event.OrderID, event.PaymentID, planID, mac)
+	audit.Record(h.DB, audit.Entry{
+		Actor: "payment:" + h.Provider.Name(), Action: "payment.activate", TargetMAC: mac, SubscriptionID: int(subID),
+		After: subscriptionState(h.Subscriptions.Subscriptions, int(subID)), SourceIP: requestIP(r),
+		Details: fmt.Sprintf("order %s, payment %s", event.OrderID, event.PaymentID),
+	})
+	w.WriteHeader(http.StatusOK)
+}
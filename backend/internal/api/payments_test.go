@@ -0,0 +1,126 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/user/wifi-control-system/internal/payment"
+)
+
+const testClientMAC = "aa:bb:cc:dd:ee:01"
+
+func newTestPayments(t *testing.T) (*PaymentsHandler, *payment.Mock, *fakeRouter) {
+	t.Helper()
+	store := newTestStore(t)
+	if _, err := store.DB.Exec("INSERT INTO plans (id, name, duration_minutes, price) VALUES (1, 'Day', 1440, 20)"); err != nil {
+		t.Fatal(err)
+	}
+	router := newFakeRouter(map[string]string{"192.168.1.50": testClientMAC})
+	provider := payment.NewMock("test-secret")
+	h := &PaymentsHandler{DB: store.DB, Provider: provider, Subscriptions: newTestSubscriptions(store, router), Currency: "INR"}
+	return h, provider, router
+}
+
+// createOrder starts an order for plan 1 from the test client.
+func createOrder(t *testing.T, h *PaymentsHandler) string {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/api/auth/payments/order", bytes.NewBufferString(`{"plan_id": 1}`))
+	r.RemoteAddr = "192.168.1.50:40000"
+	w := httptest.NewRecorder()
+	h.CreateOrder(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("CreateOrder: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Order payment.Order `json:"order"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Order.ID
+}
+
+func postWebhook(h *PaymentsHandler, body []byte, signature string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/payments/webhook", bytes.NewReader(body))
+	r.Header.Set("X-Mock-Signature", signature)
+	w := httptest.NewRecorder()
+	h.Webhook(w, r)
+	return w
+}
+
+func orderStatus(t *testing.T, h *PaymentsHandler, orderID string) string {
+	t.Helper()
+	var status string
+	if err := h.DB.QueryRow("SELECT status FROM payment_orders WHERE order_id = ?", orderID).Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func countSubscriptions(t *testing.T, h *PaymentsHandler) int {
+	t.Helper()
+	var n int
+	if err := h.DB.QueryRow("SELECT COUNT(*) FROM subscriptions WHERE mac_address = ?", testClientMAC).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestWebhookActivatesOnce(t *testing.T) {
+	h, provider, router := newTestPayments(t)
+	orderID := createOrder(t, h)
+
+	body := provider.PaymentBody(orderID, "pay_1", 2000, "captured")
+	for i := 0; i < 2; i++ {
+		if w := postWebhook(h, body, provider.Sign(body)); w.Code != http.StatusOK {
+			t.Fatalf("webhook %d: %d %s", i+1, w.Code, w.Body)
+		}
+	}
+	if status := orderStatus(t, h, orderID); status != "paid" {
+		t.Errorf("order status = %s, want paid", status)
+	}
+	if n := countSubscriptions(t, h); n != 1 {
+		t.Errorf("replayed webhook created %d subscriptions, want 1", n)
+	}
+	if !router.isAllowed(testClientMAC) {
+		t.Error("paid device was not allowed through")
+	}
+}
+
+func TestWebhookRejectsBadSignature(t *testing.T) {
+	h, provider, router := newTestPayments(t)
+	orderID := createOrder(t, h)
+
+	body := provider.PaymentBody(orderID, "pay_1", 2000, "captured")
+	forged := payment.NewMock("guessed-secret").Sign(body)
+	for _, signature := range []string{"", forged, provider.Sign([]byte("{}"))} {
+		if w := postWebhook(h, body, signature); w.Code != http.StatusUnauthorized {
+			t.Errorf("signature %q: status %d, want 401", signature, w.Code)
+		}
+	}
+	if status := orderStatus(t, h, orderID); status != "created" {
+		t.Errorf("order status = %s after forged webhooks", status)
+	}
+	if countSubscriptions(t, h) != 0 || router.isAllowed(testClientMAC) {
+		t.Error("forged webhook activated a plan")
+	}
+}
+
+func TestWebhookUnderpaidFailsOrder(t *testing.T) {
+	h, provider, router := newTestPayments(t)
+	orderID := createOrder(t, h)
+
+	body := provider.PaymentBody(orderID, "pay_1", 100, "captured")
+	if w := postWebhook(h, body, provider.Sign(body)); w.Code != http.StatusOK {
+		t.Fatalf("underpaid webhook: %d, want 200 so the provider stops retrying", w.Code)
+	}
+	if status := orderStatus(t, h, orderID); status != "failed" {
+		t.Errorf("order status = %s, want failed", status)
+	}
+	if countSubscriptions(t, h) != 0 || router.isAllowed(testClientMAC) {
+		t.Error("underpaid order activated a plan")
+	}
+}
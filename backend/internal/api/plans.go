@@ -1,22 +1,18 @@
 package api
 
 import (
-	"database/sql"
 	"encoding/json"
 	"net/http"
+	"strconv"
 	"github.com/gorilla/mux"
+	"github.com/user/wifi-control-system/internal/audit"
+	"github.com/user/wifi-control-system/internal/db"
 )
 
-type Plan struct {
-	ID              int     `json:"id"`
-	Name            string  `json:"name"`
-	DurationMinutes int     `json:"duration_minutes"`
-	Price           float64 `json:"price"`
-	DataLimitMB     int     `json:"data_limit_mb"`
-}
+type Plan = db.Plan
 
 type PlansHandler struct {
-	DB *sql.DB
+	Plans db.Plans
 }
 
 func (h *PlansHandler) CreatePlan(w http.ResponseWriter, r *http.Request) {
@@ -26,45 +22,52 @@ func (h *PlansHandler) CreatePlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := h.DB.Exec("INSERT INTO plans (name, duration_minutes, price, data_limit_mb) VALUES (?, ?, ?, ?)",
-		p.Name, p.DurationMinutes, p.Price, p.DataLimitMB)
-	if err != nil {
+	if p.MaxDevices < 1 {
+		p.MaxDevices = 1
+	}
+
+	if err := h.Plans.Create(&p); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	id, _ := result.LastInsertId()
-	p.ID = int(id)
+	e := audit.From(r)
+	e.Action = "plan.create"
+	e.After = p
 	json.NewEncoder(w).Encode(p)
 }
 
 func (h *PlansHandler) GetPlans(w http.ResponseWriter, r *http.Request) {
-	rows, err := h.DB.Query("SELECT id, name, duration_minutes, price, data_limit_mb FROM plans")
+	plans, err := h.Plans.List()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var plans []Plan
-	for rows.Next() {
-		var p Plan
-		if err := rows.Scan(&p.ID, &p.Name, &p.DurationMinutes, &p.Price, &p.DataLimitMB); err != nil {
-			continue
-		}
-		plans = append(plans, p)
-	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(plans)
 }
 
-func (h *PlansHandler) DeletePlan(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
+// planRate returns the speed limits of a plan; unknown plans are unlimited.
+func planRate(plans db.Plans, planID int) (downKbps, upKbps int) {
+	p, _ := plans.Get(planID)
+	return p.DownloadKbps, p.UploadKbps
+}
 
-	_, err := h.DB.Exec("DELETE FROM plans WHERE id = ?", id)
+func (h *PlansHandler) DeletePlan(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
+		http.Error(w, "Invalid plan ID", http.StatusBadRequest)
+		return
+	}
+
+	if p, err := h.Plans.Get(id); err == nil {
+		e := audit.From(r)
+		e.Action = "plan.delete"
+		e.Before = p
+	}
+
+	if err := h.Plans.Delete(id); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/user/wifi-control-system/internal/router"
+)
+
+// Phones with private addresses show up under a new MAC every so often.
+// The portal hands each device with an active plan a session token (cookie,
+// or the X-Device-Session header for apps) so that when it comes back under
+// another MAC the plan follows it without an admin.
+const (
+	deviceSessionCookie = "device_session"
+	deviceSessionHeader = "X-Device-Session"
+
+	// Older tokens of a subscription are dropped beyond this many
+	maxSessionsPerSubscription = 5
+)
+
+// RebindSession gives a returning device under a new (randomized) MAC its
+// plan back: the active subscription behind the request's session token
+// moves to the device making the request.
+func (h *SubscriptionsHandler) RebindSession(w http.ResponseWriter, r *http.Request) {
+	mac, err := ownMAC(h.Router, r, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if !h.rebindSession(r, mac) {
+		http.Error(w, "No active plan to move to this device", http.StatusNotFound)
+		return
+	}
+	sub, err := h.Subscriptions.Current(mac)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{"status": sub.Status, "rebound": true}
+	if token, err := h.issueSession(w, r, sub.ID, mac, sub.EndTime); err == nil {
+		resp["session_token"] = token
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// issueSession returns a session token for the device holding subscription
+// subID and sets it as a cookie. A token the request already carries for
+// the same subscription is kept.
+func (h *SubscriptionsHandler) issueSession(w http.ResponseWriter, r *http.Request, subID int, mac string, end time.Time) (string, error) {
+	if token := sessionToken(r); token != "" {
+		if ok, err := h.Sessions.Refresh(hashSessionToken(token), subID, mac); err == nil && ok {
+			setSessionCookie(w, token, end)
+			return token, nil
+		}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	if err := h.Sessions.Create(hashSessionToken(token), subID, mac, maxSessionsPerSubscription); err != nil {
+		return "", err
+	}
+
+	setSessionCookie(w, token, end)
+	return token, nil
+}
+
+// rebindSession moves the active subscription behind the request's session
+// token to mac, unless mac already has a plan of its own. It reports
+// whether mac now holds that subscription.
+func (h *SubscriptionsHandler) rebindSession(r *http.Request, mac string) bool {
+	token := sessionToken(r)
+	if token == "" || mac == "" {
+		return false
+	}
+
+	sub, err := h.Sessions.Subscription(hashSessionToken(token))
+	if err != nil {
+		return false
+	}
+	subID, oldMAC := sub.ID, sub.MacAddress
+	if oldMAC == mac {
+		return true
+	}
+	if h.hasActive(mac) {
+		return false
+	}
+
+	before := subscriptionState(h.Subscriptions, subID)
+	if err := h.moveSubscription(subID, sub.PlanID, oldMAC, mac); err != nil {
+		fmt.Printf("[SESSION] Failed to re-bind subscription %d to %s: %v\n", subID, mac, err)
+		return false
+	}
+	note := ""
+	if router.IsRandomizedMAC(mac) {
+		note = " (randomized MAC)"
+	}
+	fmt.Printf("[SESSION] Subscription %d re-bound from %s to %s%s\n", subID, oldMAC, mac, note)
+	e := describe(r, "subscription.rebind", subID, mac)
+	e.Before, e.After = before, subscriptionState(h.Subscriptions, subID)
+	e.Details = "session token" + note
+	return true
+}
+
+// moveSubscription re-keys a subscription to another MAC, blocking the old
+// device and allowing the new one with the plan's speed limits.
+func (h *SubscriptionsHandler) moveSubscription(id, planID int, from, to string) error {
+	if err := h.Subscriptions.Move(id, to); err != nil {
+		return err
+	}
+	if !h.hasActive(from) {
+		h.blockDevice(from)
+	}
+	h.Devices.Ensure(to, router.IsRandomizedMAC(to))
+	h.allowDevice(to, planID)
+	return nil
+}
+
+// allowDevice lets mac through with the speed limits of planID.
+func (h *SubscriptionsHandler) allowDevice(mac string, planID int) {
+	if h.Router != nil {
+		down, up := planRate(h.Plans, planID)
+		h.Router.SetSpeedLimit(mac, down, up)
+		h.Router.AllowMAC(mac)
+	}
+	if err := h.Devices.SetStatus(mac, "allowed"); err != nil {
+		fmt.Printf("Warning: Failed to update device status in DB: %v\n", err)
+	}
+}
+
+// hasActive reports whether mac has a plan running; a failed lookup counts
+// as none.
+func (h *SubscriptionsHandler) hasActive(mac string) bool {
+	active, err := h.Subscriptions.HasActive(mac)
+	return err == nil && active
+}
+
+func (h *SubscriptionsHandler) blockDevice(mac string) {
+	if h.Router != nil {
+		ip, _ := h.Router.FindIPbyMAC(mac)
+		h.Router.BlockMAC(mac, ip)
+	}
+	h.Devices.SetStatus(mac, "blocked")
+}
+
+func sessionToken(r *http.Request) string {
+	if c, err := r.Cookie(deviceSessionCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	return r.Header.Get(deviceSessionHeader)
+}
+
+func setSessionCookie(w http.ResponseWriter, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     deviceSessionCookie,
+		Value:    token,
+		Expires:  expires,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
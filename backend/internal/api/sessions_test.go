@@ -0,0 +1,70 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testNewMAC = "aa:bb:cc:dd:ee:02"
+
+func TestSessionRebindNeedsExplicitPost(t *testing.T) {
+	payments, _, router := newTestPayments(t)
+	h := payments.Subscriptions
+	subID, err := h.activatePlan(activation{MAC: testClientMAC, PlanID: 1, PaymentMethod: "cash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.CheckStatus(w, portalRequest("GET", "/api/auth/status", ""))
+	var status struct {
+		Status       string `json:"status"`
+		SessionToken string `json:"session_token"`
+	}
+	json.NewDecoder(w.Body).Decode(&status)
+	if status.Status != "active" || status.SessionToken == "" {
+		t.Fatalf("status = %+v, want active with a session token", status)
+	}
+
+	// The phone comes back under a new MAC
+	router.macs[testClientIP] = testNewMAC
+	withToken := func(method, target string) *http.Request {
+		r := portalRequest(method, target, "")
+		r.Header.Set(deviceSessionHeader, status.SessionToken)
+		return r
+	}
+
+	w = httptest.NewRecorder()
+	h.CheckStatus(w, withToken("GET", "/api/auth/status"))
+	if sub, _ := h.Subscriptions.Get(int(subID)); sub.MacAddress != testClientMAC {
+		t.Fatalf("status poll moved the plan to %s", sub.MacAddress)
+	}
+
+	w = httptest.NewRecorder()
+	h.RebindSession(w, portalRequest("POST", "/api/auth/session/rebind", ""))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("rebind without a token: %d, want 404", w.Code)
+	}
+
+	unknown := withToken("POST", "/api/auth/session/rebind")
+	unknown.RemoteAddr = "192.168.1.77:40000"
+	w = httptest.NewRecorder()
+	h.RebindSession(w, unknown)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("rebind from an unknown address: %d, want 403", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.RebindSession(w, withToken("POST", "/api/auth/session/rebind"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("rebind: %d %s", w.Code, w.Body)
+	}
+	if sub, _ := h.Subscriptions.Get(int(subID)); sub.MacAddress != testNewMAC {
+		t.Errorf("plan is on %s after rebind, want %s", sub.MacAddress, testNewMAC)
+	}
+	if !router.isAllowed(testNewMAC) || router.isAllowed(testClientMAC) {
+		t.Errorf("firewall not moved: allowed %v", router.allowed)
+	}
+}
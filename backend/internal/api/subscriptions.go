@@ -3,28 +3,25 @@ package api
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/user/wifi-control-system/internal/audit"
+	"github.com/user/wifi-control-system/internal/db"
+	"github.com/user/wifi-control-system/internal/router"
 )
 
-type Subscription struct {
-	ID            int       `json:"id"`
-	MacAddress    string    `json:"mac_address"`
-	PlanID        int       `json:"plan_id"`
-	PlanName      string    `json:"plan_name"`
-	StartTime     time.Time `json:"start_time"`
-	EndTime       time.Time `json:"end_time"`
-	Status        string    `json:"status"`
-	Price         float64   `json:"price"`
-	PaymentMethod string    `json:"payment_method"`
-	AmountPaid    float64   `json:"amount_paid"`
-	TransactionID string    `json:"transaction_id"`
-	Mobile        string    `json:"mobile"`
-}
+type Subscription = db.Subscription
 
 type SubscriptionsHandler struct {
+	Devices       db.Devices
+	Plans         db.Plans
+	Subscriptions db.Subscriptions
+	Sessions      db.Sessions
+	// DB is the audit log the statement import records its approvals in
 	DB     *sql.DB
 	Router interface {
 		AllowMAC(mac string) (string, error)
@@ -32,7 +29,10 @@ type SubscriptionsHandler struct {
 		FindIPbyMAC(mac string) (string, error)
 		FindMACbyIP(ip string) (string, error)
 		GetSystemInfo() map[string]interface{}
+		SetSpeedLimit(mac string, downKbps, upKbps int) error
 	}
+	// CaptivePortalAPI is the RFC 8908 API URL advertised via DHCP option 114 / RA.
+	CaptivePortalAPI string
 }
 
 func (h *SubscriptionsHandler) RequestPlan(w http.ResponseWriter, r *http.Request) {
@@ -48,20 +48,35 @@ func (h *SubscriptionsHandler) RequestPlan(w http.ResponseWriter, r *http.Reques
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	mac, err := ownMAC(h.Router, r, req.MacAddress)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// One transaction ID pays for one request
+	req.TransactionID = normalizeTransactionID(req.TransactionID)
+	if req.TransactionID != "" && transactionIDInUse(h.Subscriptions, req.TransactionID, 0) {
+		http.Error(w, "This transaction ID has already been used", http.StatusConflict)
+		return
+	}
 
 	// Insert as 'pending' with payment details
-	_, err := h.DB.Exec(`
-		INSERT INTO subscriptions (mac_address, plan_id, status, payment_method, amount_paid, transaction_id) 
-		VALUES (?, ?, 'pending', ?, ?, ?)`,
-		req.MacAddress, req.PlanID, req.PaymentMethod, req.AmountPaid, req.TransactionID)
-	
+	_, err = h.Subscriptions.Create(db.NewSubscription{
+		MacAddress: mac, PlanID: req.PlanID, Status: "pending",
+		PaymentMethod: req.PaymentMethod, AmountPaid: &req.AmountPaid, TransactionID: req.TransactionID,
+	})
 	if err != nil {
+		if db.IsUniqueViolation(err) {
+			http.Error(w, "This transaction ID has already been used", http.StatusConflict)
+			return
+		}
 		http.Error(w, fmt.Sprintf("Request failed: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	// Update device name to mobile number if it exists
-	h.DB.Exec("UPDATE devices SET device_name = ? WHERE mac_address = ?", req.Mobile, req.MacAddress)
+	h.Devices.SetName(mac, req.Mobile)
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Request sent for approval"})
@@ -76,45 +91,49 @@ func (h *SubscriptionsHandler) ApproveSubscription(w http.ResponseWriter, r *htt
 		return
 	}
 
-	// 1. Get Subscription and Plan details
-	var mac string
-	var durationMins int
-	err := h.DB.QueryRow(`
-		SELECT s.mac_address, p.duration_minutes 
-		FROM subscriptions s 
-		JOIN plans p ON s.plan_id = p.id 
-		WHERE s.id = ?`, req.SubscriptionID).Scan(&mac, &durationMins)
-	
-	if err != nil {
-		http.Error(w, "Subscription not found", http.StatusNotFound)
+	before := subscriptionState(h.Subscriptions, req.SubscriptionID)
+	if err := h.approve(req.SubscriptionID); err != nil {
+		if err == errSubscriptionNotFound {
+			http.Error(w, "Subscription not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	after := subscriptionState(h.Subscriptions, req.SubscriptionID)
+	e := describe(r, "subscription.approve", req.SubscriptionID, fmt.Sprint(after["mac_address"]))
+	e.Before, e.After = before, after
 
-	startTime := time.Now()
-	endTime := startTime.Add(time.Duration(durationMins) * time.Minute)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Subscription approved and activated"})
+}
 
-	// 2. Activate Subscription
-	_, err = h.DB.Exec(`
-		UPDATE subscriptions SET 
-			start_time = ?, 
-			end_time = ?, 
-			status = 'active' 
-		WHERE id = ?`,
-		startTime, endTime, req.SubscriptionID)
-	
+var errSubscriptionNotFound = errors.New("subscription not found")
+
+// approve activates a pending request from now. Used by ApproveSubscription
+// and the statement import.
+func (h *SubscriptionsHandler) approve(id int) error {
+	// 1. Get Subscription and Plan details
+	sub, err := h.Subscriptions.Get(id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return errSubscriptionNotFound
+	}
+	plan, err := h.Plans.Get(sub.PlanID)
+	if err != nil {
+		return errSubscriptionNotFound
 	}
 
-	// 3. Unblock Device
-	if h.Router != nil {
-		h.Router.AllowMAC(mac)
+	startTime := time.Now()
+	endTime := startTime.Add(time.Duration(plan.DurationMinutes) * time.Minute)
+
+	// 2. Activate Subscription
+	if err := h.Subscriptions.Activate(id, startTime, endTime); err != nil {
+		return err
 	}
-	h.DB.Exec("UPDATE devices SET status = 'allowed' WHERE mac_address = ?", mac)
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Subscription approved and activated"})
+	// 3. Unblock Device at the plan speed
+	h.allowDevice(sub.MacAddress, plan.ID)
+	return nil
 }
 
 func (h *SubscriptionsHandler) RejectSubscription(w http.ResponseWriter, r *http.Request) {
@@ -126,86 +145,53 @@ func (h *SubscriptionsHandler) RejectSubscription(w http.ResponseWriter, r *http
 		return
 	}
 
+	before := subscriptionState(h.Subscriptions, req.SubscriptionID)
+
 	// Update status to rejected
-	_, err := h.DB.Exec(`UPDATE subscriptions SET status = 'rejected' WHERE id = ?`, req.SubscriptionID)
-	if err != nil {
+	if err := h.Subscriptions.SetStatus(req.SubscriptionID, "rejected"); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if before != nil {
+		e := describe(r, "subscription.reject", req.SubscriptionID, fmt.Sprint(before["mac_address"]))
+		e.Before, e.After = before, subscriptionState(h.Subscriptions, req.SubscriptionID)
+	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Subscription rejected"})
 }
 
+// pendingRequest is a pending request with what looks off about its payment.
+type pendingRequest struct {
+	db.PendingRequest
+	Flags      []string `json:"flags"`
+	Suspicious bool     `json:"suspicious"`
+}
+
 func (h *SubscriptionsHandler) GetPendingRequests(w http.ResponseWriter, r *http.Request) {
-	rows, err := h.DB.Query(`
-		SELECT s.id, s.mac_address, d.device_name, p.name, p.price, p.duration_minutes, 
-		       COALESCE(s.payment_method, ''), COALESCE(s.amount_paid, 0), COALESCE(s.transaction_id, '')
-		FROM subscriptions s
-		JOIN plans p ON s.plan_id = p.id
-		JOIN devices d ON s.mac_address = d.mac_address
-		WHERE s.status = 'pending'`)
-	
+	pending, err := h.Subscriptions.Pending()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	var requests []map[string]interface{}
-	for rows.Next() {
-		var id, duration int
-		var mac, mobile, planName, payMethod, txID string
-		var price, amtPaid float64
-		if err := rows.Scan(&id, &mac, &mobile, &planName, &price, &duration, &payMethod, &amtPaid, &txID); err != nil {
-			fmt.Printf("[API] Error scanning pending request: %v\n", err)
-			continue
-		}
-		requests = append(requests, map[string]interface{}{
-			"id":               id,
-			"mac_address":      mac,
-			"mobile":           mobile,
-			"plan_name":        planName,
-			"price":            price,
-			"duration":         duration,
-			"payment_method":   payMethod,
-			"amount_paid":      amtPaid,
-			"transaction_id":   txID,
-		})
+	// Flag duplicate/forged-looking payments for the admin
+	var requests []pendingRequest
+	for _, p := range pending {
+		flags := pendingRequestFlags(h.Subscriptions, p.ID, p.TransactionID, p.AmountPaid, p.Price)
+		requests = append(requests, pendingRequest{PendingRequest: p, Flags: flags, Suspicious: len(flags) > 0})
 	}
 	json.NewEncoder(w).Encode(requests)
 }
 
 func (h *SubscriptionsHandler) GetStats(w http.ResponseWriter, r *http.Request) {
-	var totalRevenue float64
-	var activeUsers int
-	var totalPlans int
-	var blockedDevices int
-	var totalDevices int
-	var pendingRequests int
-
-	// Revenue now uses amount_paid if available, otherwise price from plan
-	h.DB.QueryRow(`
-		SELECT SUM(COALESCE(s.amount_paid, p.price, 0)) 
-		FROM subscriptions s 
-		LEFT JOIN plans p ON s.plan_id = p.id 
-		WHERE s.status IN ('active', 'expired')`).Scan(&totalRevenue)
-	
-	h.DB.QueryRow("SELECT COUNT(*) FROM subscriptions WHERE status = 'active'").Scan(&activeUsers)
-	h.DB.QueryRow("SELECT COUNT(*) FROM plans").Scan(&totalPlans)
-	h.DB.QueryRow("SELECT COUNT(*) FROM devices WHERE status = 'blocked'").Scan(&blockedDevices)
-	h.DB.QueryRow("SELECT COUNT(*) FROM devices").Scan(&totalDevices)
-	h.DB.QueryRow("SELECT COUNT(*) FROM subscriptions WHERE status = 'pending'").Scan(&pendingRequests)
-
+	stats, err := h.Subscriptions.Stats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"total_revenue":    totalRevenue,
-		"active_users":     activeUsers,
-		"total_plans":      totalPlans,
-		"blocked_devices":  blockedDevices,
-		"total_devices":    totalDevices,
-		"pending_requests": pendingRequests,
-	})
+	json.NewEncoder(w).Encode(stats)
 }
 
 func (h *SubscriptionsHandler) AssignPlan(w http.ResponseWriter, r *http.Request) {
@@ -218,119 +204,101 @@ func (h *SubscriptionsHandler) AssignPlan(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// 1. Get Plan details
-	var durationMins int
-	err := h.DB.QueryRow("SELECT duration_minutes FROM plans WHERE id = ?", req.PlanID).Scan(&durationMins)
+	id, err := h.activatePlan(activation{MAC: req.MacAddress, PlanID: req.PlanID})
 	if err != nil {
-		http.Error(w, "Plan not found", http.StatusNotFound)
+		if err == errPlanNotFound {
+			http.Error(w, "Plan not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to assign plan: %v", err), http.StatusInternalServerError)
 		return
 	}
+	describe(r, "subscription.assign", int(id), req.MacAddress).After = subscriptionState(h.Subscriptions, int(id))
 
-	startTime := time.Now()
-	endTime := startTime.Add(time.Duration(durationMins) * time.Minute)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Plan assigned successfully"})
+}
 
-	// 2. Insert Subscription
-	_, err = h.DB.Exec(`
-		INSERT INTO subscriptions (mac_address, plan_id, start_time, end_time, status) 
-		VALUES (?, ?, ?, ?, 'active')`,
-		req.MacAddress, req.PlanID, startTime, endTime)
+var errPlanNotFound = errors.New("plan not found")
+
+// activation is a subscription that starts right away.
+type activation struct {
+	MAC    string
+	PlanID int
+	// EndTime overrides now + plan duration when set.
+	EndTime       time.Time
+	PaymentMethod string
+	AmountPaid    *float64
+	TransactionID string
+	// CustomerID and ParentID link the subscription to a customer account
+	// and, for extra devices, to the subscription they share; 0 means none.
+	CustomerID int
+	ParentID   int
+}
+
+// activatePlan inserts an active subscription, applies the plan speed and
+// lets the device through. Admin assignment and voucher redemption share it.
+func (h *SubscriptionsHandler) activatePlan(a activation) (int64, error) {
+	// 1. Get Plan details
+	plan, err := h.Plans.Get(a.PlanID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to assign plan: %v", err), http.StatusInternalServerError)
-		return
+		return 0, errPlanNotFound
 	}
 
-	// 3. Inform Router and update Device status
-	if h.Router != nil {
-		fmt.Printf("[API] AssignPlan: Allowing MAC %s\n", req.MacAddress)
-		h.Router.AllowMAC(req.MacAddress)
+	startTime := time.Now()
+	endTime := startTime.Add(time.Duration(plan.DurationMinutes) * time.Minute)
+	if !a.EndTime.IsZero() {
+		endTime = a.EndTime
 	}
-	
-	// Update device status in database to 'allowed'
-	_, err = h.DB.Exec("UPDATE devices SET status = 'allowed' WHERE mac_address = ?", req.MacAddress)
+
+	// 2. Insert Subscription
+	id, err := h.Subscriptions.Create(db.NewSubscription{
+		MacAddress: a.MAC, PlanID: a.PlanID, StartTime: startTime, EndTime: endTime, Status: "active",
+		PaymentMethod: a.PaymentMethod, AmountPaid: a.AmountPaid, TransactionID: a.TransactionID,
+		CustomerID: a.CustomerID, ParentID: a.ParentID,
+	})
 	if err != nil {
-		fmt.Printf("Warning: Failed to update device status in DB: %v\n", err)
+		return 0, err
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Plan assigned successfully"})
+	// 3. Inform Router and update Device status
+	fmt.Printf("[API] Activating plan %d: Allowing MAC %s\n", a.PlanID, a.MAC)
+	h.allowDevice(a.MAC, a.PlanID)
+	return id, nil
 }
 
 func (h *SubscriptionsHandler) GetActiveSubscriptions(w http.ResponseWriter, r *http.Request) {
-	rows, err := h.DB.Query(`
-		SELECT s.id, s.mac_address, s.plan_id, p.name, s.start_time, s.end_time, s.status, p.price 
-		FROM subscriptions s
-		JOIN plans p ON s.plan_id = p.id
-		WHERE s.status = 'active' AND s.end_time > ?`, time.Now())
+	subs, err := h.Subscriptions.Active()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var subs []Subscription
-	for rows.Next() {
-		var s Subscription
-		var start, end sql.NullTime
-		if err := rows.Scan(&s.ID, &s.MacAddress, &s.PlanID, &s.PlanName, &start, &end, &s.Status, &s.Price); err != nil {
-			continue
-		}
-		if start.Valid { s.StartTime = start.Time }
-		if end.Valid { s.EndTime = end.Time }
-		subs = append(subs, s)
-	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(subs)
 }
 
 func (h *SubscriptionsHandler) GetRevenueStats(w http.ResponseWriter, r *http.Request) {
-	rows, err := h.DB.Query(`
-		SELECT date(start_time), SUM(COALESCE(p.price, 0))
-		FROM subscriptions s
-		LEFT JOIN plans p ON s.plan_id = p.id
-		WHERE s.status IN ('active', 'expired', 'pending')
-		AND start_time IS NOT NULL
-		AND start_time >= date('now', '-7 days')
-		GROUP BY date(start_time)
-		ORDER BY date(start_time) ASC`)
-	
+	stats, err := h.Subscriptions.RevenueByDay()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var stats []map[string]interface{}
-	for rows.Next() {
-		var d string
-		var total float64
-		rows.Scan(&d, &total)
-		stats = append(stats, map[string]interface{}{
-			"date":  d,
-			"total": total,
-		})
-	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(stats)
 }
+
 func (h *SubscriptionsHandler) CheckStatus(w http.ResponseWriter, r *http.Request) {
-	mac := r.URL.Query().Get("mac")
-	if mac == "" {
-		http.Error(w, "MAC address is required", http.StatusBadRequest)
+	// ?mac= is optional and must be the caller's own device
+	mac, err := ownMAC(h.Router, r, r.URL.Query().Get("mac"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
 
-	var status string
-	err := h.DB.QueryRow(`
-		SELECT status 
-		FROM subscriptions 
-		WHERE mac_address = ? 
-		AND (status = 'active' OR status = 'pending' OR status = 'rejected')
-		ORDER BY CASE WHEN status = 'active' THEN 1 WHEN status = 'pending' THEN 2 ELSE 3 END ASC, id DESC 
-		LIMIT 1`, mac).Scan(&status)
-
+	sub, err := h.Subscriptions.Current(mac)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if err == db.ErrNotFound {
 			json.NewEncoder(w).Encode(map[string]string{"status": "none"})
 			return
 		}
@@ -338,7 +306,13 @@ func (h *SubscriptionsHandler) CheckStatus(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{"status": status})
+	resp := map[string]interface{}{"status": sub.Status}
+	if sub.Status == "active" && !sub.EndTime.IsZero() {
+		if token, err := h.issueSession(w, r, sub.ID, mac, sub.EndTime); err == nil {
+			resp["session_token"] = token
+		}
+	}
+	json.NewEncoder(w).Encode(resp)
 }
 
 func (h *SubscriptionsHandler) RevokeSubscription(w http.ResponseWriter, r *http.Request) {
@@ -351,76 +325,50 @@ func (h *SubscriptionsHandler) RevokeSubscription(w http.ResponseWriter, r *http
 	}
 
 	// 1. Get MAC and status
-	var mac, status string
-	err := h.DB.QueryRow("SELECT mac_address, status FROM subscriptions WHERE id = ?", req.SubscriptionID).Scan(&mac, &status)
+	sub, err := h.Subscriptions.Get(req.SubscriptionID)
 	if err != nil {
 		http.Error(w, "Subscription not found", http.StatusNotFound)
 		return
 	}
+	mac := sub.MacAddress
 
-	if status != "active" {
+	if sub.Status != "active" {
 		http.Error(w, "Only active subscriptions can be revoked", http.StatusBadRequest)
 		return
 	}
 
+	before := subscriptionState(h.Subscriptions, req.SubscriptionID)
+
 	// 2. Update status to 'expired' (revoked)
-	_, err = h.DB.Exec("UPDATE subscriptions SET status = 'expired' WHERE id = ?", req.SubscriptionID)
-	if err != nil {
+	if err := h.Subscriptions.SetStatus(req.SubscriptionID, "expired"); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// Extra devices sharing this subscription go with it
+	shared, _ := h.Subscriptions.ExpireShared(req.SubscriptionID)
+	macs := append([]string{mac}, shared...)
+
 	// 3. Block Device immediately
-	if h.Router != nil {
-		// Attempt to find IP for blocking
-		ip, _ := h.Router.FindIPbyMAC(mac)
-		h.Router.BlockMAC(mac, ip)
+	for _, mac := range macs {
+		h.blockDevice(mac)
+	}
+
+	e := describe(r, "subscription.revoke", req.SubscriptionID, mac)
+	e.Before, e.After = before, subscriptionState(h.Subscriptions, req.SubscriptionID)
+	if len(macs) > 1 {
+		e.Details = fmt.Sprintf("also blocked %s", strings.Join(macs[1:], ", "))
 	}
-	h.DB.Exec("UPDATE devices SET status = 'blocked' WHERE mac_address = ?", mac)
 
 	json.NewEncoder(w).Encode(map[string]string{"message": "Subscription revoked and device blocked"})
 }
 
 func (h *SubscriptionsHandler) GetAllSubscriptions(w http.ResponseWriter, r *http.Request) {
-	rows, err := h.DB.Query(`
-		SELECT s.id, s.mac_address, s.plan_id, COALESCE(p.name, 'Unknown Plan'), 
-		       s.start_time, s.end_time, s.status, COALESCE(p.price, 0),
-		       COALESCE(s.payment_method, ''), COALESCE(s.amount_paid, 0), COALESCE(s.transaction_id, ''),
-		       COALESCE(d.device_name, 'Unknown')
-		FROM subscriptions s
-		LEFT JOIN plans p ON s.plan_id = p.id
-		LEFT JOIN devices d ON s.mac_address = d.mac_address
-		ORDER BY s.id DESC`)
+	subs, err := h.Subscriptions.All()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var subs []Subscription
-	for rows.Next() {
-		var s Subscription
-		var start, end sql.NullTime
-		var planName, payMethod, txID, mobile sql.NullString
-		var price, amtPaid sql.NullFloat64
-
-		if err := rows.Scan(&s.ID, &s.MacAddress, &s.PlanID, &planName, &start, &end, &s.Status, &price, &payMethod, &amtPaid, &txID, &mobile); err != nil {
-			fmt.Printf("[API] Error scanning subscription row %d: %v\n", s.ID, err)
-			continue
-		}
-		
-		s.PlanName = "Unknown Plan"
-		if planName.Valid { s.PlanName = planName.String }
-		if start.Valid { s.StartTime = start.Time }
-		if end.Valid { s.EndTime = end.Time }
-		if price.Valid { s.Price = price.Float64 }
-		if payMethod.Valid { s.PaymentMethod = payMethod.String }
-		if amtPaid.Valid { s.AmountPaid = amtPaid.Float64 }
-		if txID.Valid { s.TransactionID = txID.String }
-		if mobile.Valid { s.Mobile = mobile.String }
-
-		subs = append(subs, s)
-	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(subs)
@@ -428,13 +376,7 @@ func (h *SubscriptionsHandler) GetAllSubscriptions(w http.ResponseWriter, r *htt
 
 func (h *SubscriptionsHandler) WhoAmI(w http.ResponseWriter, r *http.Request) {
 	// 1. Get IP from request
-	ip := r.Header.Get("X-Forwarded-For")
-	if ip == "" {
-		ip = r.RemoteAddr
-		if lastColon := strings.LastIndex(ip, ":"); lastColon != -1 {
-			ip = ip[:lastColon]
-		}
-	}
+	ip := requestIP(r)
 
 	// 2. Look up MAC
 	mac := "unknown"
@@ -446,9 +388,10 @@ func (h *SubscriptionsHandler) WhoAmI(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"ip":  ip,
-		"mac": mac,
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ip":         ip,
+		"mac":        mac,
+		"randomized": router.IsRandomizedMAC(mac),
 	})
 }
 
@@ -458,29 +401,27 @@ func (h *SubscriptionsHandler) GetSystemStatus(w http.ResponseWriter, r *http.Re
 		return
 	}
 	info := h.Router.GetSystemInfo()
+	if h.CaptivePortalAPI != "" {
+		info["captive_portal_api"] = h.CaptivePortalAPI
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(info)
 }
 
 func (h *SubscriptionsHandler) FlushData(w http.ResponseWriter, r *http.Request) {
-	// Call DB Flush logic (We need to cast/wrap s.DB or just do it here)
-	// Since h.DB is *sql.DB, we can't call DBStore methods unless we have the store.
-	// We'll just execute the queries directly here for simplicity if we don't want to pass DBStore.
-	
-	// Actually, let's keep it simple and just do it here or in main.
-	// For now, raw SQL in handler is fine or better yet, use the DB interface if we had one.
-	
-	_, err := h.DB.Exec("DELETE FROM subscriptions")
+	subscriptions, devices, err := h.Subscriptions.Flush()
+	e := audit.From(r)
+	e.Action = "system.flush"
+	e.Before = map[string]int{"subscriptions": subscriptions, "devices": devices}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	_, err = h.DB.Exec("DELETE FROM devices")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	h.DB.Exec("DELETE FROM sqlite_sequence WHERE name IN ('subscriptions', 'devices')")
 
 	json.NewEncoder(w).Encode(map[string]string{"message": "System data flushed successfully"})
 }
+
+// requestIP returns the client address of r without the port.
+func requestIP(r *http.Request) string {
+	return audit.ClientIP(r)
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/user/wifi-control-system/internal/db"
+)
+
+func TestRequestPlanRejectsUsedTransactionID(t *testing.T) {
+	h, router := newMemorySubscriptions(t)
+	router.macs["192.168.1.51"] = testOtherMAC
+
+	request := func(ip, txID string) int {
+		r := portalRequest("POST", "/api/auth/request", `{"plan_id": 1, "payment_method": "upi", "amount_paid": 20, "transaction_id": "`+txID+`"}`)
+		r.RemoteAddr = ip + ":40000"
+		w := httptest.NewRecorder()
+		h.RequestPlan(w, r)
+		return w.Code
+	}
+
+	if code := request(testClientIP, "utr 4123-5678-9012"); code != http.StatusOK {
+		t.Fatalf("first request: %d", code)
+	}
+	if code := request("192.168.1.51", "UTR412356789012"); code != http.StatusConflict {
+		t.Errorf("same transaction ID from another device: %d, want 409", code)
+	}
+
+	// A rejected request frees its transaction ID
+	pending, _ := h.Subscriptions.Pending()
+	if len(pending) != 1 || pending[0].TransactionID != "UTR412356789012" {
+		t.Fatalf("pending = %+v", pending)
+	}
+	h.Subscriptions.SetStatus(pending[0].ID, "rejected")
+	if code := request("192.168.1.51", "UTR412356789012"); code != http.StatusOK {
+		t.Errorf("transaction ID of a rejected request: %d, want 200", code)
+	}
+}
+
+func TestPendingRequestsAreFlagged(t *testing.T) {
+	h, _ := newMemorySubscriptions(t)
+	paid, underpaid := 20.0, 5.0
+	for _, n := range []db.NewSubscription{
+		{MacAddress: testClientMAC, PlanID: 1, Status: "pending", AmountPaid: &paid, TransactionID: "412356789012"},
+		{MacAddress: testOtherMAC, PlanID: 1, Status: "pending", AmountPaid: &underpaid, TransactionID: "412356789012"},
+		{MacAddress: testNewMAC, PlanID: 1, Status: "pending", AmountPaid: &paid, TransactionID: "998877665544"},
+	} {
+		if _, err := h.Subscriptions.Create(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.GetPendingRequests(w, httptest.NewRequest("GET", "/api/admin/pending", nil))
+	var requests []pendingRequest
+	if err := json.NewDecoder(w.Body).Decode(&requests); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("got %d pending requests, want 3", len(requests))
+	}
+	flags := map[string]string{}
+	for _, p := range requests {
+		flags[p.MacAddress] = strings.Join(p.Flags, "; ")
+		if p.Suspicious != (len(p.Flags) > 0) {
+			t.Errorf("%s: suspicious = %v with flags %q", p.MacAddress, p.Suspicious, p.Flags)
+		}
+	}
+	if !strings.Contains(flags[testClientMAC], "already used") {
+		t.Errorf("duplicate transaction ID not flagged: %q", flags[testClientMAC])
+	}
+	if !strings.Contains(flags[testOtherMAC], "already used") || !strings.Contains(flags[testOtherMAC], "less than the plan price") {
+		t.Errorf("underpaid duplicate not flagged: %q", flags[testOtherMAC])
+	}
+	if flags[testNewMAC] != "" {
+		t.Errorf("clean request flagged: %q", flags[testNewMAC])
+	}
+}
+
+func TestApproveThenRevoke(t *testing.T) {
+	h, router := newMemorySubscriptions(t)
+	h.Devices.Seen(testClientMAC, testClientIP, "", false)
+	id, err := h.Subscriptions.Create(db.NewSubscription{MacAddress: testClientMAC, PlanID: 1, Status: "pending"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(`{"subscription_id": %d}`, id)
+
+	w := httptest.NewRecorder()
+	h.ApproveSubscription(w, httptest.NewRequest("POST", "/api/admin/approve", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("approve: %d %s", w.Code, w.Body)
+	}
+	sub, _ := h.Subscriptions.Get(int(id))
+	if sub.Status != "active" || sub.EndTime.Before(time.Now().Add(23*time.Hour)) {
+		t.Errorf("after approve: status %s, ends %v", sub.Status, sub.EndTime)
+	}
+	if d, _ := h.Devices.Get(testClientMAC); d.Status != "allowed" || !router.isAllowed(testClientMAC) {
+		t.Errorf("device not let through: %+v", d)
+	}
+
+	w = httptest.NewRecorder()
+	h.RevokeSubscription(w, httptest.NewRequest("POST", "/api/admin/revoke", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("revoke: %d %s", w.Code, w.Body)
+	}
+	if sub, _ := h.Subscriptions.Get(int(id)); sub.Status != "expired" {
+		t.Errorf("after revoke: status %s", sub.Status)
+	}
+	if d, _ := h.Devices.Get(testClientMAC); d.Status != "blocked" || router.isAllowed(testClientMAC) {
+		t.Errorf("device not blocked: %+v", d)
+	}
+
+	w = httptest.NewRecorder()
+	h.RevokeSubscription(w, httptest.NewRequest("POST", "/api/admin/revoke", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("revoking twice: %d, want 400", w.Code)
+	}
+}
+
+func TestRebindKeepsPlanOfNewMAC(t *testing.T) {
+	h, router := newMemorySubscriptions(t)
+	h.Devices.Seen(testClientMAC, testClientIP, "", false)
+	if _, err := h.activatePlan(activation{MAC: testClientMAC, PlanID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.CheckStatus(w, portalRequest("GET", "/api/auth/status", ""))
+	token := w.Result().Cookies()[0].Value
+
+	// A token the device already carries is kept
+	r := portalRequest("GET", "/api/auth/status", "")
+	r.Header.Set(deviceSessionHeader, token)
+	w = httptest.NewRecorder()
+	h.CheckStatus(w, r)
+	if c := w.Result().Cookies(); len(c) != 1 || c[0].Value != token {
+		t.Fatalf("status poll replaced the session token: %v", c)
+	}
+
+	// The new MAC already has a plan of its own
+	router.macs[testClientIP] = testNewMAC
+	own, _ := h.activatePlan(activation{MAC: testNewMAC, PlanID: 1})
+	r = portalRequest("POST", "/api/auth/session/rebind", "")
+	r.Header.Set(deviceSessionHeader, token)
+	w = httptest.NewRecorder()
+	h.RebindSession(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("rebind onto a MAC with a plan: %d, want 404", w.Code)
+	}
+	if sub, _ := h.Subscriptions.Current(testClientMAC); sub.Status != "active" {
+		t.Errorf("old device lost its plan: %+v", sub)
+	}
+
+	// Once that plan is gone the session moves over
+	h.Subscriptions.SetStatus(int(own), "expired")
+	w = httptest.NewRecorder()
+	h.RebindSession(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("rebind: %d %s", w.Code, w.Body)
+	}
+	if d, _ := h.Devices.Get(testNewMAC); d.Status != "allowed" {
+		t.Errorf("new device not allowed: %+v", d)
+	}
+	if d, _ := h.Devices.Get(testClientMAC); d.Status != "blocked" {
+		t.Errorf("old device not blocked: %+v", d)
+	}
+}
@@ -0,0 +1,386 @@
+package api
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/user/wifi-control-system/internal/audit"
+)
+
+// voucherAlphabet leaves out 0/O and 1/I/L so printed codes can be typed
+// without guessing.
+const voucherAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+const (
+	voucherCodeLength = 10
+	maxVoucherBatch   = 1000
+)
+
+type Voucher struct {
+	ID         int        `json:"id"`
+	Code       string     `json:"code"`
+	PlanID     int        `json:"plan_id"`
+	PlanName   string     `json:"plan_name"`
+	Batch      string     `json:"batch"`
+	MaxDevices int        `json:"max_devices"`
+	Uses       int        `json:"uses"`
+	Status     string     `json:"status"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// VouchersHandler sells plans through printed codes. Redeeming a code goes
+// through the same activation path as AssignPlan, so no admin approval is
+// needed. A voucher can be single-use or shared by up to MaxDevices
+// devices; shared vouchers run on one clock started by the first device.
+type VouchersHandler struct {
+	DB            *sql.DB
+	Subscriptions *SubscriptionsHandler
+}
+
+func (h *VouchersHandler) CreateBatch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PlanID     int    `json:"plan_id"`
+		Count      int    `json:"count"`
+		MaxDevices int    `json:"max_devices"`
+		ValidDays  int    `json:"valid_days"` // unredeemed codes expire after this; 0 = never
+		Batch      string `json:"batch"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Count < 1 || req.Count > maxVoucherBatch {
+		http.Error(w, fmt.Sprintf("count must be between 1 and %d", maxVoucherBatch), http.StatusBadRequest)
+		return
+	}
+	if req.MaxDevices < 1 {
+		req.MaxDevices = 1
+	}
+	var planName string
+	if err := h.DB.QueryRow("SELECT name FROM plans WHERE id = ?", req.PlanID).Scan(&planName); err != nil {
+		http.Error(w, "Plan not found", http.StatusNotFound)
+		return
+	}
+	if req.Batch == "" {
+		req.Batch = time.Now().Format("B20060102-150405")
+	}
+	var expiresAt *time.Time
+	if req.ValidDays > 0 {
+		t := time.Now().AddDate(0, 0, req.ValidDays)
+		expiresAt = &t
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	vouchers := []Voucher{}
+	for len(vouchers) < req.Count {
+		code, err := generateVoucherCode()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// A failed statement would abort the whole transaction on
+		// PostgreSQL, so collisions insert nothing instead of erroring
+		var id int
+		err = tx.QueryRow(`
+			INSERT INTO vouchers (code, plan_id, batch, max_devices, expires_at)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (code) DO NOTHING
+			RETURNING id`, code, req.PlanID, req.Batch, req.MaxDevices, expiresAt).Scan(&id)
+		if err == sql.ErrNoRows {
+			continue // code collision, draw another
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create vouchers: %v", err), http.StatusInternalServerError)
+			return
+		}
+		vouchers = append(vouchers, Voucher{
+			ID:         id,
+			Code:       code,
+			PlanID:     req.PlanID,
+			PlanName:   planName,
+			Batch:      req.Batch,
+			MaxDevices: req.MaxDevices,
+			Status:     "active",
+			ExpiresAt:  expiresAt,
+			CreatedAt:  time.Now(),
+		})
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("[VOUCHER] Created %d vouchers for plan %s (batch %s)\n", len(vouchers), planName, req.Batch)
+	e := audit.From(r)
+	e.Action = "voucher.create_batch"
+	e.Details = fmt.Sprintf("%d vouchers for plan %s, batch %s", len(vouchers), planName, req.Batch)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"batch":    req.Batch,
+		"vouchers": vouchers,
+	})
+}
+
+func (h *VouchersHandler) GetVouchers(w http.ResponseWriter, r *http.Request) {
+	vouchers, err := h.loadVouchers(r.URL.Query().Get("batch"), r.URL.Query().Get("status"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vouchers)
+}
+
+// ExportVouchers writes a batch as CSV for printing.
+func (h *VouchersHandler) ExportVouchers(w http.ResponseWriter, r *http.Request) {
+	batch := r.URL.Query().Get("batch")
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "active"
+	}
+	vouchers, err := h.loadVouchers(batch, status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	e := audit.From(r)
+	e.Action = "voucher.export"
+	e.Details = fmt.Sprintf("%d %s vouchers, batch %q", len(vouchers), status, batch)
+
+	filename := "vouchers.csv"
+	if batch != "" {
+		filename = fmt.Sprintf("vouchers-%s.csv", batch)
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"code", "plan", "duration_minutes", "price", "max_devices", "valid_until", "batch"})
+	for _, v := range vouchers {
+		var duration int
+		var price float64
+		h.DB.QueryRow("SELECT duration_minutes, price FROM plans WHERE id = ?", v.PlanID).Scan(&duration, &price)
+		validUntil := ""
+		if v.ExpiresAt != nil {
+			validUntil = v.ExpiresAt.Format("2006-01-02")
+		}
+		out.Write([]string{
+			v.Code,
+			v.PlanName,
+			strconv.Itoa(duration),
+			strconv.FormatFloat(price, 'f', 2, 64),
+			strconv.Itoa(v.MaxDevices),
+			validUntil,
+			v.Batch,
+		})
+	}
+	out.Flush()
+}
+
+// RevokeVoucher stops an unused or partly used voucher from being redeemed.
+// Subscriptions it already started keep running.
+func (h *VouchersHandler) RevokeVoucher(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	result, err := h.DB.Exec("UPDATE vouchers SET status = 'revoked' WHERE id = ? AND status = 'active'", id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Voucher not found or no longer active", http.StatusNotFound)
+		return
+	}
+	e := audit.From(r)
+	e.Action = "voucher.revoke"
+	e.Details = "voucher " + id
+	json.NewEncoder(w).Encode(map[string]string{"message": "Voucher revoked"})
+}
+
+// Redeem turns a code into an active subscription for the caller's device.
+func (h *VouchersHandler) Redeem(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code       string `json:"code"`
+		MacAddress string `json:"mac_address"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mac, err := ownMAC(h.Subscriptions.Router, r, req.MacAddress)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if _, err := h.redeem(req.Code, mac, requestIP(r)); err != nil {
+		writeError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Voucher redeemed, you are now connected"})
+}
+
+// redeem activates the plan of a voucher code on mac. The portal login
+// shares it with Redeem.
+func (h *VouchersHandler) redeem(code, mac, ip string) (int64, error) {
+	code = normalizeVoucherCode(code)
+
+	var voucherID, planID int
+	var status string
+	var expiresAt sql.NullTime
+	var price float64
+	err := h.DB.QueryRow(`
+		SELECT v.id, v.plan_id, v.status, v.expires_at, COALESCE(p.price, 0)
+		FROM vouchers v
+		LEFT JOIN plans p ON v.plan_id = p.id
+		WHERE v.code = ?`, code).Scan(&voucherID, &planID, &status, &expiresAt, &price)
+	if err != nil {
+		return 0, &clientError{http.StatusNotFound, "Invalid voucher code"}
+	}
+	if status == "revoked" || (expiresAt.Valid && time.Now().After(expiresAt.Time)) {
+		return 0, &clientError{http.StatusGone, "This voucher has expired"}
+	}
+
+	// Shared vouchers end when the first device's subscription ends
+	var sharedEnd sql.NullTime
+	h.DB.QueryRow(`
+		SELECT s.end_time
+		FROM voucher_redemptions vr
+		JOIN subscriptions s ON vr.subscription_id = s.id
+		WHERE vr.voucher_id = ?
+		ORDER BY s.end_time DESC
+		LIMIT 1`, voucherID).Scan(&sharedEnd)
+	if sharedEnd.Valid && !sharedEnd.Time.After(time.Now()) {
+		return 0, &clientError{http.StatusGone, "This voucher's time has run out"}
+	}
+
+	// One redemption per device; the unique index settles races
+	if _, err := h.DB.Exec("INSERT INTO voucher_redemptions (voucher_id, mac_address) VALUES (?, ?)", voucherID, mac); err != nil {
+		return 0, &clientError{http.StatusConflict, "This voucher is already redeemed on this device"}
+	}
+	claimed := false
+	if result, err := h.DB.Exec(`
+		UPDATE vouchers SET
+			uses = uses + 1,
+			status = CASE WHEN uses + 1 >= max_devices THEN 'used' ELSE status END
+		WHERE id = ? AND status = 'active' AND uses < max_devices`, voucherID); err == nil {
+		n, _ := result.RowsAffected()
+		claimed = n == 1
+	}
+	if !claimed {
+		h.DB.Exec("DELETE FROM voucher_redemptions WHERE voucher_id = ? AND mac_address = ?", voucherID, mac)
+		return 0, &clientError{http.StatusGone, "This voucher has already been used"}
+	}
+
+	a := activation{MAC: mac, PlanID: planID, PaymentMethod: "voucher", TransactionID: code}
+	// Revenue is counted once per voucher, on the first device
+	amount := price
+	if sharedEnd.Valid {
+		a.EndTime = sharedEnd.Time
+		amount = 0
+	}
+	a.AmountPaid = &amount
+
+	h.DB.Exec(`
+		INSERT INTO devices (mac_address, ip_address, status) VALUES (?, ?, 'blocked')
+		ON CONFLICT(mac_address) DO UPDATE SET ip_address = excluded.ip_address, last_seen = CURRENT_TIMESTAMP`, mac, ip)
+
+	subID, err := h.Subscriptions.activatePlan(a)
+	if err != nil {
+		h.DB.Exec("DELETE FROM voucher_redemptions WHERE voucher_id = ? AND mac_address = ?", voucherID, mac)
+		h.DB.Exec("UPDATE vouchers SET uses = uses - 1, status = 'active' WHERE id = ? AND status != 'revoked'", voucherID)
+		return 0, fmt.Errorf("failed to activate plan: %v", err)
+	}
+	h.DB.Exec("UPDATE voucher_redemptions SET subscription_id = ? WHERE voucher_id = ? AND mac_address = ?", subID, voucherID, mac)
+
+	fmt.Printf("[VOUCHER] %s redeemed by %s (%s)\n", code, mac, ip)
+	audit.Record(h.DB, audit.Entry{
+		Actor: audit.ActorAnonymous, Action: "voucher.redeem", TargetMAC: mac, SubscriptionID: int(subID),
+		After: subscriptionState(h.Subscriptions.Subscriptions, int(subID)), SourceIP: ip, Details: "voucher " + code,
+	})
+	return subID, nil
+}
+
+func (h *VouchersHandler) loadVouchers(batch, status string) ([]Voucher, error) {
+	query := `
+		SELECT v.id, v.code, v.plan_id, COALESCE(p.name, ''), COALESCE(v.batch, ''), v.max_devices, v.uses, v.status, v.expires_at, v.created_at
+		FROM vouchers v
+		LEFT JOIN plans p ON v.plan_id = p.id
+		WHERE 1 = 1`
+	var args []interface{}
+	if batch != "" {
+		query += " AND v.batch = ?"
+		args = append(args, batch)
+	}
+	if status != "" {
+		query += " AND v.status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY v.id"
+
+	rows, err := h.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	vouchers := []Voucher{}
+	for rows.Next() {
+		var v Voucher
+		var expires, created sql.NullTime
+		if err := rows.Scan(&v.ID, &v.Code, &v.PlanID, &v.PlanName, &v.Batch, &v.MaxDevices, &v.Uses, &v.Status, &expires, &created); err != nil {
+			continue
+		}
+		if expires.Valid {
+			t := expires.Time
+			v.ExpiresAt = &t
+		}
+		if created.Valid {
+			v.CreatedAt = created.Time
+		}
+		vouchers = append(vouchers, v)
+	}
+	return vouchers, nil
+}
+
+func generateVoucherCode() (string, error) {
+	max := big.NewInt(int64(len(voucherAlphabet)))
+	b := make([]byte, voucherCodeLength)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = voucherAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// normalizeVoucherCode accepts codes typed with spaces, dashes or in
+// lower case.
+func normalizeVoucherCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, code)
+}
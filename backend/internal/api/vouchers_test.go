@@ -0,0 +1,140 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+const testThirdMAC = "aa:bb:cc:dd:ee:03"
+
+func newTestVouchers(t *testing.T) *VouchersHandler {
+	t.Helper()
+	p, _, _ := newTestPayments(t)
+	return &VouchersHandler{DB: p.DB, Subscriptions: p.Subscriptions}
+}
+
+// addVoucher stores an active code for planID shared by maxDevices.
+func addVoucher(t *testing.T, h *VouchersHandler, code string, planID, maxDevices int) {
+	t.Helper()
+	if _, err := h.DB.Exec("INSERT INTO vouchers (code, plan_id, max_devices) VALUES (?, ?, ?)", code, planID, maxDevices); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// redeemStatus is the HTTP status redeem answers with, 200 on success.
+func redeemStatus(h *VouchersHandler, code, mac string) int {
+	_, err := h.redeem(code, mac, testClientIP)
+	if err == nil {
+		return http.StatusOK
+	}
+	if ce, ok := err.(*clientError); ok {
+		return ce.status
+	}
+	return http.StatusInternalServerError
+}
+
+func voucherUses(t *testing.T, h *VouchersHandler, code string) (uses int, status string) {
+	t.Helper()
+	if err := h.DB.QueryRow("SELECT uses, status FROM vouchers WHERE code = ?", code).Scan(&uses, &status); err != nil {
+		t.Fatal(err)
+	}
+	return uses, status
+}
+
+func TestRedeemSingleUse(t *testing.T) {
+	h := newTestVouchers(t)
+	addVoucher(t, h, "ABCDEFGH23", 1, 1)
+
+	if code := redeemStatus(h, "abcd-efgh-23", testClientMAC); code != http.StatusOK {
+		t.Fatalf("first redemption: %d", code)
+	}
+	if !h.Subscriptions.Router.(*fakeRouter).isAllowed(testClientMAC) {
+		t.Error("device not allowed after redeeming")
+	}
+	if code := redeemStatus(h, "ABCDEFGH23", testClientMAC); code != http.StatusConflict {
+		t.Errorf("same device again: %d, want 409", code)
+	}
+	if code := redeemStatus(h, "ABCDEFGH23", testOtherMAC); code != http.StatusGone {
+		t.Errorf("second device: %d, want 410", code)
+	}
+	if uses, status := voucherUses(t, h, "ABCDEFGH23"); uses != 1 || status != "used" {
+		t.Errorf("voucher uses %d, status %s; want 1, used", uses, status)
+	}
+}
+
+func TestRedeemSharedVoucher(t *testing.T) {
+	h := newTestVouchers(t)
+	addVoucher(t, h, "SHARED2345", 1, 2)
+
+	for _, mac := range []string{testClientMAC, testOtherMAC} {
+		if code := redeemStatus(h, "SHARED2345", mac); code != http.StatusOK {
+			t.Fatalf("redemption on %s: %d", mac, code)
+		}
+	}
+	if code := redeemStatus(h, "SHARED2345", testThirdMAC); code != http.StatusGone {
+		t.Errorf("device past max_devices: %d, want 410", code)
+	}
+
+	// Both devices run on the first device's clock; revenue counts once
+	ends := map[string]time.Time{}
+	paid := map[string]float64{}
+	rows, err := h.DB.Query("SELECT mac_address, end_time, amount_paid FROM subscriptions WHERE payment_method = 'voucher'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mac string
+		var end time.Time
+		var amount float64
+		if err := rows.Scan(&mac, &end, &amount); err != nil {
+			t.Fatal(err)
+		}
+		ends[mac], paid[mac] = end, amount
+	}
+	if len(ends) != 2 || !ends[testClientMAC].Equal(ends[testOtherMAC]) {
+		t.Errorf("end times %v, want one shared end", ends)
+	}
+	if paid[testClientMAC] != 20 || paid[testOtherMAC] != 0 {
+		t.Errorf("amounts paid %v, want 20 on the first device and 0 on the second", paid)
+	}
+}
+
+func TestRedeemRefusesRevokedAndExpiredCodes(t *testing.T) {
+	h := newTestVouchers(t)
+	addVoucher(t, h, "REVOKED234", 1, 1)
+	addVoucher(t, h, "EXPIRED234", 1, 1)
+	h.DB.Exec("UPDATE vouchers SET status = 'revoked' WHERE code = 'REVOKED234'")
+	h.DB.Exec("UPDATE vouchers SET expires_at = ? WHERE code = 'EXPIRED234'", time.Now().Add(-time.Hour))
+
+	for code, want := range map[string]int{
+		"REVOKED234": http.StatusGone,
+		"EXPIRED234": http.StatusGone,
+		"UNKNOWN234": http.StatusNotFound,
+	} {
+		if got := redeemStatus(h, code, testClientMAC); got != want {
+			t.Errorf("%s: %d, want %d", code, got, want)
+		}
+	}
+	if uses, _ := voucherUses(t, h, "EXPIRED234"); uses != 0 {
+		t.Errorf("expired voucher counted %d uses", uses)
+	}
+}
+
+func TestRedeemRollsBackWhenActivationFails(t *testing.T) {
+	h := newTestVouchers(t)
+	addVoucher(t, h, "NOPLAN2345", 99, 1) // the plan was deleted
+
+	if code := redeemStatus(h, "NOPLAN2345", testClientMAC); code != http.StatusInternalServerError {
+		t.Fatalf("redemption without a plan: %d, want 500", code)
+	}
+	if uses, status := voucherUses(t, h, "NOPLAN2345"); uses != 0 || status != "active" {
+		t.Errorf("voucher uses %d, status %s after a failed activation; want 0, active", uses, status)
+	}
+	var redemptions int
+	h.DB.QueryRow("SELECT COUNT(*) FROM voucher_redemptions").Scan(&redemptions)
+	if redemptions != 0 {
+		t.Errorf("%d redemptions kept after a failed activation", redemptions)
+	}
+}
@@ -0,0 +1,326 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/user/wifi-control-system/internal/db"
+)
+
+// gardenGrace keeps a resolved address open this long past its DNS TTL,
+// for connections a client opens just before its cached answer runs out.
+const gardenGrace = 5 * time.Minute
+
+type WalledGardenEntry struct {
+	ID          int       `json:"id"`
+	Kind        string    `json:"kind"` // "domain" or "cidr"
+	Value       string    `json:"value"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// WalledGardenHandler manages the destinations customers can reach before
+// their plan is approved (UPI/payment apps, support site). Domains are
+// handed to the DNS server, which resolves them for real and reports the
+// addresses back through AddResolved; CIDRs go straight to the firewall.
+type WalledGardenHandler struct {
+	DB     *sql.DB
+	Router interface {
+		AllowDestination(cidr string) error
+		RemoveDestination(cidr string) error
+	}
+	DNS interface {
+		SetWalledGarden(domains []string)
+	}
+
+	lock     sync.Mutex
+	cidrs    map[string]bool                 // CIDR entries, as of the last Reload
+	resolved map[string]map[string]time.Time // domain -> resolved /32 -> when it closes
+	applied  map[string]bool                 // destinations currently open in the firewall
+}
+
+func (h *WalledGardenHandler) GetEntries(w http.ResponseWriter, r *http.Request) {
+	entries, err := h.loadEntries()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func (h *WalledGardenHandler) CreateEntry(w http.ResponseWriter, r *http.Request) {
+	var e WalledGardenEntry
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	kind, value, err := normalizeWalledGardenValue(e.Value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	e.Kind, e.Value = kind, value
+
+	err = h.DB.QueryRow("INSERT INTO walled_garden (kind, value, description) VALUES (?, ?, ?) RETURNING id", e.Kind, e.Value, e.Description).Scan(&e.ID)
+	if err != nil {
+		if db.IsUniqueViolation(err) {
+			http.Error(w, "This destination is already in the walled garden", http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to add entry: %v", err), http.StatusInternalServerError)
+		return
+	}
+	e.CreatedAt = time.Now()
+
+	h.Reload()
+	json.NewEncoder(w).Encode(e)
+}
+
+func (h *WalledGardenHandler) UpdateEntry(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var e WalledGardenEntry
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	kind, value, err := normalizeWalledGardenValue(e.Value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.DB.Exec("UPDATE walled_garden SET kind = ?, value = ?, description = ? WHERE id = ?", kind, value, e.Description, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+
+	h.Reload()
+	json.NewEncoder(w).Encode(map[string]string{"message": "Entry updated"})
+}
+
+func (h *WalledGardenHandler) DeleteEntry(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	result, err := h.DB.Exec("DELETE FROM walled_garden WHERE id = ?", id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+
+	h.Reload()
+	json.NewEncoder(w).Encode(map[string]string{"message": "Entry deleted"})
+}
+
+// Reload pushes the stored list to the DNS server and the firewall. It is
+// called at startup and after every change.
+func (h *WalledGardenHandler) Reload() {
+	entries, err := h.loadEntries()
+	if err != nil {
+		fmt.Printf("[GARDEN] Failed to load walled garden: %v\n", err)
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.resolved == nil {
+		h.resolved = make(map[string]map[string]time.Time)
+	}
+
+	var domains []string
+	h.cidrs = make(map[string]bool)
+	for _, e := range entries {
+		if e.Kind == "cidr" {
+			h.cidrs[e.Value] = true
+			continue
+		}
+		domains = append(domains, e.Value)
+	}
+
+	// Forget addresses of domains that were removed
+	for domain := range h.resolved {
+		if !containsString(domains, domain) {
+			delete(h.resolved, domain)
+		}
+	}
+
+	if h.DNS != nil {
+		h.DNS.SetWalledGarden(domains)
+	}
+	h.apply(h.wanted(time.Now()))
+}
+
+// Start closes resolved addresses once their DNS TTL has run out.
+func (h *WalledGardenHandler) Start() {
+	ticker := time.NewTicker(time.Minute)
+	go func() {
+		for range ticker.C {
+			h.expire(time.Now())
+		}
+	}()
+}
+
+// AddResolved opens the addresses the DNS server resolved for a
+// walled-garden domain until the answer's TTL runs out.
+func (h *WalledGardenHandler) AddResolved(domain string, ips []string, ttl time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.resolved == nil {
+		h.resolved = make(map[string]map[string]time.Time)
+	}
+	if h.resolved[domain] == nil {
+		h.resolved[domain] = make(map[string]time.Time)
+	}
+	until := time.Now().Add(ttl + gardenGrace)
+	for _, ip := range ips {
+		cidr := ip + "/32"
+		if until.After(h.resolved[domain][cidr]) {
+			h.resolved[domain][cidr] = until
+		}
+		if h.applied[cidr] || h.Router == nil {
+			continue
+		}
+		if err := h.Router.AllowDestination(cidr); err != nil {
+			fmt.Printf("[GARDEN] Failed to open %s for %s: %v\n", cidr, domain, err)
+			continue
+		}
+		if h.applied == nil {
+			h.applied = make(map[string]bool)
+		}
+		h.applied[cidr] = true
+	}
+}
+
+// expire forgets the resolved addresses whose TTL ran out before now and
+// closes them in the firewall.
+func (h *WalledGardenHandler) expire(now time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for domain, addrs := range h.resolved {
+		for cidr, until := range addrs {
+			if now.After(until) {
+				delete(addrs, cidr)
+			}
+		}
+		if len(addrs) == 0 {
+			delete(h.resolved, domain)
+		}
+	}
+	h.apply(h.wanted(now))
+}
+
+// wanted is every destination that should be open at now: the CIDR
+// entries and the unexpired addresses of the domains. Callers hold h.lock.
+func (h *WalledGardenHandler) wanted(now time.Time) map[string]bool {
+	wanted := make(map[string]bool)
+	for cidr := range h.cidrs {
+		wanted[cidr] = true
+	}
+	for _, addrs := range h.resolved {
+		for cidr, until := range addrs {
+			if !now.After(until) {
+				wanted[cidr] = true
+			}
+		}
+	}
+	return wanted
+}
+
+// apply brings the firewall in line with wanted. Callers hold h.lock.
+func (h *WalledGardenHandler) apply(wanted map[string]bool) {
+	if h.applied == nil {
+		h.applied = make(map[string]bool)
+	}
+	if h.Router == nil {
+		return
+	}
+	for cidr := range h.applied {
+		if !wanted[cidr] {
+			h.Router.RemoveDestination(cidr)
+			delete(h.applied, cidr)
+		}
+	}
+	for cidr := range wanted {
+		if h.applied[cidr] {
+			continue
+		}
+		if err := h.Router.AllowDestination(cidr); err != nil {
+			fmt.Printf("[GARDEN] Failed to open %s: %v\n", cidr, err)
+			continue
+		}
+		h.applied[cidr] = true
+	}
+}
+
+func (h *WalledGardenHandler) loadEntries() ([]WalledGardenEntry, error) {
+	rows, err := h.DB.Query("SELECT id, kind, value, COALESCE(description, ''), created_at FROM walled_garden ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []WalledGardenEntry{}
+	for rows.Next() {
+		var e WalledGardenEntry
+		var created sql.NullTime
+		if err := rows.Scan(&e.ID, &e.Kind, &e.Value, &e.Description, &created); err != nil {
+			continue
+		}
+		if created.Valid {
+			e.CreatedAt = created.Time
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// normalizeWalledGardenValue classifies value as a CIDR (bare IPv4
+// addresses become /32) or a domain name.
+func normalizeWalledGardenValue(value string) (string, string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return "", "", fmt.Errorf("value is required")
+	}
+	if ip := net.ParseIP(value); ip != nil {
+		if ip.To4() == nil {
+			return "", "", fmt.Errorf("only IPv4 destinations are supported")
+		}
+		return "cidr", ip.String() + "/32", nil
+	}
+	if _, ipnet, err := net.ParseCIDR(value); err == nil {
+		if ipnet.IP.To4() == nil {
+			return "", "", fmt.Errorf("only IPv4 destinations are supported")
+		}
+		return "cidr", ipnet.String(), nil
+	}
+
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "*."), ".")
+	if !strings.Contains(value, ".") || strings.ContainsAny(value, " /:") {
+		return "", "", fmt.Errorf("invalid domain or CIDR: %s", value)
+	}
+	return "domain", value, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
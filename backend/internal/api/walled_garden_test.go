@@ -0,0 +1,72 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeGardenRouter struct {
+	open map[string]bool
+}
+
+func (r *fakeGardenRouter) AllowDestination(cidr string) error {
+	r.open[cidr] = true
+	return nil
+}
+
+func (r *fakeGardenRouter) RemoveDestination(cidr string) error {
+	delete(r.open, cidr)
+	return nil
+}
+
+func TestWalledGardenExpiresResolvedAddresses(t *testing.T) {
+	fw := &fakeGardenRouter{open: map[string]bool{}}
+	h := &WalledGardenHandler{Router: fw, cidrs: map[string]bool{"10.9.0.0/16": true}}
+	h.apply(h.wanted(time.Now()))
+
+	h.AddResolved("pay.example.com", []string{"203.0.113.7"}, time.Minute)
+	h.AddResolved("cdn.example.com", []string{"203.0.113.8"}, time.Hour)
+	for _, cidr := range []string{"10.9.0.0/16", "203.0.113.7/32", "203.0.113.8/32"} {
+		if !fw.open[cidr] {
+			t.Fatalf("%s not opened: %v", cidr, fw.open)
+		}
+	}
+
+	h.expire(time.Now().Add(time.Minute + gardenGrace + time.Second))
+	if fw.open["203.0.113.7/32"] {
+		t.Error("address with an expired TTL is still open")
+	}
+	if !fw.open["203.0.113.8/32"] || !fw.open["10.9.0.0/16"] {
+		t.Errorf("unexpired destinations were closed: %v", fw.open)
+	}
+	if _, ok := h.resolved["pay.example.com"]; ok {
+		t.Error("domain without addresses left in the resolved map")
+	}
+
+	// A fresh answer keeps the address open past its old expiry
+	h.AddResolved("cdn.example.com", []string{"203.0.113.8"}, 3*time.Hour)
+	h.expire(time.Now().Add(2 * time.Hour))
+	if !fw.open["203.0.113.8/32"] {
+		t.Error("re-resolved address was closed at its old expiry")
+	}
+}
+
+func TestNormalizeWalledGardenValue(t *testing.T) {
+	cases := []struct {
+		in, kind, value string
+		ok              bool
+	}{
+		{"10.0.0.1", "cidr", "10.0.0.1/32", true},
+		{"10.0.0.9/24", "cidr", "10.0.0.0/24", true},
+		{"*.Razorpay.com.", "domain", "razorpay.com", true},
+		{"::1", "", "", false},
+		{"localhost", "", "", false},
+		{"", "", "", false},
+	}
+	for _, c := range cases {
+		kind, value, err := normalizeWalledGardenValue(c.in)
+		if (err == nil) != c.ok || kind != c.kind || value != c.value {
+			t.Errorf("normalizeWalledGardenValue(%q) = %q, %q, %v", c.in, kind, value, err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Package audit records who did what to which device or subscription.
+//
+// Admin and device-control routes run behind Middleware, which writes one
+// audit_log row per state-changing request. Handlers describe what they did
+// through From(r); background work such as expiry or payment webhooks calls
+// Record directly.
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Actors for entries that no signed-in staff member caused.
+const (
+	ActorSystem    = "system"
+	ActorAnonymous = "anonymous"
+)
+
+// Entry is one row of the audit log. Before and After are stored as JSON.
+type Entry struct {
+	ID             int64       `json:"id"`
+	CreatedAt      time.Time   `json:"created_at"`
+	Actor          string      `json:"actor"`
+	Action         string      `json:"action"`
+	TargetMAC      string      `json:"target_mac,omitempty"`
+	SubscriptionID int         `json:"subscription_id,omitempty"`
+	Before         interface{} `json:"before,omitempty"`
+	After          interface{} `json:"after,omitempty"`
+	SourceIP       string      `json:"source_ip"`
+	Status         int         `json:"status,omitempty"`
+	Details        string      `json:"details,omitempty"`
+}
+
+// Record writes e, filling in the time and a missing actor.
+func Record(db *sql.DB, e Entry) {
+	if e.Actor == "" {
+		e.Actor = ActorSystem
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	_, err := db.Exec(`
+		INSERT INTO audit_log (created_at, actor, action, target_mac, subscription_id, before_state, after_state, source_ip, status_code, details)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.CreatedAt, e.Actor, e.Action, strings.ToLower(e.TargetMAC), nullIfZero(e.SubscriptionID),
+		marshalState(e.Before), marshalState(e.After), e.SourceIP, e.Status, e.Details)
+	if err != nil {
+		fmt.Printf("[AUDIT] Failed to record %s by %s: %v\n", e.Action, e.Actor, err)
+	}
+}
+
+// From returns the entry the middleware will write for r. Outside the
+// middleware it returns a throwaway entry, so handlers need not check.
+func From(r *http.Request) *Entry {
+	if e, ok := r.Context().Value("audit_entry").(*Entry); ok {
+		return e
+	}
+	return &Entry{}
+}
+
+// Middleware records every request that changes state (anything but GET
+// and HEAD), plus GETs whose handler named an action, e.g. exports. It
+// must run after the auth middleware so the actor is known.
+func Middleware(db *sql.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			e := &Entry{SourceIP: ClientIP(r)}
+			ctx := contextWithEntry(r, e)
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r.WithContext(ctx))
+
+			readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead
+			if readOnly && e.Action == "" {
+				return
+			}
+			if e.Actor == "" {
+				if username, ok := r.Context().Value("username").(string); ok && username != "" {
+					e.Actor = username
+				} else {
+					e.Actor = ActorAnonymous
+				}
+			}
+			if e.Action == "" {
+				e.Action = r.Method + " " + routePath(r)
+			}
+			e.Status = rec.status
+			Record(db, *e)
+		})
+	}
+}
+
+// ClientIP returns the address the request came from, without the port.
+// X-Forwarded-For is only believed from a local reverse proxy (e.g. the
+// Vite dev server); a hotspot client could otherwise claim any IP, and with
+// it any MAC.
+func ClientIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.IsLoopback() {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	return ip
+}
+
+func contextWithEntry(r *http.Request, e *Entry) context.Context {
+	return context.WithValue(r.Context(), "audit_entry", e)
+}
+
+func routePath(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return r.URL.Path
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if !s.wrote {
+		s.status, s.wrote = code, true
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wrote = true
+	return s.ResponseWriter.Write(b)
+}
+
+func marshalState(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil || string(b) == "null" {
+		return nil
+	}
+	return string(b)
+}
+
+func nullIfZero(n int) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
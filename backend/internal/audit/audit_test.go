@@ -0,0 +1,131 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/user/wifi-control-system/internal/db"
+)
+
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	store, err := db.InitDB(filepath.Join(t.TempDir(), "test.db") + "?_parse_time=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.DB.Close() })
+	if _, err := store.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return store.DB
+}
+
+// serve runs handler behind Middleware on the /api/devices/{mac}/block
+// route, as username when that is set.
+func serve(database *sql.DB, method, username string, handler http.HandlerFunc) {
+	router := mux.NewRouter()
+	router.Handle("/api/devices/{mac}/block", Middleware(database)(handler))
+	r := httptest.NewRequest(method, "/api/devices/aa:bb:cc:dd:ee:01/block", nil)
+	r.RemoteAddr = "192.0.2.1:40000"
+	if username != "" {
+		r = r.WithContext(context.WithValue(r.Context(), "username", username))
+	}
+	router.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func allEntries(t *testing.T, database *sql.DB) []Entry {
+	t.Helper()
+	entries, err := Query(database, Filter{}, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestMiddlewareRecordsActorAndStatus(t *testing.T) {
+	database := newTestDB(t)
+	serve(database, "POST", "alice", func(w http.ResponseWriter, r *http.Request) {
+		e := From(r)
+		e.Action, e.TargetMAC = "device.block", mux.Vars(r)["mac"]
+		http.Error(w, "already blocked", http.StatusConflict)
+	})
+	serve(database, "POST", "", func(w http.ResponseWriter, r *http.Request) {})
+
+	entries := allEntries(t, database)
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	// Newest first
+	anon, named := entries[0], entries[1]
+	if named.Actor != "alice" || named.Action != "device.block" || named.TargetMAC != "aa:bb:cc:dd:ee:01" ||
+		named.Status != http.StatusConflict || named.SourceIP != "192.0.2.1" {
+		t.Errorf("entry = %+v", named)
+	}
+	if anon.Actor != ActorAnonymous || anon.Action != "POST /api/devices/{mac}/block" || anon.Status != http.StatusOK {
+		t.Errorf("entry without a user or an action = %+v", anon)
+	}
+}
+
+func TestMiddlewareSkipsReadOnlyRequests(t *testing.T) {
+	database := newTestDB(t)
+	serve(database, "GET", "alice", func(w http.ResponseWriter, r *http.Request) {})
+	serve(database, "HEAD", "alice", func(w http.ResponseWriter, r *http.Request) {})
+	if entries := allEntries(t, database); len(entries) != 0 {
+		t.Errorf("read-only requests recorded: %+v", entries)
+	}
+
+	// A GET whose handler names an action, such as an export, is recorded
+	serve(database, "GET", "alice", func(w http.ResponseWriter, r *http.Request) {
+		From(r).Action = "audit.export"
+	})
+	if entries := allEntries(t, database); len(entries) != 1 || entries[0].Action != "audit.export" {
+		t.Errorf("entries = %+v, want the export", entries)
+	}
+}
+
+func TestQueryFilters(t *testing.T) {
+	database := newTestDB(t)
+	day := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	Record(database, Entry{CreatedAt: day, Actor: "alice", Action: "subscription.approve", TargetMAC: "AA:BB:CC:DD:EE:01", SubscriptionID: 3,
+		After: map[string]string{"status": "active"}})
+	Record(database, Entry{CreatedAt: day.Add(time.Hour), Actor: "bob", Action: "subscription.revoke", TargetMAC: "aa:bb:cc:dd:ee:01", SubscriptionID: 3})
+	Record(database, Entry{CreatedAt: day.AddDate(0, 0, 1), Action: "device.block", TargetMAC: "aa:bb:cc:dd:ee:02"})
+
+	for name, tc := range map[string]struct {
+		filter Filter
+		want   int
+	}{
+		"all":             {Filter{}, 3},
+		"actor":           {Filter{Actor: "alice"}, 1},
+		"system actor":    {Filter{Actor: ActorSystem}, 1},
+		"action prefix":   {Filter{Action: "subscription."}, 2},
+		"mac":             {Filter{TargetMAC: "AA:BB:CC:DD:EE:01"}, 2},
+		"subscription":    {Filter{SubscriptionID: 3}, 2},
+		"from":            {Filter{From: day.Add(30 * time.Minute)}, 2},
+		"to":              {Filter{To: day.Add(30 * time.Minute)}, 1},
+		"combined":        {Filter{Action: "subscription.", From: day.Add(30 * time.Minute)}, 1},
+		"no such subject": {Filter{SubscriptionID: 4}, 0},
+	} {
+		n, err := Count(database, tc.filter)
+		if err != nil || n != tc.want {
+			t.Errorf("%s: Count = %d, %v; want %d", name, n, err, tc.want)
+		}
+		if entries, _ := Query(database, tc.filter, 10, 0); len(entries) != tc.want {
+			t.Errorf("%s: Query returned %d entries, want %d", name, len(entries), tc.want)
+		}
+	}
+
+	entries, _ := Query(database, Filter{Actor: "alice"}, 10, 0)
+	if after, ok := entries[0].After.(map[string]interface{}); !ok || after["status"] != "active" {
+		t.Errorf("after state = %#v", entries[0].After)
+	}
+	if page, _ := Query(database, Filter{}, 1, 1); len(page) != 1 || page[0].Actor != "bob" {
+		t.Errorf("second page = %+v, want bob's entry", page)
+	}
+}
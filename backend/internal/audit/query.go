@@ -0,0 +1,99 @@
+package audit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Filter selects audit entries; zero fields match everything.
+type Filter struct {
+	Actor          string
+	Action         string // prefix, e.g. "subscription." matches all subscription actions
+	TargetMAC      string
+	SubscriptionID int
+	From, To       time.Time
+}
+
+func (f Filter) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if f.Actor != "" {
+		conds = append(conds, "actor = ?")
+		args = append(args, f.Actor)
+	}
+	if f.Action != "" {
+		conds = append(conds, "action LIKE ?")
+		args = append(args, f.Action+"%")
+	}
+	if f.TargetMAC != "" {
+		conds = append(conds, "target_mac = ?")
+		args = append(args, strings.ToLower(f.TargetMAC))
+	}
+	if f.SubscriptionID != 0 {
+		conds = append(conds, "subscription_id = ?")
+		args = append(args, f.SubscriptionID)
+	}
+	if !f.From.IsZero() {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, f.From)
+	}
+	if !f.To.IsZero() {
+		conds = append(conds, "created_at < ?")
+		args = append(args, f.To)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// Count returns how many entries match f.
+func Count(db *sql.DB, f Filter) (int, error) {
+	where, args := f.where()
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM audit_log"+where, args...).Scan(&n)
+	return n, err
+}
+
+// Query returns the entries matching f, newest first.
+func Query(db *sql.DB, f Filter, limit, offset int) ([]Entry, error) {
+	where, args := f.where()
+	rows, err := db.Query(`
+		SELECT id, created_at, actor, action, COALESCE(target_mac, ''), COALESCE(subscription_id, 0),
+		       before_state, after_state, COALESCE(source_ip, ''), COALESCE(status_code, 0), COALESCE(details, '')
+		FROM audit_log`+where+`
+		ORDER BY id DESC
+		LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		var e Entry
+		var before, after sql.NullString
+		err := rows.Scan(&e.ID, &e.CreatedAt, &e.Actor, &e.Action, &e.TargetMAC, &e.SubscriptionID,
+			&before, &after, &e.SourceIP, &e.Status, &e.Details)
+		if err != nil {
+			return nil, err
+		}
+		e.Before = unmarshalState(before)
+		e.After = unmarshalState(after)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func unmarshalState(s sql.NullString) interface{} {
+	if !s.Valid || s.String == "" {
+		return nil
+	}
+	var v interface{}
+	if json.Unmarshal([]byte(s.String), &v) != nil {
+		return s.String
+	}
+	return v
+}
@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/user/wifi-control-system/internal/audit"
+)
+
+// API keys let scripts call the admin API without a staff password. A key
+// is sent in the X-API-Key header, is stored only as a hash and may use
+// just the permissions it was given, out of APIKeyScopes.
+const (
+	apiKeyHeader = "X-API-Key"
+	apiKeyPrefix = "wm_"
+	// Shown in listings so a key can be told apart without revealing it
+	apiKeyVisibleChars = len(apiKeyPrefix) + 8
+	// API key callers appear under this prefix in the audit log
+	apiKeyActorPrefix = "api-key:"
+)
+
+// APIKeyScopes are the permissions an API key can be given: reading the
+// dashboard figures, assigning plans and blocking devices.
+var APIKeyScopes = []Permission{PermView, PermAssignPlans, PermManageDevices}
+
+// APIKey is an API key as listed to owners; the key itself is only ever
+// returned by CreateAPIKey.
+type APIKey struct {
+	ID         int          `json:"id"`
+	Name       string       `json:"name"`
+	Prefix     string       `json:"prefix"`
+	Scopes     []Permission `json:"scopes"`
+	CreatedBy  string       `json:"created_by"`
+	CreatedAt  time.Time    `json:"created_at"`
+	ExpiresAt  *time.Time   `json:"expires_at"`
+	LastUsedAt *time.Time   `json:"last_used_at"`
+	LastUsedIP string       `json:"last_used_ip"`
+	RevokedAt  *time.Time   `json:"revoked_at"`
+}
+
+// ListAPIKeys returns all API keys, revoked and expired ones included.
+func (s *AuthService) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.DB.Query(`
+		SELECT id, name, prefix, scopes, COALESCE(created_by, ''), created_at, expires_at, last_used_at, COALESCE(last_used_ip, ''), revoked_at
+		FROM api_keys ORDER BY id DESC`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		var scopes string
+		var created, expires, lastUsed, revoked sql.NullTime
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &scopes, &k.CreatedBy, &created, &expires, &lastUsed, &k.LastUsedIP, &revoked); err != nil {
+			continue
+		}
+		k.Scopes = parseScopes(scopes)
+		if created.Valid {
+			k.CreatedAt = created.Time
+		}
+		k.ExpiresAt = timeOrNil(expires)
+		k.LastUsedAt = timeOrNil(lastUsed)
+		k.RevokedAt = timeOrNil(revoked)
+		keys = append(keys, k)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// CreateAPIKey issues a key with the given name, scopes and, optionally, a
+// lifetime in days. The key is in the response and cannot be shown again.
+func (s *AuthService) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	scopes := make([]string, 0, len(req.Scopes))
+	for _, scope := range req.Scopes {
+		if !isAPIKeyScope(Permission(scope)) {
+			http.Error(w, "Unknown scope "+scope, http.StatusBadRequest)
+			return
+		}
+		scopes = append(scopes, scope)
+	}
+	if req.ExpiresInDays < 0 {
+		http.Error(w, "Invalid expiry", http.StatusBadRequest)
+		return
+	}
+	var expiresAt interface{}
+	if req.ExpiresInDays > 0 {
+		expiresAt = time.Now().AddDate(0, 0, req.ExpiresInDays)
+	}
+
+	secret, err := randomToken(24)
+	if err != nil {
+		http.Error(w, "Could not create key", http.StatusInternalServerError)
+		return
+	}
+	key := apiKeyPrefix + secret
+	createdBy, _ := r.Context().Value("username").(string)
+	var id int64
+	err = s.DB.QueryRow(`
+		INSERT INTO api_keys (name, prefix, key_hash, scopes, created_by, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		RETURNING id`,
+		req.Name, key[:apiKeyVisibleChars], hashToken(key), strings.Join(scopes, ","), createdBy, time.Now(), expiresAt).Scan(&id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	e := audit.From(r)
+	e.Action = "api_key.create"
+	e.After = map[string]interface{}{"id": id, "name": req.Name, "scopes": scopes, "expires_at": expiresAt}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "key": key, "message": "Store this key now, it is not shown again"})
+}
+
+// RevokeAPIKey stops a key from working. The row stays for the record.
+func (s *AuthService) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid key ID", http.StatusBadRequest)
+		return
+	}
+	var name string
+	if err := s.DB.QueryRow("SELECT name FROM api_keys WHERE id = ?", id).Scan(&name); err != nil {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	s.DB.Exec("UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now(), id)
+
+	e := audit.From(r)
+	e.Action = "api_key.revoke"
+	e.Details = name
+	json.NewEncoder(w).Encode(map[string]string{"message": "API key revoked"})
+}
+
+// apiKeyScopesFor returns the name and scopes of a live key and notes
+// that it was used.
+func (s *AuthService) apiKeyScopesFor(r *http.Request, key string) (string, []Permission, bool) {
+	var id int
+	var name, scopes string
+	err := s.DB.QueryRow(`
+		SELECT id, name, scopes FROM api_keys
+		WHERE key_hash = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)`,
+		hashToken(key), time.Now()).Scan(&id, &name, &scopes)
+	if err != nil {
+		return "", nil, false
+	}
+	s.DB.Exec("UPDATE api_keys SET last_used_at = ?, last_used_ip = ? WHERE id = ?", time.Now(), audit.ClientIP(r), id)
+	return name, parseScopes(scopes), true
+}
+
+func isAPIKeyScope(perm Permission) bool {
+	for _, p := range APIKeyScopes {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func parseScopes(s string) []Permission {
+	scopes := []Permission{}
+	for _, scope := range strings.Split(s, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, Permission(scope))
+		}
+	}
+	return scopes
+}
+
+func timeOrNil(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// createAPIKey issues a key through CreateAPIKey and returns it with its ID.
+func createAPIKey(t *testing.T, s *AuthService, body string) (string, int) {
+	t.Helper()
+	w := post(s.CreateAPIKey, body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("CreateAPIKey: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		ID  int    `json:"id"`
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Key, resp.ID
+}
+
+// apiKeyStatus is the status an admin route answers key with; wrap puts
+// the route's own check between Middleware and the handler.
+func apiKeyStatus(s *AuthService, key string, wrap func(http.HandlerFunc) http.HandlerFunc) int {
+	handler := s.Middleware(wrap(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest("GET", "/api/admin/stats", nil)
+	r.Header.Set(apiKeyHeader, key)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code
+}
+
+func requiring(s *AuthService, perm Permission) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc { return s.Require(perm, next) }
+}
+
+func TestAPIKeyStoredOnlyAsHash(t *testing.T) {
+	s := newTestService(t)
+	key, id := createAPIKey(t, s, `{"name": "billing", "scopes": ["dashboard.view"]}`)
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		t.Errorf("key %q lacks the %s prefix", key, apiKeyPrefix)
+	}
+
+	var prefix, hash, scopes string
+	if err := s.DB.QueryRow("SELECT prefix, key_hash, scopes FROM api_keys WHERE id = ?", id).Scan(&prefix, &hash, &scopes); err != nil {
+		t.Fatal(err)
+	}
+	if hash != hashToken(key) || prefix != key[:apiKeyVisibleChars] || strings.Contains(hash+prefix+scopes, key) {
+		t.Errorf("stored prefix %q, hash %q for key %q", prefix, hash, key)
+	}
+
+	w := httptest.NewRecorder()
+	s.ListAPIKeys(w, httptest.NewRequest("GET", "/api/admin/api-keys", nil))
+	if strings.Contains(w.Body.String(), key) {
+		t.Error("ListAPIKeys shows the key")
+	}
+
+	if code := post(s.CreateAPIKey, `{"name": "bad", "scopes": ["system.flush"]}`).Code; code != http.StatusBadRequest {
+		t.Errorf("key with a scope outside APIKeyScopes: %d, want 400", code)
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	s := newTestService(t)
+	key, _ := createAPIKey(t, s, `{"name": "billing", "scopes": ["dashboard.view", "subscriptions.assign"]}`)
+
+	for perm, want := range map[Permission]int{
+		PermView:          http.StatusOK,
+		PermAssignPlans:   http.StatusOK,
+		PermManageDevices: http.StatusForbidden,
+		PermFlushData:     http.StatusForbidden,
+		PermManageAPIKeys: http.StatusForbidden,
+	} {
+		if got := apiKeyStatus(s, key, requiring(s, perm)); got != want {
+			t.Errorf("%s: %d, want %d", perm, got, want)
+		}
+	}
+	if got := apiKeyStatus(s, "wm_unknown", requiring(s, PermView)); got != http.StatusUnauthorized {
+		t.Errorf("unknown key: %d, want 401", got)
+	}
+	if got := apiKeyStatus(s, key, s.RequireSession); got != http.StatusForbidden {
+		t.Errorf("API key on a session-only route: %d, want 403", got)
+	}
+}
+
+func TestAPIKeyExpiryAndRevocation(t *testing.T) {
+	s := newTestService(t)
+	expiring, expiringID := createAPIKey(t, s, `{"name": "temp", "scopes": ["dashboard.view"], "expires_in_days": 1}`)
+	revoked, revokedID := createAPIKey(t, s, `{"name": "old", "scopes": ["dashboard.view"]}`)
+	for _, key := range []string{expiring, revoked} {
+		if got := apiKeyStatus(s, key, requiring(s, PermView)); got != http.StatusOK {
+			t.Fatalf("fresh key: %d", got)
+		}
+	}
+
+	s.DB.Exec("UPDATE api_keys SET expires_at = ? WHERE id = ?", time.Now().Add(-time.Minute), expiringID)
+	if got := apiKeyStatus(s, expiring, requiring(s, PermView)); got != http.StatusUnauthorized {
+		t.Errorf("expired key: %d, want 401", got)
+	}
+
+	r := mux.SetURLVars(httptest.NewRequest("DELETE", "/api/admin/api-keys/x", nil), map[string]string{"id": strconv.Itoa(revokedID)})
+	w := httptest.NewRecorder()
+	s.RevokeAPIKey(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("RevokeAPIKey: %d", w.Code)
+	}
+	if got := apiKeyStatus(s, revoked, requiring(s, PermView)); got != http.StatusUnauthorized {
+		t.Errorf("revoked key: %d, want 401", got)
+	}
+}
@@ -4,25 +4,18 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/user/wifi-control-system/internal/audit"
+	"github.com/user/wifi-control-system/internal/db"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var SecretKey = []byte(getSecret())
-
-func getSecret() string {
-	s := os.Getenv("JWT_SECRET")
-	if s == "" {
-		return "dev-secret-keep-it-long-and-secure-1234567890"
-	}
-	return s
-}
-
 type Credentials struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -31,15 +24,31 @@ type Credentials struct {
 type Claims struct {
 	Username string `json:"username"`
 	Role     string `json:"role"`
+	// Session is the refresh token family of a staff sign-in, or the
+	// customer_sessions row of a customer one
+	Session string `json:"sid,omitempty"`
 	jwt.RegisteredClaims
 }
 
 type AuthService struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Users db.Users
+	// Policy is what ChangePassword and user management accept as a new
+	// password.
+	Policy PasswordPolicy
+
+	secret  []byte
+	limiter *loginLimiter
 }
 
-func NewAuthService(db *sql.DB) *AuthService {
-	return &AuthService{DB: db}
+// NewAuthService loads the token signing secret, creating it on first run.
+// The tables must exist already.
+func NewAuthService(database *sql.DB) (*AuthService, error) {
+	secret, err := loadSecret(database)
+	if err != nil {
+		return nil, fmt.Errorf("loading token secret: %v", err)
+	}
+	return &AuthService{DB: database, Users: &db.SQLUsers{DB: database}, Policy: DefaultPasswordPolicy, secret: secret, limiter: newLoginLimiter()}, nil
 }
 
 // Login validates credentials and returns a JWT
@@ -50,10 +59,24 @@ func (s *AuthService) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var passwordHash, role string
-	err := s.DB.QueryRow("SELECT password_hash, role FROM users WHERE username = ?", creds.Username).Scan(&passwordHash, &role)
+	ipKey, userKey := "ip:"+audit.ClientIP(r), "user:"+strings.ToLower(creds.Username)
+	if wait := s.limiter.retryAfter(ipKey, userKey); wait > 0 {
+		s.recordLogin(r, creds.Username, "auth.login_locked", fmt.Sprintf("locked for %s", wait.Round(time.Second)))
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "Too many failed attempts, please try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	var passwordHash, role, status string
+	var mustChange, twoFactor bool
+	err := s.DB.QueryRow(`
+		SELECT password_hash, role, COALESCE(status, 'active'), COALESCE(must_change_password, 0), COALESCE(totp_enabled, 0)
+		FROM users WHERE username = ?`, creds.Username).
+		Scan(&passwordHash, &role, &status, &mustChange, &twoFactor)
 	if err != nil {
 		if err == sql.ErrNoRows {
+			s.loginFailed(ipKey, userKey)
+			s.recordLogin(r, creds.Username, "auth.login_failed", "unknown user")
 			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 			return
 		}
@@ -62,35 +85,51 @@ func (s *AuthService) Login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(creds.Password)); err != nil {
+		s.loginFailed(ipKey, userKey)
+		s.recordLogin(r, creds.Username, "auth.login_failed", "wrong password")
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
+	s.limiter.reset(userKey)
+	if status != "active" || !IsStaffRole(role) {
+		s.recordLogin(r, creds.Username, "auth.login_failed", "account disabled")
+		http.Error(w, "Account disabled", http.StatusForbidden)
+		return
+	}
+	role = CanonicalRole(role)
 
-	// Create JWT
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &Claims{
-		Username: creds.Username,
-		Role:     role,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-		},
+	if twoFactor {
+		challenge, err := s.issueChallenge(creds.Username)
+		if err != nil {
+			http.Error(w, "Could not create token", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"two_factor_required": true, "challenge": challenge})
+		return
 	}
+	s.recordLogin(r, creds.Username, "auth.login", role)
+	s.finishLogin(w, r, creds.Username, role, mustChange)
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(SecretKey)
+// finishLogin opens the session of a signed-in staff member and answers
+// with the access token.
+func (s *AuthService) finishLogin(w http.ResponseWriter, r *http.Request, username, role string, mustChange bool) {
+	tokenString, err := s.startSession(w, r, username, role, "")
 	if err != nil {
 		http.Error(w, "Could not create token", http.StatusInternalServerError)
 		return
 	}
-
-	http.SetCookie(w, &http.Cookie{
-		Name:    "token",
-		Value:   tokenString,
-		Expires: expirationTime,
-		Path:    "/",
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":                tokenString,
+		"role":                 role,
+		"permissions":          Permissions(role),
+		"must_change_password": mustChange,
 	})
-	
-	json.NewEncoder(w).Encode(map[string]string{"token": tokenString, "role": role})
+}
+
+func (s *AuthService) loginFailed(ipKey, userKey string) {
+	s.limiter.fail(ipKey, ipFailureThreshold)
+	s.limiter.fail(userKey, userFailureThreshold)
 }
 
 // ChangePassword allows an authenticated user to change their password
@@ -123,6 +162,15 @@ func (s *AuthService) ChangePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.NewPassword == req.OldPassword {
+		http.Error(w, "New password must differ from the current one", http.StatusBadRequest)
+		return
+	}
+	if err := s.Policy.Check(username, req.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// 2. Hash new password
 	newHash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
 	if err != nil {
@@ -131,18 +179,44 @@ func (s *AuthService) ChangePassword(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 3. Update in DB
-	_, err = s.DB.Exec("UPDATE users SET password_hash = ? WHERE username = ?", string(newHash), username)
+	_, err = s.DB.Exec("UPDATE users SET password_hash = ?, must_change_password = 0 WHERE username = ?", string(newHash), username)
 	if err != nil {
 		http.Error(w, "Update failed", http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{"message": "Password updated successfully"})
+	// Sign out every other session; this one continues on a new token
+	s.revokeUser(username)
+	tokenString, err := s.startSession(w, r, username, r.Context().Value("role").(string), "")
+	if err != nil {
+		http.Error(w, "Could not create token", http.StatusInternalServerError)
+		return
+	}
+
+	audit.From(r).Action = "user.change_password"
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password updated successfully", "token": tokenString})
+}
+
+func (s *AuthService) recordLogin(r *http.Request, username, action, details string) {
+	audit.Record(s.DB, audit.Entry{Actor: username, Action: action, SourceIP: audit.ClientIP(r), Details: details})
 }
 
 // Middleware to protect routes
 func (s *AuthService) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Scripts authenticate with an API key instead of a staff session
+		if key := r.Header.Get(apiKeyHeader); key != "" {
+			name, scopes, ok := s.apiKeyScopesFor(r, key)
+			if !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			ctx := context.WithValue(r.Context(), "username", apiKeyActorPrefix+name)
+			ctx = context.WithValue(ctx, "api_key_scopes", scopes)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		// Get token from Cookie or Header
 		tokenString := ""
 		
@@ -167,21 +241,86 @@ func (s *AuthService) Middleware(next http.Handler) http.Handler {
 
 		claims := &Claims{}
 		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return SecretKey, nil
+			return s.secret, nil
 		})
 
-		if err != nil || !token.Valid {
+		if err != nil || !token.Valid || claims.Session == "" || !s.sessionActive(claims.Session, claims.Username) {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		// Check Admin role for /api/admin routes
-		if strings.Contains(r.URL.Path, "/api/admin") && claims.Role != "admin" {
+		// The role comes from the users table rather than the token, so
+		// demoting or disabling someone takes effect immediately
+		user, err := s.Users.Get(claims.Username)
+		if err != nil || user.Status != "active" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !IsStaffRole(user.Role) {
 			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), "username", claims.Username)
+		ctx = context.WithValue(ctx, "role", CanonicalRole(user.Role))
+		ctx = context.WithValue(ctx, "must_change_password", user.MustChangePassword)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// customerTokenTTL is how long a customer stays signed in on the portal.
+const customerTokenTTL = 30 * 24 * time.Hour
+
+// IssueCustomerToken signs a portal session for a customer account. The
+// token carries the "customer" role, so it is refused on admin routes, and
+// a session recorded in customer_sessions, so it can be revoked before it
+// expires.
+func (s *AuthService) IssueCustomerToken(customerID int, mobile string) (string, time.Time, error) {
+	session, err := randomToken(16)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expirationTime := time.Now().Add(customerTokenTTL)
+	_, err = s.DB.Exec("INSERT INTO customer_sessions (id, customer_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		session, customerID, time.Now(), expirationTime)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	s.DB.Exec("DELETE FROM customer_sessions WHERE expires_at < ?", time.Now())
+
+	claims := &Claims{
+		Username: mobile,
+		Role:     "customer",
+		Session:  session,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(customerID),
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString(s.secret)
+	return tokenString, expirationTime, err
+}
+
+// CustomerMiddleware protects customer routes and puts "customer_id" in
+// the request context.
+func (s *AuthService) CustomerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := &Claims{}
+		token, err := jwt.ParseWithClaims(customerTokenFrom(r), claims, func(token *jwt.Token) (interface{}, error) {
+			return s.secret, nil
+		})
+		if err != nil || !token.Valid || claims.Role != "customer" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		customerID, err := strconv.Atoi(claims.Subject)
+		if err != nil || claims.Session == "" || !s.customerSessionActive(claims.Session, customerID) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "customer_id", customerID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// Failed staff logins are counted per client IP and per username. Past a
+// threshold every further failure doubles the lockout, up to
+// loginMaxLockout. The IP threshold is higher because an office or a
+// hotspot can share one address.
+const (
+	userFailureThreshold = 5
+	ipFailureThreshold   = 20
+	loginBaseLockout     = 30 * time.Second
+	loginMaxLockout      = time.Hour
+	// Counts are forgotten this long after the last failure
+	loginFailureWindow = 24 * time.Hour
+)
+
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+type loginLimiter struct {
+	mu      sync.Mutex
+	entries map[string]*loginFailures
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{entries: make(map[string]*loginFailures)}
+}
+
+// retryAfter returns how long the longest lockout among keys still runs.
+func (l *loginLimiter) retryAfter(keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		if f, ok := l.entries[key]; ok {
+			if d := time.Until(f.lockedUntil); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait
+}
+
+// fail counts a failed attempt for key and locks it once the count
+// reaches threshold.
+func (l *loginLimiter) fail(key string, threshold int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.sweep(now)
+
+	f, ok := l.entries[key]
+	if !ok {
+		f = &loginFailures{}
+		l.entries[key] = f
+	}
+	f.count++
+	f.last = now
+	if f.count >= threshold {
+		lockout := loginMaxLockout
+		if shift := f.count - threshold; shift < 20 {
+			if d := loginBaseLockout << uint(shift); d < lockout {
+				lockout = d
+			}
+		}
+		f.lockedUntil = now.Add(lockout)
+	}
+}
+
+func (l *loginLimiter) reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+}
+
+func (l *loginLimiter) sweep(now time.Time) {
+	for key, f := range l.entries {
+		if now.Sub(f.last) > loginFailureWindow && now.After(f.lockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLoginLimiterBackoff(t *testing.T) {
+	l := newLoginLimiter()
+	for i := 1; i < userFailureThreshold; i++ {
+		l.fail("user:alice", userFailureThreshold)
+		if wait := l.retryAfter("user:alice"); wait != 0 {
+			t.Fatalf("locked for %s after %d failures", wait, i)
+		}
+	}
+
+	// Each failure past the threshold doubles the lockout
+	for _, want := range []time.Duration{loginBaseLockout, 2 * loginBaseLockout, 4 * loginBaseLockout} {
+		l.fail("user:alice", userFailureThreshold)
+		if wait := l.retryAfter("user:alice"); wait > want || wait < want-time.Second {
+			t.Errorf("locked for %s, want %s", wait, want)
+		}
+	}
+	for i := 0; i < 30; i++ {
+		l.fail("user:alice", userFailureThreshold)
+	}
+	if wait := l.retryAfter("user:alice"); wait > loginMaxLockout || wait < loginMaxLockout-time.Second {
+		t.Errorf("locked for %s after many failures, want the %s cap", wait, loginMaxLockout)
+	}
+
+	// retryAfter reports the longest lockout among the keys
+	if wait := l.retryAfter("ip:192.0.2.1", "user:alice"); wait < loginMaxLockout-time.Second {
+		t.Errorf("retryAfter over both keys = %s", wait)
+	}
+	l.reset("user:alice")
+	if wait := l.retryAfter("user:alice"); wait != 0 {
+		t.Errorf("locked for %s after reset", wait)
+	}
+}
+
+func TestLoginLocksOutAfterFailures(t *testing.T) {
+	s := newTestService(t)
+	addStaff(t, s, "alice", "correct horse", RoleOwner)
+	addStaff(t, s, "bob", "battery staple", RoleViewer)
+
+	for i := 0; i < userFailureThreshold; i++ {
+		if code := post(s.Login, `{"username": "alice", "password": "wrong"}`).Code; code != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d: %d, want 401", i+1, code)
+		}
+	}
+	w := post(s.Login, `{"username": "alice", "password": "correct horse"}`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("correct password while locked out: %d, Retry-After %q; want 429", w.Code, w.Header().Get("Retry-After"))
+	}
+	// The IP is below its own threshold, so others can still sign in
+	if code := post(s.Login, `{"username": "bob", "password": "battery staple"}`).Code; code != http.StatusOK {
+		t.Errorf("another user from the same IP: %d", code)
+	}
+}
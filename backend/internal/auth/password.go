@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// PasswordPolicy is what a new staff password must satisfy.
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{MinLength: 8}
+
+// Passwords that are refused whatever the policy, as the first guesses
+// against any admin page.
+var commonPasswords = map[string]bool{
+	"admin": true, "administrator": true, "password": true, "password1": true, "12345678": true,
+	"123456789": true, "1234567890": true, "qwertyuiop": true, "wifimint": true, "changeme": true,
+}
+
+// ParsePasswordPolicy builds a policy from a minimum length and a comma
+// separated list of required character classes (upper, lower, digit,
+// symbol). Empty values keep the defaults.
+func ParsePasswordPolicy(minLength, require string) (PasswordPolicy, error) {
+	p := DefaultPasswordPolicy
+	if minLength != "" {
+		n, err := strconv.Atoi(minLength)
+		if err != nil || n < 1 {
+			return p, fmt.Errorf("invalid minimum password length %q", minLength)
+		}
+		p.MinLength = n
+	}
+	for _, class := range strings.Split(require, ",") {
+		switch strings.TrimSpace(strings.ToLower(class)) {
+		case "":
+		case "upper":
+			p.RequireUpper = true
+		case "lower":
+			p.RequireLower = true
+		case "digit":
+			p.RequireDigit = true
+		case "symbol":
+			p.RequireSymbol = true
+		default:
+			return p, fmt.Errorf("unknown password requirement %q", class)
+		}
+	}
+	return p, nil
+}
+
+// Check returns why password is not acceptable for username, or nil.
+func (p PasswordPolicy) Check(username, password string) error {
+	if len([]rune(password)) < p.MinLength {
+		return fmt.Errorf("Password must be at least %d characters", p.MinLength)
+	}
+	if strings.EqualFold(password, username) || commonPasswords[strings.ToLower(password)] {
+		return fmt.Errorf("Password is too easy to guess")
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	var missing []string
+	if p.RequireUpper && !upper {
+		missing = append(missing, "an uppercase letter")
+	}
+	if p.RequireLower && !lower {
+		missing = append(missing, "a lowercase letter")
+	}
+	if p.RequireDigit && !digit {
+		missing = append(missing, "a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		missing = append(missing, "a symbol")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Password must contain %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
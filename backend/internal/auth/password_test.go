@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	strict, err := ParsePasswordPolicy("10", "upper, digit,symbol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		policy   PasswordPolicy
+		password string
+		ok       bool
+	}{
+		{DefaultPasswordPolicy, "short", false},
+		{DefaultPasswordPolicy, "alice", false},
+		{DefaultPasswordPolicy, "Password1", false}, // common, whatever the case
+		{DefaultPasswordPolicy, "aliceALICE", false},
+		{DefaultPasswordPolicy, "correct horse", true},
+		{strict, "correct horse", false},
+		{strict, "Correcthorse9", false},
+		{strict, "Correct-horse-9", true},
+		{strict, "Ab1!", false},
+	} {
+		err := tc.policy.Check("aliceALICE", tc.password)
+		if (err == nil) != tc.ok {
+			t.Errorf("%+v.Check(%q) = %v, want ok %v", tc.policy, tc.password, err, tc.ok)
+		}
+	}
+
+	for _, bad := range [][2]string{{"0", ""}, {"eight", ""}, {"", "upper,emoji"}} {
+		if _, err := ParsePasswordPolicy(bad[0], bad[1]); err == nil {
+			t.Errorf("ParsePasswordPolicy(%q, %q) succeeded", bad[0], bad[1])
+		}
+	}
+}
+
+func TestRequireRefusesPendingPasswordChange(t *testing.T) {
+	s := newTestService(t)
+	handler := s.Require(PermView, func(w http.ResponseWriter, r *http.Request) {})
+	for mustChange, want := range map[bool]int{true: http.StatusForbidden, false: http.StatusOK} {
+		r := httptest.NewRequest("GET", "/api/admin/stats", nil)
+		ctx := context.WithValue(r.Context(), "role", RoleOwner)
+		ctx = context.WithValue(ctx, "must_change_password", mustChange)
+		w := httptest.NewRecorder()
+		handler(w, r.WithContext(ctx))
+		if w.Code != want {
+			t.Errorf("must_change_password %v: %d, want %d", mustChange, w.Code, want)
+		}
+	}
+}
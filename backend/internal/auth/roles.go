@@ -0,0 +1,118 @@
+package auth
+
+import "net/http"
+
+// Staff roles, from most to least privileged. Accounts created before roles
+// existed have the role "admin", which is treated as owner.
+const (
+	RoleOwner   = "owner"
+	RoleManager = "manager"
+	RoleCashier = "cashier"
+	RoleViewer  = "viewer"
+)
+
+// Permission is an action on the admin API.
+type Permission string
+
+const (
+	PermView            Permission = "dashboard.view"
+	PermApprovePayments Permission = "subscriptions.approve"
+	PermAssignPlans     Permission = "subscriptions.assign"
+	PermRevoke          Permission = "subscriptions.revoke"
+	PermManagePlans     Permission = "plans.manage"
+	PermManageVouchers  Permission = "vouchers.manage"
+	PermManageDevices   Permission = "devices.manage"
+	PermManageGarden    Permission = "walled_garden.manage"
+	PermManageUsers     Permission = "users.manage"
+	PermViewAudit       Permission = "audit.view"
+	PermFlushData       Permission = "system.flush"
+	PermManageAPIKeys   Permission = "api_keys.manage"
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleOwner: {
+		PermView, PermApprovePayments, PermAssignPlans, PermRevoke, PermManagePlans,
+		PermManageVouchers, PermManageDevices, PermManageGarden, PermManageUsers, PermViewAudit, PermFlushData,
+		PermManageAPIKeys,
+	},
+	RoleManager: {
+		PermView, PermApprovePayments, PermAssignPlans, PermRevoke, PermManagePlans,
+		PermManageVouchers, PermManageDevices, PermManageGarden, PermViewAudit,
+	},
+	RoleCashier: {PermView, PermApprovePayments, PermAssignPlans},
+	RoleViewer:  {PermView},
+}
+
+// CanonicalRole maps legacy role names onto the current ones.
+func CanonicalRole(role string) string {
+	if role == "admin" {
+		return RoleOwner
+	}
+	return role
+}
+
+// IsStaffRole reports whether role may use the admin API at all.
+func IsStaffRole(role string) bool {
+	_, ok := rolePermissions[CanonicalRole(role)]
+	return ok
+}
+
+// Permissions lists what role may do.
+func Permissions(role string) []Permission {
+	perms := rolePermissions[CanonicalRole(role)]
+	if perms == nil {
+		return []Permission{}
+	}
+	return perms
+}
+
+// HasPermission reports whether role may perform perm.
+func HasPermission(role string, perm Permission) bool {
+	for _, p := range rolePermissions[CanonicalRole(role)] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Require wraps an admin handler so only roles holding perm can call it.
+// It must run behind Middleware, which puts the caller's role in the
+// request context. Staff who still have to change their password are
+// refused until they do, and API keys need perm among their scopes.
+func (s *AuthService) Require(perm Permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if scopes, ok := r.Context().Value("api_key_scopes").([]Permission); ok {
+			for _, scope := range scopes {
+				if scope == perm {
+					next(w, r)
+					return
+				}
+			}
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if mustChange, _ := r.Context().Value("must_change_password").(bool); mustChange {
+			http.Error(w, "Password change required", http.StatusForbidden)
+			return
+		}
+		role, _ := r.Context().Value("role").(string)
+		if !HasPermission(role, perm) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RequireSession wraps the handlers that act on the caller's own staff
+// account, such as changing the password, which API keys may not call.
+func (s *AuthService) RequireSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value("api_key_scopes").([]Permission); ok {
+			http.Error(w, "Not available to API keys", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var allPermissions = []Permission{
+	PermView, PermApprovePayments, PermAssignPlans, PermRevoke, PermManagePlans, PermManageVouchers,
+	PermManageDevices, PermManageGarden, PermManageUsers, PermViewAudit, PermFlushData, PermManageAPIKeys,
+}
+
+func TestRequireRolePermissions(t *testing.T) {
+	s := newTestService(t)
+	// What each role may do, spelled out rather than read from rolePermissions
+	allowed := map[string][]Permission{
+		RoleOwner: allPermissions,
+		"admin":   allPermissions,
+		RoleManager: {
+			PermView, PermApprovePayments, PermAssignPlans, PermRevoke, PermManagePlans,
+			PermManageVouchers, PermManageDevices, PermManageGarden, PermViewAudit,
+		},
+		RoleCashier: {PermView, PermApprovePayments, PermAssignPlans},
+		RoleViewer:  {PermView},
+		"user":      nil,
+		"":          nil,
+	}
+
+	for role, perms := range allowed {
+		may := map[Permission]bool{}
+		for _, p := range perms {
+			may[p] = true
+		}
+		for _, perm := range allPermissions {
+			want := http.StatusForbidden
+			if may[perm] {
+				want = http.StatusOK
+			}
+			r := httptest.NewRequest("POST", "/api/admin/x", nil)
+			r = r.WithContext(context.WithValue(r.Context(), "role", role))
+			w := httptest.NewRecorder()
+			s.Require(perm, func(w http.ResponseWriter, r *http.Request) {})(w, r)
+			if w.Code != want {
+				t.Errorf("role %q, %s: %d, want %d", role, perm, w.Code, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+const secretSetting = "jwt_secret"
+
+// loadSecret returns the key tokens are signed with. JWT_SECRET wins;
+// otherwise a random key is generated on first run and kept in the
+// settings table, so every install has its own and tokens survive
+// restarts.
+func loadSecret(db *sql.DB) ([]byte, error) {
+	if s := os.Getenv("JWT_SECRET"); s != "" {
+		return []byte(s), nil
+	}
+
+	var secret string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = ?", secretSetting).Scan(&secret)
+	if err == nil && secret != "" {
+		return []byte(secret), nil
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	// Another process may have won the race; read back whichever was stored
+	if _, err := db.Exec("INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT (key) DO NOTHING", secretSetting, hex.EncodeToString(b)); err != nil {
+		return nil, err
+	}
+	if err := db.QueryRow("SELECT value FROM settings WHERE key = ?", secretSetting).Scan(&secret); err != nil {
+		return nil, err
+	}
+	fmt.Println("[AUTH] Generated a new token signing secret")
+	return []byte(secret), nil
+}
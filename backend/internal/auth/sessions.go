@@ -0,0 +1,294 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/user/wifi-control-system/internal/audit"
+)
+
+// Staff sign-ins get a short-lived access token plus a refresh token kept
+// in refresh_tokens. Each refresh hands out a new refresh token and revokes
+// the old one; the chain shares a family ID, which access tokens carry as
+// "sid" so revoking the family ends the session at once.
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+
+	accessCookie   = "token"
+	refreshCookie  = "refresh_token"
+	customerCookie = "customer_token"
+	// The refresh cookie is only sent to the refresh and logout endpoints
+	refreshCookiePath = "/api/admin"
+)
+
+// startSession issues an access and a refresh token for username in
+// family (a new one when empty), sets both as cookies and returns the
+// access token.
+func (s *AuthService) startSession(w http.ResponseWriter, r *http.Request, username, role, family string) (string, error) {
+	if family == "" {
+		var err error
+		if family, err = randomToken(16); err != nil {
+			return "", err
+		}
+	}
+
+	expires := time.Now().Add(accessTokenTTL)
+	claims := &Claims{
+		Username: username,
+		Role:     role,
+		Session:  family,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	}
+	access, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.secret)
+	if err != nil {
+		return "", err
+	}
+
+	refresh, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	refreshExpires := time.Now().Add(refreshTokenTTL)
+	_, err = s.DB.Exec(`
+		INSERT INTO refresh_tokens (token_hash, family_id, username, created_at, expires_at, user_agent, ip_address)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		hashToken(refresh), family, username, time.Now(), refreshExpires, r.UserAgent(), audit.ClientIP(r))
+	if err != nil {
+		return "", err
+	}
+	s.DB.Exec("DELETE FROM refresh_tokens WHERE expires_at < ?", time.Now())
+
+	setCookie(w, r, accessCookie, access, "/", expires)
+	setCookie(w, r, refreshCookie, refresh, refreshCookiePath, refreshExpires)
+	return access, nil
+}
+
+// Refresh trades the refresh token cookie for a new access and refresh
+// token. A refresh token that was already
+// used means it leaked, so its whole family is revoked.
+func (s *AuthService) Refresh(w http.ResponseWriter, r *http.Request) {
+	token := refreshTokenFrom(r)
+	if token == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var id int64
+	var family, username string
+	var expires time.Time
+	var revoked sql.NullTime
+	err := s.DB.QueryRow("SELECT id, family_id, username, expires_at, revoked_at FROM refresh_tokens WHERE token_hash = ?", hashToken(token)).
+		Scan(&id, &family, &username, &expires, &revoked)
+	if err != nil || time.Now().After(expires) {
+		clearCookies(w, r)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if revoked.Valid {
+		s.revokeFamily(family)
+		s.recordLogin(r, username, "auth.refresh_reuse", "session "+family+" revoked")
+		clearCookies(w, r)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var role, status string
+	err = s.DB.QueryRow("SELECT role, COALESCE(status, 'active') FROM users WHERE username = ?", username).Scan(&role, &status)
+	if err != nil || status != "active" || !IsStaffRole(role) {
+		s.revokeFamily(family)
+		clearCookies(w, r)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Only one of two concurrent refreshes with the same token wins
+	res, err := s.DB.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now(), id)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	role = CanonicalRole(role)
+	access, err := s.startSession(w, r, username, role, family)
+	if err != nil {
+		http.Error(w, "Could not create token", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": access, "role": role, "permissions": Permissions(role)})
+}
+
+// Logout ends the session of the refresh token the request carries. It
+// works with an expired access token, so it is not behind Middleware.
+func (s *AuthService) Logout(w http.ResponseWriter, r *http.Request) {
+	if token := refreshTokenFrom(r); token != "" {
+		var family, username string
+		err := s.DB.QueryRow("SELECT family_id, username FROM refresh_tokens WHERE token_hash = ?", hashToken(token)).Scan(&family, &username)
+		if err == nil {
+			s.revokeFamily(family)
+			s.recordLogin(r, username, "auth.logout", "")
+		}
+	}
+	clearCookies(w, r)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Signed out"})
+}
+
+// RevokeAllSessions signs the caller out everywhere, including this
+// session.
+func (s *AuthService) RevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value("username").(string)
+	n := s.revokeUser(username)
+	audit.From(r).Action = "auth.revoke_sessions"
+	audit.From(r).Details = fmt.Sprintf("%d sessions", n)
+	clearCookies(w, r)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "All sessions revoked", "revoked": n})
+}
+
+// RevokeUserSessions signs another staff member out everywhere.
+func (s *AuthService) RevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	var username string
+	if err := s.DB.QueryRow("SELECT username FROM users WHERE id = ?", id).Scan(&username); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	n := s.revokeUser(username)
+	e := audit.From(r)
+	e.Action = "auth.revoke_sessions"
+	e.Details = fmt.Sprintf("%s: %d sessions", username, n)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Sessions revoked", "revoked": n})
+}
+
+// sessionActive reports whether the family an access token belongs to is
+// still signed in.
+func (s *AuthService) sessionActive(family, username string) bool {
+	var n int
+	s.DB.QueryRow(`
+		SELECT COUNT(*) FROM refresh_tokens
+		WHERE family_id = ? AND username = ? AND revoked_at IS NULL AND expires_at > ?`, family, username, time.Now()).Scan(&n)
+	return n > 0
+}
+
+func (s *AuthService) revokeFamily(family string) {
+	s.DB.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL", time.Now(), family)
+}
+
+// revokeUser ends every session of username and returns how many there
+// were.
+func (s *AuthService) revokeUser(username string) int64 {
+	var n int64
+	s.DB.QueryRow(`
+		SELECT COUNT(DISTINCT family_id) FROM refresh_tokens
+		WHERE username = ? AND revoked_at IS NULL AND expires_at > ?`, username, time.Now()).Scan(&n)
+	s.DB.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE username = ? AND revoked_at IS NULL", time.Now(), username)
+	return n
+}
+
+// CustomerLogout ends the customer session the request carries. Like
+// Logout it works with an expired token, so it is not behind
+// CustomerMiddleware.
+func (s *AuthService) CustomerLogout(w http.ResponseWriter, r *http.Request) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(customerTokenFrom(r), claims, func(token *jwt.Token) (interface{}, error) {
+		return s.secret, nil
+	}, jwt.WithoutClaimsValidation())
+	if err == nil && token.Valid && claims.Role == "customer" && claims.Session != "" {
+		s.DB.Exec("UPDATE customer_sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now(), claims.Session)
+		audit.Record(s.DB, audit.Entry{Actor: "customer:" + claims.Subject, Action: "customer.logout", SourceIP: audit.ClientIP(r)})
+	}
+	setCookie(w, r, customerCookie, "", "/", time.Unix(0, 0))
+	json.NewEncoder(w).Encode(map[string]string{"message": "Signed out"})
+}
+
+// RevokeCustomerSessions signs a customer out on every device and returns
+// how many sessions were ended.
+func (s *AuthService) RevokeCustomerSessions(customerID int) int64 {
+	res, err := s.DB.Exec(`
+		UPDATE customer_sessions SET revoked_at = ?
+		WHERE customer_id = ? AND revoked_at IS NULL AND expires_at > ?`, time.Now(), customerID, time.Now())
+	if err != nil {
+		return 0
+	}
+	n, _ := res.RowsAffected()
+	return n
+}
+
+// customerSessionActive reports whether a customer token's session is
+// still signed in.
+func (s *AuthService) customerSessionActive(session string, customerID int) bool {
+	var n int
+	s.DB.QueryRow(`
+		SELECT COUNT(*) FROM customer_sessions
+		WHERE id = ? AND customer_id = ? AND revoked_at IS NULL AND expires_at > ?`, session, customerID, time.Now()).Scan(&n)
+	return n > 0
+}
+
+// customerTokenFrom returns the customer token from the cookie or the
+// Authorization header.
+func customerTokenFrom(r *http.Request) string {
+	if c, err := r.Cookie(customerCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	return ""
+}
+
+func refreshTokenFrom(r *http.Request) string {
+	if c, err := r.Cookie(refreshCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+func setCookie(w http.ResponseWriter, r *http.Request, name, value, path string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Expires:  expires,
+		Path:     path,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func clearCookies(w http.ResponseWriter, r *http.Request) {
+	setCookie(w, r, accessCookie, "", "/", time.Unix(0, 0))
+	setCookie(w, r, refreshCookie, "", refreshCookiePath, time.Unix(0, 0))
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/user/wifi-control-system/internal/db"
+)
+
+func newTestService(t *testing.T) *AuthService {
+	t.Helper()
+	store, err := db.InitDB(filepath.Join(t.TempDir(), "test.db") + "?_parse_time=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.DB.Close() })
+	if _, err := store.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewAuthService(store.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// customerStatus is the status CustomerMiddleware answers token with.
+func customerStatus(s *AuthService, token string) int {
+	handler := s.CustomerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest("GET", "/api/customer/me", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestCustomerLogoutRevokesToken(t *testing.T) {
+	s := newTestService(t)
+	token, _, err := s.IssueCustomerToken(7, "9876543210")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, _ := s.IssueCustomerToken(7, "9876543210")
+	if code := customerStatus(s, token); code != http.StatusOK {
+		t.Fatalf("fresh token: %d", code)
+	}
+
+	r := httptest.NewRequest("POST", "/api/customer/logout", nil)
+	r.AddCookie(&http.Cookie{Name: customerCookie, Value: token})
+	s.CustomerLogout(httptest.NewRecorder(), r)
+	if code := customerStatus(s, token); code != http.StatusUnauthorized {
+		t.Errorf("token after logout: %d, want 401", code)
+	}
+	if code := customerStatus(s, other); code != http.StatusOK {
+		t.Errorf("the customer's other session was ended too: %d", code)
+	}
+
+	if n := s.RevokeCustomerSessions(7); n != 1 {
+		t.Errorf("RevokeCustomerSessions = %d, want 1", n)
+	}
+	if code := customerStatus(s, other); code != http.StatusUnauthorized {
+		t.Errorf("token after revoking all sessions: %d, want 401", code)
+	}
+}
+
+func TestCustomerTokenNeedsSession(t *testing.T) {
+	s := newTestService(t)
+	// A validly signed token from before sessions, or for another customer's session
+	claims := &Claims{
+		Username: "9876543210",
+		Role:     "customer",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(7),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+	legacy, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.secret)
+	if code := customerStatus(s, legacy); code != http.StatusUnauthorized {
+		t.Errorf("token without a session: %d, want 401", code)
+	}
+
+	token, _, _ := s.IssueCustomerToken(8, "9876543211")
+	parsed := &Claims{}
+	jwt.ParseWithClaims(token, parsed, func(*jwt.Token) (interface{}, error) { return s.secret, nil })
+	claims.Session = parsed.Session
+	borrowed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.secret)
+	if code := customerStatus(s, borrowed); code != http.StatusUnauthorized {
+		t.Errorf("token naming another customer's session: %d, want 401", code)
+	}
+}
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors.
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+// addStaff creates an active staff account.
+func addStaff(t *testing.T, s *AuthService, username, password, role string) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DB.Exec("INSERT INTO users (username, password_hash, role) VALUES (?, ?, ?)", username, string(hash), role); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// post calls handler with a JSON body from the client at 192.0.2.1.
+func post(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/login", strings.NewReader(body))
+	r.RemoteAddr = "192.0.2.1:40000"
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestTOTPCodeMatchesRFC6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+	// The RFC lists 8 digits; the app shows the last 6
+	for unix, want := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		if got := totpCode(key, unix/totpPeriod); got != want {
+			t.Errorf("code at %d = %s, want %s", unix, got, want)
+		}
+	}
+}
+
+func TestCheckTOTPRefusesReplay(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	step, ok := checkTOTP(rfc6238Secret, "081 804", now, 0)
+	if !ok || step != 1111111109/totpPeriod {
+		t.Fatalf("checkTOTP = %d, %v; want step %d", step, ok, 1111111109/totpPeriod)
+	}
+	if _, ok := checkTOTP(rfc6238Secret, "081804", now, step); ok {
+		t.Error("code of the last used step accepted again")
+	}
+}
+
+func TestCheckTOTPSkewWindow(t *testing.T) {
+	key := []byte("12345678901234567890")
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+	for offset, want := range map[int64]bool{-2: false, -1: true, 0: true, 1: true, 2: false} {
+		_, ok := checkTOTP(rfc6238Secret, totpCode(key, current+offset), now, 0)
+		if ok != want {
+			t.Errorf("code %+d steps away: accepted = %v, want %v", offset, ok, want)
+		}
+	}
+}
+
+// twoFactorLogin signs in as username, which has 2FA on, and returns the
+// challenge.
+func twoFactorLogin(t *testing.T, s *AuthService, username string) string {
+	t.Helper()
+	w := post(s.Login, `{"username": "`+username+`", "password": "correct horse"}`)
+	var resp struct {
+		Required  bool   `json:"two_factor_required"`
+		Challenge string `json:"challenge"`
+		Token     string `json:"token"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusOK || !resp.Required || resp.Challenge == "" || resp.Token != "" {
+		t.Fatalf("Login: %d %+v", w.Code, resp)
+	}
+	return resp.Challenge
+}
+
+func newTwoFactorService(t *testing.T) *AuthService {
+	t.Helper()
+	s := newTestService(t)
+	addStaff(t, s, "alice", "correct horse", RoleOwner)
+	if _, err := s.DB.Exec("UPDATE users SET totp_secret = ?, totp_enabled = 1 WHERE username = 'alice'", rfc6238Secret); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func verify(s *AuthService, challenge, code string) int {
+	return post(s.VerifyLogin, `{"challenge": "`+challenge+`", "code": "`+code+`"}`).Code
+}
+
+func TestVerifyLoginWithTOTP(t *testing.T) {
+	s := newTwoFactorService(t)
+	challenge := twoFactorLogin(t, s, "alice")
+	code := totpCode([]byte("12345678901234567890"), time.Now().Unix()/totpPeriod)
+
+	// The challenge is no session
+	handler := s.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest("GET", "/api/admin/stats", nil)
+	r.Header.Set("Authorization", "Bearer "+challenge)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("challenge used as a session: %d, want 401", w.Code)
+	}
+
+	if got := verify(s, "not-a-token", code); got != http.StatusUnauthorized {
+		t.Errorf("bad challenge: %d, want 401", got)
+	}
+	session, _, err := s.IssueCustomerToken(7, "9876543210")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := verify(s, session, code); got != http.StatusUnauthorized {
+		t.Errorf("other token as the challenge: %d, want 401", got)
+	}
+
+	if got := verify(s, challenge, code); got != http.StatusOK {
+		t.Fatalf("correct code: %d", got)
+	}
+	if got := verify(s, twoFactorLogin(t, s, "alice"), code); got != http.StatusUnauthorized {
+		t.Errorf("same code on a second login: %d, want 401", got)
+	}
+}
+
+func TestVerifyLoginWithRecoveryCode(t *testing.T) {
+	s := newTwoFactorService(t)
+	codes, err := s.newRecoveryCodes("alice")
+	if err != nil || len(codes) != recoveryCodeCount {
+		t.Fatalf("newRecoveryCodes = %d codes, %v", len(codes), err)
+	}
+	if got := verify(s, twoFactorLogin(t, s, "alice"), strings.ToUpper(codes[0])); got != http.StatusOK {
+		t.Fatalf("recovery code: %d", got)
+	}
+	if got := verify(s, twoFactorLogin(t, s, "alice"), codes[0]); got != http.StatusUnauthorized {
+		t.Errorf("used recovery code: %d, want 401", got)
+	}
+	if got := verify(s, twoFactorLogin(t, s, "alice"), codes[1]); got != http.StatusOK {
+		t.Errorf("second recovery code: %d", got)
+	}
+}
+
+func TestVerifyLoginLocksOut(t *testing.T) {
+	s := newTwoFactorService(t)
+	challenge := twoFactorLogin(t, s, "alice")
+	for i := 0; i < userFailureThreshold; i++ {
+		if got := verify(s, challenge, "000000"); got != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: %d, want 401", i+1, got)
+		}
+	}
+	code := totpCode([]byte("12345678901234567890"), time.Now().Unix()/totpPeriod)
+	if got := verify(s, challenge, code); got != http.StatusTooManyRequests {
+		t.Errorf("correct code while locked out: %d, want 429", got)
+	}
+}
@@ -0,0 +1,306 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/user/wifi-control-system/internal/audit"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Staff can turn on two-factor authentication with an authenticator app.
+// Login then answers with a short-lived challenge instead of a session,
+// and VerifyLogin trades the challenge plus a TOTP or recovery code for
+// the session.
+const (
+	challengeRole = "2fa_challenge"
+	challengeTTL  = 5 * time.Minute
+
+	recoveryCodeCount    = 10
+	recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+// SetupTwoFactor creates a new TOTP secret for the caller. It takes effect
+// once EnableTwoFactor has seen a code from it.
+func (s *AuthService) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value("username").(string)
+	if s.twoFactorEnabled(username) {
+		http.Error(w, "Two-factor authentication is already on", http.StatusConflict)
+		return
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		http.Error(w, "Could not create secret", http.StatusInternalServerError)
+		return
+	}
+	if _, err := s.DB.Exec("UPDATE users SET totp_secret = ?, totp_enabled = 0, totp_last_step = 0 WHERE username = ?", secret, username); err != nil {
+		http.Error(w, "Update failed", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"secret": secret, "uri": totpURI(username, secret)})
+}
+
+// EnableTwoFactor turns two-factor authentication on after checking a
+// code from the secret SetupTwoFactor handed out, and returns the
+// recovery codes. They are shown only this once.
+func (s *AuthService) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value("username").(string)
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var secret sql.NullString
+	var enabled bool
+	err := s.DB.QueryRow("SELECT totp_secret, COALESCE(totp_enabled, 0) FROM users WHERE username = ?", username).Scan(&secret, &enabled)
+	if err != nil || !secret.Valid {
+		http.Error(w, "Start the setup first", http.StatusBadRequest)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication is already on", http.StatusConflict)
+		return
+	}
+	step, ok := checkTOTP(secret.String, req.Code, time.Now(), 0)
+	if !ok {
+		http.Error(w, "Incorrect code", http.StatusUnauthorized)
+		return
+	}
+
+	codes, err := s.newRecoveryCodes(username)
+	if err != nil {
+		http.Error(w, "Could not create recovery codes", http.StatusInternalServerError)
+		return
+	}
+	s.DB.Exec("UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE username = ?", step, username)
+	audit.From(r).Action = "user.2fa_enable"
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Two-factor authentication is on", "recovery_codes": codes})
+}
+
+// DisableTwoFactor turns two-factor authentication off. It needs the
+// password and a current TOTP or recovery code.
+func (s *AuthService) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value("username").(string)
+	var req struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	var hash string
+	if err := s.DB.QueryRow("SELECT password_hash FROM users WHERE username = ?", username).Scan(&hash); err != nil ||
+		bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+		http.Error(w, "Current password incorrect", http.StatusUnauthorized)
+		return
+	}
+	if _, ok := s.checkSecondFactor(username, req.Code); !ok {
+		http.Error(w, "Incorrect code", http.StatusUnauthorized)
+		return
+	}
+	s.clearTwoFactor(username)
+	audit.From(r).Action = "user.2fa_disable"
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication is off"})
+}
+
+// RegenerateRecoveryCodes replaces the caller's recovery codes. It needs a
+// current TOTP code.
+func (s *AuthService) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value("username").(string)
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if method, ok := s.checkSecondFactor(username, req.Code); !ok || method != "totp" {
+		http.Error(w, "Incorrect code", http.StatusUnauthorized)
+		return
+	}
+	codes, err := s.newRecoveryCodes(username)
+	if err != nil {
+		http.Error(w, "Could not create recovery codes", http.StatusInternalServerError)
+		return
+	}
+	audit.From(r).Action = "user.2fa_recovery_codes"
+	json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+}
+
+// ResetTwoFactor turns two-factor authentication off for another staff
+// member who lost their authenticator and recovery codes.
+func (s *AuthService) ResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	var username string
+	if err := s.DB.QueryRow("SELECT username FROM users WHERE id = ?", id).Scan(&username); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	s.clearTwoFactor(username)
+	e := audit.From(r)
+	e.Action = "user.2fa_reset"
+	e.Details = username
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication reset"})
+}
+
+// VerifyLogin completes a login that Login answered with a challenge.
+func (s *AuthService) VerifyLogin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(req.Challenge, claims, func(token *jwt.Token) (interface{}, error) {
+		return s.secret, nil
+	})
+	if err != nil || !token.Valid || claims.Role != challengeRole {
+		http.Error(w, "Login expired, please sign in again", http.StatusUnauthorized)
+		return
+	}
+	username := claims.Username
+
+	ipKey, codeKey := "ip:"+audit.ClientIP(r), "2fa:"+strings.ToLower(username)
+	if wait := s.limiter.retryAfter(ipKey, codeKey); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "Too many failed attempts, please try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	var role, status string
+	var mustChange bool
+	err = s.DB.QueryRow("SELECT role, COALESCE(status, 'active'), COALESCE(must_change_password, 0) FROM users WHERE username = ?", username).
+		Scan(&role, &status, &mustChange)
+	if err != nil || status != "active" || !IsStaffRole(role) {
+		http.Error(w, "Account disabled", http.StatusForbidden)
+		return
+	}
+
+	method, ok := s.checkSecondFactor(username, req.Code)
+	if !ok {
+		s.limiter.fail(ipKey, ipFailureThreshold)
+		s.limiter.fail(codeKey, userFailureThreshold)
+		s.recordLogin(r, username, "auth.login_failed", "wrong second factor")
+		http.Error(w, "Incorrect code", http.StatusUnauthorized)
+		return
+	}
+	s.limiter.reset(codeKey)
+	role = CanonicalRole(role)
+	s.recordLogin(r, username, "auth.login", role+" ("+method+")")
+	s.finishLogin(w, r, username, role, mustChange)
+}
+
+// issueChallenge signs the token that stands between the password and
+// the TOTP step. It opens no session, so Middleware refuses it.
+func (s *AuthService) issueChallenge(username string) (string, error) {
+	claims := &Claims{
+		Username: username,
+		Role:     challengeRole,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(challengeTTL)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.secret)
+}
+
+// checkSecondFactor accepts a current TOTP code or an unused recovery code
+// of username, using it up, and says which one it was.
+func (s *AuthService) checkSecondFactor(username, code string) (string, bool) {
+	var secret string
+	var lastStep int64
+	err := s.DB.QueryRow(`
+		SELECT totp_secret, COALESCE(totp_last_step, 0) FROM users
+		WHERE username = ? AND totp_enabled = 1 AND totp_secret IS NOT NULL`, username).Scan(&secret, &lastStep)
+	if err != nil {
+		return "", false
+	}
+	if step, ok := checkTOTP(secret, code, time.Now(), lastStep); ok {
+		// Two logins racing with the same code: only one moves the step on
+		res, err := s.DB.Exec("UPDATE users SET totp_last_step = ? WHERE username = ? AND COALESCE(totp_last_step, 0) < ?", step, username, step)
+		if err == nil {
+			if n, _ := res.RowsAffected(); n == 1 {
+				return "totp", true
+			}
+		}
+		return "", false
+	}
+
+	res, err := s.DB.Exec(`
+		UPDATE recovery_codes SET used_at = ?
+		WHERE username = ? AND code_hash = ? AND used_at IS NULL`, time.Now(), username, hashToken(normalizeRecoveryCode(code)))
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 1 {
+			return "recovery_code", true
+		}
+	}
+	return "", false
+}
+
+// newRecoveryCodes replaces username's recovery codes with fresh ones.
+func (s *AuthService) newRecoveryCodes(username string) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		for j := range b {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(recoveryCodeAlphabet))))
+			if err != nil {
+				return nil, err
+			}
+			b[j] = recoveryCodeAlphabet[n.Int64()]
+		}
+		code := string(b[:5]) + "-" + string(b[5:])
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(normalizeRecoveryCode(code)))
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE username = ?", username); err != nil {
+		return nil, err
+	}
+	for _, h := range hashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (username, code_hash) VALUES (?, ?)", username, h); err != nil {
+			return nil, err
+		}
+	}
+	return codes, tx.Commit()
+}
+
+func (s *AuthService) twoFactorEnabled(username string) bool {
+	var enabled bool
+	s.DB.QueryRow("SELECT COALESCE(totp_enabled, 0) FROM users WHERE username = ?", username).Scan(&enabled)
+	return enabled
+}
+
+func (s *AuthService) clearTwoFactor(username string) {
+	s.DB.Exec("UPDATE users SET totp_secret = NULL, totp_enabled = 0, totp_last_step = 0 WHERE username = ?", username)
+	s.DB.Exec("DELETE FROM recovery_codes WHERE username = ?", username)
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/user/wifi-control-system/internal/audit"
+	"github.com/user/wifi-control-system/internal/db"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User is a staff account.
+type User = db.User
+
+// Me returns the signed-in staff member and what they may do, so the
+// dashboard can hide actions the role cannot perform.
+func (s *AuthService) Me(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value("username").(string)
+	role, _ := r.Context().Value("role").(string)
+	mustChange, _ := r.Context().Value("must_change_password").(bool)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"username":             username,
+		"role":                 role,
+		"permissions":          Permissions(role),
+		"must_change_password": mustChange,
+		"two_factor":           s.twoFactorEnabled(username),
+	})
+}
+
+// ListUsers returns all staff accounts.
+func (s *AuthService) ListUsers(w http.ResponseWriter, r *http.Request) {
+	list, err := s.Users.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	users := []User{}
+	for _, u := range list {
+		u.Role = CanonicalRole(u.Role)
+		users = append(users, u)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// CreateUser adds a staff account.
+func (s *AuthService) CreateUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Role     string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	req.Role = CanonicalRole(req.Role)
+	if req.Username == "" {
+		http.Error(w, "Username is required", http.StatusBadRequest)
+		return
+	}
+	if !IsStaffRole(req.Role) {
+		http.Error(w, "Unknown role", http.StatusBadRequest)
+		return
+	}
+	if err := s.Policy.Check(req.Username, req.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Hashing failed", http.StatusInternalServerError)
+		return
+	}
+	var id int64
+	err = s.DB.QueryRow("INSERT INTO users (username, password_hash, role, status, must_change_password) VALUES (?, ?, ?, 'active', 1) RETURNING id", req.Username, string(hash), req.Role).Scan(&id)
+	if err != nil {
+		if db.IsUniqueViolation(err) {
+			http.Error(w, "Username already exists", http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("[AUTH] %s created %s user %s\n", r.Context().Value("username"), req.Role, req.Username)
+	e := audit.From(r)
+	e.Action = "user.create"
+	e.After = map[string]interface{}{"id": id, "username": req.Username, "role": req.Role, "status": "active"}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "message": "User created"})
+}
+
+// UpdateUser changes a staff account's role or status, or resets its
+// password. Omitted fields are left unchanged.
+func (s *AuthService) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Role     string `json:"role"`
+		Status   string `json:"status"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var username, role, status string
+	err = s.DB.QueryRow("SELECT username, role, COALESCE(status, 'active') FROM users WHERE id = ?", id).Scan(&username, &role, &status)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	role = CanonicalRole(role)
+
+	newRole, newStatus := role, status
+	if req.Role != "" {
+		newRole = CanonicalRole(req.Role)
+		if !IsStaffRole(newRole) {
+			http.Error(w, "Unknown role", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Status != "" {
+		if req.Status != "active" && req.Status != "disabled" {
+			http.Error(w, "Status must be active or disabled", http.StatusBadRequest)
+			return
+		}
+		newStatus = req.Status
+	}
+	if role == RoleOwner && status == "active" && (newRole != RoleOwner || newStatus != "active") && s.activeOwners() <= 1 {
+		http.Error(w, "At least one active owner is required", http.StatusConflict)
+		return
+	}
+
+	if req.Password != "" {
+		if err := s.Policy.Check(username, req.Password); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			http.Error(w, "Hashing failed", http.StatusInternalServerError)
+			return
+		}
+		if _, err := s.DB.Exec("UPDATE users SET password_hash = ?, must_change_password = 1 WHERE id = ?", string(hash), id); err != nil {
+			http.Error(w, "Update failed", http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err := s.DB.Exec("UPDATE users SET role = ?, status = ? WHERE id = ?", newRole, newStatus, id); err != nil {
+		http.Error(w, "Update failed", http.StatusInternalServerError)
+		return
+	}
+
+	// A reset password or disabled account signs the user out everywhere
+	if req.Password != "" || newStatus != "active" {
+		s.revokeUser(username)
+	}
+
+	fmt.Printf("[AUTH] %s updated user %s (role %s, status %s)\n", r.Context().Value("username"), username, newRole, newStatus)
+	e := audit.From(r)
+	e.Action = "user.update"
+	e.Before = map[string]interface{}{"username": username, "role": role, "status": status}
+	e.After = map[string]interface{}{"username": username, "role": newRole, "status": newStatus, "password_reset": req.Password != ""}
+	json.NewEncoder(w).Encode(map[string]string{"message": "User updated"})
+}
+
+// DeleteUser removes a staff account. Staff cannot delete themselves or
+// the last active owner.
+func (s *AuthService) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var username, role, status string
+	err = s.DB.QueryRow("SELECT username, role, COALESCE(status, 'active') FROM users WHERE id = ?", id).Scan(&username, &role, &status)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if username == r.Context().Value("username") {
+		http.Error(w, "You cannot delete your own account", http.StatusBadRequest)
+		return
+	}
+	if CanonicalRole(role) == RoleOwner && status == "active" && s.activeOwners() <= 1 {
+		http.Error(w, "At least one active owner is required", http.StatusConflict)
+		return
+	}
+
+	if _, err := s.DB.Exec("DELETE FROM users WHERE id = ?", id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.revokeUser(username)
+	s.DB.Exec("DELETE FROM recovery_codes WHERE username = ?", username)
+	fmt.Printf("[AUTH] %s deleted user %s\n", r.Context().Value("username"), username)
+	e := audit.From(r)
+	e.Action = "user.delete"
+	e.Before = map[string]interface{}{"username": username, "role": CanonicalRole(role), "status": status}
+	json.NewEncoder(w).Encode(map[string]string{"message": "User deleted"})
+}
+
+func (s *AuthService) activeOwners() int {
+	var n int
+	s.DB.QueryRow("SELECT COUNT(*) FROM users WHERE role IN ('owner', 'admin') AND COALESCE(status, 'active') = 'active'").Scan(&n)
+	return n
+}
+
+// FlagDefaultPassword makes username change its password at next sign-in
+// if it is still password, e.g. the seeded admin account.
+func (s *AuthService) FlagDefaultPassword(username, password string) {
+	var hash string
+	if err := s.DB.QueryRow("SELECT password_hash FROM users WHERE username = ?", username).Scan(&hash); err != nil {
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+		s.DB.Exec("UPDATE users SET must_change_password = 1 WHERE username = ?", username)
+		fmt.Printf("[AUTH] %s still uses the default password and must change it at next sign-in\n", username)
+	}
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SQLDevices is the Devices repository on the devices table.
+type SQLDevices struct {
+	DB *sql.DB
+}
+
+func (r *SQLDevices) List() ([]Device, error) {
+	rows, err := r.DB.Query(`
+		SELECT mac_address, COALESCE(device_name, ''), COALESCE(ip_address, ''), status, last_seen, COALESCE(randomized, 0)
+		FROM devices ORDER BY last_seen DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []Device
+	for rows.Next() {
+		var d Device
+		var lastSeen sql.NullTime
+		if err := rows.Scan(&d.MAC, &d.Name, &d.IP, &d.Status, &lastSeen, &d.Randomized); err != nil {
+			continue
+		}
+		d.LastSeen = lastSeen.Time
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+func (r *SQLDevices) Get(mac string) (Device, error) {
+	var d Device
+	var lastSeen sql.NullTime
+	err := r.DB.QueryRow(`
+		SELECT mac_address, COALESCE(device_name, ''), COALESCE(ip_address, ''), status, last_seen, COALESCE(randomized, 0)
+		FROM devices WHERE mac_address = ?`, mac).
+		Scan(&d.MAC, &d.Name, &d.IP, &d.Status, &lastSeen, &d.Randomized)
+	if err == sql.ErrNoRows {
+		return d, ErrNotFound
+	}
+	d.LastSeen = lastSeen.Time
+	return d, err
+}
+
+func (r *SQLDevices) Seen(mac, ip, name string, randomized bool) (bool, error) {
+	// Only insert if not exists, to preserve status
+	res, err := r.DB.Exec(`
+		INSERT INTO devices (mac_address, ip_address, device_name, status, randomized)
+		VALUES (?, ?, ?, 'blocked', ?)
+		ON CONFLICT(mac_address) DO NOTHING`,
+		mac, ip, name, randomized)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return true, nil
+	}
+	_, err = r.DB.Exec("UPDATE devices SET ip_address = ?, last_seen = CURRENT_TIMESTAMP WHERE mac_address = ?", ip, mac)
+	return false, err
+}
+
+func (r *SQLDevices) SetStatus(mac, status string) error {
+	_, err := r.DB.Exec("UPDATE devices SET status = ? WHERE mac_address = ?", status, mac)
+	return err
+}
+
+func (r *SQLDevices) SetName(mac, name string) error {
+	_, err := r.DB.Exec("UPDATE devices SET device_name = ? WHERE mac_address = ?", name, mac)
+	return err
+}
+
+func (r *SQLDevices) Ensure(mac string, randomized bool) error {
+	_, err := r.DB.Exec(`
+		INSERT INTO devices (mac_address, device_name, ip_address, status, randomized) VALUES (?, '', '', 'blocked', ?)
+		ON CONFLICT(mac_address) DO UPDATE SET last_seen = CURRENT_TIMESTAMP`, mac, randomized)
+	return err
+}
+
+func (r *SQLDevices) PruneRandomized(unseenSince time.Time) (int64, error) {
+	res, err := r.DB.Exec(`
+		DELETE FROM devices
+		WHERE randomized = 1 AND status = 'blocked' AND last_seen < ?
+		AND mac_address NOT IN (SELECT mac_address FROM subscriptions)`,
+		unseenSince.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,156 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Dialect is the SQL flavour of the database a DBStore is connected to.
+// Queries are written once, in the SQL both databases accept, with ?
+// placeholders; the few statements that differ switch on it.
+type Dialect string
+
+const (
+	SQLite   Dialect = "sqlite"
+	Postgres Dialect = "postgres"
+)
+
+// DefaultDSN is the SQLite database used when DATABASE_URL is not set.
+const DefaultDSN = "wifi.db?_parse_time=true"
+
+// DialectOf picks the database for a data source name: postgres:// and
+// postgresql:// URLs are PostgreSQL, anything else is a SQLite file.
+func DialectOf(dsn string) Dialect {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return Postgres
+	}
+	return SQLite
+}
+
+// postgresDriver is lib/pq behind a wrapper that lets the SQLite-style
+// queries run unchanged: ? placeholders become $1, $2, ... and Go bools
+// are sent as 0 and 1, since flag columns are integers in both schemas.
+const postgresDriver = "wifimint-postgres"
+
+func init() {
+	sql.Register(postgresDriver, pgDriver{})
+}
+
+type pgDriver struct{}
+
+func (pgDriver) Open(dsn string) (driver.Conn, error) {
+	cn, err := pq.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &pgConn{cn}, nil
+}
+
+type pgConn struct {
+	driver.Conn
+}
+
+func (c *pgConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(rebind(query))
+}
+
+func (c *pgConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, rebind(query))
+}
+
+func (c *pgConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, rebind(query), args)
+}
+
+func (c *pgConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, rebind(query), args)
+}
+
+func (c *pgConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *pgConn) Ping(ctx context.Context) error {
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c *pgConn) ResetSession(ctx context.Context) error {
+	return c.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (c *pgConn) IsValid() bool {
+	return c.Conn.(driver.Validator).IsValid()
+}
+
+// CheckNamedValue stores bools the way SQLite does; everything else gets
+// the default conversion.
+func (c *pgConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if b, ok := nv.Value.(bool); ok {
+		nv.Value = int64(0)
+		if b {
+			nv.Value = int64(1)
+		}
+		return nil
+	}
+	return driver.ErrSkip
+}
+
+// rebind numbers the ? placeholders in query for PostgreSQL, leaving
+// string literals, quoted identifiers and comments alone.
+func rebind(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(query); i++ {
+		switch ch := query[i]; {
+		case ch == '\'' || ch == '"':
+			end := strings.IndexByte(query[i+1:], ch)
+			if end < 0 {
+				b.WriteString(query[i:])
+				return b.String()
+			}
+			b.WriteString(query[i : i+end+2])
+			i += end + 1
+		case ch == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				b.WriteString(query[i:])
+				return b.String()
+			}
+			b.WriteString(query[i : i+end])
+			i += end - 1
+		case ch == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
+
+// date is the SQL for the calendar day, as YYYY-MM-DD, of a timestamp.
+func (d Dialect) date(expr string) string {
+	if d == Postgres {
+		return "to_char(" + expr + ", 'YYYY-MM-DD')"
+	}
+	return "date(" + expr + ")"
+}
+
+// IsUniqueViolation reports whether err is an insert or update refused by
+// a UNIQUE constraint.
+func IsUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+	return err != nil && strings.Contains(err.Error(), "UNIQUE")
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestDialectOf(t *testing.T) {
+	cases := map[string]Dialect{
+		"postgres://wifi@localhost/wifimint":   Postgres,
+		"postgresql://wifi@localhost/wifimint": Postgres,
+		DefaultDSN:                             SQLite,
+		"/var/lib/wifimint/wifi.db":            SQLite,
+	}
+	for dsn, want := range cases {
+		if got := DialectOf(dsn); got != want {
+			t.Errorf("DialectOf(%q) = %s, want %s", dsn, got, want)
+		}
+	}
+}
+
+func TestRebind(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"SELECT 1", "SELECT 1"},
+		{"SELECT * FROM devices WHERE mac_address = ? AND status = ?", "SELECT * FROM devices WHERE mac_address = $1 AND status = $2"},
+		{"UPDATE plans SET name = '?' WHERE id = ?", "UPDATE plans SET name = '?' WHERE id = $1"},
+		{"SELECT 'it''s ?', ?", "SELECT 'it''s ?', $1"},
+		{`SELECT "odd?column" FROM t WHERE a = ?`, `SELECT "odd?column" FROM t WHERE a = $1`},
+		{"SELECT ? -- why not ?\nFROM t WHERE b = ?", "SELECT $1 -- why not ?\nFROM t WHERE b = $2"},
+		{"SELECT a - ? FROM t", "SELECT a - $1 FROM t"},
+		{"SELECT ? -- trailing ?", "SELECT $1 -- trailing ?"},
+		{"SELECT ?, 'unterminated ?", "SELECT $1, 'unterminated ?"},
+	}
+	for _, c := range cases {
+		if got := rebind(c.in); got != c.want {
+			t.Errorf("rebind(%q)\n got %q\nwant %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestIsUniqueViolation(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("database is locked"), false},
+		{errors.New("UNIQUE constraint failed: subscriptions.transaction_id"), true},
+		{&pq.Error{Code: "23505"}, true},
+		{fmt.Errorf("creating subscription: %w", &pq.Error{Code: "23505"}), true},
+		// A foreign key violation whose message happens to say UNIQUE
+		{&pq.Error{Code: "23503", Message: "UNIQUE"}, false},
+	}
+	for _, c := range cases {
+		if got := IsUniqueViolation(c.err); got != c.want {
+			t.Errorf("IsUniqueViolation(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestCheckNamedValueStoresBoolsAsIntegers(t *testing.T) {
+	c := &pgConn{}
+	for in, want := range map[bool]int64{true: 1, false: 0} {
+		nv := &driver.NamedValue{Ordinal: 1, Value: in}
+		if err := c.CheckNamedValue(nv); err != nil {
+			t.Fatalf("CheckNamedValue(%v): %v", in, err)
+		}
+		if nv.Value != want {
+			t.Errorf("CheckNamedValue(%v) stored %#v, want %d", in, nv.Value, want)
+		}
+	}
+
+	// Everything else is left to database/sql's default conversion
+	for _, v := range []interface{}{"yes", int64(1), nil} {
+		nv := &driver.NamedValue{Ordinal: 1, Value: v}
+		if err := c.CheckNamedValue(nv); err != driver.ErrSkip {
+			t.Errorf("CheckNamedValue(%#v) = %v, want driver.ErrSkip", v, err)
+		}
+		if nv.Value != v {
+			t.Errorf("CheckNamedValue(%#v) changed the value to %#v", v, nv.Value)
+		}
+	}
+}
@@ -0,0 +1,560 @@
+package db
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory holds the repositories in maps instead of SQLite, so handlers
+// can be exercised without a database. All of them share one set of data,
+// as the SQL ones share the tables.
+type Memory struct {
+	mu       sync.Mutex
+	devices  map[string]Device
+	plans    map[int]Plan
+	subs     map[int]*memorySubscription
+	sessions map[string]*memorySession
+	users    map[string]User
+	lastID   int
+}
+
+type memorySubscription struct {
+	NewSubscription
+	ID        int
+	BytesUsed int64
+}
+
+type memorySession struct {
+	subscriptionID int
+	mac            string
+	created        time.Time
+}
+
+// NewMemory returns empty in-memory repositories.
+func NewMemory() *Memory {
+	return &Memory{
+		devices:  map[string]Device{},
+		plans:    map[int]Plan{},
+		subs:     map[int]*memorySubscription{},
+		sessions: map[string]*memorySession{},
+		users:    map[string]User{},
+	}
+}
+
+func (m *Memory) Devices() Devices             { return memoryDevices{m} }
+func (m *Memory) Plans() Plans                 { return memoryPlans{m} }
+func (m *Memory) Subscriptions() Subscriptions { return memorySubscriptions{m} }
+func (m *Memory) Sessions() Sessions           { return memorySessions{m} }
+func (m *Memory) Users() Users                 { return memoryUsers{m} }
+
+func (m *Memory) nextID() int {
+	m.lastID++
+	return m.lastID
+}
+
+type memoryDevices struct{ m *Memory }
+
+func (r memoryDevices) List() ([]Device, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	var devices []Device
+	for _, d := range r.m.devices {
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].LastSeen.After(devices[j].LastSeen) })
+	return devices, nil
+}
+
+func (r memoryDevices) Get(mac string) (Device, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	d, ok := r.m.devices[mac]
+	if !ok {
+		return d, ErrNotFound
+	}
+	return d, nil
+}
+
+func (r memoryDevices) Seen(mac, ip, name string, randomized bool) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	d, ok := r.m.devices[mac]
+	if !ok {
+		r.m.devices[mac] = Device{MAC: mac, IP: ip, Name: name, Status: "blocked", LastSeen: time.Now(), Randomized: randomized}
+		return true, nil
+	}
+	d.IP, d.LastSeen = ip, time.Now()
+	r.m.devices[mac] = d
+	return false, nil
+}
+
+func (r memoryDevices) SetStatus(mac, status string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	if d, ok := r.m.devices[mac]; ok {
+		d.Status = status
+		r.m.devices[mac] = d
+	}
+	return nil
+}
+
+func (r memoryDevices) SetName(mac, name string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	if d, ok := r.m.devices[mac]; ok {
+		d.Name = name
+		r.m.devices[mac] = d
+	}
+	return nil
+}
+
+func (r memoryDevices) Ensure(mac string, randomized bool) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	d, ok := r.m.devices[mac]
+	if !ok {
+		d = Device{MAC: mac, Status: "blocked", Randomized: randomized}
+	}
+	d.LastSeen = time.Now()
+	r.m.devices[mac] = d
+	return nil
+}
+
+func (r memoryDevices) PruneRandomized(unseenSince time.Time) (int64, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	var n int64
+	for mac, d := range r.m.devices {
+		if !d.Randomized || d.Status != "blocked" || !d.LastSeen.Before(unseenSince) || r.m.hasSubscription(mac) {
+			continue
+		}
+		delete(r.m.devices, mac)
+		n++
+	}
+	return n, nil
+}
+
+func (m *Memory) hasSubscription(mac string) bool {
+	for _, s := range m.subs {
+		if s.MacAddress == mac {
+			return true
+		}
+	}
+	return false
+}
+
+type memoryPlans struct{ m *Memory }
+
+func (r memoryPlans) List() ([]Plan, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	var plans []Plan
+	for _, p := range r.m.plans {
+		plans = append(plans, p)
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].ID < plans[j].ID })
+	return plans, nil
+}
+
+func (r memoryPlans) Get(id int) (Plan, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	p, ok := r.m.plans[id]
+	if !ok {
+		return p, ErrNotFound
+	}
+	return p, nil
+}
+
+func (r memoryPlans) Create(p *Plan) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	p.ID = r.m.nextID()
+	r.m.plans[p.ID] = *p
+	return nil
+}
+
+func (r memoryPlans) Delete(id int) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	delete(r.m.plans, id)
+	return nil
+}
+
+type memorySubscriptions struct{ m *Memory }
+
+// view fills in the plan and device details the SQL joins would.
+func (m *Memory) view(s *memorySubscription) Subscription {
+	v := Subscription{
+		ID: s.ID, MacAddress: s.MacAddress, PlanID: s.PlanID, StartTime: s.StartTime, EndTime: s.EndTime,
+		Status: s.Status, PaymentMethod: s.PaymentMethod, TransactionID: s.TransactionID, BytesUsed: s.BytesUsed,
+	}
+	if s.AmountPaid != nil {
+		v.AmountPaid = *s.AmountPaid
+	}
+	if p, ok := m.plans[s.PlanID]; ok {
+		v.PlanName, v.Price, v.DataLimitMB = p.Name, p.Price, p.DataLimitMB
+	}
+	if d, ok := m.devices[s.MacAddress]; ok {
+		v.Mobile = d.Name
+	}
+	return v
+}
+
+func (m *Memory) sortedSubscriptions() []*memorySubscription {
+	subs := make([]*memorySubscription, 0, len(m.subs))
+	for _, s := range m.subs {
+		subs = append(subs, s)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+	return subs
+}
+
+func (r memorySubscriptions) Get(id int) (Subscription, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	s, ok := r.m.subs[id]
+	if !ok {
+		return Subscription{}, ErrNotFound
+	}
+	return r.m.view(s), nil
+}
+
+func (r memorySubscriptions) Active() ([]Subscription, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	var subs []Subscription
+	for _, s := range r.m.sortedSubscriptions() {
+		if s.Status == "active" && s.EndTime.After(time.Now()) {
+			subs = append(subs, r.m.view(s))
+		}
+	}
+	return subs, nil
+}
+
+func (r memorySubscriptions) All() ([]Subscription, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	var subs []Subscription
+	all := r.m.sortedSubscriptions()
+	for i := len(all) - 1; i >= 0; i-- {
+		subs = append(subs, r.m.view(all[i]))
+	}
+	return subs, nil
+}
+
+func (r memorySubscriptions) Pending() ([]PendingRequest, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	var requests []PendingRequest
+	for _, s := range r.m.sortedSubscriptions() {
+		p, ok := r.m.plans[s.PlanID]
+		if s.Status != "pending" || !ok {
+			continue
+		}
+		req := PendingRequest{
+			ID: s.ID, MacAddress: s.MacAddress, Mobile: r.m.devices[s.MacAddress].Name, PlanName: p.Name, Price: p.Price,
+			Duration: p.DurationMinutes, PaymentMethod: s.PaymentMethod, TransactionID: s.TransactionID,
+		}
+		if s.AmountPaid != nil {
+			req.AmountPaid = *s.AmountPaid
+		}
+		requests = append(requests, req)
+	}
+	return requests, nil
+}
+
+func (r memorySubscriptions) Current(mac string) (Subscription, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	rank := map[string]int{"active": 1, "pending": 2, "rejected": 3}
+	var best *memorySubscription
+	for _, s := range r.m.sortedSubscriptions() {
+		if s.MacAddress != mac || rank[s.Status] == 0 {
+			continue
+		}
+		if best == nil || rank[s.Status] < rank[best.Status] || (rank[s.Status] == rank[best.Status] && s.ID > best.ID) {
+			best = s
+		}
+	}
+	if best == nil {
+		return Subscription{}, ErrNotFound
+	}
+	return Subscription{ID: best.ID, MacAddress: mac, Status: best.Status, EndTime: best.EndTime}, nil
+}
+
+func (r memorySubscriptions) HasActive(mac string) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for _, s := range r.m.subs {
+		if s.MacAddress == mac && s.Status == "active" && s.EndTime.After(time.Now()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r memorySubscriptions) ActiveForCustomer(mac string, customerID int) (Subscription, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	var best *memorySubscription
+	for _, s := range r.m.subs {
+		if s.MacAddress == mac && s.CustomerID == customerID && s.Status == "active" && s.EndTime.After(time.Now()) &&
+			(best == nil || s.EndTime.After(best.EndTime)) {
+			best = s
+		}
+	}
+	if best == nil {
+		return Subscription{}, ErrNotFound
+	}
+	return Subscription{ID: best.ID, MacAddress: mac, PlanID: best.PlanID, Status: best.Status, EndTime: best.EndTime}, nil
+}
+
+func (r memorySubscriptions) TransactionIDInUse(txID string, excludeID int) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for _, s := range r.m.subs {
+		if s.ID != excludeID && strings.ToUpper(s.TransactionID) == txID &&
+			s.Status != "rejected" && s.PaymentMethod != "voucher" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r memorySubscriptions) Create(n NewSubscription) (int64, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	s := &memorySubscription{NewSubscription: n, ID: r.m.nextID()}
+	r.m.subs[s.ID] = s
+	return int64(s.ID), nil
+}
+
+func (r memorySubscriptions) Activate(id int, start, end time.Time) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	if s, ok := r.m.subs[id]; ok {
+		s.StartTime, s.EndTime, s.Status = start, end, "active"
+	}
+	return nil
+}
+
+func (r memorySubscriptions) SetStatus(id int, status string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	if s, ok := r.m.subs[id]; ok {
+		s.Status = status
+	}
+	return nil
+}
+
+func (r memorySubscriptions) Move(id int, mac string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	if s, ok := r.m.subs[id]; ok {
+		s.MacAddress = mac
+	}
+	for _, sess := range r.m.sessions {
+		if sess.subscriptionID == id {
+			sess.mac = mac
+		}
+	}
+	return nil
+}
+
+func (r memorySubscriptions) ExpireShared(parentID int) ([]string, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	var macs []string
+	for _, s := range r.m.sortedSubscriptions() {
+		if s.ParentID == parentID && s.Status == "active" {
+			s.Status = "expired"
+			macs = append(macs, s.MacAddress)
+		}
+	}
+	return macs, nil
+}
+
+func (r memorySubscriptions) AddUsage(mac string, bytes uint64) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	for _, s := range r.m.subs {
+		if s.MacAddress == mac && s.Status == "active" {
+			s.BytesUsed += int64(bytes)
+		}
+	}
+	return nil
+}
+
+func (r memorySubscriptions) DueForExpiry(now time.Time) ([]Expiry, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	family := func(s *memorySubscription) int {
+		if s.ParentID != 0 {
+			return s.ParentID
+		}
+		return s.ID
+	}
+	// Extra devices share the data allowance of their parent
+	used := map[int]int64{}
+	for _, s := range r.m.subs {
+		used[family(s)] += s.BytesUsed
+	}
+
+	var due []Expiry
+	for _, s := range r.m.sortedSubscriptions() {
+		if s.Status != "active" {
+			continue
+		}
+		limit := int64(r.m.plans[s.PlanID].DataLimitMB) * 1048576
+		switch {
+		case s.EndTime.Before(now):
+			due = append(due, Expiry{SubscriptionID: s.ID, MacAddress: s.MacAddress, Reason: "time"})
+		case limit > 0 && used[family(s)] >= limit:
+			due = append(due, Expiry{SubscriptionID: s.ID, MacAddress: s.MacAddress, Reason: "data"})
+		}
+	}
+	return due, nil
+}
+
+func (r memorySubscriptions) Stats() (Stats, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	st := Stats{TotalPlans: len(r.m.plans), TotalDevices: len(r.m.devices)}
+	for _, s := range r.m.subs {
+		switch s.Status {
+		case "active":
+			st.ActiveUsers++
+		case "pending":
+			st.PendingRequests++
+		}
+		if s.Status == "active" || s.Status == "expired" {
+			if s.AmountPaid != nil {
+				st.TotalRevenue += *s.AmountPaid
+			} else {
+				st.TotalRevenue += r.m.plans[s.PlanID].Price
+			}
+		}
+	}
+	for _, d := range r.m.devices {
+		if d.Status == "blocked" {
+			st.BlockedDevices++
+		}
+	}
+	return st, nil
+}
+
+func (r memorySubscriptions) RevenueByDay() ([]RevenueDay, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	since := time.Now().UTC().AddDate(0, 0, -7).Truncate(24 * time.Hour)
+	totals := map[string]float64{}
+	for _, s := range r.m.subs {
+		if s.Status == "rejected" || s.StartTime.IsZero() || s.StartTime.Before(since) {
+			continue
+		}
+		totals[s.StartTime.UTC().Format("2006-01-02")] += r.m.plans[s.PlanID].Price
+	}
+	var days []RevenueDay
+	for d, total := range totals {
+		days = append(days, RevenueDay{Date: d, Total: total})
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Date < days[j].Date })
+	return days, nil
+}
+
+func (r memorySubscriptions) Flush() (int, int, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	subscriptions, devices := len(r.m.subs), len(r.m.devices)
+	r.m.subs = map[int]*memorySubscription{}
+	r.m.devices = map[string]Device{}
+	r.m.sessions = map[string]*memorySession{}
+	return subscriptions, devices, nil
+}
+
+type memorySessions struct{ m *Memory }
+
+func (r memorySessions) Refresh(tokenHash string, subscriptionID int, mac string) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	sess, ok := r.m.sessions[tokenHash]
+	if !ok || sess.subscriptionID != subscriptionID {
+		return false, nil
+	}
+	sess.mac = mac
+	return true, nil
+}
+
+func (r memorySessions) Create(tokenHash string, subscriptionID int, mac string, keep int) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	r.m.sessions[tokenHash] = &memorySession{subscriptionID: subscriptionID, mac: mac, created: time.Now()}
+
+	var hashes []string
+	for hash, sess := range r.m.sessions {
+		if sess.subscriptionID == subscriptionID {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return r.m.sessions[hashes[i]].created.After(r.m.sessions[hashes[j]].created)
+	})
+	for len(hashes) > keep {
+		delete(r.m.sessions, hashes[len(hashes)-1])
+		hashes = hashes[:len(hashes)-1]
+	}
+	return nil
+}
+
+func (r memorySessions) Subscription(tokenHash string) (Subscription, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	sess, ok := r.m.sessions[tokenHash]
+	if !ok {
+		return Subscription{}, ErrNotFound
+	}
+	s, ok := r.m.subs[sess.subscriptionID]
+	if !ok || s.Status != "active" || !s.EndTime.After(time.Now()) {
+		return Subscription{}, ErrNotFound
+	}
+	return Subscription{ID: s.ID, PlanID: s.PlanID, MacAddress: s.MacAddress}, nil
+}
+
+type memoryUsers struct{ m *Memory }
+
+func (r memoryUsers) List() ([]User, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	var users []User
+	for _, u := range r.m.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (r memoryUsers) Get(username string) (User, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	u, ok := r.m.users[username]
+	if !ok {
+		return u, ErrNotFound
+	}
+	return u, nil
+}
+
+func (r memoryUsers) EnsureExists(username, passwordHash, role string) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	if _, ok := r.m.users[username]; ok {
+		return false, nil
+	}
+	r.m.users[username] = User{
+		ID: r.m.nextID(), Username: username, PasswordHash: passwordHash, Role: role,
+		Status: "active", MustChangePassword: true, CreatedAt: time.Now(),
+	}
+	return true, nil
+}
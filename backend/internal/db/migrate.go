@@ -0,0 +1,308 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema changes are SQL files in migrations/<dialect>/, named
+// NNNN_description.sql and applied in order, each in its own transaction.
+// Both dialects have the same versions; a change adds the next file to
+// each. schema_migrations records which versions a database has. Applied
+// files must never be edited.
+//
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey is the PostgreSQL advisory lock Migrate holds, so that
+// servers starting together against one database apply each migration once.
+const migrationLockKey = 0x77696669 // "wifi"
+
+// baselineVersion is the migration describing the schema that
+// CreateTables used to build before migrations existed.
+const baselineVersion = 1
+
+// Migration is one schema change.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// MigrationStatus is a migration and when it was applied, if it was.
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Columns CreateTables used to add to existing tables with ALTER TABLE.
+// Databases from before migrations may lack any of them.
+var legacyColumns = []struct{ table, column, definition string }{
+	{"subscriptions", "payment_method", "TEXT"},
+	{"subscriptions", "amount_paid", "REAL"},
+	{"subscriptions", "transaction_id", "TEXT"},
+	{"subscriptions", "bytes_used", "INTEGER DEFAULT 0"},
+	{"plans", "download_kbps", "INTEGER DEFAULT 0"},
+	{"plans", "upload_kbps", "INTEGER DEFAULT 0"},
+	{"plans", "max_devices", "INTEGER DEFAULT 1"},
+	{"subscriptions", "customer_id", "INTEGER REFERENCES customers(id)"},
+	{"subscriptions", "parent_subscription_id", "INTEGER REFERENCES subscriptions(id)"},
+	{"devices", "randomized", "INTEGER DEFAULT 0"},
+	{"users", "must_change_password", "INTEGER DEFAULT 0"},
+	{"users", "totp_secret", "TEXT"},
+	{"users", "totp_enabled", "INTEGER DEFAULT 0"},
+	{"users", "totp_last_step", "INTEGER DEFAULT 0"},
+}
+
+// Migrations returns the migrations built into this binary for a
+// dialect, in order.
+func Migrations(d Dialect) ([]Migration, error) {
+	dir := "migrations/" + string(d)
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var migrations []Migration
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".sql")
+		num, desc, ok := strings.Cut(name, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil || version < 1 {
+			return nil, fmt.Errorf("migration file %s is not named NNNN_description.sql", e.Name())
+		}
+		body, err := migrationFiles.ReadFile(dir + "/" + e.Name())
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: desc, SQL: string(body)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %04d is missing or duplicated", i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// SchemaVersion returns the highest migration applied to the database, or
+// 0 for a new or pre-migration database.
+func (s *DBStore) SchemaVersion() (int, error) {
+	if err := s.ensureMigrationsTable(); err != nil {
+		return 0, err
+	}
+	var version int
+	err := s.DB.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// CheckSchemaVersion refuses databases migrated by a newer build, whose
+// schema this one does not know.
+func (s *DBStore) CheckSchemaVersion() error {
+	migrations, err := Migrations(s.Dialect)
+	if err != nil {
+		return err
+	}
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if latest := len(migrations); version > latest {
+		return fmt.Errorf("database schema is at version %d but this build only knows up to %d; run a newer build", version, latest)
+	}
+	return nil
+}
+
+// MigrationStatus lists every known migration and whether it is applied.
+func (s *DBStore) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := Migrations(s.Dialect)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+	applied := map[int]time.Time{}
+	rows, err := s.DB.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var at sql.NullTime
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at.Time
+	}
+
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		st := MigrationStatus{Migration: m}
+		if at, ok := applied[m.Version]; ok {
+			st.AppliedAt = &at
+		}
+		status = append(status, st)
+	}
+	return status, nil
+}
+
+// Migrate applies the pending migrations and returns them. A database
+// from before migrations is first adopted at the baseline version.
+func (s *DBStore) Migrate() ([]Migration, error) {
+	if s.Dialect == Postgres {
+		unlock, err := s.lockMigrations()
+		if err != nil {
+			return nil, fmt.Errorf("locking migrations: %v", err)
+		}
+		defer unlock()
+	}
+	if err := s.CheckSchemaVersion(); err != nil {
+		return nil, err
+	}
+	if err := s.adoptLegacySchema(); err != nil {
+		return nil, fmt.Errorf("adopting existing schema: %v", err)
+	}
+	status, err := s.MigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, st := range status {
+		if st.AppliedAt != nil {
+			continue
+		}
+		if err := s.apply(st.Migration); err != nil {
+			return applied, fmt.Errorf("migration %04d_%s: %v", st.Version, st.Name, err)
+		}
+		applied = append(applied, st.Migration)
+	}
+	return applied, nil
+}
+
+// lockMigrations waits for the PostgreSQL advisory lock on migrations and
+// returns the function releasing it. The lock belongs to a database
+// session, so it is taken and released on one pooled connection held
+// until then.
+func (s *DBStore) lockMigrations() (func(), error) {
+	ctx := context.Background()
+	conn, err := s.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock(?)", migrationLockKey); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return func() {
+		conn.ExecContext(ctx, "SELECT pg_advisory_unlock(?)", migrationLockKey)
+		conn.Close()
+	}, nil
+}
+
+func (s *DBStore) apply(m Migration) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)", m.Version, m.Name, time.Now()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *DBStore) ensureMigrationsTable() error {
+	_, err := s.DB.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	return err
+}
+
+// adoptLegacySchema brings a database built by the old CreateTables, which
+// has tables but no recorded migrations, up to the baseline and records it
+// as applied there. New databases are left to the baseline migration, as
+// are all PostgreSQL ones, which only ever had migrations.
+func (s *DBStore) adoptLegacySchema() error {
+	if s.Dialect != SQLite {
+		return nil
+	}
+	version, err := s.SchemaVersion()
+	if err != nil || version > 0 {
+		return err
+	}
+	var tables int
+	if err := s.DB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'users'").Scan(&tables); err != nil || tables == 0 {
+		return err
+	}
+
+	migrations, err := Migrations(s.Dialect)
+	if err != nil {
+		return err
+	}
+	baseline := migrations[baselineVersion-1]
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// The baseline only creates what is missing, so tables added after this
+	// database was built appear and existing ones are left alone
+	if _, err := tx.Exec(baseline.SQL); err != nil {
+		return err
+	}
+	for _, c := range legacyColumns {
+		exists, err := columnExists(tx, c.table, c.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition)); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)", baseline.Version, baseline.Name, time.Now()); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("Adopted existing database at schema version %d\n", baseline.Version)
+	return nil
+}
+
+func columnExists(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
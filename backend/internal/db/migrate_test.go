@@ -0,0 +1,256 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// postgresDSNEnv names a scratch PostgreSQL database, as a postgres:// URL,
+// that the store tests also run against. Each test gets a schema of its own
+// there, dropped when it ends.
+const postgresDSNEnv = "WIFIMINT_TEST_POSTGRES"
+
+// newTestStore opens an empty SQLite database in a temporary directory.
+func newTestStore(t *testing.T) *DBStore {
+	t.Helper()
+	s, err := InitDB(filepath.Join(t.TempDir(), "test.db") + "?_parse_time=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.DB.Close() })
+	return s
+}
+
+// newPostgresStore opens an empty schema in the WIFIMINT_TEST_POSTGRES
+// database, and skips the test when that is not set.
+func newPostgresStore(t *testing.T) *DBStore {
+	t.Helper()
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skip(postgresDSNEnv + " is not set")
+	}
+	if DialectOf(dsn) != Postgres {
+		t.Fatalf("%s must be a postgres:// URL", postgresDSNEnv)
+	}
+	admin, err := InitDB(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.DB.Close() })
+
+	schema := fmt.Sprintf("wifimint_test_%d", time.Now().UnixNano())
+	if _, err := admin.DB.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.DB.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	// lib/pq passes parameters it does not know on to the server
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	s, err := InitDB(dsn + sep + "search_path=" + schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.DB.Close() })
+	return s
+}
+
+// eachDialect runs test on an empty SQLite database and, when
+// WIFIMINT_TEST_POSTGRES is set, an empty PostgreSQL schema.
+func eachDialect(t *testing.T, test func(t *testing.T, s *DBStore)) {
+	t.Run("sqlite", func(t *testing.T) { test(t, newTestStore(t)) })
+	t.Run("postgres", func(t *testing.T) { test(t, newPostgresStore(t)) })
+}
+
+func TestMigrationsMatchAcrossDialects(t *testing.T) {
+	sqlite, err := Migrations(SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postgres, err := Migrations(Postgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sqlite) != len(postgres) {
+		t.Fatalf("%d sqlite migrations, %d postgres", len(sqlite), len(postgres))
+	}
+	for i := range sqlite {
+		if sqlite[i].Name != postgres[i].Name {
+			t.Errorf("migration %04d: sqlite %q, postgres %q", i+1, sqlite[i].Name, postgres[i].Name)
+		}
+	}
+}
+
+var (
+	createTablePattern = regexp.MustCompile(`(?s)CREATE TABLE IF NOT EXISTS (\w+) \((.*?)\n\);`)
+	addColumnPattern   = regexp.MustCompile(`ALTER TABLE (\w+) ADD COLUMN (\w+)`)
+	createIndexPattern = regexp.MustCompile(`CREATE (?:UNIQUE )?INDEX IF NOT EXISTS (\w+)\s+ON (\w+)`)
+)
+
+// schemaOf lists the tables, columns and indexes a migration creates, as
+// "table.column" and "index name on table".
+func schemaOf(sql string) []string {
+	var schema []string
+	for _, m := range createTablePattern.FindAllStringSubmatch(sql, -1) {
+		for _, line := range strings.Split(m[2], "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "--") {
+				continue
+			}
+			switch strings.ToUpper(strings.SplitN(fields[0], "(", 2)[0]) {
+			case "FOREIGN", "PRIMARY", "UNIQUE", "CHECK", "CONSTRAINT":
+				continue
+			}
+			schema = append(schema, m[1]+"."+fields[0])
+		}
+	}
+	for _, m := range addColumnPattern.FindAllStringSubmatch(sql, -1) {
+		schema = append(schema, m[1]+"."+m[2])
+	}
+	for _, m := range createIndexPattern.FindAllStringSubmatch(sql, -1) {
+		schema = append(schema, m[1]+" on "+m[2])
+	}
+	sort.Strings(schema)
+	return schema
+}
+
+func TestMigrationsDefineSameSchema(t *testing.T) {
+	sqlite, err := Migrations(SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postgres, err := Migrations(Postgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range sqlite {
+		want, got := schemaOf(sqlite[i].SQL), schemaOf(postgres[i].SQL)
+		if len(want) == 0 {
+			t.Errorf("migration %04d: found nothing in the sqlite file", i+1)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("migration %04d_%s:\npostgres %v\n  sqlite %v", i+1, sqlite[i].Name, got, want)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	eachDialect(t, func(t *testing.T, s *DBStore) {
+		migrations, err := Migrations(s.Dialect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		applied, err := s.Migrate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(applied) != len(migrations) {
+			t.Errorf("applied %d migrations to a new database, want %d", len(applied), len(migrations))
+		}
+		if version, _ := s.SchemaVersion(); version != len(migrations) {
+			t.Errorf("schema version %d, want %d", version, len(migrations))
+		}
+		if applied, err := s.Migrate(); err != nil || len(applied) != 0 {
+			t.Errorf("second Migrate applied %d: %v", len(applied), err)
+		}
+	})
+}
+
+func TestConcurrentMigrateAppliesOnce(t *testing.T) {
+	s := newPostgresStore(t)
+	migrations, err := Migrations(Postgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	total := 0
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			applied, err := s.Migrate()
+			if err != nil {
+				t.Errorf("Migrate: %v", err)
+			}
+			mu.Lock()
+			total += len(applied)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if total != len(migrations) {
+		t.Errorf("%d migrations applied in all, want %d", total, len(migrations))
+	}
+}
+
+func TestMigrateEnforcesUniqueTransactionIDs(t *testing.T) {
+	eachDialect(t, testUniqueTransactionIDs)
+}
+
+func testUniqueTransactionIDs(t *testing.T, s *DBStore) {
+	if _, err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	insert := "INSERT INTO subscriptions (mac_address, status, payment_method, transaction_id) VALUES (?, ?, ?, ?)"
+	if _, err := s.DB.Exec(insert, "aa:bb:cc:dd:ee:01", "pending", "upi", "UTR1"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.DB.Exec(insert, "aa:bb:cc:dd:ee:02", "active", "upi", "UTR1")
+	if !IsUniqueViolation(err) {
+		t.Errorf("second use of a transaction ID: %v, want a unique violation", err)
+	}
+	for _, row := range [][]any{
+		{"aa:bb:cc:dd:ee:03", "rejected", "upi", "UTR1"},
+		{"aa:bb:cc:dd:ee:04", "expired", "upi", "UTR1"},
+		{"aa:bb:cc:dd:ee:05", "active", "voucher", "CODE1"},
+		{"aa:bb:cc:dd:ee:06", "active", "voucher", "CODE1"},
+	} {
+		if _, err := s.DB.Exec(insert, row...); err != nil {
+			t.Errorf("insert %v: %v", row, err)
+		}
+	}
+}
+
+func TestMigrateUpgradesHistoricDuplicateTransactionIDs(t *testing.T) {
+	eachDialect(t, func(t *testing.T, s *DBStore) {
+		migrations, err := Migrations(s.Dialect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A database at the baseline whose expired Paytm requests all
+		// carry the same reference
+		if err := s.ensureMigrationsTable(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.apply(migrations[baselineVersion-1]); err != nil {
+			t.Fatal(err)
+		}
+		for _, mac := range []string{"aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02", "aa:bb:cc:dd:ee:03"} {
+			if _, err := s.DB.Exec("INSERT INTO subscriptions (mac_address, status, payment_method, transaction_id) VALUES (?, 'expired', 'paytm', '0000')", mac); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := s.Migrate(); err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+		if version, _ := s.SchemaVersion(); version != len(migrations) {
+			t.Errorf("schema version %d, want %d", version, len(migrations))
+		}
+		if inUse, _ := s.Subscriptions().TransactionIDInUse("0000", 0); !inUse {
+			t.Error("historic transaction ID not in use")
+		}
+	})
+}
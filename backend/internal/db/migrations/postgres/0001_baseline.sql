@@ -0,0 +1,192 @@
+-- PostgreSQL twin of sqlite/0001_baseline.sql. Foreign keys are left out
+-- because SQLite does not enforce them here and the code relies on that,
+-- e.g. deleting a plan keeps its subscriptions. Flags stay INTEGER 0/1.
+
+CREATE TABLE IF NOT EXISTS users (
+	id SERIAL PRIMARY KEY,
+	username TEXT UNIQUE NOT NULL,
+	password_hash TEXT NOT NULL,
+	role TEXT DEFAULT 'user', -- 'admin' or 'user'
+	status TEXT DEFAULT 'active',
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	must_change_password INTEGER DEFAULT 0,
+	totp_secret TEXT,
+	totp_enabled INTEGER DEFAULT 0,
+	totp_last_step BIGINT DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS devices (
+	mac_address TEXT PRIMARY KEY,
+	user_id INTEGER,
+	device_name TEXT,
+	ip_address TEXT,
+	status TEXT DEFAULT 'blocked', -- 'blocked', 'allowed'
+	last_seen TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	randomized INTEGER DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS plans (
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	duration_minutes INTEGER NOT NULL,
+	price DOUBLE PRECISION NOT NULL,
+	data_limit_mb INTEGER DEFAULT 0,
+	download_kbps INTEGER DEFAULT 0,
+	upload_kbps INTEGER DEFAULT 0,
+	max_devices INTEGER DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+	id SERIAL PRIMARY KEY,
+	mac_address TEXT NOT NULL,
+	plan_id INTEGER,
+	start_time TIMESTAMPTZ,
+	end_time TIMESTAMPTZ,
+	status TEXT DEFAULT 'pending', -- 'pending', 'active', 'expired', 'rejected'
+	payment_method TEXT,
+	amount_paid DOUBLE PRECISION,
+	transaction_id TEXT,
+	bytes_used BIGINT DEFAULT 0,
+	customer_id INTEGER,
+	parent_subscription_id INTEGER
+);
+
+CREATE TABLE IF NOT EXISTS walled_garden (
+	id SERIAL PRIMARY KEY,
+	kind TEXT NOT NULL, -- 'domain' or 'cidr'
+	value TEXT UNIQUE NOT NULL,
+	description TEXT DEFAULT '',
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS dhcp_leases (
+	mac_address TEXT PRIMARY KEY,
+	ip_address TEXT UNIQUE NOT NULL,
+	hostname TEXT DEFAULT '',
+	expires_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS vouchers (
+	id SERIAL PRIMARY KEY,
+	code TEXT UNIQUE NOT NULL,
+	plan_id INTEGER NOT NULL,
+	batch TEXT DEFAULT '',
+	max_devices INTEGER DEFAULT 1,
+	uses INTEGER DEFAULT 0,
+	status TEXT DEFAULT 'active', -- 'active', 'used', 'revoked'
+	expires_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS voucher_redemptions (
+	id SERIAL PRIMARY KEY,
+	voucher_id INTEGER NOT NULL,
+	mac_address TEXT NOT NULL,
+	subscription_id INTEGER,
+	redeemed_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(voucher_id, mac_address)
+);
+
+CREATE TABLE IF NOT EXISTS payment_orders (
+	id SERIAL PRIMARY KEY,
+	provider TEXT NOT NULL,
+	order_id TEXT UNIQUE NOT NULL,
+	mac_address TEXT NOT NULL,
+	plan_id INTEGER NOT NULL,
+	amount INTEGER NOT NULL, -- smallest currency unit
+	currency TEXT NOT NULL,
+	status TEXT DEFAULT 'created', -- 'created', 'paid', 'failed'
+	payment_id TEXT,
+	subscription_id INTEGER,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	paid_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS customers (
+	id SERIAL PRIMARY KEY,
+	mobile TEXT UNIQUE NOT NULL,
+	name TEXT DEFAULT '',
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	last_login TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS otp_codes (
+	mobile TEXT PRIMARY KEY,
+	code_hash TEXT NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL,
+	attempts INTEGER DEFAULT 0,
+	sent_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS device_sessions (
+	token_hash TEXT PRIMARY KEY, -- sha256 of the portal session token
+	subscription_id INTEGER NOT NULL,
+	mac_address TEXT NOT NULL,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	last_seen TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+	id SERIAL PRIMARY KEY,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	actor TEXT NOT NULL, -- staff username, 'system', 'customer:<id>' or 'anonymous'
+	action TEXT NOT NULL,
+	target_mac TEXT,
+	subscription_id INTEGER,
+	before_state TEXT, -- JSON
+	after_state TEXT, -- JSON
+	source_ip TEXT,
+	status_code INTEGER,
+	details TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_target_mac ON audit_log(target_mac);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_subscription ON audit_log(subscription_id);
+
+CREATE TABLE IF NOT EXISTS settings (
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL,
+	updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	id SERIAL PRIMARY KEY,
+	token_hash TEXT UNIQUE NOT NULL, -- sha256 of the token
+	family_id TEXT NOT NULL, -- one per sign-in; rotation keeps it
+	username TEXT NOT NULL,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMPTZ NOT NULL,
+	revoked_at TIMESTAMPTZ,
+	user_agent TEXT,
+	ip_address TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family ON refresh_tokens(family_id);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_username ON refresh_tokens(username);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+	id SERIAL PRIMARY KEY,
+	username TEXT NOT NULL,
+	code_hash TEXT NOT NULL, -- sha256 of the normalized code
+	used_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_username ON recovery_codes(username);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	prefix TEXT NOT NULL, -- first characters of the key, to recognise it
+	key_hash TEXT UNIQUE NOT NULL, -- sha256 of the key
+	scopes TEXT NOT NULL, -- comma separated permissions
+	created_by TEXT,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMPTZ,
+	last_used_at TIMESTAMPTZ,
+	last_used_ip TEXT,
+	revoked_at TIMESTAMPTZ
+);
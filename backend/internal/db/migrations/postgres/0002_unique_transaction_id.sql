@@ -0,0 +1,10 @@
+-- A UPI transaction ID pays for one live request. Vouchers reuse their
+-- code as the reference on every device, and rejected requests may be
+-- resent. Only pending and active requests are covered, so databases that
+-- took a reference twice in the past (expired Paytm rows all read "0000")
+-- still upgrade; TransactionIDInUse keeps refusing historic IDs.
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_subscriptions_transaction_id
+	ON subscriptions(transaction_id)
+	WHERE transaction_id IS NOT NULL AND transaction_id != ''
+		AND status IN ('pending', 'active') AND COALESCE(payment_method, '') != 'voucher';
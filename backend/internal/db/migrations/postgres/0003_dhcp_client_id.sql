@@ -0,0 +1,4 @@
+-- The client identifier (DHCP option 61, hex) a lease was given to, so
+-- another client claiming the same MAC cannot take it over.
+
+ALTER TABLE dhcp_leases ADD COLUMN client_id TEXT DEFAULT '';
@@ -0,0 +1,12 @@
+-- One row per customer sign-in. Customer tokens carry the ID as "sid" and
+-- are refused once the row is revoked or gone.
+
+CREATE TABLE IF NOT EXISTS customer_sessions (
+	id TEXT PRIMARY KEY,
+	customer_id INTEGER NOT NULL,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMPTZ NOT NULL,
+	revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_customer_sessions_customer ON customer_sessions(customer_id);
@@ -0,0 +1,198 @@
+-- Schema as of the switch to versioned migrations. Databases created
+-- before that are adopted at this version (see adoptLegacySchema).
+
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT UNIQUE NOT NULL,
+	password_hash TEXT NOT NULL,
+	role TEXT DEFAULT 'user', -- 'admin' or 'user'
+	status TEXT DEFAULT 'active',
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	must_change_password INTEGER DEFAULT 0,
+	totp_secret TEXT,
+	totp_enabled INTEGER DEFAULT 0,
+	totp_last_step INTEGER DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS devices (
+	mac_address TEXT PRIMARY KEY,
+	user_id INTEGER,
+	device_name TEXT,
+	ip_address TEXT,
+	status TEXT DEFAULT 'blocked', -- 'blocked', 'allowed'
+	last_seen DATETIME DEFAULT CURRENT_TIMESTAMP,
+	randomized INTEGER DEFAULT 0,
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS plans (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	duration_minutes INTEGER NOT NULL,
+	price REAL NOT NULL,
+	data_limit_mb INTEGER DEFAULT 0,
+	download_kbps INTEGER DEFAULT 0,
+	upload_kbps INTEGER DEFAULT 0,
+	max_devices INTEGER DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	mac_address TEXT NOT NULL,
+	plan_id INTEGER,
+	start_time DATETIME,
+	end_time DATETIME,
+	status TEXT DEFAULT 'pending', -- 'pending', 'active', 'expired', 'rejected'
+	payment_method TEXT,
+	amount_paid REAL,
+	transaction_id TEXT,
+	bytes_used INTEGER DEFAULT 0,
+	customer_id INTEGER REFERENCES customers(id),
+	parent_subscription_id INTEGER REFERENCES subscriptions(id),
+	FOREIGN KEY(mac_address) REFERENCES devices(mac_address),
+	FOREIGN KEY(plan_id) REFERENCES plans(id)
+);
+
+CREATE TABLE IF NOT EXISTS walled_garden (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	kind TEXT NOT NULL, -- 'domain' or 'cidr'
+	value TEXT UNIQUE NOT NULL,
+	description TEXT DEFAULT '',
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS dhcp_leases (
+	mac_address TEXT PRIMARY KEY,
+	ip_address TEXT UNIQUE NOT NULL,
+	hostname TEXT DEFAULT '',
+	expires_at DATETIME NOT NULL,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS vouchers (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	code TEXT UNIQUE NOT NULL,
+	plan_id INTEGER NOT NULL,
+	batch TEXT DEFAULT '',
+	max_devices INTEGER DEFAULT 1,
+	uses INTEGER DEFAULT 0,
+	status TEXT DEFAULT 'active', -- 'active', 'used', 'revoked'
+	expires_at DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY(plan_id) REFERENCES plans(id)
+);
+
+CREATE TABLE IF NOT EXISTS voucher_redemptions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	voucher_id INTEGER NOT NULL,
+	mac_address TEXT NOT NULL,
+	subscription_id INTEGER,
+	redeemed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(voucher_id, mac_address),
+	FOREIGN KEY(voucher_id) REFERENCES vouchers(id)
+);
+
+CREATE TABLE IF NOT EXISTS payment_orders (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	provider TEXT NOT NULL,
+	order_id TEXT UNIQUE NOT NULL,
+	mac_address TEXT NOT NULL,
+	plan_id INTEGER NOT NULL,
+	amount INTEGER NOT NULL, -- smallest currency unit
+	currency TEXT NOT NULL,
+	status TEXT DEFAULT 'created', -- 'created', 'paid', 'failed'
+	payment_id TEXT,
+	subscription_id INTEGER,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	paid_at DATETIME,
+	FOREIGN KEY(plan_id) REFERENCES plans(id)
+);
+
+CREATE TABLE IF NOT EXISTS customers (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	mobile TEXT UNIQUE NOT NULL,
+	name TEXT DEFAULT '',
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	last_login DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS otp_codes (
+	mobile TEXT PRIMARY KEY,
+	code_hash TEXT NOT NULL,
+	expires_at DATETIME NOT NULL,
+	attempts INTEGER DEFAULT 0,
+	sent_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS device_sessions (
+	token_hash TEXT PRIMARY KEY, -- sha256 of the portal session token
+	subscription_id INTEGER NOT NULL,
+	mac_address TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	last_seen DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY(subscription_id) REFERENCES subscriptions(id)
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	actor TEXT NOT NULL, -- staff username, 'system', 'customer:<id>' or 'anonymous'
+	action TEXT NOT NULL,
+	target_mac TEXT,
+	subscription_id INTEGER,
+	before_state TEXT, -- JSON
+	after_state TEXT, -- JSON
+	source_ip TEXT,
+	status_code INTEGER,
+	details TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_target_mac ON audit_log(target_mac);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_subscription ON audit_log(subscription_id);
+
+CREATE TABLE IF NOT EXISTS settings (
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	token_hash TEXT UNIQUE NOT NULL, -- sha256 of the token
+	family_id TEXT NOT NULL, -- one per sign-in; rotation keeps it
+	username TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	expires_at DATETIME NOT NULL,
+	revoked_at DATETIME,
+	user_agent TEXT,
+	ip_address TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family ON refresh_tokens(family_id);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_username ON refresh_tokens(username);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL,
+	code_hash TEXT NOT NULL, -- sha256 of the normalized code
+	used_at DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_username ON recovery_codes(username);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	prefix TEXT NOT NULL, -- first characters of the key, to recognise it
+	key_hash TEXT UNIQUE NOT NULL, -- sha256 of the key
+	scopes TEXT NOT NULL, -- comma separated permissions
+	created_by TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	expires_at DATETIME,
+	last_used_at DATETIME,
+	last_used_ip TEXT,
+	revoked_at DATETIME
+);
@@ -0,0 +1,53 @@
+package db
+
+import "database/sql"
+
+// SQLPlans is the Plans repository on the plans table.
+type SQLPlans struct {
+	DB *sql.DB
+}
+
+const planColumns = `id, name, duration_minutes, price, COALESCE(data_limit_mb, 0),
+	COALESCE(download_kbps, 0), COALESCE(upload_kbps, 0), COALESCE(max_devices, 1)`
+
+func scanPlan(row interface{ Scan(...interface{}) error }) (Plan, error) {
+	var p Plan
+	err := row.Scan(&p.ID, &p.Name, &p.DurationMinutes, &p.Price, &p.DataLimitMB, &p.DownloadKbps, &p.UploadKbps, &p.MaxDevices)
+	return p, err
+}
+
+func (r *SQLPlans) List() ([]Plan, error) {
+	rows, err := r.DB.Query("SELECT " + planColumns + " FROM plans")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plans []Plan
+	for rows.Next() {
+		p, err := scanPlan(rows)
+		if err != nil {
+			continue
+		}
+		plans = append(plans, p)
+	}
+	return plans, rows.Err()
+}
+
+func (r *SQLPlans) Get(id int) (Plan, error) {
+	p, err := scanPlan(r.DB.QueryRow("SELECT "+planColumns+" FROM plans WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return p, ErrNotFound
+	}
+	return p, err
+}
+
+func (r *SQLPlans) Create(p *Plan) error {
+	return r.DB.QueryRow("INSERT INTO plans (name, duration_minutes, price, data_limit_mb, download_kbps, upload_kbps, max_devices) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id",
+		p.Name, p.DurationMinutes, p.Price, p.DataLimitMB, p.DownloadKbps, p.UploadKbps, p.MaxDevices).Scan(&p.ID)
+}
+
+func (r *SQLPlans) Delete(id int) error {
+	_, err := r.DB.Exec("DELETE FROM plans WHERE id = ?", id)
+	return err
+}
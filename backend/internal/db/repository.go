@@ -0,0 +1,222 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+// Handlers reach devices, plans, subscriptions, portal sessions and staff
+// accounts through these interfaces. The SQL implementations are what the server runs; the
+// Memory ones (memory.go) stand in for them when testing handlers.
+
+// ErrNotFound is returned when a looked-up row does not exist.
+var ErrNotFound = errors.New("not found")
+
+// Device is a client seen on the hotspot.
+type Device struct {
+	MAC        string    `json:"mac"`
+	Name       string    `json:"name"`
+	IP         string    `json:"ip"`
+	Status     string    `json:"status"` // 'blocked' or 'allowed'
+	LastSeen   time.Time `json:"last_seen"`
+	Randomized bool      `json:"randomized"`
+}
+
+// Plan is something a client can buy.
+type Plan struct {
+	ID              int     `json:"id"`
+	Name            string  `json:"name"`
+	DurationMinutes int     `json:"duration_minutes"`
+	Price           float64 `json:"price"`
+	DataLimitMB     int     `json:"data_limit_mb"`
+	DownloadKbps    int     `json:"download_kbps"`
+	UploadKbps      int     `json:"upload_kbps"`
+	MaxDevices      int     `json:"max_devices"`
+}
+
+// Subscription is a device's plan, with the plan details listings show.
+type Subscription struct {
+	ID            int       `json:"id"`
+	MacAddress    string    `json:"mac_address"`
+	PlanID        int       `json:"plan_id"`
+	PlanName      string    `json:"plan_name"`
+	StartTime     time.Time `json:"start_time"`
+	EndTime       time.Time `json:"end_time"`
+	Status        string    `json:"status"` // 'pending', 'active', 'expired' or 'rejected'
+	Price         float64   `json:"price"`
+	PaymentMethod string    `json:"payment_method"`
+	AmountPaid    float64   `json:"amount_paid"`
+	TransactionID string    `json:"transaction_id"`
+	Mobile        string    `json:"mobile"`
+	BytesUsed     int64     `json:"bytes_used"`
+	DataLimitMB   int       `json:"data_limit_mb"`
+}
+
+// NewSubscription is a subscription to insert. Zero values are stored as
+// NULL, so a nil AmountPaid counts as the plan price in revenue.
+type NewSubscription struct {
+	MacAddress    string
+	PlanID        int
+	StartTime     time.Time
+	EndTime       time.Time
+	Status        string
+	PaymentMethod string
+	AmountPaid    *float64
+	TransactionID string
+	CustomerID    int
+	ParentID      int
+}
+
+// PendingRequest is a plan request waiting for an admin.
+type PendingRequest struct {
+	ID            int     `json:"id"`
+	MacAddress    string  `json:"mac_address"`
+	Mobile        string  `json:"mobile"`
+	PlanName      string  `json:"plan_name"`
+	Price         float64 `json:"price"`
+	Duration      int     `json:"duration"`
+	PaymentMethod string  `json:"payment_method"`
+	AmountPaid    float64 `json:"amount_paid"`
+	TransactionID string  `json:"transaction_id"`
+}
+
+// Expiry is an active subscription past its end time or data limit.
+type Expiry struct {
+	SubscriptionID int
+	MacAddress     string
+	Reason         string // 'time' or 'data'
+}
+
+// Stats are the dashboard totals.
+type Stats struct {
+	TotalRevenue    float64 `json:"total_revenue"`
+	ActiveUsers     int     `json:"active_users"`
+	TotalPlans      int     `json:"total_plans"`
+	BlockedDevices  int     `json:"blocked_devices"`
+	TotalDevices    int     `json:"total_devices"`
+	PendingRequests int     `json:"pending_requests"`
+}
+
+// RevenueDay is one day of the revenue chart.
+type RevenueDay struct {
+	Date  string  `json:"date"`
+	Total float64 `json:"total"`
+}
+
+// User is a staff account.
+type User struct {
+	ID                 int       `json:"id"`
+	Username           string    `json:"username"`
+	PasswordHash       string    `json:"-"`
+	Role               string    `json:"role"`
+	Status             string    `json:"status"`
+	MustChangePassword bool      `json:"must_change_password"`
+	TwoFactor          bool      `json:"two_factor"`
+	CreatedAt          time.Time `json:"created_at"`
+}
+
+// Devices stores the clients seen on the hotspot.
+type Devices interface {
+	List() ([]Device, error)
+	Get(mac string) (Device, error)
+	// Seen records a scanned device, storing it as blocked if it is new,
+	// and reports whether it was.
+	Seen(mac, ip, name string, randomized bool) (bool, error)
+	SetStatus(mac, status string) error
+	SetName(mac, name string) error
+	// Ensure stores mac as blocked if it is new and marks it seen.
+	Ensure(mac string, randomized bool) error
+	// PruneRandomized forgets blocked randomized MACs without any
+	// subscription that were last seen before unseenSince.
+	PruneRandomized(unseenSince time.Time) (int64, error)
+}
+
+// Plans stores the plans on sale.
+type Plans interface {
+	List() ([]Plan, error)
+	Get(id int) (Plan, error)
+	// Create stores p and sets its ID.
+	Create(p *Plan) error
+	Delete(id int) error
+}
+
+// Subscriptions stores plan requests and subscriptions.
+type Subscriptions interface {
+	Get(id int) (Subscription, error)
+	// Active lists subscriptions that are active and not yet past their end.
+	Active() ([]Subscription, error)
+	All() ([]Subscription, error)
+	Pending() ([]PendingRequest, error)
+	// Current is the subscription the portal shows for mac: the active
+	// one, else the latest pending or rejected request.
+	Current(mac string) (Subscription, error)
+	// HasActive reports whether mac has an active subscription that has not
+	// reached its end time yet.
+	HasActive(mac string) (bool, error)
+	// ActiveForCustomer is mac's active, unexpired subscription owned by
+	// customerID that ends last.
+	ActiveForCustomer(mac string, customerID int) (Subscription, error)
+	// TransactionIDInUse reports whether a subscription other than
+	// excludeID, neither rejected nor paid by voucher, claimed the
+	// upper-cased txID.
+	TransactionIDInUse(txID string, excludeID int) (bool, error)
+	Create(s NewSubscription) (int64, error)
+	// Activate makes a subscription active between start and end.
+	Activate(id int, start, end time.Time) error
+	SetStatus(id int, status string) error
+	// Move re-keys a subscription, and its portal sessions, to mac.
+	Move(id int, mac string) error
+	// ExpireShared expires the active extra devices sharing parentID and
+	// returns their MACs.
+	ExpireShared(parentID int) ([]string, error)
+	// AddUsage adds bytes to mac's active subscription.
+	AddUsage(mac string, bytes uint64) error
+	DueForExpiry(now time.Time) ([]Expiry, error)
+	Stats() (Stats, error)
+	// RevenueByDay is the plan price total per start day over the last week.
+	RevenueByDay() ([]RevenueDay, error)
+	// Flush deletes all subscriptions and devices, keeping plans and staff.
+	// It returns how many of each there were.
+	Flush() (subscriptions, devices int, err error)
+}
+
+// Sessions stores the portal's device session tokens by their hash, so a
+// plan can follow a device that comes back under another MAC.
+type Sessions interface {
+	// Refresh moves the token to mac if it belongs to subscriptionID and
+	// reports whether it does.
+	Refresh(tokenHash string, subscriptionID int, mac string) (bool, error)
+	// Create stores a token for subscriptionID, dropping all but its
+	// newest keep tokens.
+	Create(tokenHash string, subscriptionID int, mac string, keep int) error
+	// Subscription is the active, unexpired subscription behind a token,
+	// with its ID, MAC and plan.
+	Subscription(tokenHash string) (Subscription, error)
+}
+
+// Users stores staff accounts.
+type Users interface {
+	List() ([]User, error)
+	Get(username string) (User, error)
+	// EnsureExists creates the account if there is none by that name, with
+	// a password that must be changed at first sign-in, and reports
+	// whether it did.
+	EnsureExists(username, passwordHash, role string) (bool, error)
+}
+
+// Devices returns the store's device repository.
+func (s *DBStore) Devices() Devices { return &SQLDevices{DB: s.DB} }
+
+// Plans returns the store's plan repository.
+func (s *DBStore) Plans() Plans { return &SQLPlans{DB: s.DB} }
+
+// Subscriptions returns the store's subscription repository.
+func (s *DBStore) Subscriptions() Subscriptions {
+	return &SQLSubscriptions{DB: s.DB, Dialect: s.Dialect}
+}
+
+// Sessions returns the store's portal session repository.
+func (s *DBStore) Sessions() Sessions { return &SQLSessions{DB: s.DB} }
+
+// Users returns the store's staff account repository.
+func (s *DBStore) Users() Users { return &SQLUsers{DB: s.DB} }
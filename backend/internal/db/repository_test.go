@@ -0,0 +1,323 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+// repositories is what DBStore and Memory both hand out.
+type repositories interface {
+	Devices() Devices
+	Plans() Plans
+	Subscriptions() Subscriptions
+	Sessions() Sessions
+	Users() Users
+}
+
+// eachRepository runs test on migrated databases of each dialect (see
+// eachDialect) and on the in-memory fakes, which must behave the same.
+func eachRepository(t *testing.T, test func(t *testing.T, r repositories)) {
+	eachDialect(t, func(t *testing.T, s *DBStore) {
+		if _, err := s.Migrate(); err != nil {
+			t.Fatal(err)
+		}
+		test(t, s)
+	})
+	t.Run("memory", func(t *testing.T) { test(t, NewMemory()) })
+}
+
+const (
+	testMAC      = "aa:bb:cc:dd:ee:01"
+	testOtherMAC = "aa:bb:cc:dd:ee:02"
+	testNewMAC   = "aa:bb:cc:dd:ee:03"
+)
+
+// createTestPlan stores a day plan for ₹20 with a 10 MB data limit.
+func createTestPlan(t *testing.T, r repositories) Plan {
+	t.Helper()
+	p := Plan{Name: "Day", DurationMinutes: 1440, Price: 20, DataLimitMB: 10, MaxDevices: 2}
+	if err := r.Plans().Create(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.ID == 0 {
+		t.Fatal("Create did not set the plan ID")
+	}
+	return p
+}
+
+func TestDeviceRepository(t *testing.T) {
+	eachRepository(t, func(t *testing.T, r repositories) {
+		devices := r.Devices()
+		if isNew, err := devices.Seen(testMAC, "192.168.1.50", "", true); err != nil || !isNew {
+			t.Fatalf("first Seen = %v, %v; want new", isNew, err)
+		}
+		if isNew, err := devices.Seen(testMAC, "192.168.1.51", "", true); err != nil || isNew {
+			t.Fatalf("second Seen = %v, %v; want known", isNew, err)
+		}
+		devices.SetStatus(testMAC, "allowed")
+		devices.SetName(testMAC, "9876543210")
+		d, err := devices.Get(testMAC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.IP != "192.168.1.51" || d.Status != "allowed" || d.Name != "9876543210" || !d.Randomized {
+			t.Errorf("Get = %+v", d)
+		}
+
+		// Ensure adds a blocked device and leaves a known one as it is
+		if err := devices.Ensure(testOtherMAC, true); err != nil {
+			t.Fatal(err)
+		}
+		devices.Ensure(testMAC, true)
+		if d, _ := devices.Get(testOtherMAC); d.Status != "blocked" || !d.Randomized {
+			t.Errorf("ensured device = %+v", d)
+		}
+		if d, _ := devices.Get(testMAC); d.Status != "allowed" {
+			t.Errorf("Ensure changed a known device: %+v", d)
+		}
+		if _, err := devices.Get(testNewMAC); err != ErrNotFound {
+			t.Errorf("Get of an unknown MAC: %v, want ErrNotFound", err)
+		}
+		if list, _ := devices.List(); len(list) != 2 {
+			t.Errorf("List returned %d devices, want 2", len(list))
+		}
+
+		// Blocked randomized MACs go, unless a subscription names them
+		devices.SetStatus(testMAC, "blocked")
+		r.Subscriptions().Create(NewSubscription{MacAddress: testOtherMAC, PlanID: createTestPlan(t, r).ID, Status: "expired"})
+		pruned, err := devices.PruneRandomized(time.Now().Add(time.Hour))
+		if err != nil || pruned != 1 {
+			t.Errorf("PruneRandomized = %d, %v; want 1", pruned, err)
+		}
+		if _, err := devices.Get(testOtherMAC); err != nil {
+			t.Errorf("device with a subscription was pruned: %v", err)
+		}
+	})
+}
+
+func TestPlanRepository(t *testing.T) {
+	eachRepository(t, func(t *testing.T, r repositories) {
+		p := createTestPlan(t, r)
+		got, err := r.Plans().Get(p.ID)
+		if err != nil || got != p {
+			t.Errorf("Get = %+v, %v; want %+v", got, err, p)
+		}
+		if err := r.Plans().Delete(p.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Plans().Get(p.ID); err != ErrNotFound {
+			t.Errorf("Get of a deleted plan: %v, want ErrNotFound", err)
+		}
+		if list, _ := r.Plans().List(); len(list) != 0 {
+			t.Errorf("List = %+v after Delete", list)
+		}
+	})
+}
+
+func TestSubscriptionRepository(t *testing.T) {
+	eachRepository(t, func(t *testing.T, r repositories) {
+		subs := r.Subscriptions()
+		plan := createTestPlan(t, r)
+		paid := 20.0
+		id, err := subs.Create(NewSubscription{
+			MacAddress: testMAC, PlanID: plan.ID, Status: "pending",
+			PaymentMethod: "upi", AmountPaid: &paid, TransactionID: "UTR412356789012",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parent := int(id)
+
+		if inUse, _ := subs.TransactionIDInUse("UTR412356789012", 0); !inUse {
+			t.Error("transaction ID of a pending request not in use")
+		}
+		if inUse, _ := subs.TransactionIDInUse("UTR412356789012", parent); inUse {
+			t.Error("a request's own transaction ID counted against it")
+		}
+		// Pending requests are listed before the device was ever scanned
+		pending, err := subs.Pending()
+		if err != nil || len(pending) != 1 {
+			t.Fatalf("Pending = %+v, %v", pending, err)
+		}
+		if p := pending[0]; p.ID != parent || p.Price != 20 || p.AmountPaid != 20 || p.TransactionID != "UTR412356789012" {
+			t.Errorf("pending request = %+v", p)
+		}
+		if cur, _ := subs.Current(testMAC); cur.ID != parent || cur.Status != "pending" {
+			t.Errorf("Current = %+v, want the pending request", cur)
+		}
+
+		start := time.Now()
+		if err := subs.Activate(parent, start, start.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if active, _ := subs.HasActive(testMAC); !active {
+			t.Error("HasActive false after Activate")
+		}
+		sub, err := subs.Get(parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sub.Status != "active" || sub.PlanName != "Day" || sub.EndTime.Sub(start).Round(time.Second) != time.Hour {
+			t.Errorf("Get = %+v", sub)
+		}
+		if active, _ := subs.Active(); len(active) != 1 {
+			t.Errorf("Active = %+v", active)
+		}
+
+		extra, err := subs.Create(NewSubscription{
+			MacAddress: testOtherMAC, PlanID: plan.ID, Status: "active",
+			StartTime: start, EndTime: start.Add(time.Hour), ParentID: parent,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The extra device shares the parent's 10 MB
+		subs.AddUsage(testMAC, 6<<20)
+		subs.AddUsage(testOtherMAC, 5<<20)
+		due, err := subs.DueForExpiry(time.Now())
+		if err != nil || len(due) != 2 || due[0].Reason != "data" {
+			t.Errorf("DueForExpiry = %+v, %v; want both for data", due, err)
+		}
+
+		if err := subs.Move(parent, testNewMAC); err != nil {
+			t.Fatal(err)
+		}
+		if active, _ := subs.HasActive(testMAC); active {
+			t.Error("old MAC still active after Move")
+		}
+		if sub, _ := subs.Get(parent); sub.MacAddress != testNewMAC || sub.BytesUsed != 6<<20 {
+			t.Errorf("moved subscription = %+v", sub)
+		}
+
+		macs, err := subs.ExpireShared(parent)
+		if err != nil || len(macs) != 1 || macs[0] != testOtherMAC {
+			t.Errorf("ExpireShared = %v, %v", macs, err)
+		}
+		if sub, _ := subs.Get(int(extra)); sub.Status != "expired" {
+			t.Errorf("shared subscription is %s", sub.Status)
+		}
+
+		// A rejected request frees its transaction ID
+		subs.SetStatus(parent, "rejected")
+		if inUse, _ := subs.TransactionIDInUse("UTR412356789012", 0); inUse {
+			t.Error("transaction ID of a rejected request still in use")
+		}
+
+		stats, err := subs.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.TotalRevenue != 20 || stats.ActiveUsers != 0 || stats.TotalPlans != 1 || stats.PendingRequests != 0 {
+			t.Errorf("Stats = %+v", stats)
+		}
+
+		n, _, err := subs.Flush()
+		if err != nil || n != 2 {
+			t.Errorf("Flush = %d, %v; want 2 subscriptions", n, err)
+		}
+		if _, err := subs.Get(parent); err != ErrNotFound {
+			t.Errorf("Get after Flush: %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestActiveForCustomer(t *testing.T) {
+	eachRepository(t, func(t *testing.T, r repositories) {
+		subs := r.Subscriptions()
+		plan := createTestPlan(t, r)
+		start := time.Now()
+		for _, n := range []NewSubscription{
+			{MacAddress: testMAC, PlanID: plan.ID, Status: "active", StartTime: start, EndTime: start.Add(time.Hour)},
+			{MacAddress: testMAC, PlanID: plan.ID, Status: "expired", StartTime: start, EndTime: start.Add(3 * time.Hour), CustomerID: 7},
+			{MacAddress: testMAC, PlanID: plan.ID, Status: "active", StartTime: start, EndTime: start.Add(2 * time.Hour), CustomerID: 7},
+		} {
+			if _, err := subs.Create(n); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := subs.ActiveForCustomer(testMAC, 7)
+		if err != nil || got.PlanID != plan.ID || got.EndTime.Sub(start).Round(time.Second) != 2*time.Hour {
+			t.Errorf("ActiveForCustomer = %+v, %v; want the customer's active plan", got, err)
+		}
+		if _, err := subs.ActiveForCustomer(testMAC, 8); err != ErrNotFound {
+			t.Errorf("another customer's device: %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestSessionRepository(t *testing.T) {
+	eachRepository(t, func(t *testing.T, r repositories) {
+		plan := createTestPlan(t, r)
+		id, err := r.Subscriptions().Create(NewSubscription{
+			MacAddress: testMAC, PlanID: plan.ID, Status: "active",
+			StartTime: time.Now(), EndTime: time.Now().Add(time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub := int(id)
+		sessions := r.Sessions()
+
+		if err := sessions.Create("hash1", sub, testMAC, 2); err != nil {
+			t.Fatal(err)
+		}
+		got, err := sessions.Subscription("hash1")
+		if err != nil || got.ID != sub || got.PlanID != plan.ID || got.MacAddress != testMAC {
+			t.Errorf("Subscription = %+v, %v", got, err)
+		}
+		if ok, err := sessions.Refresh("hash1", sub, testOtherMAC); err != nil || !ok {
+			t.Errorf("Refresh = %v, %v; want true", ok, err)
+		}
+		if ok, _ := sessions.Refresh("hash1", sub+1, testOtherMAC); ok {
+			t.Error("Refresh accepted another subscription's token")
+		}
+		if ok, _ := sessions.Refresh("unknown", sub, testOtherMAC); ok {
+			t.Error("Refresh accepted an unknown token")
+		}
+
+		// Only the newest two tokens are kept
+		for _, hash := range []string{"hash2", "hash3"} {
+			time.Sleep(2 * time.Millisecond)
+			if err := sessions.Create(hash, sub, testMAC, 2); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := sessions.Subscription("hash1"); err != ErrNotFound {
+			t.Errorf("oldest token kept: %v", err)
+		}
+		if _, err := sessions.Subscription("hash3"); err != nil {
+			t.Errorf("newest token dropped: %v", err)
+		}
+
+		r.Subscriptions().SetStatus(sub, "expired")
+		if _, err := sessions.Subscription("hash3"); err != ErrNotFound {
+			t.Errorf("token of an expired subscription: %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestUserRepository(t *testing.T) {
+	eachRepository(t, func(t *testing.T, r repositories) {
+		users := r.Users()
+		if created, err := users.EnsureExists("admin", "hash", "admin"); err != nil || !created {
+			t.Fatalf("EnsureExists = %v, %v; want created", created, err)
+		}
+		if created, _ := users.EnsureExists("admin", "other", "user"); created {
+			t.Error("EnsureExists created the account twice")
+		}
+		u, err := users.Get("admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.PasswordHash != "hash" || u.Role != "admin" || u.Status != "active" || !u.MustChangePassword {
+			t.Errorf("Get = %+v", u)
+		}
+		if _, err := users.Get("nobody"); err != ErrNotFound {
+			t.Errorf("Get of an unknown user: %v, want ErrNotFound", err)
+		}
+		if list, _ := users.List(); len(list) != 1 {
+			t.Errorf("List = %+v", list)
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SQLSessions is the Sessions repository on the device_sessions table.
+type SQLSessions struct {
+	DB *sql.DB
+}
+
+func (r *SQLSessions) Refresh(tokenHash string, subscriptionID int, mac string) (bool, error) {
+	res, err := r.DB.Exec(`
+		UPDATE device_sessions SET mac_address = ?, last_seen = ?
+		WHERE token_hash = ? AND subscription_id = ?`, mac, time.Now(), tokenHash, subscriptionID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (r *SQLSessions) Create(tokenHash string, subscriptionID int, mac string, keep int) error {
+	_, err := r.DB.Exec(`
+		INSERT INTO device_sessions (token_hash, subscription_id, mac_address, created_at, last_seen)
+		VALUES (?, ?, ?, ?, ?)`, tokenHash, subscriptionID, mac, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = r.DB.Exec(`
+		DELETE FROM device_sessions WHERE subscription_id = ? AND token_hash NOT IN (
+			SELECT token_hash FROM device_sessions WHERE subscription_id = ?
+			ORDER BY created_at DESC LIMIT ?)`, subscriptionID, subscriptionID, keep)
+	return err
+}
+
+func (r *SQLSessions) Subscription(tokenHash string) (Subscription, error) {
+	var s Subscription
+	err := r.DB.QueryRow(`
+		SELECT s.id, s.plan_id, s.mac_address
+		FROM device_sessions d
+		JOIN subscriptions s ON d.subscription_id = s.id
+		WHERE d.token_hash = ? AND s.status = 'active' AND s.end_time > ?`,
+		tokenHash, time.Now()).Scan(&s.ID, &s.PlanID, &s.MacAddress)
+	if err == sql.ErrNoRows {
+		return s, ErrNotFound
+	}
+	return s, err
+}
@@ -0,0 +1,351 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SQLSubscriptions is the Subscriptions repository on the subscriptions
+// table.
+type SQLSubscriptions struct {
+	DB      *sql.DB
+	Dialect Dialect
+}
+
+func (r *SQLSubscriptions) Get(id int) (Subscription, error) {
+	var s Subscription
+	var start, end sql.NullTime
+	err := r.DB.QueryRow(`
+		SELECT s.id, s.mac_address, COALESCE(s.plan_id, 0), COALESCE(p.name, ''), s.start_time, s.end_time, s.status,
+		       COALESCE(p.price, 0), COALESCE(s.payment_method, ''), COALESCE(s.amount_paid, 0), COALESCE(s.transaction_id, ''),
+		       COALESCE(s.bytes_used, 0), COALESCE(p.data_limit_mb, 0)
+		FROM subscriptions s
+		LEFT JOIN plans p ON s.plan_id = p.id
+		WHERE s.id = ?`, id).
+		Scan(&s.ID, &s.MacAddress, &s.PlanID, &s.PlanName, &start, &end, &s.Status,
+			&s.Price, &s.PaymentMethod, &s.AmountPaid, &s.TransactionID, &s.BytesUsed, &s.DataLimitMB)
+	if err == sql.ErrNoRows {
+		return s, ErrNotFound
+	}
+	s.StartTime, s.EndTime = start.Time, end.Time
+	return s, err
+}
+
+func (r *SQLSubscriptions) Active() ([]Subscription, error) {
+	rows, err := r.DB.Query(`
+		SELECT s.id, s.mac_address, COALESCE(s.plan_id, 0), COALESCE(p.name, ''), s.start_time, s.end_time, s.status, COALESCE(p.price, 0),
+		       COALESCE(s.bytes_used, 0), COALESCE(p.data_limit_mb, 0)
+		FROM subscriptions s
+		LEFT JOIN plans p ON s.plan_id = p.id
+		WHERE s.status = 'active' AND s.end_time > ?`, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []Subscription
+	for rows.Next() {
+		var s Subscription
+		var start, end sql.NullTime
+		if err := rows.Scan(&s.ID, &s.MacAddress, &s.PlanID, &s.PlanName, &start, &end, &s.Status, &s.Price, &s.BytesUsed, &s.DataLimitMB); err != nil {
+			continue
+		}
+		s.StartTime, s.EndTime = start.Time, end.Time
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
+func (r *SQLSubscriptions) All() ([]Subscription, error) {
+	rows, err := r.DB.Query(`
+		SELECT s.id, s.mac_address, s.plan_id, COALESCE(p.name, 'Unknown Plan'),
+		       s.start_time, s.end_time, s.status, COALESCE(p.price, 0),
+		       COALESCE(s.payment_method, ''), COALESCE(s.amount_paid, 0), COALESCE(s.transaction_id, ''),
+		       COALESCE(d.device_name, 'Unknown')
+		FROM subscriptions s
+		LEFT JOIN plans p ON s.plan_id = p.id
+		LEFT JOIN devices d ON s.mac_address = d.mac_address
+		ORDER BY s.id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []Subscription
+	for rows.Next() {
+		var s Subscription
+		var start, end sql.NullTime
+		var planName, payMethod, txID, mobile sql.NullString
+		var price, amtPaid sql.NullFloat64
+		if err := rows.Scan(&s.ID, &s.MacAddress, &s.PlanID, &planName, &start, &end, &s.Status, &price, &payMethod, &amtPaid, &txID, &mobile); err != nil {
+			continue
+		}
+		s.PlanName = "Unknown Plan"
+		if planName.Valid {
+			s.PlanName = planName.String
+		}
+		s.StartTime, s.EndTime = start.Time, end.Time
+		s.Price, s.AmountPaid = price.Float64, amtPaid.Float64
+		s.PaymentMethod, s.TransactionID, s.Mobile = payMethod.String, txID.String, mobile.String
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
+func (r *SQLSubscriptions) Pending() ([]PendingRequest, error) {
+	rows, err := r.DB.Query(`
+		SELECT s.id, s.mac_address, d.device_name, p.name, p.price, p.duration_minutes,
+		       COALESCE(s.payment_method, ''), COALESCE(s.amount_paid, 0), COALESCE(s.transaction_id, '')
+		FROM subscriptions s
+		JOIN plans p ON s.plan_id = p.id
+		LEFT JOIN devices d ON s.mac_address = d.mac_address
+		WHERE s.status = 'pending'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []PendingRequest
+	for rows.Next() {
+		var p PendingRequest
+		var mobile sql.NullString
+		if err := rows.Scan(&p.ID, &p.MacAddress, &mobile, &p.PlanName, &p.Price, &p.Duration, &p.PaymentMethod, &p.AmountPaid, &p.TransactionID); err != nil {
+			continue
+		}
+		p.Mobile = mobile.String
+		requests = append(requests, p)
+	}
+	return requests, rows.Err()
+}
+
+func (r *SQLSubscriptions) Current(mac string) (Subscription, error) {
+	var s Subscription
+	var end sql.NullTime
+	err := r.DB.QueryRow(`
+		SELECT id, status, end_time
+		FROM subscriptions
+		WHERE mac_address = ?
+		AND (status = 'active' OR status = 'pending' OR status = 'rejected')
+		ORDER BY CASE WHEN status = 'active' THEN 1 WHEN status = 'pending' THEN 2 ELSE 3 END ASC, id DESC
+		LIMIT 1`, mac).Scan(&s.ID, &s.Status, &end)
+	if err == sql.ErrNoRows {
+		return s, ErrNotFound
+	}
+	s.MacAddress, s.EndTime = mac, end.Time
+	return s, err
+}
+
+func (r *SQLSubscriptions) HasActive(mac string) (bool, error) {
+	var count int
+	err := r.DB.QueryRow(`
+		SELECT COUNT(*)
+		FROM subscriptions
+		WHERE mac_address = ? AND status = 'active' AND end_time > ?`, mac, time.Now()).Scan(&count)
+	return count > 0, err
+}
+
+func (r *SQLSubscriptions) ActiveForCustomer(mac string, customerID int) (Subscription, error) {
+	s := Subscription{MacAddress: mac, Status: "active"}
+	err := r.DB.QueryRow(`
+		SELECT id, COALESCE(plan_id, 0), end_time FROM subscriptions
+		WHERE mac_address = ? AND customer_id = ? AND status = 'active' AND end_time > ?
+		ORDER BY end_time DESC LIMIT 1`, mac, customerID, time.Now()).Scan(&s.ID, &s.PlanID, &s.EndTime)
+	if err == sql.ErrNoRows {
+		return s, ErrNotFound
+	}
+	return s, err
+}
+
+func (r *SQLSubscriptions) TransactionIDInUse(txID string, excludeID int) (bool, error) {
+	var count int
+	err := r.DB.QueryRow(`
+		SELECT COUNT(*) FROM subscriptions
+		WHERE UPPER(transaction_id) = ? AND id != ? AND status != 'rejected'
+		AND COALESCE(payment_method, '') != 'voucher'`, txID, excludeID).Scan(&count)
+	return count > 0, err
+}
+
+func (r *SQLSubscriptions) Create(n NewSubscription) (int64, error) {
+	var id int64
+	err := r.DB.QueryRow(`
+		INSERT INTO subscriptions (mac_address, plan_id, start_time, end_time, status, payment_method, amount_paid, transaction_id, customer_id, parent_subscription_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id`,
+		n.MacAddress, n.PlanID, nullIfZeroTime(n.StartTime), nullIfZeroTime(n.EndTime), n.Status,
+		nullIfEmpty(n.PaymentMethod), n.AmountPaid, nullIfEmpty(n.TransactionID), nullIfZero(n.CustomerID), nullIfZero(n.ParentID)).Scan(&id)
+	return id, err
+}
+
+func (r *SQLSubscriptions) Activate(id int, start, end time.Time) error {
+	_, err := r.DB.Exec("UPDATE subscriptions SET start_time = ?, end_time = ?, status = 'active' WHERE id = ?", start, end, id)
+	return err
+}
+
+func (r *SQLSubscriptions) SetStatus(id int, status string) error {
+	_, err := r.DB.Exec("UPDATE subscriptions SET status = ? WHERE id = ?", status, id)
+	return err
+}
+
+func (r *SQLSubscriptions) Move(id int, mac string) error {
+	if _, err := r.DB.Exec("UPDATE subscriptions SET mac_address = ? WHERE id = ?", mac, id); err != nil {
+		return err
+	}
+	_, err := r.DB.Exec("UPDATE device_sessions SET mac_address = ?, last_seen = ? WHERE subscription_id = ?", mac, time.Now(), id)
+	return err
+}
+
+func (r *SQLSubscriptions) ExpireShared(parentID int) ([]string, error) {
+	rows, err := r.DB.Query("SELECT mac_address FROM subscriptions WHERE parent_subscription_id = ? AND status = 'active'", parentID)
+	if err != nil {
+		return nil, err
+	}
+	var macs []string
+	for rows.Next() {
+		var mac string
+		if rows.Scan(&mac) == nil {
+			macs = append(macs, mac)
+		}
+	}
+	rows.Close()
+	_, err = r.DB.Exec("UPDATE subscriptions SET status = 'expired' WHERE parent_subscription_id = ? AND status = 'active'", parentID)
+	return macs, err
+}
+
+func (r *SQLSubscriptions) AddUsage(mac string, bytes uint64) error {
+	_, err := r.DB.Exec(`
+		UPDATE subscriptions SET bytes_used = COALESCE(bytes_used, 0) + ?
+		WHERE mac_address = ? AND status = 'active'`, bytes, mac)
+	return err
+}
+
+func (r *SQLSubscriptions) DueForExpiry(now time.Time) ([]Expiry, error) {
+	rows, err := r.DB.Query(`
+		SELECT s.id, s.mac_address,
+		       CASE WHEN s.end_time < ? THEN 'time' ELSE 'data' END
+		FROM subscriptions s
+		LEFT JOIN plans p ON s.plan_id = p.id
+		WHERE s.status = 'active'
+		AND (s.end_time < ?
+		     OR (COALESCE(p.data_limit_mb, 0) > 0 AND (
+		         -- Extra devices share the data allowance of their parent
+		         SELECT COALESCE(SUM(COALESCE(f.bytes_used, 0)), 0) FROM subscriptions f
+		         WHERE COALESCE(f.parent_subscription_id, f.id) = COALESCE(s.parent_subscription_id, s.id)
+		     ) >= p.data_limit_mb * 1048576))`,
+		now, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []Expiry
+	for rows.Next() {
+		var e Expiry
+		if err := rows.Scan(&e.SubscriptionID, &e.MacAddress, &e.Reason); err != nil {
+			continue
+		}
+		due = append(due, e)
+	}
+	return due, rows.Err()
+}
+
+func (r *SQLSubscriptions) Stats() (Stats, error) {
+	var st Stats
+	var revenue sql.NullFloat64
+	// Revenue uses amount_paid if available, otherwise price from plan
+	err := r.DB.QueryRow(`
+		SELECT SUM(COALESCE(s.amount_paid, p.price, 0))
+		FROM subscriptions s
+		LEFT JOIN plans p ON s.plan_id = p.id
+		WHERE s.status IN ('active', 'expired')`).Scan(&revenue)
+	if err != nil {
+		return st, err
+	}
+	st.TotalRevenue = revenue.Float64
+
+	counts := []struct {
+		query string
+		dest  *int
+	}{
+		{"SELECT COUNT(*) FROM subscriptions WHERE status = 'active'", &st.ActiveUsers},
+		{"SELECT COUNT(*) FROM plans", &st.TotalPlans},
+		{"SELECT COUNT(*) FROM devices WHERE status = 'blocked'", &st.BlockedDevices},
+		{"SELECT COUNT(*) FROM devices", &st.TotalDevices},
+		{"SELECT COUNT(*) FROM subscriptions WHERE status = 'pending'", &st.PendingRequests},
+	}
+	for _, c := range counts {
+		if err := r.DB.QueryRow(c.query).Scan(c.dest); err != nil {
+			return st, err
+		}
+	}
+	return st, nil
+}
+
+func (r *SQLSubscriptions) RevenueByDay() ([]RevenueDay, error) {
+	day := r.Dialect.date("start_time")
+	since := time.Now().UTC().AddDate(0, 0, -7).Format("2006-01-02")
+	rows, err := r.DB.Query(`
+		SELECT `+day+`, SUM(COALESCE(p.price, 0))
+		FROM subscriptions s
+		LEFT JOIN plans p ON s.plan_id = p.id
+		WHERE s.status IN ('active', 'expired', 'pending')
+		AND start_time IS NOT NULL
+		AND start_time >= ?
+		GROUP BY `+day+`
+		ORDER BY `+day+` ASC`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days []RevenueDay
+	for rows.Next() {
+		var d RevenueDay
+		if err := rows.Scan(&d.Date, &d.Total); err != nil {
+			continue
+		}
+		days = append(days, d)
+	}
+	return days, rows.Err()
+}
+
+func (r *SQLSubscriptions) Flush() (int, int, error) {
+	var subscriptions, devices int
+	r.DB.QueryRow("SELECT COUNT(*) FROM subscriptions").Scan(&subscriptions)
+	r.DB.QueryRow("SELECT COUNT(*) FROM devices").Scan(&devices)
+
+	if _, err := r.DB.Exec("DELETE FROM subscriptions"); err != nil {
+		return subscriptions, devices, err
+	}
+	if _, err := r.DB.Exec("DELETE FROM devices"); err != nil {
+		return subscriptions, devices, err
+	}
+	// Portal sessions belong to the deleted subscriptions; restart the IDs
+	r.DB.Exec("DELETE FROM device_sessions")
+	if r.Dialect == Postgres {
+		r.DB.Exec("ALTER SEQUENCE subscriptions_id_seq RESTART")
+	} else {
+		r.DB.Exec("DELETE FROM sqlite_sequence WHERE name IN ('subscriptions', 'devices')")
+	}
+	return subscriptions, devices, nil
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func nullIfZero(n int) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+func nullIfZeroTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
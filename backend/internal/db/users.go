@@ -0,0 +1,56 @@
+package db
+
+import "database/sql"
+
+// SQLUsers is the Users repository on the users table.
+type SQLUsers struct {
+	DB *sql.DB
+}
+
+const userColumns = `id, username, password_hash, role, COALESCE(status, 'active'),
+	COALESCE(must_change_password, 0), COALESCE(totp_enabled, 0), created_at`
+
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	var u User
+	var created sql.NullTime
+	err := row.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.Status, &u.MustChangePassword, &u.TwoFactor, &created)
+	u.CreatedAt = created.Time
+	return u, err
+}
+
+func (r *SQLUsers) List() ([]User, error) {
+	rows, err := r.DB.Query("SELECT " + userColumns + " FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			continue
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (r *SQLUsers) Get(username string) (User, error) {
+	u, err := scanUser(r.DB.QueryRow("SELECT "+userColumns+" FROM users WHERE username = ?", username))
+	if err == sql.ErrNoRows {
+		return u, ErrNotFound
+	}
+	return u, err
+}
+
+func (r *SQLUsers) EnsureExists(username, passwordHash, role string) (bool, error) {
+	res, err := r.DB.Exec(`
+		INSERT INTO users (username, password_hash, role, must_change_password) VALUES (?, ?, ?, 1)
+		ON CONFLICT(username) DO NOTHING`, username, passwordHash, role)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
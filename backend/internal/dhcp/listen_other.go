@@ -0,0 +1,13 @@
+//go:build !linux
+
+package dhcp
+
+import (
+	"fmt"
+	"net"
+)
+
+// listen is only implemented on Linux.
+func listen(iface string) (net.PacketConn, error) {
+	return nil, fmt.Errorf("the DHCP server is only supported on Linux")
+}
@@ -0,0 +1,220 @@
+package dhcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Message types (option 53)
+const (
+	Discover = 1
+	Offer    = 2
+	Request  = 3
+	Decline  = 4
+	Ack      = 5
+	Nak      = 6
+	Release  = 7
+	Inform   = 8
+)
+
+// Option codes used by the server
+const (
+	OptSubnetMask       = 1
+	OptRouter           = 3
+	OptDNS              = 6
+	OptHostname         = 12
+	OptRequestedIP      = 50
+	OptLeaseTime        = 51
+	OptMessageType      = 53
+	OptServerID         = 54
+	OptClientID         = 61
+	OptRenewalTime      = 58
+	OptRebindingTime    = 59
+	OptCaptivePortalURL = 114 // RFC 8910
+	optPad              = 0
+	optEnd              = 255
+)
+
+const (
+	bootRequest = 1
+	bootReply   = 2
+
+	headerLen = 236
+	minLen    = 300 // BOOTP minimum, some clients drop shorter replies
+
+	flagBroadcast = 0x8000
+)
+
+var magicCookie = []byte{99, 130, 83, 99}
+
+// Packet is a DHCPv4 message (RFC 2131).
+type Packet struct {
+	Op      byte
+	XID     uint32
+	Secs    uint16
+	Flags   uint16
+	CIAddr  net.IP
+	YIAddr  net.IP
+	SIAddr  net.IP
+	GIAddr  net.IP
+	CHAddr  net.HardwareAddr
+	Options map[byte][]byte
+}
+
+// Parse decodes a DHCPv4 message from the wire.
+func Parse(b []byte) (*Packet, error) {
+	if len(b) < headerLen+len(magicCookie) {
+		return nil, fmt.Errorf("short packet (%d bytes)", len(b))
+	}
+	if !bytes.Equal(b[headerLen:headerLen+4], magicCookie) {
+		return nil, fmt.Errorf("missing DHCP magic cookie")
+	}
+	if b[1] != 1 || b[2] != 6 {
+		return nil, fmt.Errorf("unsupported hardware type %d/%d", b[1], b[2])
+	}
+
+	p := &Packet{
+		Op:      b[0],
+		XID:     binary.BigEndian.Uint32(b[4:8]),
+		Secs:    binary.BigEndian.Uint16(b[8:10]),
+		Flags:   binary.BigEndian.Uint16(b[10:12]),
+		CIAddr:  net.IP(append([]byte(nil), b[12:16]...)),
+		YIAddr:  net.IP(append([]byte(nil), b[16:20]...)),
+		SIAddr:  net.IP(append([]byte(nil), b[20:24]...)),
+		GIAddr:  net.IP(append([]byte(nil), b[24:28]...)),
+		CHAddr:  net.HardwareAddr(append([]byte(nil), b[28:34]...)),
+		Options: make(map[byte][]byte),
+	}
+
+	opts := b[headerLen+4:]
+	for i := 0; i < len(opts); {
+		code := opts[i]
+		if code == optEnd {
+			break
+		}
+		if code == optPad {
+			i++
+			continue
+		}
+		if i+1 >= len(opts) {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+		n := int(opts[i+1])
+		if i+2+n > len(opts) {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+		// Long options may be split across several instances (RFC 3396)
+		p.Options[code] = append(p.Options[code], opts[i+2:i+2+n]...)
+		i += 2 + n
+	}
+	return p, nil
+}
+
+// Marshal encodes the message, padded to the BOOTP minimum length.
+func (p *Packet) Marshal() []byte {
+	b := make([]byte, headerLen, minLen)
+	b[0] = p.Op
+	b[1] = 1 // Ethernet
+	b[2] = 6
+	binary.BigEndian.PutUint32(b[4:8], p.XID)
+	binary.BigEndian.PutUint16(b[8:10], p.Secs)
+	binary.BigEndian.PutUint16(b[10:12], p.Flags)
+	copy(b[12:16], p.CIAddr.To4())
+	copy(b[16:20], p.YIAddr.To4())
+	copy(b[20:24], p.SIAddr.To4())
+	copy(b[24:28], p.GIAddr.To4())
+	copy(b[28:44], p.CHAddr)
+	b = append(b, magicCookie...)
+
+	// Message type first, the rest in code order
+	codes := make([]int, 0, len(p.Options))
+	for code := range p.Options {
+		if code != OptMessageType {
+			codes = append(codes, int(code))
+		}
+	}
+	sort.Ints(codes)
+	if t, ok := p.Options[OptMessageType]; ok {
+		b = appendOption(b, OptMessageType, t)
+	}
+	for _, code := range codes {
+		b = appendOption(b, byte(code), p.Options[byte(code)])
+	}
+	b = append(b, optEnd)
+
+	for len(b) < minLen {
+		b = append(b, optPad)
+	}
+	return b
+}
+
+func appendOption(b []byte, code byte, value []byte) []byte {
+	for {
+		n := len(value)
+		if n > 255 {
+			n = 255
+		}
+		b = append(b, code, byte(n))
+		b = append(b, value[:n]...)
+		value = value[n:]
+		if len(value) == 0 {
+			return b
+		}
+	}
+}
+
+// MessageType returns option 53, or 0 if it is missing.
+func (p *Packet) MessageType() byte {
+	if v := p.Options[OptMessageType]; len(v) == 1 {
+		return v[0]
+	}
+	return 0
+}
+
+// IPOption returns an IPv4 option such as the requested IP or server ID.
+func (p *Packet) IPOption(code byte) net.IP {
+	if v := p.Options[code]; len(v) == 4 {
+		return net.IP(append([]byte(nil), v...))
+	}
+	return nil
+}
+
+// ClientID returns option 61 as hex, or "" if the client sent none.
+func (p *Packet) ClientID() string {
+	return hex.EncodeToString(p.Options[OptClientID])
+}
+
+// reply starts a BOOTREPLY for p.
+func (p *Packet) reply(msgType byte) *Packet {
+	return &Packet{
+		Op:      bootReply,
+		XID:     p.XID,
+		Flags:   p.Flags,
+		CIAddr:  net.IPv4zero,
+		YIAddr:  net.IPv4zero,
+		SIAddr:  net.IPv4zero,
+		GIAddr:  p.GIAddr,
+		CHAddr:  p.CHAddr,
+		Options: map[byte][]byte{OptMessageType: {msgType}},
+	}
+}
+
+func uint32Option(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func ipListOption(ips []net.IP) []byte {
+	var b []byte
+	for _, ip := range ips {
+		if v4 := ip.To4(); v4 != nil {
+			b = append(b, v4...)
+		}
+	}
+	return b
+}
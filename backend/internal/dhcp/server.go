@@ -0,0 +1,418 @@
+package dhcp
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// offerHold is how long an offered address stays reserved while the
+// client decides.
+const offerHold = time.Minute
+
+// declineHold keeps an address out of the pool after a client reported it
+// as already in use (DHCPDECLINE).
+const declineHold = 10 * time.Minute
+
+type Lease struct {
+	MAC string `json:"mac_address"`
+	// ClientID is the client identifier (option 61) in hex, empty if the
+	// client sent none.
+	ClientID  string    `json:"client_id,omitempty"`
+	IP        string    `json:"ip_address"`
+	Hostname  string    `json:"hostname"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Server is a small DHCPv4 server for the hotspot interface. It hands out
+// addresses from one range, keeps leases in the dhcp_leases table and
+// answers IP<->MAC lookups from them, which is exact where ARP is a guess.
+// Leases are keyed on the hardware address, which any client can claim, so
+// an unexpired lease stays with the client identifier and address it was
+// given; a second client using the same MAC is refused until it runs out.
+type Server struct {
+	DB        *sql.DB
+	Interface string
+	// ServerIP is this host on the hotspot interface; it is the server ID
+	// and the default gateway handed to clients.
+	ServerIP   net.IP
+	Netmask    net.IPMask
+	RangeStart net.IP
+	RangeEnd   net.IP
+	DNS        []net.IP
+	// CaptivePortalURL is sent as option 114 (RFC 8910) when set.
+	CaptivePortalURL string
+	LeaseTime        time.Duration
+
+	conn     net.PacketConn
+	lock     sync.Mutex
+	leases   map[string]Lease     // MAC -> lease
+	declined map[string]time.Time // IP -> end of hold
+}
+
+func NewServer(db *sql.DB, iface string, serverIP, rangeStart, rangeEnd net.IP) *Server {
+	return &Server{
+		DB:         db,
+		Interface:  iface,
+		ServerIP:   serverIP.To4(),
+		RangeStart: rangeStart.To4(),
+		RangeEnd:   rangeEnd.To4(),
+		LeaseTime:  12 * time.Hour,
+		leases:     make(map[string]Lease),
+		declined:   make(map[string]time.Time),
+	}
+}
+
+// Start loads the stored leases and serves DHCP on the interface until
+// Stop is called.
+func (s *Server) Start() error {
+	if s.ServerIP == nil || s.RangeStart == nil || s.RangeEnd == nil {
+		return fmt.Errorf("server IP and address range are required")
+	}
+	if ipToUint(s.RangeStart) > ipToUint(s.RangeEnd) {
+		return fmt.Errorf("invalid range %s-%s", s.RangeStart, s.RangeEnd)
+	}
+	if s.Netmask == nil {
+		s.Netmask = interfaceMask(s.Interface, s.ServerIP)
+	}
+	if err := s.loadLeases(); err != nil {
+		return fmt.Errorf("failed to load leases: %v", err)
+	}
+
+	conn, err := listen(s.Interface)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	fmt.Printf("[DHCP] Serving %s-%s on %s (lease %s)\n", s.RangeStart, s.RangeEnd, s.Interface, s.LeaseTime)
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return nil // closed by Stop
+		}
+		req, err := Parse(buf[:n])
+		if err != nil || req.Op != bootRequest {
+			continue
+		}
+		resp, dst := s.handle(req)
+		if resp == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(resp.Marshal(), dst); err != nil {
+			fmt.Printf("[DHCP] Failed to reply to %s: %v\n", req.CHAddr, err)
+		}
+	}
+}
+
+func (s *Server) Stop() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// LookupIP returns the address currently leased to mac.
+func (s *Server) LookupIP(mac string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	l, ok := s.leases[mac]
+	if !ok || !l.ExpiresAt.After(time.Now()) {
+		return "", false
+	}
+	return l.IP, true
+}
+
+// LookupMAC returns the client currently holding ip.
+func (s *Server) LookupMAC(ip string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for mac, l := range s.leases {
+		if l.IP == ip && l.ExpiresAt.After(now) {
+			return mac, true
+		}
+	}
+	return "", false
+}
+
+// Leases returns every known lease, active or not, ordered by address.
+func (s *Server) Leases() []Lease {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	leases := make([]Lease, 0, len(s.leases))
+	for _, l := range s.leases {
+		leases = append(leases, l)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return ipToUint(net.ParseIP(leases[i].IP)) < ipToUint(net.ParseIP(leases[j].IP))
+	})
+	return leases
+}
+
+// handle answers one client message and returns where to send the reply.
+func (s *Server) handle(req *Packet) (*Packet, *net.UDPAddr) {
+	mac := req.CHAddr.String()
+	clientID := req.ClientID()
+	hostname := string(req.Options[OptHostname])
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch req.MessageType() {
+	case Discover:
+		if !s.owns(mac, clientID) {
+			fmt.Printf("[DHCP] %s has an unexpired lease for another client identifier, no offer\n", mac)
+			return nil, nil
+		}
+		ip := s.pick(mac, req.IPOption(OptRequestedIP))
+		if ip == nil {
+			fmt.Printf("[DHCP] Pool exhausted, no offer for %s\n", mac)
+			return nil, nil
+		}
+		if l, ok := s.leases[mac]; !ok || l.IP != ip.String() || l.ExpiresAt.Before(time.Now().Add(offerHold)) {
+			s.store(mac, clientID, ip, hostname, time.Now().Add(offerHold))
+		}
+		resp := req.reply(Offer)
+		resp.YIAddr = ip
+		s.addLeaseOptions(resp)
+		return resp, s.destination(req, resp)
+
+	case Request:
+		if id := req.IPOption(OptServerID); id != nil && !id.Equal(s.ServerIP) {
+			// The client accepted another server's offer
+			return nil, nil
+		}
+		ip := req.IPOption(OptRequestedIP)
+		if ip == nil {
+			ip = req.CIAddr.To4()
+		}
+		if ip == nil || ip.Equal(net.IPv4zero) || !s.available(mac, ip) || !s.owns(mac, clientID) || s.moving(mac, ip) {
+			fmt.Printf("[DHCP] NAK %s for %s\n", mac, ip)
+			resp := req.reply(Nak)
+			resp.Options[OptServerID] = s.ServerIP
+			resp.Flags |= flagBroadcast
+			return resp, s.destination(req, resp)
+		}
+		s.store(mac, clientID, ip, hostname, time.Now().Add(s.LeaseTime))
+		fmt.Printf("[DHCP] Leased %s to %s %s\n", ip, mac, hostname)
+		resp := req.reply(Ack)
+		resp.YIAddr = ip
+		resp.CIAddr = req.CIAddr
+		s.addLeaseOptions(resp)
+		return resp, s.destination(req, resp)
+
+	case Release:
+		if l, ok := s.leases[mac]; ok && l.IP == req.CIAddr.String() && s.owns(mac, clientID) {
+			s.store(mac, l.ClientID, req.CIAddr, l.Hostname, time.Now())
+			fmt.Printf("[DHCP] %s released %s\n", mac, l.IP)
+		}
+		return nil, nil
+
+	case Decline:
+		if ip := req.IPOption(OptRequestedIP); ip != nil {
+			fmt.Printf("[DHCP] %s declined %s (address in use)\n", mac, ip)
+			s.declined[ip.String()] = time.Now().Add(declineHold)
+			if l, ok := s.leases[mac]; ok && l.IP == ip.String() && s.owns(mac, clientID) {
+				s.DB.Exec("DELETE FROM dhcp_leases WHERE mac_address = ?", mac)
+				delete(s.leases, mac)
+			}
+		}
+		return nil, nil
+
+	case Inform:
+		// Client configured its address itself and only wants options
+		resp := req.reply(Ack)
+		resp.CIAddr = req.CIAddr
+		s.addOptions(resp)
+		return resp, s.destination(req, resp)
+	}
+	return nil, nil
+}
+
+func (s *Server) addOptions(p *Packet) {
+	p.Options[OptServerID] = s.ServerIP
+	p.Options[OptSubnetMask] = []byte(s.Netmask)
+	p.Options[OptRouter] = s.ServerIP
+	if len(s.DNS) > 0 {
+		p.Options[OptDNS] = ipListOption(s.DNS)
+	}
+	if s.CaptivePortalURL != "" {
+		p.Options[OptCaptivePortalURL] = []byte(s.CaptivePortalURL)
+	}
+}
+
+func (s *Server) addLeaseOptions(p *Packet) {
+	s.addOptions(p)
+	secs := uint32(s.LeaseTime / time.Second)
+	p.Options[OptLeaseTime] = uint32Option(secs)
+	p.Options[OptRenewalTime] = uint32Option(secs / 2)
+	p.Options[OptRebindingTime] = uint32Option(secs / 8 * 7)
+}
+
+// destination follows RFC 2131 4.1: relays get the reply on port 67,
+// renewing clients by unicast, everyone else by broadcast.
+func (s *Server) destination(req, resp *Packet) *net.UDPAddr {
+	if ip := req.GIAddr.To4(); ip != nil && !ip.Equal(net.IPv4zero) {
+		return &net.UDPAddr{IP: ip, Port: 67}
+	}
+	if resp.MessageType() != Nak {
+		if ip := req.CIAddr.To4(); ip != nil && !ip.Equal(net.IPv4zero) {
+			return &net.UDPAddr{IP: ip, Port: 68}
+		}
+	}
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+}
+
+// pick chooses an address for mac: its previous one, the one it asked
+// for, a never-used one, then one whose lease has run out. Callers hold
+// s.lock.
+func (s *Server) pick(mac string, requested net.IP) net.IP {
+	if l, ok := s.leases[mac]; ok {
+		if ip := net.ParseIP(l.IP).To4(); ip != nil && s.available(mac, ip) {
+			return ip
+		}
+	}
+	if requested != nil && s.available(mac, requested) {
+		return requested.To4()
+	}
+
+	used := make(map[uint32]bool)
+	for _, l := range s.leases {
+		used[ipToUint(net.ParseIP(l.IP))] = true
+	}
+	start, end := ipToUint(s.RangeStart), ipToUint(s.RangeEnd)
+	for n := start; n <= end && n >= start; n++ {
+		if ip := uintToIP(n); !used[n] && s.available(mac, ip) {
+			return ip
+		}
+	}
+	for n := start; n <= end && n >= start; n++ {
+		if ip := uintToIP(n); s.available(mac, ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// owns reports whether a message with clientID may act on the lease of
+// mac: there is none, it has expired, or it was given to the same client
+// identifier. Leases from before identifiers were recorded belong to
+// whoever asks. Callers hold s.lock.
+func (s *Server) owns(mac, clientID string) bool {
+	l, ok := s.leases[mac]
+	if !ok || !l.ExpiresAt.After(time.Now()) {
+		return true
+	}
+	return l.ClientID == "" || l.ClientID == clientID
+}
+
+// moving reports whether giving ip to mac would move its unexpired lease
+// off an address it can still hold. Callers hold s.lock.
+func (s *Server) moving(mac string, ip net.IP) bool {
+	l, ok := s.leases[mac]
+	if !ok || !l.ExpiresAt.After(time.Now()) || l.IP == ip.String() {
+		return false
+	}
+	current := net.ParseIP(l.IP).To4()
+	return current != nil && s.available(mac, current)
+}
+
+// available reports whether mac may hold ip. Callers hold s.lock.
+func (s *Server) available(mac string, ip net.IP) bool {
+	n := ipToUint(ip)
+	if n < ipToUint(s.RangeStart) || n > ipToUint(s.RangeEnd) || ip.Equal(s.ServerIP) {
+		return false
+	}
+	now := time.Now()
+	if until, ok := s.declined[ip.String()]; ok {
+		if now.Before(until) {
+			return false
+		}
+		delete(s.declined, ip.String())
+	}
+	for other, l := range s.leases {
+		if other != mac && l.IP == ip.String() && l.ExpiresAt.After(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// store saves a lease in memory and in the DB. Callers hold s.lock.
+func (s *Server) store(mac, clientID string, ip net.IP, hostname string, expires time.Time) {
+	addr := ip.String()
+	// The address may still be on record for a client whose lease ran out
+	for other, l := range s.leases {
+		if other != mac && l.IP == addr {
+			delete(s.leases, other)
+		}
+	}
+	s.DB.Exec("DELETE FROM dhcp_leases WHERE ip_address = ? AND mac_address != ?", addr, mac)
+	_, err := s.DB.Exec(`
+		INSERT INTO dhcp_leases (mac_address, client_id, ip_address, hostname, expires_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(mac_address) DO UPDATE SET
+			client_id = excluded.client_id,
+			ip_address = excluded.ip_address,
+			hostname = excluded.hostname,
+			expires_at = excluded.expires_at,
+			updated_at = CURRENT_TIMESTAMP`, mac, clientID, addr, hostname, expires)
+	if err != nil {
+		fmt.Printf("[DHCP] Failed to save lease %s -> %s: %v\n", mac, addr, err)
+	}
+	s.leases[mac] = Lease{MAC: mac, ClientID: clientID, IP: addr, Hostname: hostname, ExpiresAt: expires}
+}
+
+func (s *Server) loadLeases() error {
+	rows, err := s.DB.Query("SELECT mac_address, COALESCE(client_id, ''), ip_address, COALESCE(hostname, ''), expires_at FROM dhcp_leases")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for rows.Next() {
+		var l Lease
+		if err := rows.Scan(&l.MAC, &l.ClientID, &l.IP, &l.Hostname, &l.ExpiresAt); err != nil {
+			continue
+		}
+		s.leases[l.MAC] = l
+	}
+	return rows.Err()
+}
+
+// interfaceMask finds the prefix of ip on iface, falling back to /24.
+func interfaceMask(iface string, ip net.IP) net.IPMask {
+	if ifi, err := net.InterfaceByName(iface); err == nil {
+		addrs, _ := ifi.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) && ipnet.IP.To4() != nil {
+				return net.IPMask(append([]byte(nil), ipnet.Mask[len(ipnet.Mask)-4:]...))
+			}
+		}
+	}
+	return net.CIDRMask(24, 32)
+}
+
+func ipToUint(ip net.IP) uint32 {
+	v4 := ip.To4()
+	if v4 == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v4)
+}
+
+func uintToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
@@ -0,0 +1,131 @@
+package dhcp
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/user/wifi-control-system/internal/db"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	store, err := db.InitDB(filepath.Join(t.TempDir(), "test.db") + "?_parse_time=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.DB.Close() })
+	if _, err := store.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(store.DB, "wlan0", net.ParseIP("192.168.1.1"), net.ParseIP("192.168.1.100"), net.ParseIP("192.168.1.110"))
+	s.Netmask = net.CIDRMask(24, 32)
+	return s
+}
+
+// message builds a client message from mac. clientID and requested are
+// left out when empty.
+func message(msgType byte, mac, clientID, requested string) *Packet {
+	hw, _ := net.ParseMAC(mac)
+	p := &Packet{
+		Op:      bootRequest,
+		XID:     1,
+		CIAddr:  net.IPv4zero,
+		YIAddr:  net.IPv4zero,
+		SIAddr:  net.IPv4zero,
+		GIAddr:  net.IPv4zero,
+		CHAddr:  hw,
+		Options: map[byte][]byte{OptMessageType: {msgType}},
+	}
+	if clientID != "" {
+		p.Options[OptClientID] = []byte(clientID)
+	}
+	if requested != "" {
+		p.Options[OptRequestedIP] = net.ParseIP(requested).To4()
+	}
+	return p
+}
+
+// lease runs DISCOVER/REQUEST for mac and returns the acknowledged address.
+func lease(t *testing.T, s *Server, mac, clientID string) string {
+	t.Helper()
+	offer, _ := s.handle(message(Discover, mac, clientID, ""))
+	if offer == nil {
+		t.Fatalf("no offer for %s", mac)
+	}
+	req := message(Request, mac, clientID, offer.YIAddr.String())
+	req.Options[OptServerID] = s.ServerIP
+	ack, _ := s.handle(req)
+	if ack == nil || ack.MessageType() != Ack {
+		t.Fatalf("request for %s was not acknowledged: %+v", offer.YIAddr, ack)
+	}
+	return ack.YIAddr.String()
+}
+
+func TestLeaseRoundTrip(t *testing.T) {
+	s := newTestServer(t)
+	ip := lease(t, s, "aa:bb:cc:dd:ee:01", "phone")
+	if mac, ok := s.LookupMAC(ip); !ok || mac != "aa:bb:cc:dd:ee:01" {
+		t.Errorf("LookupMAC(%s) = %q, %v", ip, mac, ok)
+	}
+	if again := lease(t, s, "aa:bb:cc:dd:ee:01", "phone"); again != ip {
+		t.Errorf("renewal moved the client from %s to %s", ip, again)
+	}
+
+	// Leases survive a restart with their client identifier
+	restarted := NewServer(s.DB, "wlan0", s.ServerIP, s.RangeStart, s.RangeEnd)
+	if err := restarted.loadLeases(); err != nil {
+		t.Fatal(err)
+	}
+	if l := restarted.leases["aa:bb:cc:dd:ee:01"]; l.IP != ip || l.ClientID != s.leases["aa:bb:cc:dd:ee:01"].ClientID {
+		t.Errorf("reloaded lease = %+v", l)
+	}
+}
+
+func TestSpoofedMACCannotTakeLease(t *testing.T) {
+	s := newTestServer(t)
+	const mac = "aa:bb:cc:dd:ee:01"
+	ip := lease(t, s, mac, "phone")
+
+	if offer, _ := s.handle(message(Discover, mac, "laptop", "")); offer != nil {
+		t.Errorf("offered %s to another client identifier", offer.YIAddr)
+	}
+	for _, clientID := range []string{"laptop", ""} {
+		resp, _ := s.handle(message(Request, mac, clientID, ip))
+		if resp == nil || resp.MessageType() != Nak {
+			t.Errorf("request from client identifier %q was not refused: %+v", clientID, resp)
+		}
+	}
+	release := message(Release, mac, "laptop", "")
+	release.CIAddr = net.ParseIP(ip).To4()
+	s.handle(release)
+	if got, ok := s.LookupIP(mac); !ok || got != ip {
+		t.Errorf("another client released the lease: LookupIP = %q, %v", got, ok)
+	}
+}
+
+func TestUnexpiredLeaseDoesNotMove(t *testing.T) {
+	s := newTestServer(t)
+	const mac = "aa:bb:cc:dd:ee:01"
+	ip := lease(t, s, mac, "phone")
+
+	resp, _ := s.handle(message(Request, mac, "phone", "192.168.1.109"))
+	if resp == nil || resp.MessageType() != Nak {
+		t.Fatalf("lease moved to another address: %+v", resp)
+	}
+	if got, _ := s.LookupIP(mac); got != ip {
+		t.Errorf("LookupIP = %s, want %s", got, ip)
+	}
+	if offer, _ := s.handle(message(Discover, mac, "phone", "192.168.1.109")); offer == nil || offer.YIAddr.String() != ip {
+		t.Errorf("offer = %+v, want the leased %s", offer, ip)
+	}
+
+	// Once released the client may take any free address
+	release := message(Release, mac, "phone", "")
+	release.CIAddr = net.ParseIP(ip).To4()
+	s.handle(release)
+	req := message(Request, mac, "phone", "192.168.1.109")
+	if resp, _ := s.handle(req); resp == nil || resp.MessageType() != Ack {
+		t.Errorf("request after release was refused: %+v", resp)
+	}
+}
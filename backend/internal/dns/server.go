@@ -2,40 +2,86 @@ package dns
 
 import (
 	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
+// Authorizer decides whether a client IP has paid for real internet access.
+type Authorizer interface {
+	IsAuthorized(ip string) bool
+}
+
+// authCacheTTL bounds how long an authorization decision is reused. Every
+// lookup costs an ARP lookup and a DB query, and a page load fires dozens
+// of queries.
+const authCacheTTL = 5 * time.Second
+
+// spoofTTL keeps spoofed answers short-lived so clients pick up real
+// records soon after their plan is activated.
+const spoofTTL = 10
+
+type authDecision struct {
+	allowed bool
+	expires time.Time
+}
+
 type DNSServer struct {
 	RedirectIP string
 	Server     *dns.Server
+	// Upstreams are the resolvers ("host:port") used for authorized clients.
+	Upstreams []string
+	// Authorizer is consulted per client; nil means nobody is authorized.
+	Authorizer Authorizer
+	// OnWalledGardenResolve receives the IPv4 addresses resolved for a
+	// walled-garden domain, and the shortest TTL among them, before the
+	// answer is sent, so the firewall can open them in time for the
+	// client's first connection.
+	OnWalledGardenResolve func(domain string, ips []string, ttl time.Duration)
+
+	cacheLock     sync.Mutex
+	authCache     map[string]authDecision
+	gardenLock    sync.RWMutex
+	gardenDomains []string
 }
 
 func NewDNSServer(redirectIP string) *DNSServer {
 	return &DNSServer{
 		RedirectIP: redirectIP,
+		Upstreams:  []string{"1.1.1.1:53", "8.8.8.8:53"},
+		authCache:  make(map[string]authDecision),
 	}
 }
 
-func (s *DNSServer) Start() error {
-	// 1. Create a specific handler
-	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
-		m := new(dns.Msg)
-		m.SetReply(r)
-		m.Authoritative = true
-
-		for _, question := range r.Question {
-			fmt.Printf("[DNS] Capturing Query: %s from %s -> Redirecting to %s\n", question.Name, w.RemoteAddr(), s.RedirectIP)
-
-			// Answer with A record pointing to our RedirectIP
-			rr, err := dns.NewRR(fmt.Sprintf("%s A %s", question.Name, s.RedirectIP))
-			if err == nil {
-				m.Answer = append(m.Answer, rr)
-			}
+// ServeDNS forwards queries of authorized clients and of walled-garden
+// domains, and spoofs the rest.
+func (s *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	clientIP := remoteIP(w.RemoteAddr())
+
+	if s.isAuthorized(clientIP) {
+		w.WriteMsg(s.forward(r, w.RemoteAddr().Network()))
+		return
+	}
+
+	// Walled garden domains resolve for real even before payment
+	if len(r.Question) > 0 {
+		if domain, ok := s.matchWalledGarden(r.Question[0].Name); ok {
+			resp := s.forward(r, w.RemoteAddr().Network())
+			s.reportWalledGarden(domain, resp)
+			w.WriteMsg(resp)
+			return
 		}
+	}
 
-		w.WriteMsg(m)
-	})
+	w.WriteMsg(s.spoof(r, clientIP))
+}
+
+func (s *DNSServer) Start() error {
+	// 1. The server itself is the handler
+	var handler dns.Handler = s
 
 	// 2. Start UDP Server
 	go func() {
@@ -65,3 +111,120 @@ func (s *DNSServer) Stop() {
 		s.Server.Shutdown()
 	}
 }
+
+// spoof answers A questions with RedirectIP and everything else with an
+// empty NOERROR response, so clients fall back to IPv4 and reach the portal.
+func (s *DNSServer) spoof(r *dns.Msg, clientIP string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	for _, question := range r.Question {
+		if question.Qtype != dns.TypeA || question.Qclass != dns.ClassINET {
+			continue
+		}
+		fmt.Printf("[DNS] Capturing Query: %s from %s -> Redirecting to %s\n", question.Name, clientIP, s.RedirectIP)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: spoofTTL},
+			A:   net.ParseIP(s.RedirectIP),
+		})
+	}
+	return m
+}
+
+// forward relays the query to the first upstream that answers.
+func (s *DNSServer) forward(r *dns.Msg, network string) *dns.Msg {
+	client := &dns.Client{Net: network, Timeout: 2 * time.Second}
+	for _, upstream := range s.Upstreams {
+		resp, _, err := client.Exchange(r, upstream)
+		if err != nil {
+			fmt.Printf("[DNS] Upstream %s failed: %v\n", upstream, err)
+			continue
+		}
+		return resp
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeServerFailure)
+	return m
+}
+
+// SetWalledGarden replaces the list of domains reachable before payment.
+// A domain also covers all of its subdomains.
+func (s *DNSServer) SetWalledGarden(domains []string) {
+	normalized := make([]string, 0, len(domains))
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(d), "."))
+		if d != "" {
+			normalized = append(normalized, d)
+		}
+	}
+	s.gardenLock.Lock()
+	s.gardenDomains = normalized
+	s.gardenLock.Unlock()
+}
+
+func (s *DNSServer) matchWalledGarden(qname string) (string, bool) {
+	name := strings.ToLower(strings.TrimSuffix(qname, "."))
+	s.gardenLock.RLock()
+	defer s.gardenLock.RUnlock()
+	for _, d := range s.gardenDomains {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return d, true
+		}
+	}
+	return "", false
+}
+
+func (s *DNSServer) reportWalledGarden(domain string, resp *dns.Msg) {
+	if s.OnWalledGardenResolve == nil {
+		return
+	}
+	var ips []string
+	var ttl uint32
+	for _, rr := range resp.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			ips = append(ips, a.A.String())
+			if len(ips) == 1 || a.Hdr.Ttl < ttl {
+				ttl = a.Hdr.Ttl
+			}
+		}
+	}
+	if len(ips) > 0 {
+		s.OnWalledGardenResolve(domain, ips, time.Duration(ttl)*time.Second)
+	}
+}
+
+func (s *DNSServer) isAuthorized(ip string) bool {
+	if s.Authorizer == nil || ip == "" {
+		return false
+	}
+
+	s.cacheLock.Lock()
+	if d, ok := s.authCache[ip]; ok && time.Now().Before(d.expires) {
+		s.cacheLock.Unlock()
+		return d.allowed
+	}
+	s.cacheLock.Unlock()
+
+	allowed := s.Authorizer.IsAuthorized(ip)
+
+	s.cacheLock.Lock()
+	s.authCache[ip] = authDecision{allowed: allowed, expires: time.Now().Add(authCacheTTL)}
+	s.cacheLock.Unlock()
+	return allowed
+}
+
+func remoteIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.String()
+	case *net.TCPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
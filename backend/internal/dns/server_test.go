@@ -0,0 +1,161 @@
+package dns
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeAuthorizer gives 127.0.0.1 a fixed decision and counts the calls.
+type fakeAuthorizer struct {
+	mu      sync.Mutex
+	allowed bool
+	calls   int
+}
+
+func (a *fakeAuthorizer) IsAuthorized(ip string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls++
+	return a.allowed && ip == "127.0.0.1"
+}
+
+func (a *fakeAuthorizer) set(allowed bool) {
+	a.mu.Lock()
+	a.allowed = allowed
+	a.mu.Unlock()
+}
+
+func (a *fakeAuthorizer) callCount() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.calls
+}
+
+// serveUDP runs handler on a local UDP port until the test ends.
+func serveUDP(t *testing.T, handler dns.Handler) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+const upstreamIP = "93.184.216.34"
+
+// startUpstream is a resolver that answers every A question with
+// upstreamIP and counts the queries it got.
+func startUpstream(t *testing.T) (string, *int32) {
+	var queries int32
+	addr := serveUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if q := r.Question[0]; q.Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP(upstreamIP),
+			})
+		}
+		w.WriteMsg(m)
+	}))
+	return addr, &queries
+}
+
+func newTestServer(t *testing.T) (*DNSServer, string, *fakeAuthorizer, *int32) {
+	t.Helper()
+	upstream, queries := startUpstream(t)
+	auth := &fakeAuthorizer{}
+	s := NewDNSServer("192.168.1.1")
+	s.Upstreams = []string{upstream}
+	s.Authorizer = auth
+	return s, serveUDP(t, s), auth, queries
+}
+
+func query(t *testing.T, server, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	resp, _, err := (&dns.Client{Timeout: 2 * time.Second}).Exchange(m, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestSpoofsAForUnauthorizedClients(t *testing.T) {
+	_, server, _, queries := newTestServer(t)
+	resp := query(t, server, "example.com", dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess || !resp.Authoritative || len(resp.Answer) != 1 {
+		t.Fatalf("response = %v", resp)
+	}
+	a, ok := resp.Answer[0].(*dns.A)
+	if !ok || a.A.String() != "192.168.1.1" || a.Hdr.Ttl != spoofTTL {
+		t.Errorf("answer = %v, want 192.168.1.1 with TTL %d", resp.Answer[0], spoofTTL)
+	}
+	if n := atomic.LoadInt32(queries); n != 0 {
+		t.Errorf("upstream got %d queries for an unauthorized client", n)
+	}
+}
+
+func TestEmptyAnswerForOtherTypes(t *testing.T) {
+	_, server, _, _ := newTestServer(t)
+	for _, qtype := range []uint16{dns.TypeAAAA, dns.TypeHTTPS, dns.TypeTXT} {
+		resp := query(t, server, "example.com", qtype)
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+			t.Errorf("%s: rcode %s with %d answers, want an empty NOERROR",
+				dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode], len(resp.Answer))
+		}
+	}
+}
+
+func TestForwardsForAuthorizedClients(t *testing.T) {
+	_, server, auth, queries := newTestServer(t)
+	auth.set(true)
+	resp := query(t, server, "example.com", dns.TypeA)
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != upstreamIP {
+		t.Errorf("answer = %v, want the upstream's %s", resp.Answer, upstreamIP)
+	}
+	query(t, server, "example.com", dns.TypeAAAA)
+	if n := atomic.LoadInt32(queries); n != 2 {
+		t.Errorf("upstream got %d queries, want 2", n)
+	}
+}
+
+func TestAuthorizationIsCached(t *testing.T) {
+	s, server, auth, _ := newTestServer(t)
+	for i := 0; i < 3; i++ {
+		query(t, server, "example.com", dns.TypeA)
+	}
+	if n := auth.callCount(); n != 1 {
+		t.Errorf("Authorizer asked %d times, want once", n)
+	}
+
+	// Paying shows only once the cached decision runs out
+	auth.set(true)
+	if resp := query(t, server, "example.com", dns.TypeA); resp.Answer[0].(*dns.A).A.String() != "192.168.1.1" {
+		t.Errorf("cached refusal ignored: %v", resp.Answer)
+	}
+	s.cacheLock.Lock()
+	for ip, d := range s.authCache {
+		d.expires = time.Now().Add(-time.Second)
+		s.authCache[ip] = d
+	}
+	s.cacheLock.Unlock()
+	if resp := query(t, server, "example.com", dns.TypeA); resp.Answer[0].(*dns.A).A.String() != upstreamIP {
+		t.Errorf("expired decision reused: %v", resp.Answer)
+	}
+	if n := auth.callCount(); n != 2 {
+		t.Errorf("Authorizer asked %d times, want twice", n)
+	}
+}
@@ -0,0 +1,66 @@
+package payment
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Mock is a local provider for development and tests. Orders are created
+// in memory; a payment is simulated by posting a body from PaymentBody to
+// the webhook with the X-Mock-Signature header from Sign. Anyone who
+// knows the secret can activate plans, so it has to be set and kept like
+// a real provider's.
+type Mock struct {
+	WebhookSecret string
+}
+
+func NewMock(webhookSecret string) *Mock {
+	return &Mock{WebhookSecret: webhookSecret}
+}
+
+func (p *Mock) Name() string { return "mock" }
+
+// CreateOrder returns an order with a random ID, so IDs stay unique in
+// payment_orders across restarts.
+func (p *Mock) CreateOrder(amount int64, currency, receipt string) (*Order, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &Order{ID: "order_mock_" + hex.EncodeToString(b), Amount: amount, Currency: currency, Receipt: receipt}, nil
+}
+
+// Sign returns the X-Mock-Signature value for body.
+func (p *Mock) Sign(body []byte) string {
+	return sign(p.WebhookSecret, body)
+}
+
+// PaymentBody builds the webhook body for a payment against orderID.
+func (p *Mock) PaymentBody(orderID, paymentID string, amount int64, status string) []byte {
+	body, _ := json.Marshal(map[string]interface{}{
+		"order_id":   orderID,
+		"payment_id": paymentID,
+		"amount":     amount,
+		"status":     status,
+	})
+	return body
+}
+
+func (p *Mock) VerifyWebhook(body []byte, header http.Header) (*Event, error) {
+	if p.WebhookSecret == "" || !validSignature(p.WebhookSecret, body, header.Get("X-Mock-Signature")) {
+		return nil, fmt.Errorf("invalid webhook signature")
+	}
+	var hook struct {
+		OrderID   string `json:"order_id"`
+		PaymentID string `json:"payment_id"`
+		Amount    int64  `json:"amount"`
+		Status    string `json:"status"`
+	}
+	if err := json.Unmarshal(body, &hook); err != nil {
+		return nil, fmt.Errorf("bad webhook payload: %v", err)
+	}
+	return &Event{OrderID: hook.OrderID, PaymentID: hook.PaymentID, Amount: hook.Amount, Status: hook.Status}, nil
+}
@@ -0,0 +1,73 @@
+package payment
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// Order is a provider-side order the customer pays against.
+type Order struct {
+	ID       string `json:"order_id"`
+	Amount   int64  `json:"amount"` // smallest currency unit (paise)
+	Currency string `json:"currency"`
+	Receipt  string `json:"receipt"`
+	// KeyID is the public key the checkout widget needs, if any.
+	KeyID string `json:"key_id,omitempty"`
+}
+
+// Event is a verified webhook notification.
+type Event struct {
+	OrderID   string
+	PaymentID string
+	Amount    int64
+	// Status is "captured" once the money is in, "failed" otherwise.
+	Status string
+}
+
+// Provider creates orders and verifies the provider's signed webhooks.
+type Provider interface {
+	Name() string
+	CreateOrder(amount int64, currency, receipt string) (*Order, error)
+	// VerifyWebhook checks the signature over the raw body and decodes it.
+	// It returns (nil, nil) for events that are not about payments.
+	VerifyWebhook(body []byte, header http.Header) (*Event, error)
+}
+
+// Config holds the credentials shared by the providers.
+type Config struct {
+	KeyID         string
+	KeySecret     string
+	WebhookSecret string
+}
+
+// NewProvider returns the provider called name: "razorpay" or "mock".
+func NewProvider(name string, cfg Config) (Provider, error) {
+	switch name {
+	case "razorpay":
+		if cfg.KeyID == "" || cfg.KeySecret == "" || cfg.WebhookSecret == "" {
+			return nil, fmt.Errorf("razorpay needs a key ID, key secret and webhook secret")
+		}
+		return NewRazorpay(cfg), nil
+	case "mock":
+		if cfg.WebhookSecret == "" {
+			return nil, fmt.Errorf("mock needs a webhook secret")
+		}
+		return NewMock(cfg.WebhookSecret), nil
+	}
+	return nil, fmt.Errorf("unknown payment provider %q (use razorpay or mock)", name)
+}
+
+// sign is the hex HMAC-SHA256 both providers use for webhooks.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func validSignature(secret string, body []byte, signature string) bool {
+	expected := sign(secret, body)
+	return signature != "" && hmac.Equal([]byte(expected), []byte(signature))
+}
@@ -0,0 +1,82 @@
+package payment
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNewProviderNeedsWebhookSecret(t *testing.T) {
+	if _, err := NewProvider("mock", Config{}); err == nil {
+		t.Error("mock provider created without a webhook secret")
+	}
+	if _, err := NewProvider("razorpay", Config{KeyID: "id", KeySecret: "secret"}); err == nil {
+		t.Error("razorpay provider created without a webhook secret")
+	}
+	if _, err := NewProvider("mock", Config{WebhookSecret: "s"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMockVerifyWebhook(t *testing.T) {
+	p := NewMock("secret")
+	body := p.PaymentBody("order_mock_1", "pay_1", 2000, "captured")
+
+	header := http.Header{}
+	header.Set("X-Mock-Signature", p.Sign(body))
+	event, err := p.VerifyWebhook(body, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *event != (Event{OrderID: "order_mock_1", PaymentID: "pay_1", Amount: 2000, Status: "captured"}) {
+		t.Errorf("event = %+v", event)
+	}
+
+	header.Set("X-Mock-Signature", NewMock("other").Sign(body))
+	if _, err := p.VerifyWebhook(body, header); err == nil {
+		t.Error("webhook signed with another secret was accepted")
+	}
+	if _, err := (&Mock{}).VerifyWebhook(body, http.Header{"X-Mock-Signature": {sign("", body)}}); err == nil {
+		t.Error("webhook accepted by a mock without a secret")
+	}
+}
+
+func TestRazorpayVerifyWebhook(t *testing.T) {
+	p := NewRazorpay(Config{KeyID: "id", KeySecret: "secret", WebhookSecret: "hook"})
+	body := []byte(`{"event":"payment.captured","payload":{"payment":{"entity":{"id":"pay_1","order_id":"order_1","amount":2000,"status":"captured"}}}}`)
+
+	header := http.Header{}
+	header.Set("X-Razorpay-Signature", sign("hook", body))
+	event, err := p.VerifyWebhook(body, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.OrderID != "order_1" || event.Status != "captured" || event.Amount != 2000 {
+		t.Errorf("event = %+v", event)
+	}
+
+	header.Set("X-Razorpay-Signature", sign("secret", body))
+	if _, err := p.VerifyWebhook(body, header); err == nil {
+		t.Error("webhook signed with the API secret was accepted")
+	}
+
+	other := []byte(`{"event":"refund.created"}`)
+	header.Set("X-Razorpay-Signature", sign("hook", other))
+	if event, err := p.VerifyWebhook(other, header); event != nil || err != nil {
+		t.Errorf("refund event = %+v, %v; want it ignored", event, err)
+	}
+}
+
+func TestMockOrderIDs(t *testing.T) {
+	p := NewMock("secret")
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		order, err := p.CreateOrder(100, "INR", "r")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[order.ID] {
+			t.Fatalf("order ID %s repeated", order.ID)
+		}
+		seen[order.ID] = true
+	}
+}
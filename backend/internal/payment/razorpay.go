@@ -0,0 +1,105 @@
+package payment
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Razorpay talks to the Razorpay Orders API. The customer pays (UPI, card,
+// wallet) in Razorpay Checkout against the returned order, and Razorpay
+// reports the result to the webhook signed with the webhook secret.
+type Razorpay struct {
+	KeyID         string
+	KeySecret     string
+	WebhookSecret string
+	BaseURL       string
+	Client        *http.Client
+}
+
+func NewRazorpay(cfg Config) *Razorpay {
+	return &Razorpay{
+		KeyID:         cfg.KeyID,
+		KeySecret:     cfg.KeySecret,
+		WebhookSecret: cfg.WebhookSecret,
+		BaseURL:       "https://api.razorpay.com/v1",
+		Client:        &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *Razorpay) Name() string { return "razorpay" }
+
+func (p *Razorpay) CreateOrder(amount int64, currency, receipt string) (*Order, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"amount":   amount,
+		"currency": currency,
+		"receipt":  receipt,
+	})
+	req, err := http.NewRequest("POST", p.BaseURL+"/orders", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(p.KeyID, p.KeySecret)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("razorpay: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("razorpay: create order failed (%d): %s", resp.StatusCode, data)
+	}
+
+	var order struct {
+		ID       string `json:"id"`
+		Amount   int64  `json:"amount"`
+		Currency string `json:"currency"`
+		Receipt  string `json:"receipt"`
+	}
+	if err := json.Unmarshal(data, &order); err != nil {
+		return nil, fmt.Errorf("razorpay: bad order response: %v", err)
+	}
+	return &Order{ID: order.ID, Amount: order.Amount, Currency: order.Currency, Receipt: order.Receipt, KeyID: p.KeyID}, nil
+}
+
+// VerifyWebhook checks X-Razorpay-Signature and decodes payment.captured,
+// order.paid and payment.failed events.
+func (p *Razorpay) VerifyWebhook(body []byte, header http.Header) (*Event, error) {
+	if !validSignature(p.WebhookSecret, body, header.Get("X-Razorpay-Signature")) {
+		return nil, fmt.Errorf("invalid webhook signature")
+	}
+
+	var hook struct {
+		Event   string `json:"event"`
+		Payload struct {
+			Payment struct {
+				Entity struct {
+					ID      string `json:"id"`
+					OrderID string `json:"order_id"`
+					Amount  int64  `json:"amount"`
+					Status  string `json:"status"`
+				} `json:"entity"`
+			} `json:"payment"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &hook); err != nil {
+		return nil, fmt.Errorf("bad webhook payload: %v", err)
+	}
+
+	payment := hook.Payload.Payment.Entity
+	event := &Event{OrderID: payment.OrderID, PaymentID: payment.ID, Amount: payment.Amount}
+	switch hook.Event {
+	case "payment.captured", "order.paid":
+		event.Status = "captured"
+	case "payment.failed":
+		event.Status = "failed"
+	default:
+		return nil, nil
+	}
+	return event, nil
+}
@@ -0,0 +1,478 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// PacketConn sends and receives raw Ethernet frames on one interface. The
+// Linux implementation is an AF_PACKET socket; tests can plug in a veth
+// pair or any other packet source.
+type PacketConn interface {
+	ReadFrame(buf []byte) (int, error)
+	WriteFrame(frame []byte) error
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+const (
+	arpRequest = 1
+	arpReply   = 2
+
+	etherTypeARP = 0x0806
+	arpFrameLen  = 42
+	minFrameLen  = 60
+
+	// neighborTTL is how long a learned IP->MAC mapping is believed
+	// without being seen again.
+	neighborTTL = 2 * time.Minute
+)
+
+var broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// arpPacket is an Ethernet/IPv4 ARP frame.
+type arpPacket struct {
+	EthDst    net.HardwareAddr
+	EthSrc    net.HardwareAddr
+	Op        uint16
+	SenderMAC net.HardwareAddr
+	SenderIP  net.IP
+	TargetMAC net.HardwareAddr
+	TargetIP  net.IP
+}
+
+func (p *arpPacket) marshal() []byte {
+	b := make([]byte, minFrameLen)
+	copy(b[0:6], p.EthDst)
+	copy(b[6:12], p.EthSrc)
+	binary.BigEndian.PutUint16(b[12:14], etherTypeARP)
+	binary.BigEndian.PutUint16(b[14:16], 1)      // Ethernet
+	binary.BigEndian.PutUint16(b[16:18], 0x0800) // IPv4
+	b[18] = 6
+	b[19] = 4
+	binary.BigEndian.PutUint16(b[20:22], p.Op)
+	copy(b[22:28], p.SenderMAC)
+	copy(b[28:32], p.SenderIP.To4())
+	copy(b[32:38], p.TargetMAC)
+	copy(b[38:42], p.TargetIP.To4())
+	return b
+}
+
+func parseARP(b []byte) (*arpPacket, error) {
+	if len(b) < arpFrameLen {
+		return nil, fmt.Errorf("short frame")
+	}
+	if binary.BigEndian.Uint16(b[12:14]) != etherTypeARP {
+		return nil, fmt.Errorf("not an ARP frame")
+	}
+	if binary.BigEndian.Uint16(b[16:18]) != 0x0800 || b[18] != 6 || b[19] != 4 {
+		return nil, fmt.Errorf("not an Ethernet/IPv4 ARP frame")
+	}
+	return &arpPacket{
+		EthDst:    net.HardwareAddr(append([]byte(nil), b[0:6]...)),
+		EthSrc:    net.HardwareAddr(append([]byte(nil), b[6:12]...)),
+		Op:        binary.BigEndian.Uint16(b[20:22]),
+		SenderMAC: net.HardwareAddr(append([]byte(nil), b[22:28]...)),
+		SenderIP:  net.IP(append([]byte(nil), b[28:32]...)),
+		TargetMAC: net.HardwareAddr(append([]byte(nil), b[32:38]...)),
+		TargetIP:  net.IP(append([]byte(nil), b[38:42]...)),
+	}, nil
+}
+
+// Neighbor is a host that answered ARP on the hotspot interface.
+type Neighbor struct {
+	IP       string
+	MAC      string
+	LastSeen time.Time
+}
+
+type spoofTarget struct {
+	ip  net.IP
+	mac net.HardwareAddr
+}
+
+type restoreJob struct {
+	spoofTarget
+	rounds int
+}
+
+type scanJob struct {
+	ips      []net.IP
+	started  time.Time
+	deadline time.Time
+	done     chan []Neighbor
+}
+
+// ARPEngine replaces the arp-scan/arpspoof subprocesses. A single
+// goroutine (Run) sweeps the subnet, keeps every blocked client poisoned
+// and restores the real mappings when a client is allowed again, no matter
+// how many clients there are.
+type ARPEngine struct {
+	Conn    PacketConn
+	HostMAC net.HardwareAddr
+	HostIP  net.IP
+	Subnet  *net.IPNet
+	// Interval between spoof/restore rounds.
+	Interval time.Duration
+	// RestoreRounds is how many rounds of correct replies an allowed client gets.
+	RestoreRounds int
+
+	lock       sync.Mutex
+	gatewayIP  net.IP
+	gatewayMAC net.HardwareAddr
+	targets    map[string]spoofTarget // target MAC -> target
+	restores   map[string]*restoreJob // target MAC -> job
+	neighbors  map[string]Neighbor    // IP -> neighbor
+	scans      chan *scanJob
+	stop       chan struct{}
+	stopOnce   sync.Once
+	closeOnce  sync.Once
+	done       chan struct{} // closed when Run returns
+	running    bool
+	stopped    bool
+}
+
+func NewARPEngine(conn PacketConn, hostMAC net.HardwareAddr, hostIP net.IP, subnet *net.IPNet) *ARPEngine {
+	return &ARPEngine{
+		Conn:          conn,
+		HostMAC:       hostMAC,
+		HostIP:        hostIP,
+		Subnet:        subnet,
+		Interval:      2 * time.Second,
+		RestoreRounds: 20,
+		targets:       make(map[string]spoofTarget),
+		restores:      make(map[string]*restoreJob),
+		neighbors:     make(map[string]Neighbor),
+		scans:         make(chan *scanJob, 4),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// SetGateway tells the engine which host clients must be cut off from.
+// mac may be nil; it is then learned over ARP.
+func (e *ARPEngine) SetGateway(ip net.IP, mac net.HardwareAddr) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.gatewayIP = ip
+	if mac != nil {
+		e.gatewayMAC = mac
+	}
+}
+
+// Spoof starts poisoning the target and the gateway against each other.
+func (e *ARPEngine) Spoof(ip net.IP, mac net.HardwareAddr) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	key := mac.String()
+	delete(e.restores, key)
+	e.targets[key] = spoofTarget{ip: ip.To4(), mac: mac}
+}
+
+// Restore stops poisoning the target and re-announces the real mappings
+// for RestoreRounds rounds.
+func (e *ARPEngine) Restore(ip net.IP, mac net.HardwareAddr) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	key := mac.String()
+	delete(e.targets, key)
+	e.restores[key] = &restoreJob{spoofTarget: spoofTarget{ip: ip.To4(), mac: mac}, rounds: e.RestoreRounds}
+}
+
+// IsSpoofing reports whether mac is currently poisoned.
+func (e *ARPEngine) IsSpoofing(mac string) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, ok := e.targets[mac]
+	return ok
+}
+
+// Lookup returns the MAC last seen for ip, if seen within neighborTTL.
+func (e *ARPEngine) Lookup(ip string) (string, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	n, ok := e.neighbors[ip]
+	if !ok || time.Since(n.LastSeen) > neighborTTL {
+		return "", false
+	}
+	return n.MAC, true
+}
+
+// LookupIP returns the IP last seen for mac.
+func (e *ARPEngine) LookupIP(mac string) (string, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	best := Neighbor{LastSeen: time.Now().Add(-neighborTTL)}
+	for _, n := range e.neighbors {
+		if n.MAC == mac && n.LastSeen.After(best.LastSeen) {
+			best = n
+		}
+	}
+	return best.IP, best.IP != ""
+}
+
+// Scan sweeps the subnet with ARP requests and returns every host that
+// answered within timeout.
+func (e *ARPEngine) Scan(timeout time.Duration) ([]Neighbor, error) {
+	if e.Subnet == nil {
+		return nil, fmt.Errorf("no subnet to scan")
+	}
+	ips := subnetHosts(e.Subnet, 1024)
+	now := time.Now()
+	job := &scanJob{ips: ips, started: now, deadline: now.Add(timeout), done: make(chan []Neighbor, 1)}
+	select {
+	case e.scans <- job:
+	case <-e.stop:
+		return nil, fmt.Errorf("arp engine stopped")
+	}
+	select {
+	case result := <-job.done:
+		return result, nil
+	case <-e.stop:
+		return nil, fmt.Errorf("arp engine stopped")
+	}
+}
+
+// Close stops Run and closes the socket. It is safe to call more than once.
+func (e *ARPEngine) Close() error {
+	e.halt()
+	var err error
+	e.closeOnce.Do(func() { err = e.Conn.Close() })
+	return err
+}
+
+// halt stops Run and waits for it to return, so nothing else uses the
+// socket afterwards.
+func (e *ARPEngine) halt() {
+	e.stopOnce.Do(func() { close(e.stop) })
+	e.lock.Lock()
+	e.stopped = true
+	running := e.running
+	e.lock.Unlock()
+	if running {
+		<-e.done
+	}
+}
+
+// Shutdown releases every poisoned client with a few quick rounds of
+// correct replies, then closes the engine. Used when the server exits.
+func (e *ARPEngine) Shutdown() {
+	e.halt()
+	e.lock.Lock()
+	for key, t := range e.targets {
+		e.restores[key] = &restoreJob{spoofTarget: t, rounds: 3}
+		delete(e.targets, key)
+	}
+	e.lock.Unlock()
+
+	for i := 0; i < 3; i++ {
+		e.round()
+		time.Sleep(200 * time.Millisecond)
+	}
+	e.Close()
+}
+
+// Run is the engine loop. It returns after Close.
+func (e *ARPEngine) Run() {
+	e.lock.Lock()
+	if e.stopped {
+		e.lock.Unlock()
+		return
+	}
+	e.running = true
+	e.lock.Unlock()
+	defer close(e.done)
+
+	buf := make([]byte, 1514)
+	var pending []*scanJob
+	nextRound := time.Now()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		default:
+		}
+
+		now := time.Now()
+		if !now.Before(nextRound) {
+			e.round()
+			nextRound = now.Add(e.Interval)
+		}
+
+		// Accept new scans without blocking
+	accept:
+		for {
+			select {
+			case job := <-e.scans:
+				for _, ip := range job.ips {
+					e.send(e.request(ip))
+				}
+				pending = append(pending, job)
+			default:
+				break accept
+			}
+		}
+
+		// Finish scans whose answer window has closed
+		deadline := nextRound
+		remaining := pending[:0]
+		for _, job := range pending {
+			if !now.Before(job.deadline) {
+				job.done <- e.seenSince(job.started)
+				continue
+			}
+			if job.deadline.Before(deadline) {
+				deadline = job.deadline
+			}
+			remaining = append(remaining, job)
+		}
+		pending = remaining
+
+		// Stay responsive to Close and new scans
+		if max := now.Add(200 * time.Millisecond); max.Before(deadline) {
+			deadline = max
+		}
+		e.Conn.SetReadDeadline(deadline)
+		n, err := e.Conn.ReadFrame(buf)
+		if err != nil || n == 0 {
+			continue
+		}
+		e.handle(buf[:n])
+	}
+}
+
+// round sends one batch of spoofed and restoring replies.
+func (e *ARPEngine) round() {
+	e.lock.Lock()
+	gwIP, gwMAC := e.gatewayIP, e.gatewayMAC
+	targets := make([]spoofTarget, 0, len(e.targets))
+	for _, t := range e.targets {
+		targets = append(targets, t)
+	}
+	for ip, n := range e.neighbors {
+		if time.Since(n.LastSeen) > neighborTTL {
+			delete(e.neighbors, ip)
+		}
+	}
+	var restores []spoofTarget
+	for key, job := range e.restores {
+		restores = append(restores, job.spoofTarget)
+		job.rounds--
+		if job.rounds <= 0 {
+			delete(e.restores, key)
+		}
+	}
+	e.lock.Unlock()
+
+	if gwIP == nil {
+		return
+	}
+	if gwMAC == nil && (len(targets) > 0 || len(restores) > 0) {
+		e.send(e.request(gwIP))
+	}
+
+	for _, t := range targets {
+		// Tell the client the gateway is at our MAC
+		e.send(e.reply(t.mac, t.ip, e.HostMAC, gwIP))
+		// Tell the gateway the client is at our MAC
+		if gwMAC != nil {
+			e.send(e.reply(gwMAC, gwIP, e.HostMAC, t.ip))
+		}
+	}
+	for _, t := range restores {
+		if gwMAC == nil {
+			continue
+		}
+		e.send(e.reply(t.mac, t.ip, gwMAC, gwIP))
+		e.send(e.reply(gwMAC, gwIP, t.mac, t.ip))
+	}
+}
+
+// handle learns neighbors from any ARP frame not sent by us. A frame
+// whose ARP sender differs from its Ethernet source is forged, e.g. a
+// client claiming another device's MAC, and is ignored.
+func (e *ARPEngine) handle(frame []byte) {
+	p, err := parseARP(frame)
+	if err != nil || bytes.Equal(p.SenderMAC, e.HostMAC) || p.SenderIP.IsUnspecified() {
+		return
+	}
+	if !bytes.Equal(p.SenderMAC, p.EthSrc) {
+		return
+	}
+	ip := p.SenderIP.String()
+	mac := p.SenderMAC.String()
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.neighbors[ip] = Neighbor{IP: ip, MAC: mac, LastSeen: time.Now()}
+	if e.gatewayIP != nil && p.SenderIP.Equal(e.gatewayIP) {
+		e.gatewayMAC = p.SenderMAC
+	}
+}
+
+func (e *ARPEngine) seenSince(t time.Time) []Neighbor {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	var out []Neighbor
+	for _, n := range e.neighbors {
+		if !n.LastSeen.Before(t) {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+func (e *ARPEngine) request(ip net.IP) *arpPacket {
+	return &arpPacket{
+		EthDst:    broadcastMAC,
+		EthSrc:    e.HostMAC,
+		Op:        arpRequest,
+		SenderMAC: e.HostMAC,
+		SenderIP:  e.HostIP,
+		TargetMAC: make(net.HardwareAddr, 6),
+		TargetIP:  ip,
+	}
+}
+
+// reply builds "senderIP is-at senderMAC" addressed to the victim.
+func (e *ARPEngine) reply(dstMAC net.HardwareAddr, dstIP net.IP, senderMAC net.HardwareAddr, senderIP net.IP) *arpPacket {
+	return &arpPacket{
+		EthDst:    dstMAC,
+		EthSrc:    e.HostMAC,
+		Op:        arpReply,
+		SenderMAC: senderMAC,
+		SenderIP:  senderIP,
+		TargetMAC: dstMAC,
+		TargetIP:  dstIP,
+	}
+}
+
+func (e *ARPEngine) send(p *arpPacket) {
+	if err := e.Conn.WriteFrame(p.marshal()); err != nil {
+		fmt.Printf("[ARP] Send failed: %v\n", err)
+	}
+}
+
+// subnetHosts lists the host addresses of n, capped at limit.
+func subnetHosts(n *net.IPNet, limit int) []net.IP {
+	base := n.IP.Mask(n.Mask).To4()
+	if base == nil {
+		return nil
+	}
+	ones, bits := n.Mask.Size()
+	size := 1 << uint(bits-ones)
+	start := binary.BigEndian.Uint32(base)
+
+	var ips []net.IP
+	for i := 1; i < size-1 && len(ips) < limit; i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, start+uint32(i))
+		ips = append(ips, ip)
+	}
+	return ips
+}
@@ -0,0 +1,63 @@
+//go:build linux
+
+package router
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// rawARPConn is an AF_PACKET socket bound to one interface that only
+// receives ARP frames.
+type rawARPConn struct {
+	fd      int
+	ifindex int
+}
+
+// OpenARPSocket opens a raw ARP socket on iface. It needs CAP_NET_RAW.
+func OpenARPSocket(iface string) (PacketConn, *net.Interface, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, nil, err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(htons(etherTypeARP)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("raw socket: %v", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(etherTypeARP), Ifindex: ifi.Index}); err != nil {
+		unix.Close(fd)
+		return nil, nil, fmt.Errorf("bind %s: %v", iface, err)
+	}
+	return &rawARPConn{fd: fd, ifindex: ifi.Index}, ifi, nil
+}
+
+func (c *rawARPConn) ReadFrame(buf []byte) (int, error) {
+	n, _, err := unix.Recvfrom(c.fd, buf, 0)
+	return n, err
+}
+
+func (c *rawARPConn) WriteFrame(frame []byte) error {
+	addr := &unix.SockaddrLinklayer{Protocol: htons(etherTypeARP), Ifindex: c.ifindex, Halen: 6}
+	copy(addr.Addr[:], frame[0:6])
+	return unix.Sendto(c.fd, frame, 0, addr)
+}
+
+func (c *rawARPConn) SetReadDeadline(t time.Time) error {
+	d := time.Until(t)
+	if d < time.Millisecond {
+		d = time.Millisecond
+	}
+	tv := unix.NsecToTimeval(d.Nanoseconds())
+	return unix.SetsockoptTimeval(c.fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+}
+
+func (c *rawARPConn) Close() error {
+	return unix.Close(c.fd)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package router
+
+import (
+	"fmt"
+	"net"
+)
+
+// OpenARPSocket is only implemented on Linux.
+func OpenARPSocket(iface string) (PacketConn, *net.Interface, error) {
+	return nil, nil, fmt.Errorf("raw ARP sockets are only supported on Linux")
+}
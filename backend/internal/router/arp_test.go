@@ -0,0 +1,224 @@
+package router
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePacketConn is a PacketConn fed from a channel; sent frames are kept.
+type fakePacketConn struct {
+	in chan []byte
+
+	mu       sync.Mutex
+	sent     [][]byte
+	deadline time.Time
+	closed   int
+	reading  bool
+}
+
+func newFakePacketConn() *fakePacketConn {
+	return &fakePacketConn{in: make(chan []byte, 16)}
+}
+
+func (c *fakePacketConn) ReadFrame(buf []byte) (int, error) {
+	c.mu.Lock()
+	if c.closed > 0 {
+		c.mu.Unlock()
+		return 0, errors.New("use of closed socket")
+	}
+	c.reading = true
+	wait := time.Until(c.deadline)
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.reading = false
+		c.mu.Unlock()
+	}()
+
+	select {
+	case frame := <-c.in:
+		return copy(buf, frame), nil
+	case <-time.After(wait):
+		return 0, errors.New("timeout")
+	}
+}
+
+func (c *fakePacketConn) WriteFrame(frame []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed > 0 {
+		return errors.New("use of closed socket")
+	}
+	c.sent = append(c.sent, append([]byte(nil), frame...))
+	return nil
+}
+
+func (c *fakePacketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *fakePacketConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reading {
+		return errors.New("closed while a read was in progress")
+	}
+	c.closed++
+	return nil
+}
+
+func (c *fakePacketConn) sentPackets(t *testing.T) []*arpPacket {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []*arpPacket
+	for _, f := range c.sent {
+		p, err := parseARP(f)
+		if err != nil {
+			t.Fatalf("sent frame is not ARP: %v", err)
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+var (
+	testHostMAC    = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	testGatewayMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0xfe}
+	testVictimMAC  = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0, 0, 0x01}
+	testClientMAC  = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0, 0, 0x02}
+)
+
+func newTestEngine(conn PacketConn) *ARPEngine {
+	_, subnet, _ := net.ParseCIDR("192.168.1.0/24")
+	e := NewARPEngine(conn, testHostMAC, net.ParseIP("192.168.1.1"), subnet)
+	e.Interval = 10 * time.Millisecond
+	e.SetGateway(net.ParseIP("192.168.1.254"), testGatewayMAC)
+	return e
+}
+
+// announce is a gratuitous ARP reply: "ip is-at sender", sent from ethSrc.
+func announce(ethSrc, sender net.HardwareAddr, ip string) []byte {
+	p := &arpPacket{
+		EthDst: broadcastMAC, EthSrc: ethSrc, Op: arpReply,
+		SenderMAC: sender, SenderIP: net.ParseIP(ip),
+		TargetMAC: broadcastMAC, TargetIP: net.ParseIP(ip),
+	}
+	return p.marshal()
+}
+
+func TestARPIgnoresForgedSender(t *testing.T) {
+	e := newTestEngine(newFakePacketConn())
+
+	// A client claims 192.168.1.60 is at the victim's MAC
+	e.handle(announce(testClientMAC, testVictimMAC, "192.168.1.60"))
+	if mac, ok := e.Lookup("192.168.1.60"); ok {
+		t.Fatalf("forged mapping learned: 192.168.1.60 -> %s", mac)
+	}
+
+	e.handle(announce(testClientMAC, testClientMAC, "192.168.1.60"))
+	if mac, ok := e.Lookup("192.168.1.60"); !ok || mac != testClientMAC.String() {
+		t.Errorf("Lookup = %q, %v; want %s", mac, ok, testClientMAC)
+	}
+}
+
+func TestARPNeighborsExpire(t *testing.T) {
+	e := newTestEngine(newFakePacketConn())
+	e.handle(announce(testClientMAC, testClientMAC, "192.168.1.60"))
+
+	e.lock.Lock()
+	n := e.neighbors["192.168.1.60"]
+	n.LastSeen = time.Now().Add(-neighborTTL - time.Second)
+	e.neighbors["192.168.1.60"] = n
+	e.lock.Unlock()
+
+	if _, ok := e.Lookup("192.168.1.60"); ok {
+		t.Error("stale neighbor returned by Lookup")
+	}
+	if _, ok := e.LookupIP(testClientMAC.String()); ok {
+		t.Error("stale neighbor returned by LookupIP")
+	}
+	e.round()
+	if len(e.neighbors) != 0 {
+		t.Errorf("stale neighbor kept: %v", e.neighbors)
+	}
+}
+
+func TestARPSpoofAndRestore(t *testing.T) {
+	conn := newFakePacketConn()
+	e := newTestEngine(conn)
+	e.Spoof(net.ParseIP("192.168.1.60"), testClientMAC)
+	e.round()
+
+	sent := conn.sentPackets(t)
+	if len(sent) != 2 {
+		t.Fatalf("sent %d frames, want 2", len(sent))
+	}
+	if !sent[0].SenderIP.Equal(net.ParseIP("192.168.1.254")) || sent[0].SenderMAC.String() != testHostMAC.String() {
+		t.Errorf("client was not told the gateway is at our MAC: %+v", sent[0])
+	}
+
+	conn.sent = nil
+	e.Restore(net.ParseIP("192.168.1.60"), testClientMAC)
+	e.round()
+	sent = conn.sentPackets(t)
+	if len(sent) != 2 || sent[0].SenderMAC.String() != testGatewayMAC.String() {
+		t.Errorf("restore did not announce the real gateway: %+v", sent)
+	}
+	if e.IsSpoofing(testClientMAC.String()) {
+		t.Error("still spoofing after Restore")
+	}
+}
+
+func TestARPShutdownStopsRunFirst(t *testing.T) {
+	conn := newFakePacketConn()
+	e := newTestEngine(conn)
+	go e.Run()
+	e.Spoof(net.ParseIP("192.168.1.60"), testClientMAC)
+	time.Sleep(50 * time.Millisecond)
+
+	// Close fails in the fake if Run is still reading
+	e.Shutdown()
+	if conn.closed != 1 {
+		t.Fatalf("socket closed %d times, want 1", conn.closed)
+	}
+	last := conn.sentPackets(t)
+	if p := last[len(last)-1]; p.SenderMAC.String() == testHostMAC.String() {
+		t.Error("last frame before shutdown was still a spoofed reply")
+	}
+
+	// A second Close must not panic
+	if err := e.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	if conn.closed != 1 {
+		t.Errorf("socket closed %d times, want 1", conn.closed)
+	}
+}
+
+func TestARPScan(t *testing.T) {
+	conn := newFakePacketConn()
+	e := newTestEngine(conn)
+	_, e.Subnet, _ = net.ParseCIDR("192.168.1.0/30")
+	go e.Run()
+	defer e.Close()
+
+	// The client answers while the sweep is running
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		conn.in <- announce(testClientMAC, testClientMAC, "192.168.1.2")
+	}()
+	neighbors, err := e.Scan(300 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(neighbors) != 1 || neighbors[0].MAC != testClientMAC.String() {
+		t.Errorf("Scan = %+v", neighbors)
+	}
+}
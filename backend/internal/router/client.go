@@ -2,8 +2,8 @@ package router
 
 import (
 	"fmt"
+	"net"
 	"os"
-	"os/exec"
 	"strings"
 	"sync"
 	"time"
@@ -16,45 +16,81 @@ type Device struct {
 	IsBlocked bool   `json:"is_blocked"`
 }
 
+// Rate is a per-client speed limit in kbit/s; zero means unlimited.
+type Rate struct {
+	DownloadKbps int `json:"download_kbps"`
+	UploadKbps   int `json:"upload_kbps"`
+}
+
+// LeaseTable is an authoritative IP<->MAC source, such as the built-in
+// DHCP server. It is consulted before ARP.
+type LeaseTable interface {
+	LookupIP(mac string) (string, bool)
+	LookupMAC(ip string) (string, bool)
+}
+
 type BlockInfo struct {
-	Cmds []*exec.Cmd
-	IP   string
+	IP string
 }
 
 type RouterClient struct {
 	Interface     string
 	ActiveAttacks map[string]BlockInfo
+	Accounted     map[string]string // MAC -> IP with byte counters installed
+	Shaper        *Shaper
+	Rates         map[string]Rate   // MAC -> plan speed, applied on AllowMAC
+	shaped        map[string]string // MAC -> IP with shaping classes installed
 	GatewayIP     string
 	GatewayMAC    string
 	HostIP        string
 	HostMAC       string
+	Firewall      Firewall
+	Exec          Executor
+	ARP           *ARPEngine
+	Leases        LeaseTable
 	lock          sync.Mutex
 }
 
 func NewRouterClient(iface string) *RouterClient {
-	return &RouterClient{
+	c := &RouterClient{
 		Interface:     iface,
 		ActiveAttacks: make(map[string]BlockInfo),
+		Accounted:     make(map[string]string),
+		Exec:          SystemExecutor{},
+	}
+	c.Firewall = NewIPTablesFirewall(c.ExecuteCommand)
+	c.Shaper = NewShaper(iface, c.ExecuteCommand)
+	c.Rates = make(map[string]Rate)
+	c.shaped = make(map[string]string)
+	return c
+}
+
+// SetFirewallBackend swaps the firewall implementation by name ("iptables" or "nftables").
+func (c *RouterClient) SetFirewallBackend(name string) error {
+	fw, err := NewFirewall(name, c.ExecuteCommand)
+	if err != nil {
+		return err
 	}
+	c.Firewall = fw
+	return nil
 }
 
 func (c *RouterClient) Connect() error {
-	requiredTools := []string{"arp-scan", "arpspoof", "iptables"}
+	requiredTools := []string{c.Firewall.Tool()}
 	for _, tool := range requiredTools {
-		if _, err := exec.LookPath(tool); err != nil {
+		if _, err := c.Exec.LookPath(tool); err != nil {
 			return fmt.Errorf("required tool not found: %s", tool)
 		}
 	}
 
 	if c.GatewayIP == "" {
-		cmd := exec.Command("sh", "-c", fmt.Sprintf("ip route show dev %s | grep default | awk '{print $3}'", c.Interface))
-		output, err := cmd.Output()
+		output, err := c.Exec.Output("sh", "-c", fmt.Sprintf("ip route show dev %s | grep default | awk '{print $3}'", c.Interface))
 		if err == nil && len(output) > 0 {
 			c.GatewayIP = strings.TrimSpace(string(output))
 			fmt.Printf("[INIT] Auto-detected Real Gateway IP: %s on %s\n", c.GatewayIP, c.Interface)
 			
 			// Detect Gateway MAC early
-			arpOut, _ := exec.Command("sh", "-c", fmt.Sprintf("arping -c 1 -I %s %s && arp -n %s | grep %s | awk '{print $3}'", c.Interface, c.GatewayIP, c.GatewayIP, c.GatewayIP)).Output()
+			arpOut, _ := c.Exec.Output("sh", "-c", fmt.Sprintf("arping -c 1 -I %s %s && arp -n %s | grep %s | awk '{print $3}'", c.Interface, c.GatewayIP, c.GatewayIP, c.GatewayIP))
 			c.GatewayMAC = strings.ToLower(strings.TrimSpace(string(arpOut)))
 			if c.GatewayMAC != "" {
 				fmt.Printf("[INIT] Gateway MAC Detected: %s\n", c.GatewayMAC)
@@ -63,25 +99,67 @@ func (c *RouterClient) Connect() error {
 	}
 
 	// Detect Host IP and MAC
-	cmdIP := exec.Command("sh", "-c", fmt.Sprintf("ip -o -4 addr show %s | awk '{print $4}' | cut -d/ -f1", c.Interface))
-	outIP, _ := cmdIP.Output()
+	outIP, _ := c.Exec.Output("sh", "-c", fmt.Sprintf("ip -o -4 addr show %s | awk '{print $4}' | cut -d/ -f1", c.Interface))
 	c.HostIP = strings.TrimSpace(string(outIP))
 
-	cmdMAC := exec.Command("sh", "-c", fmt.Sprintf("cat /sys/class/net/%s/address", c.Interface))
-	outMAC, _ := cmdMAC.Output()
+	outMAC, _ := c.Exec.Output("sh", "-c", fmt.Sprintf("cat /sys/class/net/%s/address", c.Interface))
 	c.HostMAC = strings.ToLower(strings.TrimSpace(string(outMAC)))
 
 	fmt.Printf("[INIT] Host Personal Info: IP=%s MAC=%s\n", c.HostIP, c.HostMAC)
 
-	exec.Command("sysctl", "-w", "net.ipv4.ip_forward=1").Run()
+	c.Exec.CombinedOutput("sysctl", "-w", "net.ipv4.ip_forward=1")
+
+	// The native ARP engine sends real frames, so it only runs when
+	// commands do (not in dry-run mode or tests)
+	if c.live() && c.ARP == nil {
+		if err := c.startARP(); err != nil {
+			fmt.Printf("[INIT] Warning: ARP engine unavailable (%v). Falling back to /proc/net/arp and firewall-only blocking.\n", err)
+		}
+	}
 
 	fmt.Printf("RouterClient Ready: Interface=%s, Gateway=%s, Tools Verified.\n", c.Interface, c.GatewayIP)
 	return nil
 }
 
+// startARP opens the raw ARP socket and starts the engine loop.
+func (c *RouterClient) startARP() error {
+	conn, ifi, err := OpenARPSocket(c.Interface)
+	if err != nil {
+		return err
+	}
+
+	var subnet *net.IPNet
+	addrs, _ := ifi.Addrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			subnet = ipnet
+			break
+		}
+	}
+	hostIP := net.ParseIP(c.HostIP)
+	if subnet == nil || hostIP == nil {
+		conn.Close()
+		return fmt.Errorf("no IPv4 address on %s", c.Interface)
+	}
+
+	c.ARP = NewARPEngine(conn, ifi.HardwareAddr, hostIP, subnet)
+	if gw := net.ParseIP(c.GatewayIP); gw != nil {
+		gwMAC, _ := net.ParseMAC(c.GatewayMAC)
+		c.ARP.SetGateway(gw, gwMAC)
+	}
+	go c.ARP.Run()
+	fmt.Printf("[INIT] ARP engine running on %s (%s)\n", c.Interface, subnet)
+	return nil
+}
+
+// live reports whether commands really run on the host.
+func (c *RouterClient) live() bool {
+	_, ok := c.Exec.(SystemExecutor)
+	return ok
+}
+
 func (c *RouterClient) ExecuteCommand(command string) (string, error) {
-	cmd := exec.Command("sh", "-c", command)
-	output, err := cmd.CombinedOutput()
+	output, err := c.Exec.CombinedOutput("sh", "-c", command)
 	if err != nil {
 		return "", fmt.Errorf("failed to run command: %v, output: %s", err, string(output))
 	}
@@ -89,65 +167,66 @@ func (c *RouterClient) ExecuteCommand(command string) (string, error) {
 }
 
 func (c *RouterClient) GetConnectedDevices() ([]Device, error) {
-	cmd := exec.Command("arp-scan", "-l", "-I", c.Interface)
-	output, err := cmd.Output()
-	var isFallback bool
-	var lines []string
-	if err != nil {
-		fmt.Printf("[ROUTER] Warning: arp-scan failed (%v). Falling back to /proc/net/arp\n", err)
-		data, err := os.ReadFile("/proc/net/arp")
-		if err != nil {
-			return nil, fmt.Errorf("scan failed and fallback failed: %v", err)
+	if c.ARP != nil {
+		neighbors, err := c.ARP.Scan(1500 * time.Millisecond)
+		if err == nil {
+			var devices []Device
+			for _, n := range neighbors {
+				devices = append(devices, Device{
+					IP:        n.IP,
+					MAC:       n.MAC,
+					Name:      "Unknown",
+					IsBlocked: c.ARP.IsSpoofing(n.MAC),
+				})
+			}
+			return devices, nil
 		}
-		lines = strings.Split(string(data), "\n")
-		isFallback = true
-	} else {
-		lines = strings.Split(string(output), "\n")
+		fmt.Printf("[ROUTER] Warning: ARP sweep failed (%v). Falling back to /proc/net/arp\n", err)
+	}
+
+	data, err := os.ReadFile("/proc/net/arp")
+	if err != nil {
+		return nil, fmt.Errorf("scan failed: %v", err)
 	}
 
 	var devices []Device
-	
+
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	for _, line := range lines {
+	for _, line := range strings.Split(string(data), "\n") {
+		// /proc/net/arp: IP, HW, Flags, MAC, Mask, Device
 		fields := strings.Fields(line)
-		if len(fields) >= 2 {
-			ip := fields[0]
-			mac := ""
-			name := "Unknown"
-
-			if isFallback {
-				// /proc/net/arp: IP, HW, Flags, MAC, Mask, Device
-				if len(fields) >= 4 {
-					mac = strings.ToLower(fields[3])
-				}
-			} else {
-				// arp-scan: IP, MAC, Name
-				mac = strings.ToLower(fields[1])
-				if len(fields) > 2 {
-					name = strings.Join(fields[2:], " ")
-				}
-			}
-
-			if strings.Count(ip, ".") == 3 && strings.Count(mac, ":") == 5 {
-				_, blocked := c.ActiveAttacks[mac]
-				
-				devices = append(devices, Device{
-					IP:        ip,
-					MAC:       mac,
-					Name:      name,
-					IsBlocked: blocked,
-				})
-			}
+		if len(fields) < 4 {
+			continue
+		}
+		ip := fields[0]
+		mac := strings.ToLower(fields[3])
+		if strings.Count(ip, ".") == 3 && strings.Count(mac, ":") == 5 && mac != "00:00:00:00:00:00" {
+			_, blocked := c.ActiveAttacks[mac]
+			devices = append(devices, Device{
+				IP:        ip,
+				MAC:       mac,
+				Name:      "Unknown",
+				IsBlocked: blocked,
+			})
 		}
 	}
 	return devices, nil
 }
 
 func (c *RouterClient) FindIPbyMAC(mac string) (string, error) {
-	cmd := exec.Command("arp", "-n")
-	output, err := cmd.Output()
+	if c.Leases != nil {
+		if ip, ok := c.Leases.LookupIP(strings.ToLower(mac)); ok {
+			return ip, nil
+		}
+	}
+	if c.ARP != nil {
+		if ip, ok := c.ARP.LookupIP(strings.ToLower(mac)); ok {
+			return ip, nil
+		}
+	}
+	output, err := c.Exec.Output("arp", "-n")
 	if err == nil {
 		lines := strings.Split(string(output), "\n")
 		for _, line := range lines {
@@ -162,35 +241,45 @@ func (c *RouterClient) FindIPbyMAC(mac string) (string, error) {
 	return "", fmt.Errorf("MAC %s not found in ARP cache", mac)
 }
 
+// FindMACbyIP identifies the device behind ip, which is how portal
+// requests prove which MAC they act for. DHCP leases win, then the
+// kernel's neighbor table; the ARP engine's cache is the last resort.
 func (c *RouterClient) FindMACbyIP(ip string) (string, error) {
-	cmd := exec.Command("arp", "-n", ip)
-	output, err := cmd.Output()
+	if c.Leases != nil {
+		if mac, ok := c.Leases.LookupMAC(ip); ok {
+			return mac, nil
+		}
+	}
+	output, err := c.Exec.Output("arp", "-n", ip)
 	if err == nil {
 		lines := strings.Split(string(output), "\n")
 		for _, line := range lines {
-			if strings.Contains(line, ip) {
-				fields := strings.Fields(line)
-				if len(fields) >= 3 {
-					return strings.ToLower(fields[2]), nil
-				}
+			fields := strings.Fields(line)
+			if len(fields) >= 3 && fields[0] == ip && strings.Count(fields[2], ":") == 5 {
+				return strings.ToLower(fields[2]), nil
 			}
 		}
 	}
+	if c.ARP != nil {
+		if mac, ok := c.ARP.Lookup(ip); ok {
+			return mac, nil
+		}
+	}
 	return "", fmt.Errorf("IP %s not found in ARP cache", ip)
 }
 
-// RestoreARP sends gratuitous ARP packets for a longer duration to force client gateway update
+// RestoreARP re-announces the real gateway/client mappings for a while to
+// force the client's ARP cache to update
 func (c *RouterClient) RestoreARP(mac string, ip string) {
-	fmt.Printf("[ROUTER] Starting intensive ARP restoration for %s (%s)\n", ip, mac)
-	for i := 0; i < 45; i++ {
-		// Send packets to both sides to fix the ARP table
-		// 1. Tell the Client (ip) that Gateway (GatewayIP) is at REAL MAC (we use -r for arpspoof cleanup)
-		exec.Command("arpspoof", "-i", c.Interface, "-t", ip, c.GatewayIP, "-r").Run()
-		// 2. Tell the Gateway (GatewayIP) that Client (ip) is at REAL MAC
-		exec.Command("arpspoof", "-i", c.Interface, "-t", c.GatewayIP, ip, "-r").Run()
-		
-		time.Sleep(1 * time.Second)
+	if c.ARP == nil {
+		return
 	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil || net.ParseIP(ip) == nil {
+		return
+	}
+	fmt.Printf("[ROUTER] Starting ARP restoration for %s (%s)\n", ip, mac)
+	c.ARP.Restore(net.ParseIP(ip), hw)
 }
 
 // AllowMAC stops the ARP spoofing attack and allows internet
@@ -199,38 +288,38 @@ func (c *RouterClient) AllowMAC(mac string) (string, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	// 1. Ensure Redirection bypass - remove and re-insert at top
-	for {
-		if _, err := c.ExecuteCommand(fmt.Sprintf("iptables -t nat -D WIFIMINT_REDIRECT -m mac --mac-source %s -j RETURN", mac)); err != nil {
-			break
-		}
+	// 1. Ensure Redirection bypass
+	if err := c.Firewall.AllowMAC(mac); err != nil {
+		fmt.Printf("[ROUTER] Warning: %s bypass for %s failed: %v\n", c.Firewall.Name(), mac, err)
 	}
-	c.ExecuteCommand(fmt.Sprintf("iptables -t nat -I WIFIMINT_REDIRECT -m mac --mac-source %s -j RETURN", mac))
 
 	ip, err := c.FindIPbyMAC(mac)
 	if err == nil {
-		// 2. Aggressively remove EVERY instance of FORWARD drop rules
-		for {
-			if _, err := c.ExecuteCommand(fmt.Sprintf("iptables -D FORWARD -s %s -j DROP", ip)); err != nil {
-				break
+		// 2. Remove FORWARD drops
+		c.Firewall.UnblockIP(ip)
+
+		// 3. Apply the plan speed
+		c.applyRate(mac, ip)
+
+		// 4. Count traffic for data quotas
+		if old, ok := c.Accounted[mac]; !ok || old != ip {
+			if ok {
+				c.Firewall.StopAccounting(old)
 			}
-		}
-		for {
-			if _, err := c.ExecuteCommand(fmt.Sprintf("iptables -D FORWARD -d %s -j DROP", ip)); err != nil {
-				break
+			if err := c.Firewall.StartAccounting(ip); err == nil {
+				c.Accounted[mac] = ip
 			}
 		}
-		
-		exec.Command("conntrack", "-D", "-s", ip).Run()
-		go c.RestoreARP(mac, ip)
+
+		c.Exec.CombinedOutput("conntrack", "-D", "-s", ip)
+		c.RestoreARP(mac, ip)
 	}
 
 	if info, exists := c.ActiveAttacks[mac]; exists {
-		fmt.Printf("[UNBLOCK] Stopping active attack process for %s\n", info.IP)
-		for _, cmd := range info.Cmds {
-			if cmd != nil && cmd.Process != nil {
-				cmd.Process.Signal(os.Interrupt)
-			}
+		fmt.Printf("[UNBLOCK] Stopping ARP block for %s\n", info.IP)
+		if err != nil {
+			// No current IP; still stop poisoning the last one we used
+			c.RestoreARP(mac, info.IP)
 		}
 		delete(c.ActiveAttacks, mac)
 		return "Device Unblocked", nil
@@ -244,7 +333,16 @@ func (c *RouterClient) BlockMAC(mac string, targetIP string) (string, error) {
 	defer c.lock.Unlock()
 
 	// 1. Remove from Redirection bypass list
-	c.ExecuteCommand(fmt.Sprintf("iptables -t nat -D WIFIMINT_REDIRECT -m mac --mac-source %s -j RETURN", mac))
+	c.Firewall.RemoveMAC(mac)
+	if ip, ok := c.Accounted[mac]; ok {
+		c.Firewall.StopAccounting(ip)
+		delete(c.Accounted, mac)
+	}
+	if ip, ok := c.shaped[mac]; ok {
+		c.Shaper.Remove(ip)
+		delete(c.shaped, mac)
+	}
+	delete(c.Rates, mac)
 
 	if _, exists := c.ActiveAttacks[mac]; exists {
 		return "Already blocking this device", nil
@@ -277,66 +375,103 @@ func (c *RouterClient) BlockMAC(mac string, targetIP string) (string, error) {
 	}
 
 	fmt.Printf("[BLOCK] Starting Dual ARP Block: Target=%s Gateway=%s\n", targetIP, gatewayIP)
-	cmd1 := exec.Command("arpspoof", "-i", c.Interface, "-t", targetIP, gatewayIP)
-	cmd2 := exec.Command("arpspoof", "-i", c.Interface, "-t", gatewayIP, targetIP)
-	
-	if err := cmd1.Start(); err != nil {
-		return "", fmt.Errorf("failed to start arpspoof 1: %v", err)
-	}
-	if err := cmd2.Start(); err != nil {
-		cmd1.Process.Kill()
-		return "", fmt.Errorf("failed to start arpspoof 2: %v", err)
+	if c.ARP != nil {
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			return "", fmt.Errorf("invalid MAC %s: %v", mac, err)
+		}
+		c.ARP.Spoof(net.ParseIP(targetIP), hw)
+	} else {
+		fmt.Printf("[BLOCK] Warning: ARP engine unavailable, relying on %s drop only\n", c.Firewall.Name())
 	}
 
-	// Add high-priority iptables forward drop
-	c.ExecuteCommand(fmt.Sprintf("iptables -I FORWARD -s %s -j DROP", targetIP))
-	c.ExecuteCommand(fmt.Sprintf("iptables -I FORWARD -d %s -j DROP", targetIP))
+	// Add high-priority forward drop
+	if err := c.Firewall.BlockIP(targetIP); err != nil {
+		fmt.Printf("[ROUTER] Warning: %s forward drop for %s failed: %v\n", c.Firewall.Name(), targetIP, err)
+	}
 
 	c.ActiveAttacks[mac] = BlockInfo{
-		Cmds: []*exec.Cmd{cmd1, cmd2},
-		IP:   targetIP,
+		IP: targetIP,
 	}
 	
 	return fmt.Sprintf("Blocking started for %s (%s)", targetIP, mac), nil
 }
 
-func (c *RouterClient) SetSpeedLimit(ip string, rateMbps int) (string, error) {
-	cmd := fmt.Sprintf("tc qdisc add dev %s handle 1: root htb default 11 && tc class add dev %s parent 1: classid 1:1 htb rate %dmbit", c.Interface, c.Interface, rateMbps)
-	return c.ExecuteCommand(cmd)
+// ReadUsage returns the bytes forwarded per allowed MAC since it was last
+// allowed. Counters restart from zero whenever a MAC is re-allowed on a new IP.
+func (c *RouterClient) ReadUsage() (map[string]uint64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	counters, err := c.Firewall.ReadCounters()
+	if err != nil {
+		return nil, err
+	}
+	usage := make(map[string]uint64)
+	for mac, ip := range c.Accounted {
+		usage[mac] = counters[ip]
+	}
+	return usage, nil
 }
 
-func (c *RouterClient) SetupCaptivePortal(laptopIP string) error {
-	fmt.Printf("Initialising Dynamic Redirection Chain...\n")
+// AllowDestination adds cidr to the walled garden, reachable by every client.
+func (c *RouterClient) AllowDestination(cidr string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Firewall.AllowDestination(cidr)
+}
 
-	c.ExecuteCommand("iptables -t nat -N WIFIMINT_REDIRECT")
-	c.ExecuteCommand("iptables -t nat -F WIFIMINT_REDIRECT")
-	
-	// Redirect DNS (UDP & TCP) to our local server on :5353
-	c.ExecuteCommand(fmt.Sprintf("iptables -t nat -A WIFIMINT_REDIRECT -p udp --dport 53 -j REDIRECT --to-ports 5353"))
-	c.ExecuteCommand(fmt.Sprintf("iptables -t nat -A WIFIMINT_REDIRECT -p tcp --dport 53 -j REDIRECT --to-ports 5353"))
+// RemoveDestination takes cidr out of the walled garden.
+func (c *RouterClient) RemoveDestination(cidr string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Firewall.RemoveDestination(cidr)
+}
 
-	// Redirect HTTP to our backend on :8080
-	c.ExecuteCommand(fmt.Sprintf("iptables -t nat -A WIFIMINT_REDIRECT -p tcp --dport 80 -j REDIRECT --to-ports 8080"))
+// SetSpeedLimit records the plan speed for mac. It is applied by AllowMAC,
+// or immediately if the device is already shaped.
+func (c *RouterClient) SetSpeedLimit(mac string, downKbps, upKbps int) error {
+	mac = strings.ToLower(mac)
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	// Ensure Host Machine always has internet - high priority bypass at the VERY START
-	if c.HostIP != "" {
-		c.ExecuteCommand(fmt.Sprintf("iptables -t nat -I WIFIMINT_REDIRECT 1 -s %s -j RETURN", c.HostIP))
-	}
-	if c.HostMAC != "" {
-		c.ExecuteCommand(fmt.Sprintf("iptables -t nat -I WIFIMINT_REDIRECT 1 -m mac --mac-source %s -j RETURN", c.HostMAC))
+	c.Rates[mac] = Rate{DownloadKbps: downKbps, UploadKbps: upKbps}
+	if ip, ok := c.shaped[mac]; ok {
+		c.applyRate(mac, ip)
 	}
+	return nil
+}
 
-	// Force clear and re-add hook to ensure it's at the top of PREROUTING
-	// We use -I with index 1 to ensure it's the absolute first rule hit
-	c.ExecuteCommand(fmt.Sprintf("iptables -t nat -D PREROUTING -i %s -j WIFIMINT_REDIRECT", c.Interface))
-	c.ExecuteCommand(fmt.Sprintf("iptables -t nat -I PREROUTING 1 -i %s -j WIFIMINT_REDIRECT", c.Interface))
-	
-	c.ExecuteCommand("echo 1 > /proc/sys/net/ipv4/ip_forward")
-	
-	// Ensure masquerade is present
-	c.ExecuteCommand(fmt.Sprintf("iptables -t nat -D POSTROUTING -o %s -j MASQUERADE", c.Interface))
-	c.ExecuteCommand(fmt.Sprintf("iptables -t nat -A POSTROUTING -o %s -j MASQUERADE", c.Interface))
+// applyRate installs the shaping classes for mac on ip. Callers hold c.lock.
+func (c *RouterClient) applyRate(mac, ip string) {
+	if old, ok := c.shaped[mac]; ok && old != ip {
+		c.Shaper.Remove(old)
+		delete(c.shaped, mac)
+	}
+	rate, ok := c.Rates[mac]
+	if !ok || (rate.DownloadKbps <= 0 && rate.UploadKbps <= 0) {
+		if old, ok := c.shaped[mac]; ok {
+			c.Shaper.Remove(old)
+			delete(c.shaped, mac)
+		}
+		return
+	}
+	if err := c.Shaper.Apply(ip, rate.DownloadKbps, rate.UploadKbps); err != nil {
+		fmt.Printf("[ROUTER] Warning: speed limit for %s (%s) failed: %v\n", mac, ip, err)
+		return
+	}
+	c.shaped[mac] = ip
+}
 
+func (c *RouterClient) SetupCaptivePortal(laptopIP string) error {
+	fmt.Printf("Initialising Dynamic Redirection Chain (%s)...\n", c.Firewall.Name())
+	if err := c.Firewall.SetupCaptivePortal(c.Interface, c.HostIP, c.HostMAC); err != nil {
+		return err
+	}
+	// Shaping is optional; without it plans simply run unlimited
+	if err := c.Shaper.Setup(); err != nil {
+		fmt.Printf("[ROUTER] Warning: %v. Plan speed limits disabled.\n", err)
+	}
 	return nil
 }
 
@@ -346,23 +481,24 @@ func (c *RouterClient) GetSystemInfo() map[string]interface{} {
 		"gateway_ip": c.GatewayIP,
 		"host_ip":    c.HostIP,
 		"host_mac":   c.HostMAC,
+		"firewall":   c.Firewall.Name(),
 	}
 }
 
 func (c *RouterClient) Cleanup() {
 	fmt.Println("Cleaning up...")
-	c.ExecuteCommand(fmt.Sprintf("iptables -t nat -D PREROUTING -i %s -j WIFIMINT_REDIRECT", c.Interface))
-	c.ExecuteCommand("iptables -t nat -F WIFIMINT_REDIRECT")
-	c.ExecuteCommand("iptables -t nat -X WIFIMINT_REDIRECT")
+	c.Firewall.Cleanup(c.Interface)
+	c.Shaper.Cleanup()
 	
 	c.lock.Lock()
-	for mac, info := range c.ActiveAttacks {
-		for _, cmd := range info.Cmds {
-			if cmd != nil && cmd.Process != nil {
-				cmd.Process.Signal(os.Interrupt)
-			}
-		}
+	for mac := range c.ActiveAttacks {
 		delete(c.ActiveAttacks, mac)
 	}
 	c.lock.Unlock()
+
+	// Hand every poisoned client its real gateway back before exiting
+	if c.ARP != nil {
+		c.ARP.Shutdown()
+		c.ARP = nil
+	}
 }
@@ -0,0 +1,90 @@
+package router
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// newTestClient returns a RouterClient that records commands instead of
+// running them, on the given firewall backend.
+func newTestClient(t *testing.T, backend string) (*RouterClient, *RecordingExecutor) {
+	t.Helper()
+	rec := NewRecordingExecutor()
+	c := NewRouterClient("wlan0")
+	c.Exec = rec
+	if err := c.SetFirewallBackend(backend); err != nil {
+		t.Fatal(err)
+	}
+	c.GatewayIP, c.HostIP, c.HostMAC = "192.168.1.254", "192.168.1.1", "02:00:00:00:00:01"
+	rec.Responses["arp -n"] = "Address                  HWtype  HWaddress           Flags Mask            Iface\n" +
+		"192.168.1.50             ether   aa:bb:cc:dd:ee:ff   C                     wlan0\n"
+	return c, rec
+}
+
+// checkGolden compares the recorded transcript with testdata/<name>.golden.
+// Run "go test -update" after an intended change to the commands.
+func checkGolden(t *testing.T, name string, rec *RecordingExecutor) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	got := rec.Transcript()
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("commands differ from %s:\n--- got\n%s--- want\n%s", path, got, want)
+	}
+}
+
+func TestSetupCaptivePortalGolden(t *testing.T) {
+	for _, backend := range []string{"iptables", "nftables"} {
+		t.Run(backend, func(t *testing.T) {
+			c, rec := newTestClient(t, backend)
+			if err := c.SetupCaptivePortal("192.168.1.1"); err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, "setup_"+backend, rec)
+		})
+	}
+}
+
+func TestAllowBlockGolden(t *testing.T) {
+	for _, backend := range []string{"iptables", "nftables"} {
+		t.Run(backend, func(t *testing.T) {
+			c, rec := newTestClient(t, backend)
+			c.SetSpeedLimit("AA:BB:CC:DD:EE:FF", 2048, 512)
+			if _, err := c.AllowMAC("AA:BB:CC:DD:EE:FF"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.BlockMAC("aa:bb:cc:dd:ee:ff", ""); err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, "allow_block_"+backend, rec)
+		})
+	}
+}
+
+func TestBlockMACSkipsGateway(t *testing.T) {
+	c, rec := newTestClient(t, "iptables")
+	if _, err := c.BlockMAC("aa:bb:cc:dd:ee:00", "192.168.1.254"); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range rec.Commands() {
+		if cmd == "iptables -I FORWARD -s 192.168.1.254 -j DROP" {
+			t.Fatalf("gateway was blocked: %q", rec.Commands())
+		}
+	}
+	if len(c.ActiveAttacks) != 0 {
+		t.Errorf("ActiveAttacks = %v, want none", c.ActiveAttacks)
+	}
+}
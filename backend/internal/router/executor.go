@@ -0,0 +1,191 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Executor runs external programs on behalf of RouterClient. Swapping it
+// lets the block/allow logic run without touching the host.
+type Executor interface {
+	// LookPath reports whether a tool is installed.
+	LookPath(file string) (string, error)
+	// Output runs a command and returns its stdout.
+	Output(name string, args ...string) ([]byte, error)
+	// CombinedOutput runs a command and returns stdout and stderr.
+	CombinedOutput(name string, args ...string) ([]byte, error)
+}
+
+// SystemExecutor runs commands on the host with os/exec.
+type SystemExecutor struct{}
+
+func (SystemExecutor) LookPath(file string) (string, error) {
+	return exec.LookPath(file)
+}
+
+func (SystemExecutor) Output(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).Output()
+}
+
+func (SystemExecutor) CombinedOutput(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// errRuleMissing is what iptables -C reports for a rule that is not there.
+var errRuleMissing = errors.New("iptables: Bad rule (does a matching rule exist in that chain?)")
+
+// DryRunExecutor logs every command instead of running it, so an operator
+// can preview what a change would do to a live box. Nothing is ever
+// installed, so "iptables -C" probes fail and delete loops stop at once;
+// every other command "succeeds" with empty output.
+type DryRunExecutor struct{}
+
+func (DryRunExecutor) LookPath(file string) (string, error) {
+	return file, nil
+}
+
+func (DryRunExecutor) Output(name string, args ...string) ([]byte, error) {
+	return DryRunExecutor{}.run(commandLine(name, args))
+}
+
+func (DryRunExecutor) CombinedOutput(name string, args ...string) ([]byte, error) {
+	return DryRunExecutor{}.run(commandLine(name, args))
+}
+
+func (DryRunExecutor) run(line string) ([]byte, error) {
+	fmt.Printf("[DRY-RUN] %s\n", line)
+	if isRuleCheck(line) {
+		return nil, errRuleMissing
+	}
+	return nil, nil
+}
+
+// RecordingExecutor is the fake Executor for tests. It records the exact
+// command sequence instead of running anything. Responses maps a command
+// line to canned output and Failures maps a command line to the error it
+// should return; anything else succeeds with empty output, except that an
+// "iptables -C" probe fails once the matching -D has been recorded, as if
+// the box held every rule exactly once.
+type RecordingExecutor struct {
+	Responses map[string]string
+	Failures  map[string]error
+
+	mu       sync.Mutex
+	commands []string
+	deleted  map[string]bool
+}
+
+func NewRecordingExecutor() *RecordingExecutor {
+	return &RecordingExecutor{
+		Responses: make(map[string]string),
+		Failures:  make(map[string]error),
+	}
+}
+
+func (e *RecordingExecutor) LookPath(file string) (string, error) {
+	return file, nil
+}
+
+func (e *RecordingExecutor) Output(name string, args ...string) ([]byte, error) {
+	return e.record(commandLine(name, args))
+}
+
+func (e *RecordingExecutor) CombinedOutput(name string, args ...string) ([]byte, error) {
+	return e.record(commandLine(name, args))
+}
+
+// Run is the CommandRunner for firewall and shaper tests.
+func (e *RecordingExecutor) Run(command string) (string, error) {
+	out, err := e.CombinedOutput("sh", "-c", command)
+	return string(out), err
+}
+
+// Commands returns a copy of every command line recorded so far.
+func (e *RecordingExecutor) Commands() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.commands...)
+}
+
+// Transcript renders the recorded commands one per line, the format used
+// for golden files.
+func (e *RecordingExecutor) Transcript() string {
+	cmds := e.Commands()
+	if len(cmds) == 0 {
+		return ""
+	}
+	return strings.Join(cmds, "\n") + "\n"
+}
+
+// Reset forgets every recorded command.
+func (e *RecordingExecutor) Reset() {
+	e.mu.Lock()
+	e.commands = nil
+	e.deleted = nil
+	e.mu.Unlock()
+}
+
+func (e *RecordingExecutor) record(line string) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.commands = append(e.commands, line)
+	if err, ok := e.Failures[line]; ok {
+		return nil, err
+	}
+	if out, ok := e.Responses[line]; ok {
+		return []byte(out), nil
+	}
+	if isRuleCheck(line) && e.deleted[line] {
+		return nil, errRuleMissing
+	}
+	if check, op := ruleCheck(line); op == "-D" {
+		if e.deleted == nil {
+			e.deleted = make(map[string]bool)
+		}
+		e.deleted[check] = true
+	} else if op != "" {
+		delete(e.deleted, check)
+	}
+	return nil, nil
+}
+
+// isRuleCheck reports whether line is an "iptables -C" probe.
+func isRuleCheck(line string) bool {
+	return strings.HasPrefix(line, "iptables ") && strings.Contains(line, " -C ")
+}
+
+// ruleCheck turns an iptables -A, -I or -D command into the -C probe for
+// the same rule and returns which of the three it was, or "" for any other
+// command. A position after the chain of an -I is dropped.
+func ruleCheck(line string) (check, op string) {
+	if !strings.HasPrefix(line, "iptables ") {
+		return "", ""
+	}
+	fields := strings.Fields(line)
+	for i, f := range fields {
+		if f != "-A" && f != "-I" && f != "-D" {
+			continue
+		}
+		if f == "-I" && i+2 < len(fields) {
+			if _, err := strconv.Atoi(fields[i+2]); err == nil {
+				fields = append(fields[:i+2], fields[i+3:]...)
+			}
+		}
+		fields[i] = "-C"
+		return strings.Join(fields, " "), f
+	}
+	return "", ""
+}
+
+// commandLine renders a command for logs and transcripts. "sh -c" wrappers
+// are unwrapped so the recorded line is the script that would have run.
+func commandLine(name string, args []string) string {
+	if name == "sh" && len(args) == 2 && args[0] == "-c" {
+		return args[1]
+	}
+	return strings.TrimSpace(name + " " + strings.Join(args, " "))
+}
@@ -0,0 +1,29 @@
+package router
+
+import "testing"
+
+func TestDryRunExecutorFailsRuleChecks(t *testing.T) {
+	var exec DryRunExecutor
+	if _, err := exec.CombinedOutput("sh", "-c", "iptables -C FORWARD -s 10.0.0.5 -j DROP"); err == nil {
+		t.Error("dry-run -C probe succeeded")
+	}
+	if _, err := exec.CombinedOutput("sh", "-c", "iptables -D FORWARD -s 10.0.0.5 -j DROP"); err != nil {
+		t.Errorf("dry-run -D failed: %v", err)
+	}
+}
+
+func TestRecordingExecutorHoldsEachRuleOnce(t *testing.T) {
+	rec := NewRecordingExecutor()
+	check := "iptables -C FORWARD -j WIFIMINT_ACCT"
+	if _, err := rec.Run(check); err != nil {
+		t.Fatalf("probe before delete: %v", err)
+	}
+	rec.Run("iptables -D FORWARD -j WIFIMINT_ACCT")
+	if _, err := rec.Run(check); err == nil {
+		t.Error("probe succeeded after delete")
+	}
+	rec.Run("iptables -I FORWARD 1 -j WIFIMINT_ACCT")
+	if _, err := rec.Run(check); err != nil {
+		t.Errorf("probe after re-insert: %v", err)
+	}
+}
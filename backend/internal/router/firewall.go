@@ -0,0 +1,56 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CommandRunner executes a shell command line and returns its combined output.
+// RouterClient.ExecuteCommand satisfies it.
+type CommandRunner func(command string) (string, error)
+
+// Firewall abstracts the packet filter used to build the captive portal.
+// Every backend owns the redirect of unauthorized clients to the portal,
+// the MAC bypass for paying clients and the FORWARD drops for blocked IPs.
+type Firewall interface {
+	// Name identifies the backend ("iptables" or "nftables").
+	Name() string
+	// Tool is the binary that must be present on the host.
+	Tool() string
+	// SetupCaptivePortal (re)creates the redirect rules on iface.
+	SetupCaptivePortal(iface, hostIP, hostMAC string) error
+	// AllowMAC lets mac bypass the portal redirect.
+	AllowMAC(mac string) error
+	// RemoveMAC puts mac back behind the portal redirect.
+	RemoveMAC(mac string) error
+	// BlockIP drops all forwarded traffic from and to ip.
+	BlockIP(ip string) error
+	// UnblockIP removes the drops installed by BlockIP.
+	UnblockIP(ip string) error
+	// AllowDestination lets every client reach cidr before paying (walled garden).
+	AllowDestination(cidr string) error
+	// RemoveDestination takes cidr out of the walled garden.
+	RemoveDestination(cidr string) error
+	// StartAccounting begins counting forwarded bytes to and from ip.
+	StartAccounting(ip string) error
+	// StopAccounting drops the counters for ip.
+	StopAccounting(ip string) error
+	// ReadCounters returns the bytes counted per IP (both directions)
+	// since StartAccounting.
+	ReadCounters() (map[string]uint64, error)
+	// Cleanup removes everything installed by SetupCaptivePortal.
+	Cleanup(iface string) error
+}
+
+// NewFirewall returns the backend registered under name. An empty name
+// selects iptables, which is what every existing install runs.
+func NewFirewall(name string, run CommandRunner) (Firewall, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "iptables":
+		return NewIPTablesFirewall(run), nil
+	case "nftables", "nft":
+		return NewNFTablesFirewall(run), nil
+	default:
+		return nil, fmt.Errorf("unknown firewall backend: %s", name)
+	}
+}
@@ -0,0 +1,144 @@
+package router
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewFirewall(t *testing.T) {
+	rec := NewRecordingExecutor()
+	for name, want := range map[string]string{"": "iptables", "iptables": "iptables", "nftables": "nftables", "NFT": "nftables"} {
+		fw, err := NewFirewall(name, rec.Run)
+		if err != nil {
+			t.Fatalf("NewFirewall(%q): %v", name, err)
+		}
+		if fw.Name() != want {
+			t.Errorf("NewFirewall(%q) = %s, want %s", name, fw.Name(), want)
+		}
+	}
+	if _, err := NewFirewall("pf", rec.Run); err == nil {
+		t.Error("NewFirewall(pf) succeeded")
+	}
+}
+
+func TestIPTablesDeletesEveryDuplicate(t *testing.T) {
+	// The rule is installed twice; -C fails once both copies are gone
+	copies := 2
+	var commands []string
+	fw := NewIPTablesFirewall(func(command string) (string, error) {
+		commands = append(commands, command)
+		switch {
+		case strings.Contains(command, " -C ") && copies == 0:
+			return "", errors.New("bad rule")
+		case strings.Contains(command, " -D "):
+			copies--
+		}
+		return "", nil
+	})
+
+	if err := fw.AllowMAC("aa:bb:cc:dd:ee:ff"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"iptables -t nat -C WIFIMINT_REDIRECT -m mac --mac-source aa:bb:cc:dd:ee:ff -j RETURN",
+		"iptables -t nat -D WIFIMINT_REDIRECT -m mac --mac-source aa:bb:cc:dd:ee:ff -j RETURN",
+		"iptables -t nat -C WIFIMINT_REDIRECT -m mac --mac-source aa:bb:cc:dd:ee:ff -j RETURN",
+		"iptables -t nat -D WIFIMINT_REDIRECT -m mac --mac-source aa:bb:cc:dd:ee:ff -j RETURN",
+		"iptables -t nat -C WIFIMINT_REDIRECT -m mac --mac-source aa:bb:cc:dd:ee:ff -j RETURN",
+		"iptables -t nat -I WIFIMINT_REDIRECT -m mac --mac-source aa:bb:cc:dd:ee:ff -j RETURN",
+	}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("commands:\n%q\nwant\n%q", commands, want)
+	}
+}
+
+func TestIPTablesDryRunDeletesNothing(t *testing.T) {
+	var deletes int
+	fw := NewIPTablesFirewall(func(command string) (string, error) {
+		if strings.Contains(command, " -D ") {
+			deletes++
+		}
+		out, err := DryRunExecutor{}.CombinedOutput("sh", "-c", command)
+		return string(out), err
+	})
+
+	fw.UnblockIP("10.0.0.5")
+	if deletes != 0 {
+		t.Errorf("dry run issued %d deletes for rules it never installed", deletes)
+	}
+}
+
+func TestIPTablesDeleteStopsWhenRuleIsGone(t *testing.T) {
+	rec := NewRecordingExecutor()
+	rec.Failures["iptables -C FORWARD -s 10.0.0.5 -j DROP"] = errors.New("bad rule")
+	rec.Failures["iptables -C FORWARD -d 10.0.0.5 -j DROP"] = errors.New("bad rule")
+	fw := NewIPTablesFirewall(rec.Run)
+
+	fw.UnblockIP("10.0.0.5")
+	want := []string{
+		"iptables -C FORWARD -s 10.0.0.5 -j DROP",
+		"iptables -C FORWARD -d 10.0.0.5 -j DROP",
+	}
+	if got := rec.Commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands:\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestIPTablesReadCounters(t *testing.T) {
+	rec := NewRecordingExecutor()
+	rec.Responses["iptables -L WIFIMINT_ACCT -n -v -x"] = `Chain WIFIMINT_ACCT (1 references)
+    pkts      bytes target     prot opt in     out     source               destination
+      12     3456            all  --  *      *       10.0.0.5             0.0.0.0/0
+      20    10000            all  --  *      *       0.0.0.0/0            10.0.0.5
+       1       60            all  --  *      *       10.0.0.6             0.0.0.0/0
+`
+	counters, err := NewIPTablesFirewall(rec.Run).ReadCounters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]uint64{"10.0.0.5": 13456, "10.0.0.6": 60}
+	if !reflect.DeepEqual(counters, want) {
+		t.Errorf("counters = %v, want %v", counters, want)
+	}
+}
+
+func TestNFTablesSetElements(t *testing.T) {
+	rec := NewRecordingExecutor()
+	fw := NewNFTablesFirewall(rec.Run)
+
+	fw.AllowMAC("aa:bb:cc:dd:ee:ff")
+	fw.BlockIP("10.0.0.5")
+	fw.UnblockIP("10.0.0.5")
+	fw.RemoveMAC("aa:bb:cc:dd:ee:ff")
+	want := []string{
+		"nft add element ip wifimint allowed_macs '{ aa:bb:cc:dd:ee:ff }'",
+		"nft add element ip wifimint blocked_ips '{ 10.0.0.5 }'",
+		"nft delete element ip wifimint blocked_ips '{ 10.0.0.5 }'",
+		"nft delete element ip wifimint allowed_macs '{ aa:bb:cc:dd:ee:ff }'",
+	}
+	if got := rec.Commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands:\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestNFTablesReadCounters(t *testing.T) {
+	rec := NewRecordingExecutor()
+	rec.Responses["nft list set ip wifimint acct_ips"] = `table ip wifimint {
+	set acct_ips {
+		type ipv4_addr
+		counter
+		elements = { 10.0.0.5 counter packets 12 bytes 3456, 10.0.0.6 counter packets 1 bytes 60 }
+	}
+}
+`
+	counters, err := NewNFTablesFirewall(rec.Run).ReadCounters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]uint64{"10.0.0.5": 3456, "10.0.0.6": 60}
+	if !reflect.DeepEqual(counters, want) {
+		t.Errorf("counters = %v, want %v", counters, want)
+	}
+}
@@ -0,0 +1,201 @@
+package router
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxRuleDuplicates bounds the "delete until it fails" loops so a runner
+// that never reports "rule not found" cannot spin forever.
+const maxRuleDuplicates = 64
+
+// IPTablesFirewall is the legacy backend. It keeps one RETURN rule per
+// allowed MAC in the WIFIMINT_REDIRECT nat chain, walled-garden
+// destinations in the WIFIMINT_GARDEN filter chain and target-less
+// per-IP counting rules in WIFIMINT_ACCT.
+type IPTablesFirewall struct {
+	run CommandRunner
+}
+
+func NewIPTablesFirewall(run CommandRunner) *IPTablesFirewall {
+	return &IPTablesFirewall{run: run}
+}
+
+func (f *IPTablesFirewall) Name() string { return "iptables" }
+
+func (f *IPTablesFirewall) Tool() string { return "iptables" }
+
+func (f *IPTablesFirewall) SetupCaptivePortal(iface, hostIP, hostMAC string) error {
+	f.run("iptables -t nat -N WIFIMINT_REDIRECT")
+	f.run("iptables -t nat -F WIFIMINT_REDIRECT")
+
+	// Redirect DNS (UDP & TCP) to our local server on :5353
+	f.run("iptables -t nat -A WIFIMINT_REDIRECT -p udp --dport 53 -j REDIRECT --to-ports 5353")
+	f.run("iptables -t nat -A WIFIMINT_REDIRECT -p tcp --dport 53 -j REDIRECT --to-ports 5353")
+
+	// Redirect HTTP to our backend on :8080
+	f.run("iptables -t nat -A WIFIMINT_REDIRECT -p tcp --dport 80 -j REDIRECT --to-ports 8080")
+
+	// Ensure Host Machine always has internet - high priority bypass at the VERY START
+	if hostIP != "" {
+		f.run(fmt.Sprintf("iptables -t nat -I WIFIMINT_REDIRECT 1 -s %s -j RETURN", hostIP))
+	}
+	if hostMAC != "" {
+		f.run(fmt.Sprintf("iptables -t nat -I WIFIMINT_REDIRECT 1 -m mac --mac-source %s -j RETURN", hostMAC))
+	}
+
+	// Walled garden: destinations reachable before payment
+	f.run("iptables -N WIFIMINT_GARDEN")
+	f.run("iptables -F WIFIMINT_GARDEN")
+	// Per-client byte counters for data quotas
+	f.run("iptables -N WIFIMINT_ACCT")
+	f.run("iptables -F WIFIMINT_ACCT")
+	f.hookChains()
+
+	// Force clear and re-add hook to ensure it's at the top of PREROUTING
+	// We use -I with index 1 to ensure it's the absolute first rule hit
+	f.run(fmt.Sprintf("iptables -t nat -D PREROUTING -i %s -j WIFIMINT_REDIRECT", iface))
+	f.run(fmt.Sprintf("iptables -t nat -I PREROUTING 1 -i %s -j WIFIMINT_REDIRECT", iface))
+
+	f.run("echo 1 > /proc/sys/net/ipv4/ip_forward")
+
+	// Ensure masquerade is present
+	f.run(fmt.Sprintf("iptables -t nat -D POSTROUTING -o %s -j MASQUERADE", iface))
+	f.run(fmt.Sprintf("iptables -t nat -A POSTROUTING -o %s -j MASQUERADE", iface))
+	return nil
+}
+
+func (f *IPTablesFirewall) AllowMAC(mac string) error {
+	// Remove and re-insert at top so the bypass always wins
+	f.RemoveMAC(mac)
+	_, err := f.run(fmt.Sprintf("iptables -t nat -I WIFIMINT_REDIRECT -m mac --mac-source %s -j RETURN", mac))
+	return err
+}
+
+func (f *IPTablesFirewall) RemoveMAC(mac string) error {
+	f.deleteAll(fmt.Sprintf("iptables -t nat -D WIFIMINT_REDIRECT -m mac --mac-source %s -j RETURN", mac))
+	return nil
+}
+
+func (f *IPTablesFirewall) BlockIP(ip string) error {
+	// Add high-priority iptables forward drop
+	if _, err := f.run(fmt.Sprintf("iptables -I FORWARD -s %s -j DROP", ip)); err != nil {
+		return err
+	}
+	_, err := f.run(fmt.Sprintf("iptables -I FORWARD -d %s -j DROP", ip))
+	// The drops were inserted at the top; keep the walled garden above them
+	f.hookChains()
+	return err
+}
+
+func (f *IPTablesFirewall) UnblockIP(ip string) error {
+	// Aggressively remove EVERY instance of FORWARD drop rules
+	f.deleteAll(fmt.Sprintf("iptables -D FORWARD -s %s -j DROP", ip))
+	f.deleteAll(fmt.Sprintf("iptables -D FORWARD -d %s -j DROP", ip))
+	return nil
+}
+
+func (f *IPTablesFirewall) AllowDestination(cidr string) error {
+	f.RemoveDestination(cidr)
+	// Skip the portal redirect for the destination...
+	if _, err := f.run(fmt.Sprintf("iptables -t nat -I WIFIMINT_REDIRECT 1 -d %s -j RETURN", cidr)); err != nil {
+		return err
+	}
+	// ...and let it through even for ARP-blocked clients
+	if _, err := f.run(fmt.Sprintf("iptables -A WIFIMINT_GARDEN -d %s -j ACCEPT", cidr)); err != nil {
+		return err
+	}
+	_, err := f.run(fmt.Sprintf("iptables -A WIFIMINT_GARDEN -s %s -j ACCEPT", cidr))
+	return err
+}
+
+func (f *IPTablesFirewall) RemoveDestination(cidr string) error {
+	f.deleteAll(fmt.Sprintf("iptables -t nat -D WIFIMINT_REDIRECT -d %s -j RETURN", cidr))
+	f.deleteAll(fmt.Sprintf("iptables -D WIFIMINT_GARDEN -d %s -j ACCEPT", cidr))
+	f.deleteAll(fmt.Sprintf("iptables -D WIFIMINT_GARDEN -s %s -j ACCEPT", cidr))
+	return nil
+}
+
+func (f *IPTablesFirewall) Cleanup(iface string) error {
+	f.run(fmt.Sprintf("iptables -t nat -D PREROUTING -i %s -j WIFIMINT_REDIRECT", iface))
+	f.run("iptables -t nat -F WIFIMINT_REDIRECT")
+	f.run("iptables -t nat -X WIFIMINT_REDIRECT")
+	f.deleteAll("iptables -D FORWARD -j WIFIMINT_GARDEN")
+	f.run("iptables -F WIFIMINT_GARDEN")
+	f.run("iptables -X WIFIMINT_GARDEN")
+	f.deleteAll("iptables -D FORWARD -j WIFIMINT_ACCT")
+	f.run("iptables -F WIFIMINT_ACCT")
+	f.run("iptables -X WIFIMINT_ACCT")
+	return nil
+}
+
+func (f *IPTablesFirewall) StartAccounting(ip string) error {
+	f.StopAccounting(ip)
+	if _, err := f.run(fmt.Sprintf("iptables -A WIFIMINT_ACCT -s %s", ip)); err != nil {
+		return err
+	}
+	_, err := f.run(fmt.Sprintf("iptables -A WIFIMINT_ACCT -d %s", ip))
+	return err
+}
+
+func (f *IPTablesFirewall) StopAccounting(ip string) error {
+	f.deleteAll(fmt.Sprintf("iptables -D WIFIMINT_ACCT -s %s", ip))
+	f.deleteAll(fmt.Sprintf("iptables -D WIFIMINT_ACCT -d %s", ip))
+	return nil
+}
+
+func (f *IPTablesFirewall) ReadCounters() (map[string]uint64, error) {
+	out, err := f.run("iptables -L WIFIMINT_ACCT -n -v -x")
+	if err != nil {
+		return nil, err
+	}
+	return parseIPTablesCounters(out), nil
+}
+
+// hookChains moves the WIFIMINT_GARDEN and WIFIMINT_ACCT jumps to the top
+// of FORWARD, accounting first so walled-garden traffic is counted too.
+func (f *IPTablesFirewall) hookChains() {
+	f.deleteAll("iptables -D FORWARD -j WIFIMINT_GARDEN")
+	f.deleteAll("iptables -D FORWARD -j WIFIMINT_ACCT")
+	f.run("iptables -I FORWARD 1 -j WIFIMINT_GARDEN")
+	f.run("iptables -I FORWARD 1 -j WIFIMINT_ACCT")
+}
+
+// parseIPTablesCounters sums the byte column of "iptables -L -n -v -x"
+// output per client IP. Rules without a target have one column less, so
+// source and destination are read from the end of the line.
+func parseIPTablesCounters(out string) map[string]uint64 {
+	counters := make(map[string]uint64)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			continue
+		}
+		bytes, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue // header lines
+		}
+		src, dst := fields[len(fields)-2], fields[len(fields)-1]
+		ip := src
+		if src == "0.0.0.0/0" {
+			ip = dst
+		}
+		counters[strings.TrimSuffix(ip, "/32")] += bytes
+	}
+	return counters
+}
+
+// deleteAll repeats a -D command for as long as the matching -C check
+// still finds the rule.
+func (f *IPTablesFirewall) deleteAll(command string) {
+	check := strings.Replace(command, " -D ", " -C ", 1)
+	for i := 0; i < maxRuleDuplicates; i++ {
+		if _, err := f.run(check); err != nil {
+			return
+		}
+		if _, err := f.run(command); err != nil {
+			return
+		}
+	}
+}
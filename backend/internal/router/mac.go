@@ -0,0 +1,14 @@
+package router
+
+import "net"
+
+// IsRandomizedMAC reports whether mac is locally administered, which is how
+// iOS and Android private (per-SSID, rotating) addresses are marked. Such a
+// MAC says nothing about which physical device is behind it.
+func IsRandomizedMAC(mac string) bool {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) == 0 {
+		return false
+	}
+	return hw[0]&0x02 != 0
+}
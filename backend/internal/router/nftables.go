@@ -0,0 +1,145 @@
+package router
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// nftTable is the table owned by WiFiMint. Deleting it removes every rule
+// we installed without touching the rest of the ruleset.
+const nftTable = "ip wifimint"
+
+// NFTablesFirewall is the backend for gateways that ship nftables only.
+// Allowed MACs live in a single set, so allowing or removing a client is
+// one element update instead of a rule insert/delete loop. Byte accounting
+// uses a set with per-element counters the same way.
+type NFTablesFirewall struct {
+	run CommandRunner
+}
+
+func NewNFTablesFirewall(run CommandRunner) *NFTablesFirewall {
+	return &NFTablesFirewall{run: run}
+}
+
+func (f *NFTablesFirewall) Name() string { return "nftables" }
+
+func (f *NFTablesFirewall) Tool() string { return "nft" }
+
+func (f *NFTablesFirewall) SetupCaptivePortal(iface, hostIP, hostMAC string) error {
+	// Start from a clean table on every boot
+	f.run(fmt.Sprintf("nft delete table %s", nftTable))
+
+	cmds := []string{
+		fmt.Sprintf("nft add table %s", nftTable),
+		fmt.Sprintf("nft add set %s allowed_macs '{ type ether_addr; }'", nftTable),
+		fmt.Sprintf("nft add set %s blocked_ips '{ type ipv4_addr; }'", nftTable),
+		fmt.Sprintf("nft add set %s garden_nets '{ type ipv4_addr; flags interval; }'", nftTable),
+		fmt.Sprintf("nft add set %s acct_ips '{ type ipv4_addr; counter; }'", nftTable),
+		fmt.Sprintf("nft add chain %s prerouting '{ type nat hook prerouting priority -100; policy accept; }'", nftTable),
+		fmt.Sprintf("nft add chain %s forward '{ type filter hook forward priority -10; policy accept; }'", nftTable),
+		fmt.Sprintf("nft add chain %s postrouting '{ type nat hook postrouting priority 100; policy accept; }'", nftTable),
+	}
+
+	// Ensure Host Machine always has internet
+	if hostMAC != "" {
+		cmds = append(cmds, fmt.Sprintf("nft add rule %s prerouting iifname \"%s\" ether saddr %s return", nftTable, iface, hostMAC))
+	}
+	if hostIP != "" {
+		cmds = append(cmds, fmt.Sprintf("nft add rule %s prerouting iifname \"%s\" ip saddr %s return", nftTable, iface, hostIP))
+	}
+
+	cmds = append(cmds,
+		// Paying clients bypass the portal
+		fmt.Sprintf("nft add rule %s prerouting iifname \"%s\" ether saddr @allowed_macs return", nftTable, iface),
+		// Walled garden destinations are reachable before payment
+		fmt.Sprintf("nft add rule %s prerouting iifname \"%s\" ip daddr @garden_nets return", nftTable, iface),
+		// Redirect DNS (UDP & TCP) to our local server on :5353
+		fmt.Sprintf("nft add rule %s prerouting iifname \"%s\" udp dport 53 redirect to :5353", nftTable, iface),
+		fmt.Sprintf("nft add rule %s prerouting iifname \"%s\" tcp dport 53 redirect to :5353", nftTable, iface),
+		// Redirect HTTP to our backend on :8080
+		fmt.Sprintf("nft add rule %s prerouting iifname \"%s\" tcp dport 80 redirect to :8080", nftTable, iface),
+		// Count forwarded bytes per client (both lookups hit the same element counter)
+		fmt.Sprintf("nft add rule %s forward ip saddr @acct_ips", nftTable),
+		fmt.Sprintf("nft add rule %s forward ip daddr @acct_ips", nftTable),
+		// Blocked clients get nothing forwarded, except the walled garden
+		fmt.Sprintf("nft add rule %s forward ip daddr @garden_nets accept", nftTable),
+		fmt.Sprintf("nft add rule %s forward ip saddr @garden_nets accept", nftTable),
+		fmt.Sprintf("nft add rule %s forward ip saddr @blocked_ips drop", nftTable),
+		fmt.Sprintf("nft add rule %s forward ip daddr @blocked_ips drop", nftTable),
+		fmt.Sprintf("nft add rule %s postrouting oifname \"%s\" masquerade", nftTable, iface),
+	)
+
+	for _, cmd := range cmds {
+		if _, err := f.run(cmd); err != nil {
+			return fmt.Errorf("nftables setup failed: %v", err)
+		}
+	}
+
+	f.run("echo 1 > /proc/sys/net/ipv4/ip_forward")
+	return nil
+}
+
+func (f *NFTablesFirewall) AllowMAC(mac string) error {
+	_, err := f.run(fmt.Sprintf("nft add element %s allowed_macs '{ %s }'", nftTable, mac))
+	return err
+}
+
+func (f *NFTablesFirewall) RemoveMAC(mac string) error {
+	// Deleting a missing element fails; that just means it was never allowed
+	f.run(fmt.Sprintf("nft delete element %s allowed_macs '{ %s }'", nftTable, mac))
+	return nil
+}
+
+func (f *NFTablesFirewall) BlockIP(ip string) error {
+	_, err := f.run(fmt.Sprintf("nft add element %s blocked_ips '{ %s }'", nftTable, ip))
+	return err
+}
+
+func (f *NFTablesFirewall) UnblockIP(ip string) error {
+	f.run(fmt.Sprintf("nft delete element %s blocked_ips '{ %s }'", nftTable, ip))
+	return nil
+}
+
+func (f *NFTablesFirewall) AllowDestination(cidr string) error {
+	_, err := f.run(fmt.Sprintf("nft add element %s garden_nets '{ %s }'", nftTable, cidr))
+	return err
+}
+
+func (f *NFTablesFirewall) RemoveDestination(cidr string) error {
+	f.run(fmt.Sprintf("nft delete element %s garden_nets '{ %s }'", nftTable, cidr))
+	return nil
+}
+
+func (f *NFTablesFirewall) StartAccounting(ip string) error {
+	_, err := f.run(fmt.Sprintf("nft add element %s acct_ips '{ %s }'", nftTable, ip))
+	return err
+}
+
+func (f *NFTablesFirewall) StopAccounting(ip string) error {
+	f.run(fmt.Sprintf("nft delete element %s acct_ips '{ %s }'", nftTable, ip))
+	return nil
+}
+
+// nftCounterElement matches "10.0.0.5 counter packets 12 bytes 3456".
+var nftCounterElement = regexp.MustCompile(`(\d+\.\d+\.\d+\.\d+) counter packets \d+ bytes (\d+)`)
+
+func (f *NFTablesFirewall) ReadCounters() (map[string]uint64, error) {
+	out, err := f.run(fmt.Sprintf("nft list set %s acct_ips", nftTable))
+	if err != nil {
+		return nil, err
+	}
+	counters := make(map[string]uint64)
+	for _, m := range nftCounterElement.FindAllStringSubmatch(out, -1) {
+		bytes, err := strconv.ParseUint(m[2], 10, 64)
+		if err == nil {
+			counters[m[1]] += bytes
+		}
+	}
+	return counters, nil
+}
+
+func (f *NFTablesFirewall) Cleanup(iface string) error {
+	_, err := f.run(fmt.Sprintf("nft delete table %s", nftTable))
+	return err
+}
@@ -0,0 +1,168 @@
+package router
+
+import (
+	"fmt"
+	"sync"
+)
+
+// shaperIFB receives the hotspot interface's ingress traffic so uploads can
+// be shaped with an egress qdisc.
+const shaperIFB = "ifb_wifimint"
+
+// Class minor ids and filter prios are 16 bits; ids of removed classes are
+// reused so a long-running hotspot never runs out.
+const (
+	shaperFirstID = 0x10
+	shaperLastID  = 0xfffe
+)
+
+// Shaper gives every client its own HTB class: download on the egress of
+// the hotspot interface, upload on the egress of an IFB device mirrored
+// from the interface ingress. Each client's filters use their own prio so
+// they can be deleted without touching anybody else's.
+type Shaper struct {
+	Interface string
+	IFB       string
+
+	run     CommandRunner
+	lock    sync.Mutex
+	ready   bool
+	classes map[string]int // client IP -> class minor id
+	nextID  int
+	freeIDs []int // ids of removed classes, reused before nextID
+}
+
+func NewShaper(iface string, run CommandRunner) *Shaper {
+	return &Shaper{
+		Interface: iface,
+		IFB:       shaperIFB,
+		run:       run,
+		classes:   make(map[string]int),
+		nextID:    shaperFirstID,
+	}
+}
+
+// Setup installs the root qdiscs. Traffic that matches no client filter
+// falls through the HTB default and is not shaped.
+func (s *Shaper) Setup() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.teardown()
+
+	// Upload path: interface ingress -> IFB egress
+	s.run(fmt.Sprintf("ip link add %s type ifb", s.IFB))
+	cmds := []string{
+		fmt.Sprintf("ip link set dev %s up", s.IFB),
+		fmt.Sprintf("tc qdisc add dev %s root handle 1: htb default 9999", s.Interface),
+		fmt.Sprintf("tc class add dev %s parent 1: classid 1:1 htb rate 10gbit", s.Interface),
+		fmt.Sprintf("tc qdisc add dev %s handle ffff: ingress", s.Interface),
+		fmt.Sprintf("tc filter add dev %s parent ffff: protocol ip u32 match u32 0 0 action mirred egress redirect dev %s", s.Interface, s.IFB),
+		fmt.Sprintf("tc qdisc add dev %s root handle 1: htb default 9999", s.IFB),
+		fmt.Sprintf("tc class add dev %s parent 1: classid 1:1 htb rate 10gbit", s.IFB),
+	}
+	for _, cmd := range cmds {
+		if _, err := s.run(cmd); err != nil {
+			return fmt.Errorf("traffic shaping setup failed: %v", err)
+		}
+	}
+	s.ready = true
+	return nil
+}
+
+// Apply creates or updates the classes for ip. A zero rate leaves that
+// direction unshaped.
+func (s *Shaper) Apply(ip string, downKbps, upKbps int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.ready {
+		return fmt.Errorf("traffic shaping is not set up")
+	}
+
+	id, exists := s.classes[ip]
+	if exists {
+		s.removeFilters(id)
+	} else {
+		var err error
+		if id, err = s.allocID(); err != nil {
+			return err
+		}
+		s.classes[ip] = id
+	}
+
+	if downKbps > 0 {
+		if err := s.shape(s.Interface, id, "dst", ip, downKbps); err != nil {
+			return err
+		}
+	}
+	if upKbps > 0 {
+		if err := s.shape(s.IFB, id, "src", ip, upKbps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove tears down the classes for ip.
+func (s *Shaper) Remove(ip string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	id, exists := s.classes[ip]
+	if !exists {
+		return nil
+	}
+	s.removeFilters(id)
+	s.run(fmt.Sprintf("tc class del dev %s classid 1:%x", s.Interface, id))
+	s.run(fmt.Sprintf("tc class del dev %s classid 1:%x", s.IFB, id))
+	delete(s.classes, ip)
+	s.freeIDs = append(s.freeIDs, id)
+	return nil
+}
+
+// Cleanup removes the qdiscs and the IFB device.
+func (s *Shaper) Cleanup() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.teardown()
+	s.run(fmt.Sprintf("ip link del %s", s.IFB))
+	s.ready = false
+}
+
+func (s *Shaper) shape(dev string, id int, dir, ip string, kbps int) error {
+	if _, err := s.run(fmt.Sprintf("tc class replace dev %s parent 1:1 classid 1:%x htb rate %dkbit ceil %dkbit", dev, id, kbps, kbps)); err != nil {
+		return err
+	}
+	_, err := s.run(fmt.Sprintf("tc filter add dev %s parent 1: protocol ip prio %d u32 match ip %s %s/32 flowid 1:%x", dev, id, dir, ip, id))
+	return err
+}
+
+// allocID returns an unused class id. Callers hold s.lock.
+func (s *Shaper) allocID() (int, error) {
+	if n := len(s.freeIDs); n > 0 {
+		id := s.freeIDs[n-1]
+		s.freeIDs = s.freeIDs[:n-1]
+		return id, nil
+	}
+	if s.nextID > shaperLastID {
+		return 0, fmt.Errorf("no free traffic shaping class ids")
+	}
+	id := s.nextID
+	s.nextID++
+	return id, nil
+}
+
+func (s *Shaper) removeFilters(id int) {
+	s.run(fmt.Sprintf("tc filter del dev %s parent 1: protocol ip prio %d", s.Interface, id))
+	s.run(fmt.Sprintf("tc filter del dev %s parent 1: protocol ip prio %d", s.IFB, id))
+}
+
+func (s *Shaper) teardown() {
+	s.run(fmt.Sprintf("tc qdisc del dev %s root", s.Interface))
+	s.run(fmt.Sprintf("tc qdisc del dev %s ingress", s.Interface))
+	s.run(fmt.Sprintf("tc qdisc del dev %s root", s.IFB))
+	s.classes = make(map[string]int)
+	s.nextID = shaperFirstID
+	s.freeIDs = nil
+}
@@ -0,0 +1,38 @@
+package router
+
+import "testing"
+
+func TestShaperReusesRemovedClassIDs(t *testing.T) {
+	rec := NewRecordingExecutor()
+	s := NewShaper("wlan0", rec.Run)
+	if err := s.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Far more clients come and go than there are 16-bit ids
+	for i := 0; i <= shaperLastID-shaperFirstID+1; i++ {
+		ip := "10.0.0.5"
+		if i%2 == 1 {
+			ip = "10.0.0.6"
+		}
+		if err := s.Apply(ip, 1024, 256); err != nil {
+			t.Fatalf("Apply #%d: %v", i, err)
+		}
+		s.Remove(ip)
+	}
+	if s.nextID != shaperFirstID+1 {
+		t.Errorf("nextID = %#x, want %#x: removed ids were not reused", s.nextID, shaperFirstID+1)
+	}
+}
+
+func TestShaperRunsOutOfIDs(t *testing.T) {
+	s := NewShaper("wlan0", NewRecordingExecutor().Run)
+	s.ready = true
+	s.nextID = shaperLastID
+	if err := s.Apply("10.0.0.5", 1024, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Apply("10.0.0.6", 1024, 0); err == nil {
+		t.Error("Apply past the last class id succeeded")
+	}
+}
@@ -0,0 +1,66 @@
+package sms
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Sender delivers a text message to a mobile number.
+type Sender interface {
+	Send(to, message string) error
+}
+
+// NewSender returns the sender called name: "log" (default) or "http".
+func NewSender(name, gatewayURL, gatewayToken string) (Sender, error) {
+	switch name {
+	case "", "log":
+		return LogSender{}, nil
+	case "http":
+		if gatewayURL == "" {
+			return nil, fmt.Errorf("the http SMS sender needs a gateway URL")
+		}
+		return &HTTPSender{URL: gatewayURL, Token: gatewayToken, Client: &http.Client{Timeout: 10 * time.Second}}, nil
+	}
+	return nil, fmt.Errorf("unknown SMS sender %q (use log or http)", name)
+}
+
+// LogSender prints messages instead of sending them. It is the local stub
+// for development: the OTP shows up in the backend log.
+type LogSender struct{}
+
+func (LogSender) Send(to, message string) error {
+	fmt.Printf("[SMS] To %s: %s\n", to, message)
+	return nil
+}
+
+// HTTPSender posts {"to", "message"} as JSON to an SMS gateway, which
+// covers most providers' HTTP APIs or a small relay in front of them.
+type HTTPSender struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+func (s *HTTPSender) Send(to, message string) error {
+	body, _ := json.Marshal(map[string]string{"to": to, "message": message})
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sms gateway: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("sms gateway returned %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -4,16 +4,22 @@ import (
 	"fmt"
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/user/wifi-control-system/internal/api"
+	"github.com/user/wifi-control-system/internal/audit"
 	"github.com/user/wifi-control-system/internal/auth" // New Import
 	"github.com/user/wifi-control-system/internal/db"
+	"github.com/user/wifi-control-system/internal/dhcp"
 	"github.com/user/wifi-control-system/internal/dns"
+	"github.com/user/wifi-control-system/internal/payment"
 	"github.com/user/wifi-control-system/internal/router"
+	"github.com/user/wifi-control-system/internal/sms"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -23,14 +29,25 @@ func main() {
 	fmt.Println("Designed & Developed by Rajan Goswami")
 	fmt.Println("-----------------------------------------------")
 
-	// 1. Initialize Database (SQLite)
-	store, err := db.InitDB("wifi.db?_parse_time=true")
+	// 1. Initialize Database (SQLite, or PostgreSQL when DATABASE_URL is a
+	// postgres:// URL)
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		dsn = db.DefaultDSN
+	}
+	store, err := db.InitDB(dsn)
 	if err != nil {
 		log.Fatalf("Database initialization failed: %v", err)
 	}
-	// Create tables and default admin
+	// "migrate status" shows the schema version and "migrate up" applies
+	// pending migrations, without starting the server
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(store, os.Args[2:]))
+	}
+	// Apply pending migrations and create the default admin; a schema
+	// from a newer build is refused
 	if err := store.CreateTables(); err != nil {
-		log.Fatalf("Failed to create tables: %v", err)
+		log.Fatalf("Database migration failed: %v", err)
 	}
 	
 	// Ensure default admin exists
@@ -42,6 +59,15 @@ func main() {
 	if hotspotInterface == "" { hotspotInterface = "wlp0s20f3" } // Default wireless interface
 
 	routerClient := router.NewRouterClient(hotspotInterface)
+	// ROUTER_DRY_RUN=1 logs every firewall/ARP command instead of running it
+	if os.Getenv("ROUTER_DRY_RUN") == "1" {
+		log.Println("Router dry-run mode: commands will be logged, not executed.")
+		routerClient.Exec = router.DryRunExecutor{}
+	}
+	// FIREWALL_BACKEND selects the packet filter: "iptables" (default) or "nftables"
+	if err := routerClient.SetFirewallBackend(os.Getenv("FIREWALL_BACKEND")); err != nil {
+		log.Fatalf("Firewall backend: %v", err)
+	}
 	// We don't fail hard here if not root, just warn, because we might test logic.
 	if err := routerClient.Connect(); err != nil {
 		// The branding logs were previously here, but have been moved to the start of main.
@@ -58,13 +84,25 @@ func main() {
 		log.Println("Warning: ROUTER_IP not set. DNS Redirection might point to wrong IP.")
 	}
 
-	// Setup Captive Portal (iptables)
+	// Setup Captive Portal (iptables/nftables)
 	if err := routerClient.SetupCaptivePortal(laptopIP); err != nil {
 		log.Printf("Captive Portal Setup Error: %v\n", err)
 	}
 	defer routerClient.Cleanup()
 
 	dnsServer := dns.NewDNSServer(laptopIP)
+	// Paying clients get real answers from DNS_UPSTREAMS (comma separated host:port)
+	if upstreams := os.Getenv("DNS_UPSTREAMS"); upstreams != "" {
+		dnsServer.Upstreams = strings.Split(upstreams, ",")
+	}
+	dnsServer.Authorizer = &api.SubscriptionAuthorizer{DB: store.DB, Router: routerClient}
+
+	// Walled garden: domains/CIDRs reachable before payment
+	gardenHandler := &api.WalledGardenHandler{DB: store.DB, Router: routerClient, DNS: dnsServer}
+	dnsServer.OnWalledGardenResolve = gardenHandler.AddResolved
+	gardenHandler.Reload()
+	gardenHandler.Start()
+
 	go func() {
 		if err := dnsServer.Start(); err != nil {
 			log.Printf("DNS Server Error: %v\n", err)
@@ -73,13 +111,81 @@ func main() {
 	defer dnsServer.Stop()
 
 	// 4. Initialize Services
-	authService := auth.NewAuthService(store.DB)
-	authHandler := &api.AuthHandler{Router: routerClient} 
-	plansHandler := &api.PlansHandler{DB: store.DB}
-	subsHandler := &api.SubscriptionsHandler{DB: store.DB, Router: routerClient}
+	authService, err := auth.NewAuthService(store.DB)
+	if err != nil {
+		log.Fatalf("Auth: %v", err)
+	}
+	// Staff passwords: PASSWORD_MIN_LENGTH and PASSWORD_REQUIRE=upper,lower,digit,symbol
+	if authService.Policy, err = auth.ParsePasswordPolicy(os.Getenv("PASSWORD_MIN_LENGTH"), os.Getenv("PASSWORD_REQUIRE")); err != nil {
+		log.Fatalf("Auth: %v", err)
+	}
+	authService.FlagDefaultPassword("admin", "admin")
+	devices, plans, subscriptions := store.Devices(), store.Plans(), store.Subscriptions()
+	plansHandler := &api.PlansHandler{Plans: plans}
+	subsHandler := &api.SubscriptionsHandler{Devices: devices, Plans: plans, Subscriptions: subscriptions, Sessions: store.Sessions(), DB: store.DB, Router: routerClient}
+	vouchersHandler := &api.VouchersHandler{DB: store.DB, Subscriptions: subsHandler}
+
+	// Online payments (PAYMENT_PROVIDER=razorpay|mock) activate plans from signed webhooks
+	var paymentsHandler *api.PaymentsHandler
+	if name := os.Getenv("PAYMENT_PROVIDER"); name != "" {
+		provider, err := payment.NewProvider(name, payment.Config{
+			KeyID:         os.Getenv("PAYMENT_KEY_ID"),
+			KeySecret:     os.Getenv("PAYMENT_KEY_SECRET"),
+			WebhookSecret: os.Getenv("PAYMENT_WEBHOOK_SECRET"),
+		})
+		if err != nil {
+			log.Fatalf("Payments: %v", err)
+		}
+		currency := os.Getenv("PAYMENT_CURRENCY")
+		if currency == "" { currency = "INR" }
+		paymentsHandler = &api.PaymentsHandler{DB: store.DB, Provider: provider, Subscriptions: subsHandler, Currency: currency}
+		fmt.Printf("Payments: %s provider, webhook at /api/payments/webhook\n", provider.Name())
+	}
+
+	// Customer accounts sign in with a one-time code sent by SMS (SMS_PROVIDER=log|http)
+	smsSender, err := sms.NewSender(os.Getenv("SMS_PROVIDER"), os.Getenv("SMS_GATEWAY_URL"), os.Getenv("SMS_GATEWAY_TOKEN"))
+	if err != nil {
+		log.Fatalf("SMS: %v", err)
+	}
+	customersHandler := &api.CustomersHandler{DB: store.DB, SMS: smsSender, Auth: authService, Subscriptions: subsHandler}
+
+	// Portal login: a voucher or a customer account puts the device on a subscription
+	authHandler := &api.AuthHandler{Router: routerClient, Subscriptions: subsHandler, Vouchers: vouchersHandler, Customers: customersHandler}
+
+	// RFC 8908 Captive Portal API, advertised via DHCP option 114 / RA option 37 (RFC 8910).
+	// Clients ignore API URLs that are not https, so it is only advertised
+	// when CAPTIVE_PORTAL_API_URL names a TLS endpoint in front of :8080
+	portalURL := fmt.Sprintf("http://%s:8080/login", laptopIP)
+	captiveAPIURL := os.Getenv("CAPTIVE_PORTAL_API_URL")
+	if captiveAPIURL != "" && !strings.HasPrefix(strings.ToLower(captiveAPIURL), "https://") {
+		log.Fatalf("CAPTIVE_PORTAL_API_URL must be an https:// URL (RFC 8908), got %s", captiveAPIURL)
+	}
+	captiveHandler := &api.CaptivePortalHandler{DB: store.DB, Router: routerClient, PortalURL: portalURL}
+	subsHandler.CaptivePortalAPI = captiveAPIURL
+	if captiveAPIURL == "" {
+		log.Printf("WARNING: CAPTIVE_PORTAL_API_URL is not set, so the Captive Portal API is not advertised. Clients only use an https API URL: serve http://%s:8080/api/captive-portal behind TLS and set CAPTIVE_PORTAL_API_URL.", laptopIP)
+	} else {
+		fmt.Printf("Captive Portal API: %s (advertise with DHCP option 114, e.g. dnsmasq: dhcp-option=114,\"%s\")\n", captiveAPIURL, captiveAPIURL)
+	}
+
+	// Built-in DHCP server (DHCP_ENABLED=1) gives exact IP<->MAC leases
+	var dhcpServer *dhcp.Server
+	if os.Getenv("DHCP_ENABLED") == "1" {
+		dhcpServer, err = newDHCPServer(store, hotspotInterface, laptopIP, dnsServer.Upstreams, captiveAPIURL)
+		if err != nil {
+			log.Fatalf("DHCP: %v", err)
+		}
+		routerClient.Leases = dhcpServer
+		go func() {
+			if err := dhcpServer.Start(); err != nil {
+				log.Printf("DHCP Server Error: %v\n", err)
+			}
+		}()
+		defer dhcpServer.Stop()
+	}
 	
 	// Start Subscription Expiry Monitor
-	monitor := &api.SubscriptionMonitor{DB: store.DB, Router: routerClient}
+	monitor := &api.SubscriptionMonitor{Devices: devices, Plans: plans, Subscriptions: subscriptions, DB: store.DB, Router: routerClient}
 	monitor.Start()
 	monitor.SyncAllowedDevices()
 
@@ -92,44 +198,103 @@ func main() {
 	
 	// Admin Auth
 	r.HandleFunc("/api/admin/login", authService.Login).Methods("POST")
+	// Short-lived access tokens are renewed with the refresh cookie; both work without a valid access token
+	r.HandleFunc("/api/admin/login/verify", authService.VerifyLogin).Methods("POST")
+	r.HandleFunc("/api/admin/refresh", authService.Refresh).Methods("POST")
+	r.HandleFunc("/api/admin/logout", authService.Logout).Methods("POST")
 
 	// Protected Admin Routes
 	adminRouter := r.PathPrefix("/api/admin").Subrouter()
 	adminRouter.Use(authService.Middleware)
-	adminRouter.HandleFunc("/dashboard", func(w http.ResponseWriter, r *http.Request) {
+	// Every state-changing admin request lands in audit_log
+	auditLog := audit.Middleware(store.DB)
+	adminRouter.Use(auditLog)
+	adminRouter.HandleFunc("/dashboard", authService.Require(auth.PermView, func(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"message": "Welcome Admin!"})
-	}).Methods("GET")
+	})).Methods("GET")
 	
 	// Plans Management
-	adminRouter.HandleFunc("/plans", plansHandler.GetPlans).Methods("GET")
-	adminRouter.HandleFunc("/plans", plansHandler.CreatePlan).Methods("POST")
-	adminRouter.HandleFunc("/plans/{id}", plansHandler.DeletePlan).Methods("DELETE")
+	adminRouter.HandleFunc("/plans", authService.Require(auth.PermView, plansHandler.GetPlans)).Methods("GET")
+	adminRouter.HandleFunc("/plans", authService.Require(auth.PermManagePlans, plansHandler.CreatePlan)).Methods("POST")
+	adminRouter.HandleFunc("/plans/{id}", authService.Require(auth.PermManagePlans, plansHandler.DeletePlan)).Methods("DELETE")
 	
 	// Subscriptions Management
-	adminRouter.HandleFunc("/subscriptions", subsHandler.GetActiveSubscriptions).Methods("GET")
-	adminRouter.HandleFunc("/all-subscriptions", subsHandler.GetAllSubscriptions).Methods("GET")
-	adminRouter.HandleFunc("/assign-plan", subsHandler.AssignPlan).Methods("POST")
-	adminRouter.HandleFunc("/revoke-subscription", subsHandler.RevokeSubscription).Methods("POST")
-	adminRouter.HandleFunc("/pending-requests", subsHandler.GetPendingRequests).Methods("GET")
-	adminRouter.HandleFunc("/approve-subscription", subsHandler.ApproveSubscription).Methods("POST")
-	adminRouter.HandleFunc("/reject-subscription", subsHandler.RejectSubscription).Methods("POST")
-	adminRouter.HandleFunc("/stats", subsHandler.GetStats).Methods("GET")
-	adminRouter.HandleFunc("/revenue-stats", subsHandler.GetRevenueStats).Methods("GET")
-	adminRouter.HandleFunc("/system-status", subsHandler.GetSystemStatus).Methods("GET")
-	adminRouter.HandleFunc("/change-password", authService.ChangePassword).Methods("POST")
-	adminRouter.HandleFunc("/flush-data", subsHandler.FlushData).Methods("POST")
+	adminRouter.HandleFunc("/subscriptions", authService.Require(auth.PermView, subsHandler.GetActiveSubscriptions)).Methods("GET")
+	adminRouter.HandleFunc("/all-subscriptions", authService.Require(auth.PermView, subsHandler.GetAllSubscriptions)).Methods("GET")
+	adminRouter.HandleFunc("/assign-plan", authService.Require(auth.PermAssignPlans, subsHandler.AssignPlan)).Methods("POST")
+	adminRouter.HandleFunc("/revoke-subscription", authService.Require(auth.PermRevoke, subsHandler.RevokeSubscription)).Methods("POST")
+	adminRouter.HandleFunc("/pending-requests", authService.Require(auth.PermView, subsHandler.GetPendingRequests)).Methods("GET")
+	adminRouter.HandleFunc("/pending-requests/import-statement", authService.Require(auth.PermApprovePayments, subsHandler.ImportStatement)).Methods("POST")
+	adminRouter.HandleFunc("/approve-subscription", authService.Require(auth.PermApprovePayments, subsHandler.ApproveSubscription)).Methods("POST")
+	adminRouter.HandleFunc("/reject-subscription", authService.Require(auth.PermApprovePayments, subsHandler.RejectSubscription)).Methods("POST")
+	adminRouter.HandleFunc("/stats", authService.Require(auth.PermView, subsHandler.GetStats)).Methods("GET")
+	adminRouter.HandleFunc("/revenue-stats", authService.Require(auth.PermView, subsHandler.GetRevenueStats)).Methods("GET")
+	adminRouter.HandleFunc("/system-status", authService.Require(auth.PermView, subsHandler.GetSystemStatus)).Methods("GET")
+	adminRouter.HandleFunc("/change-password", authService.RequireSession(authService.ChangePassword)).Methods("POST")
+	adminRouter.HandleFunc("/me", authService.RequireSession(authService.Me)).Methods("GET")
+	adminRouter.HandleFunc("/sessions/revoke-all", authService.RequireSession(authService.RevokeAllSessions)).Methods("POST")
+	// Two-factor authentication (TOTP) for the signed-in staff member
+	adminRouter.HandleFunc("/2fa/setup", authService.RequireSession(authService.SetupTwoFactor)).Methods("POST")
+	adminRouter.HandleFunc("/2fa/enable", authService.RequireSession(authService.EnableTwoFactor)).Methods("POST")
+	adminRouter.HandleFunc("/2fa/disable", authService.RequireSession(authService.DisableTwoFactor)).Methods("POST")
+	adminRouter.HandleFunc("/2fa/recovery-codes", authService.RequireSession(authService.RegenerateRecoveryCodes)).Methods("POST")
+
+	// Staff Accounts
+	adminRouter.HandleFunc("/users", authService.Require(auth.PermManageUsers, authService.ListUsers)).Methods("GET")
+	adminRouter.HandleFunc("/users", authService.Require(auth.PermManageUsers, authService.CreateUser)).Methods("POST")
+	adminRouter.HandleFunc("/users/{id}", authService.Require(auth.PermManageUsers, authService.UpdateUser)).Methods("PUT")
+	adminRouter.HandleFunc("/users/{id}", authService.Require(auth.PermManageUsers, authService.DeleteUser)).Methods("DELETE")
+	adminRouter.HandleFunc("/users/{id}/sessions", authService.Require(auth.PermManageUsers, authService.RevokeUserSessions)).Methods("DELETE")
+	adminRouter.HandleFunc("/users/{id}/2fa", authService.Require(auth.PermManageUsers, authService.ResetTwoFactor)).Methods("DELETE")
+	adminRouter.HandleFunc("/flush-data", authService.Require(auth.PermFlushData, subsHandler.FlushData)).Methods("POST")
+
+	// API keys for scripts and integrations
+	adminRouter.HandleFunc("/api-keys", authService.Require(auth.PermManageAPIKeys, authService.ListAPIKeys)).Methods("GET")
+	adminRouter.HandleFunc("/api-keys", authService.Require(auth.PermManageAPIKeys, authService.CreateAPIKey)).Methods("POST")
+	adminRouter.HandleFunc("/api-keys/{id}", authService.Require(auth.PermManageAPIKeys, authService.RevokeAPIKey)).Methods("DELETE")
+
+	// Walled Garden Management
+	adminRouter.HandleFunc("/walled-garden", authService.Require(auth.PermView, gardenHandler.GetEntries)).Methods("GET")
+	adminRouter.HandleFunc("/walled-garden", authService.Require(auth.PermManageGarden, gardenHandler.CreateEntry)).Methods("POST")
+	adminRouter.HandleFunc("/walled-garden/{id}", authService.Require(auth.PermManageGarden, gardenHandler.UpdateEntry)).Methods("PUT")
+	adminRouter.HandleFunc("/walled-garden/{id}", authService.Require(auth.PermManageGarden, gardenHandler.DeleteEntry)).Methods("DELETE")
+
+	// Vouchers
+	adminRouter.HandleFunc("/vouchers", authService.Require(auth.PermManageVouchers, vouchersHandler.GetVouchers)).Methods("GET")
+	adminRouter.HandleFunc("/vouchers/batch", authService.Require(auth.PermManageVouchers, vouchersHandler.CreateBatch)).Methods("POST")
+	adminRouter.HandleFunc("/vouchers/export", authService.Require(auth.PermManageVouchers, vouchersHandler.ExportVouchers)).Methods("GET")
+	adminRouter.HandleFunc("/vouchers/{id}", authService.Require(auth.PermManageVouchers, vouchersHandler.RevokeVoucher)).Methods("DELETE")
+
+	// Customer Accounts
+	adminRouter.HandleFunc("/customer-accounts", authService.Require(auth.PermView, customersHandler.GetCustomers)).Methods("GET")
+	adminRouter.HandleFunc("/customer-accounts/{id}/sessions", authService.Require(auth.PermRevoke, customersHandler.RevokeSessions)).Methods("DELETE")
+
+	// Audit Log
+	auditHandler := &api.AuditHandler{DB: store.DB}
+	adminRouter.HandleFunc("/audit", authService.Require(auth.PermViewAudit, auditHandler.GetEntries)).Methods("GET")
+	adminRouter.HandleFunc("/audit/export", authService.Require(auth.PermViewAudit, auditHandler.ExportEntries)).Methods("GET")
+
+	// DHCP Leases
+	adminRouter.HandleFunc("/dhcp-leases", authService.Require(auth.PermView, func(w http.ResponseWriter, r *http.Request) {
+		leases := []dhcp.Lease{}
+		if dhcpServer != nil {
+			leases = dhcpServer.Leases()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(leases)
+	})).Methods("GET")
 
 	// Customer Base Management
-	adminRouter.HandleFunc("/customers", func(w http.ResponseWriter, r *http.Request) {
-		devices, err := store.GetAllDevices()
+	adminRouter.HandleFunc("/customers", authService.Require(auth.PermView, func(w http.ResponseWriter, r *http.Request) {
+		list, err := devices.List()
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		json.NewEncoder(w).Encode(devices)
-	}).Methods("GET")
+		json.NewEncoder(w).Encode(list)
+	})).Methods("GET")
 
-	adminRouter.HandleFunc("/customers/{mac}/name", func(w http.ResponseWriter, r *http.Request) {
+	adminRouter.HandleFunc("/customers/{mac}/name", authService.Require(auth.PermManageDevices, func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		mac := vars["mac"]
 		var req struct { Name string `json:"name"` }
@@ -137,76 +302,49 @@ func main() {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if err := store.UpdateDeviceName(mac, req.Name); err != nil {
+		old, _ := devices.Get(mac)
+		if err := devices.SetName(mac, req.Name); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		e := audit.From(r)
+		e.Action, e.TargetMAC = "device.rename", mac
+		e.Before, e.After = map[string]string{"name": old.Name}, map[string]string{"name": req.Name}
 		json.NewEncoder(w).Encode(map[string]string{"message": "Name updated"})
-	}).Methods("PUT")
-
-	// Device Scanning Endpoint
-	r.HandleFunc("/api/devices", func(w http.ResponseWriter, r *http.Request) {
-		devices, err := routerClient.GetConnectedDevices()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(devices)
-	}).Methods("GET")
-
-	// Block Device Endpoint
-	r.HandleFunc("/api/block", func(w http.ResponseWriter, r *http.Request) {
-		var req struct { 
-			Mac string `json:"mac"`
-			IP  string `json:"ip"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		
-		fmt.Printf("API: Blocking MAC %s (IP: %s)\n", req.Mac, req.IP)
-		msg, err := routerClient.BlockMAC(req.Mac, req.IP)
-		if err != nil {
-			log.Printf("BlockMAC Failed: %v\n", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		// Sync with DB
-		store.DB.Exec("UPDATE devices SET status = 'blocked' WHERE mac_address = ?", req.Mac)
-		json.NewEncoder(w).Encode(map[string]string{"message": msg})
-	}).Methods("POST")
+	})).Methods("PUT")
 
-	// Unblock Device Endpoint
-	r.HandleFunc("/api/unblock", func(w http.ResponseWriter, r *http.Request) {
-		var req struct { Mac string `json:"mac"` }
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		
-		fmt.Printf("[API] REQUEST: Unblock MAC %s\n", req.Mac)
-		msg, err := routerClient.AllowMAC(req.Mac)
-		if err != nil {
-			log.Printf("AllowMAC Failed: %v\n", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		// Sync with DB
-		store.DB.Exec("UPDATE devices SET status = 'allowed' WHERE mac_address = ?", req.Mac)
-		json.NewEncoder(w).Encode(map[string]string{"message": msg})
-	}).Methods("POST")
+	// Device control is staff-only (see deviceRoutes)
+	deviceRoutes(r, authService, auditLog, routerClient, devices)
 	
-	// Legacy Client Login (Captive Portal)
-	r.HandleFunc("/api/auth/login", authHandler.Login).Methods("POST")
-	r.HandleFunc("/api/auth/logout", authHandler.Logout).Methods("POST")
+	// Client Login (Captive Portal): voucher or customer account. Both act only on the caller's own MAC.
+	r.Handle("/api/auth/login", auditLog(http.HandlerFunc(authHandler.Login))).Methods("POST")
+	r.Handle("/api/auth/logout", auditLog(http.HandlerFunc(authHandler.Logout))).Methods("POST")
 	
 	// Public Plans and Request Flow
 	r.HandleFunc("/api/public/plans", plansHandler.GetPlans).Methods("GET")
 	r.HandleFunc("/api/auth/request-plan", subsHandler.RequestPlan).Methods("POST")
+	r.HandleFunc("/api/auth/redeem-voucher", vouchersHandler.Redeem).Methods("POST")
+	if paymentsHandler != nil {
+		r.HandleFunc("/api/auth/payments/order", paymentsHandler.CreateOrder).Methods("POST")
+		r.HandleFunc("/api/auth/payments/{order_id}", paymentsHandler.GetOrderStatus).Methods("GET")
+		r.HandleFunc("/api/payments/webhook", paymentsHandler.Webhook).Methods("POST")
+	}
 	r.HandleFunc("/api/auth/status", subsHandler.CheckStatus).Methods("GET")
+	r.Handle("/api/auth/session/rebind", auditLog(http.HandlerFunc(subsHandler.RebindSession))).Methods("POST")
+
+	// Customer Accounts (OTP login, devices sharing a plan)
+	r.HandleFunc("/api/customer/otp", customersHandler.RequestOTP).Methods("POST")
+	r.HandleFunc("/api/customer/verify", customersHandler.VerifyOTP).Methods("POST")
+	r.HandleFunc("/api/customer/logout", authService.CustomerLogout).Methods("POST")
+	customerRouter := r.PathPrefix("/api/customer").Subrouter()
+	customerRouter.Use(authService.CustomerMiddleware)
+	customerRouter.HandleFunc("/me", customersHandler.GetMe).Methods("GET")
+	customerRouter.HandleFunc("/devices", customersHandler.AddDevice).Methods("POST")
+	customerRouter.HandleFunc("/devices/{mac}", customersHandler.RemoveDevice).Methods("DELETE")
+	customerRouter.HandleFunc("/transfer", customersHandler.Transfer).Methods("POST")
+	customerRouter.HandleFunc("/sessions/revoke-all", customersHandler.LogoutEverywhere).Methods("POST")
 	r.HandleFunc("/api/auth/whoami", subsHandler.WhoAmI).Methods("GET")
+	r.HandleFunc("/api/captive-portal", captiveHandler.GetStatus).Methods("GET")
 
 	// Static Frontend Files (SPA Support)
 	// We detect the correct path whether run from root or from backend folder
@@ -249,7 +387,7 @@ func main() {
 				   strings.Contains(path, "wifiredirect")
 
 		// SERVE LOGIC:
-		if isTrustedHost && (isPortalPath || isApiReq || isStaticAsset) {
+		if isTrustedHost && !isProbe && (isPortalPath || isApiReq || isStaticAsset) {
 			if isApiReq { return } // Let mux handle API
 
 			filePath := frontendDist + path
@@ -274,9 +412,8 @@ func main() {
 
 		// REDIRECT LOGIC:
 		// If it's a probe OR it's an untrusted host, send to /login
-		fmt.Printf("[PORTAL] Redirecting %s (%s) -> http://%s:8080/login\n", host, path, laptopIP)
-		portalURL := fmt.Sprintf("http://%s:8080/login", laptopIP)
-		
+		fmt.Printf("[PORTAL] Redirecting %s (%s) -> %s\n", host, path, portalURL)
+
 		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 		w.Header().Set("Pragma", "no-cache")
 		w.Header().Set("Expires", "0")
@@ -289,3 +426,188 @@ func main() {
 	fmt.Printf("Server starting on port %s...\n", port)
 	log.Fatal(http.ListenAndServe(port, r))
 }
+
+// newDHCPServer builds the DHCP server from DHCP_RANGE ("start-end",
+// default .100-.250 of ROUTER_IP's /24), DHCP_LEASE_TIME (Go duration) and
+// DHCP_DNS (comma separated, default the DNS upstreams).
+func newDHCPServer(store *db.DBStore, iface, routerIP string, upstreams []string, captiveAPIURL string) (*dhcp.Server, error) {
+	serverIP := net.ParseIP(routerIP).To4()
+	if serverIP == nil {
+		return nil, fmt.Errorf("ROUTER_IP %q is not an IPv4 address", routerIP)
+	}
+
+	dhcpRange := os.Getenv("DHCP_RANGE")
+	if dhcpRange == "" {
+		dhcpRange = fmt.Sprintf("%d.%d.%d.100-%d.%d.%d.250", serverIP[0], serverIP[1], serverIP[2], serverIP[0], serverIP[1], serverIP[2])
+	}
+	bounds := strings.SplitN(dhcpRange, "-", 2)
+	if len(bounds) != 2 || net.ParseIP(strings.TrimSpace(bounds[0])) == nil || net.ParseIP(strings.TrimSpace(bounds[1])) == nil {
+		return nil, fmt.Errorf("invalid DHCP_RANGE %q", dhcpRange)
+	}
+
+	server := dhcp.NewServer(store.DB, iface, serverIP, net.ParseIP(strings.TrimSpace(bounds[0])), net.ParseIP(strings.TrimSpace(bounds[1])))
+	server.CaptivePortalURL = captiveAPIURL
+
+	if lease := os.Getenv("DHCP_LEASE_TIME"); lease != "" {
+		d, err := time.ParseDuration(lease)
+		if err != nil || d < time.Minute {
+			return nil, fmt.Errorf("invalid DHCP_LEASE_TIME %q", lease)
+		}
+		server.LeaseTime = d
+	}
+
+	// Captive clients have all DNS redirected anyway; paying clients need a
+	// real resolver since they bypass the redirect
+	dnsServers := upstreams
+	if v := os.Getenv("DHCP_DNS"); v != "" {
+		dnsServers = strings.Split(v, ",")
+	}
+	for _, d := range dnsServers {
+		d = strings.TrimSpace(d)
+		if host, _, err := net.SplitHostPort(d); err == nil {
+			d = host
+		}
+		if ip := net.ParseIP(d); ip != nil && ip.To4() != nil {
+			server.DNS = append(server.DNS, ip)
+		}
+	}
+	return server, nil
+}
+
+// deviceRouter is the part of the router client the device endpoints use.
+type deviceRouter interface {
+	GetConnectedDevices() ([]router.Device, error)
+	BlockMAC(mac string, ip string) (string, error)
+	AllowMAC(mac string) (string, error)
+}
+
+// deviceRoutes adds the device control endpoints. They are staff-only:
+// same auth as /api/admin, then the role's permission, then the audit log.
+func deviceRoutes(r *mux.Router, authService *auth.AuthService, auditLog func(http.Handler) http.Handler, routerClient deviceRouter, devices db.Devices) {
+	staffOnly := func(perm auth.Permission, h http.HandlerFunc) http.Handler {
+		return authService.Middleware(auditLog(authService.Require(perm, h)))
+	}
+
+	// Device Scanning Endpoint
+	r.Handle("/api/devices", staffOnly(auth.PermView, func(w http.ResponseWriter, r *http.Request) {
+		devices, err := routerClient.GetConnectedDevices()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(devices)
+	})).Methods("GET")
+
+	// Block Device Endpoint
+	r.Handle("/api/block", staffOnly(auth.PermManageDevices, func(w http.ResponseWriter, r *http.Request) {
+		var req struct { 
+			Mac string `json:"mac"`
+			IP  string `json:"ip"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	
+		fmt.Printf("API: Blocking MAC %s (IP: %s)\n", req.Mac, req.IP)
+		msg, err := routerClient.BlockMAC(req.Mac, req.IP)
+		if err != nil {
+			log.Printf("BlockMAC Failed: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Sync with DB
+		e := audit.From(r)
+		e.Action, e.TargetMAC, e.Before = "device.block", req.Mac, deviceState(devices, req.Mac)
+		devices.SetStatus(req.Mac, "blocked")
+		e.After = deviceState(devices, req.Mac)
+		json.NewEncoder(w).Encode(map[string]string{"message": msg})
+	})).Methods("POST")
+
+	// Unblock Device Endpoint
+	r.Handle("/api/unblock", staffOnly(auth.PermManageDevices, func(w http.ResponseWriter, r *http.Request) {
+		var req struct { Mac string `json:"mac"` }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	
+		fmt.Printf("[API] REQUEST: Unblock MAC %s\n", req.Mac)
+		msg, err := routerClient.AllowMAC(req.Mac)
+		if err != nil {
+			log.Printf("AllowMAC Failed: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Sync with DB
+		e := audit.From(r)
+		e.Action, e.TargetMAC, e.Before = "device.unblock", req.Mac, deviceState(devices, req.Mac)
+		devices.SetStatus(req.Mac, "allowed")
+		e.After = deviceState(devices, req.Mac)
+		json.NewEncoder(w).Encode(map[string]string{"message": msg})
+	})).Methods("POST")
+}
+
+// deviceState is the audit snapshot of a device row.
+func deviceState(devices db.Devices, mac string) map[string]string {
+	d, err := devices.Get(mac)
+	if err != nil {
+		return nil
+	}
+	return map[string]string{"status": d.Status}
+}
+
+// runMigrate handles "migrate status" and "migrate up" and returns the
+// exit code.
+func runMigrate(store *db.DBStore, args []string) int {
+	command := "status"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "status":
+		status, err := store.MigrationStatus()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+			return 1
+		}
+		version, err := store.SchemaVersion()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Schema version %d of %d\n", version, len(status))
+		for _, st := range status {
+			state := "pending"
+			if st.AppliedAt != nil {
+				state = "applied " + st.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("  %04d_%-30s %s\n", st.Version, st.Name, state)
+		}
+		if version > len(status) {
+			fmt.Println("The database was migrated by a newer build.")
+			return 1
+		}
+		return 0
+
+	case "up":
+		applied, err := store.Migrate()
+		for _, m := range applied {
+			fmt.Printf("Applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("Schema is up to date.")
+		}
+		return 0
+
+	default:
+		fmt.Fprintf(os.Stderr, "usage: %s migrate [status|up]\n", os.Args[0])
+		return 2
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/user/wifi-control-system/internal/audit"
+	"github.com/user/wifi-control-system/internal/auth"
+	"github.com/user/wifi-control-system/internal/db"
+	"github.com/user/wifi-control-system/internal/router"
+)
+
+type fakeDeviceRouter struct {
+	blocked []string
+}
+
+func (f *fakeDeviceRouter) GetConnectedDevices() ([]router.Device, error) { return nil, nil }
+
+func (f *fakeDeviceRouter) BlockMAC(mac, ip string) (string, error) {
+	f.blocked = append(f.blocked, mac)
+	return "blocked", nil
+}
+
+func (f *fakeDeviceRouter) AllowMAC(mac string) (string, error) { return "allowed", nil }
+
+func TestDeviceRoutesNeedStaff(t *testing.T) {
+	store, err := db.InitDB(filepath.Join(t.TempDir(), "test.db") + "?_parse_time=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.DB.Close()
+	if _, err := store.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	authService, err := auth.NewAuthService(store.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// API keys are stored as the hex sha256 of the key
+	store.DB.Exec("INSERT INTO api_keys (name, prefix, key_hash, scopes) VALUES ('view', 'v', ?, 'dashboard.view')", sha256Hex("view-key"))
+	store.DB.Exec("INSERT INTO api_keys (name, prefix, key_hash, scopes) VALUES ('devices', 'd', ?, 'devices.manage')", sha256Hex("devices-key"))
+
+	fake := &fakeDeviceRouter{}
+	r := mux.NewRouter()
+	deviceRoutes(r, authService, audit.Middleware(store.DB), fake, store.Devices())
+
+	block := func(key string) int {
+		req := httptest.NewRequest("POST", "/api/block", strings.NewReader(`{"mac": "aa:bb:cc:dd:ee:01"}`))
+		req.RemoteAddr = "192.168.1.50:40000"
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := block(""); code != http.StatusUnauthorized {
+		t.Errorf("block without auth: %d, want 401", code)
+	}
+	if code := block("view-key"); code != http.StatusForbidden {
+		t.Errorf("block with a view-only key: %d, want 403", code)
+	}
+	if len(fake.blocked) != 0 {
+		t.Fatalf("unauthorized requests blocked %v", fake.blocked)
+	}
+	if code := block("devices-key"); code != http.StatusOK {
+		t.Errorf("block with a devices key: %d, want 200", code)
+	}
+	if len(fake.blocked) != 1 {
+		t.Errorf("blocked %v, want one device", fake.blocked)
+	}
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
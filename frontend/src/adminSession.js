@@ -0,0 +1,52 @@
+// Admin access tokens expire after a few minutes. When a call made with the
+// admin token comes back 401, trade the refresh cookie for a new token once
+// and repeat the call; if that fails the session is over.
+const originalFetch = window.fetch.bind(window);
+let refreshing = null;
+
+const storeSession = (data) => {
+    localStorage.setItem('admin_token', data.token);
+    localStorage.setItem('admin_role', data.role);
+    localStorage.setItem('admin_permissions', JSON.stringify(data.permissions || []));
+};
+
+export const clearAdminSession = () => {
+    localStorage.removeItem('admin_token');
+    localStorage.removeItem('admin_role');
+    localStorage.removeItem('admin_permissions');
+    localStorage.removeItem('admin_must_change_password');
+};
+
+const refreshAdminToken = () => {
+    if (!refreshing) {
+        refreshing = originalFetch('/api/admin/refresh', { method: 'POST', credentials: 'same-origin' })
+            .then(res => (res.ok ? res.json() : Promise.reject(new Error('Session expired'))))
+            .then(data => {
+                storeSession(data);
+                return data.token;
+            })
+            .finally(() => { refreshing = null; });
+    }
+    return refreshing;
+};
+
+export const installAdminSession = () => {
+    window.fetch = async (input, init = {}) => {
+        const res = await originalFetch(input, init);
+        const token = localStorage.getItem('admin_token');
+        const headers = new Headers(init.headers);
+        if (res.status !== 401 || !token || headers.get('Authorization') !== `Bearer ${token}`) {
+            return res;
+        }
+
+        try {
+            const fresh = await refreshAdminToken();
+            headers.set('Authorization', `Bearer ${fresh}`);
+            return originalFetch(input, { ...init, headers });
+        } catch {
+            clearAdminSession();
+            window.location.href = '/admin';
+            return res;
+        }
+    };
+};
@@ -27,7 +27,9 @@ export default function Dashboard() {
         if (!isAdminAuth) return;
         const fetchDevices = async () => {
             try {
-                const res = await fetch('/api/devices');
+                const res = await fetch('/api/devices', {
+                    headers: { 'Authorization': `Bearer ${localStorage.getItem('admin_token')}` }
+                });
                 const data = await res.json();
                 if (Array.isArray(data)) setDevices(data);
             } catch (e) { console.error(e) }
@@ -51,7 +53,10 @@ export default function Dashboard() {
         await fetch(`/api/${action}`, {
             method: 'POST',
             body: JSON.stringify({ mac }),
-            headers: { 'Content-Type': 'application/json' }
+            headers: {
+                'Content-Type': 'application/json',
+                'Authorization': `Bearer ${localStorage.getItem('admin_token')}`
+            }
         });
     };
 
@@ -41,7 +41,14 @@ export default function Login() {
     const checkInitialStatus = async (detectedMac) => {
         try {
             const res = await fetch(`/api/auth/status?mac=${detectedMac}`);
-            const data = await res.json();
+            let data = await res.json();
+            if (data.status !== 'active' && data.status !== 'pending') {
+                // A device back under a new MAC takes its plan along
+                const rebind = await fetch('/api/auth/session/rebind', { method: 'POST' });
+                if (rebind.ok) {
+                    data = await rebind.json();
+                }
+            }
             if (data.status === 'active') {
                 setRequestStatus('active');
                 setStep(4);
@@ -98,6 +105,8 @@ export default function Login() {
                     setRequestStatus('pending');
                 }
                 setStep(4);
+            } else if (res.status === 409) {
+                alert(await res.text());
             } else {
                 alert("Request failed. Please try again.");
             }
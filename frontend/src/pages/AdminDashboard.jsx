@@ -8,11 +8,16 @@ import {
     FileText, LayoutDashboard, ChevronRight, Settings, TrendingUp, Globe
 } from 'lucide-react';
 import Sidebar from '../components/Sidebar';
+import { clearAdminSession } from '../adminSession';
 import { AreaChart, Area, XAxis, YAxis, CartesianGrid, Tooltip, ResponsiveContainer } from 'recharts';
 
 const AdminDashboard = () => {
     const location = useLocation();
     const [activeTab, setActiveTab] = useState('overview');
+    // Seeded or reset passwords must be changed before anything else works
+    const [mustChangePassword, setMustChangePassword] = useState(localStorage.getItem('admin_must_change_password') === '1');
+    const permissions = JSON.parse(localStorage.getItem('admin_permissions') || '[]');
+    const can = (permission) => permissions.includes(permission);
     const [stats, setStats] = useState([
         { title: 'Total Revenue', value: '₹0', icon: Activity, color: 'text-emerald-400', bg: 'bg-emerald-500/10' },
         { title: 'Subscribed Users', value: '0', icon: Users, color: 'text-blue-400', bg: 'bg-blue-500/10' },
@@ -34,6 +39,7 @@ const AdminDashboard = () => {
     const [notifications, setNotifications] = useState([]);
     const [passwords, setPasswords] = useState({ old: '', new: '', confirm: '' });
     const [isUpdatingPass, setIsUpdatingPass] = useState(false);
+    const [twoFactor, setTwoFactor] = useState({ enabled: false, setup: null, code: '', password: '', recoveryCodes: [] });
     const [duplicateAlert, setDuplicateAlert] = useState(null);
 
     const addNotification = (message, type = 'info') => {
@@ -47,14 +53,16 @@ const AdminDashboard = () => {
     useEffect(() => {
         const params = new URLSearchParams(location.search);
         const tab = params.get('tab');
-        if (tab) setActiveTab(tab);
-    }, [location]);
+        if (mustChangePassword) setActiveTab('settings');
+        else if (tab) setActiveTab(tab);
+    }, [location, mustChangePassword]);
 
     useEffect(() => {
+        if (mustChangePassword) return;
         fetchData();
         const interval = setInterval(fetchData, 5000);
         return () => clearInterval(interval);
-    }, []);
+    }, [mustChangePassword]);
 
     const fetchData = async () => {
         try {
@@ -63,7 +71,7 @@ const AdminDashboard = () => {
 
             const [statsRes, liveRes, plansRes, subsRes, allSubsRes, reqRes, revRes, sysRes] = await Promise.all([
                 fetch('/api/admin/stats', { headers }),
-                fetch('/api/devices'),
+                fetch('/api/devices', { headers }),
                 fetch('/api/admin/plans', { headers }),
                 fetch('/api/admin/subscriptions', { headers }),
                 fetch('/api/admin/all-subscriptions', { headers }),
@@ -374,16 +382,65 @@ const AdminDashboard = () => {
                 })
             });
             if (res.ok) {
+                const data = await res.json();
+                if (data.token) localStorage.setItem('admin_token', data.token);
+                localStorage.removeItem('admin_must_change_password');
+                setMustChangePassword(false);
                 addNotification("Password changed successfully", "success");
                 setPasswords({ old: '', new: '', confirm: '' });
             } else {
-                const data = await res.json();
-                addNotification(data.error || "Failed to change password", "error");
+                const message = (await res.text()).trim();
+                addNotification(message || "Failed to change password", "error");
             }
         } catch (error) { addNotification("System error", "error") }
         finally { setIsUpdatingPass(false) }
     };
 
+    useEffect(() => {
+        if (activeTab !== 'settings') return;
+        const token = localStorage.getItem('admin_token');
+        fetch('/api/admin/me', { headers: { 'Authorization': `Bearer ${token}` } })
+            .then(res => res.ok ? res.json() : null)
+            .then(me => me && setTwoFactor(tf => ({ ...tf, enabled: !!me.two_factor })))
+            .catch(() => {});
+    }, [activeTab]);
+
+    const twoFactorRequest = async (path, body) => {
+        const token = localStorage.getItem('admin_token');
+        const res = await fetch(`/api/admin/2fa/${path}`, {
+            method: 'POST',
+            headers: { 'Authorization': `Bearer ${token}`, 'Content-Type': 'application/json' },
+            body: JSON.stringify(body || {})
+        });
+        if (!res.ok) throw new Error((await res.text()).trim() || 'Request failed');
+        return res.json();
+    };
+
+    const handleTwoFactorSetup = async () => {
+        try {
+            const setup = await twoFactorRequest('setup');
+            setTwoFactor(tf => ({ ...tf, setup, code: '', recoveryCodes: [] }));
+        } catch (error) { addNotification(error.message, "error") }
+    };
+
+    const handleTwoFactorEnable = async (e) => {
+        e.preventDefault();
+        try {
+            const data = await twoFactorRequest('enable', { code: twoFactor.code });
+            setTwoFactor({ enabled: true, setup: null, code: '', password: '', recoveryCodes: data.recovery_codes || [] });
+            addNotification("Two-factor authentication enabled", "success");
+        } catch (error) { addNotification(error.message, "error") }
+    };
+
+    const handleTwoFactorDisable = async (e) => {
+        e.preventDefault();
+        try {
+            await twoFactorRequest('disable', { password: twoFactor.password, code: twoFactor.code });
+            setTwoFactor({ enabled: false, setup: null, code: '', password: '', recoveryCodes: [] });
+            addNotification("Two-factor authentication disabled", "success");
+        } catch (error) { addNotification(error.message, "error") }
+    };
+
     const handleFlushData = async () => {
         if (!window.confirm("CRITICAL: This will permanently delete all device logs and subscription history! System settings will remain. Proceed?")) return;
         try {
@@ -651,6 +708,15 @@ const AdminDashboard = () => {
                             <div>
                                 <h4 className="font-bold text-lg text-white">{req.device_name || 'New User'}</h4>
                                 <p className="text-xs text-slate-500 font-mono tracking-tight">{req.mac_address}</p>
+                                {req.suspicious && (
+                                    <div className="mt-2 space-y-1">
+                                        {req.flags.map((flag) => (
+                                            <p key={flag} className="flex items-center gap-1 text-[11px] font-semibold text-amber-400">
+                                                <ShieldAlert size={12} /> {flag}
+                                            </p>
+                                        ))}
+                                    </div>
+                                )}
                             </div>
                         </div>
 
@@ -829,6 +895,79 @@ const AdminDashboard = () => {
                         {isUpdatingPass ? 'Updating...' : 'Update Security Key'}
                     </button>
                 </form>
+
+                <div className="pt-8 border-t border-white/5 space-y-5">
+                    <div className="flex justify-between items-center">
+                        <h4 className="font-bold text-white flex items-center gap-2">
+                            <ShieldCheck size={18} className="text-indigo-400" /> Two-Factor Authentication
+                        </h4>
+                        <span className={`text-[10px] font-black uppercase tracking-widest ${twoFactor.enabled ? 'text-green-400' : 'text-slate-500'}`}>
+                            {twoFactor.enabled ? 'On' : 'Off'}
+                        </span>
+                    </div>
+
+                    {twoFactor.recoveryCodes.length > 0 && (
+                        <div className="p-5 bg-amber-500/5 border border-amber-500/20 rounded-2xl space-y-3">
+                            <p className="text-[11px] text-amber-300 font-bold">Save these recovery codes now. Each works once if you lose your authenticator; they are not shown again.</p>
+                            <div className="grid grid-cols-2 gap-2 font-mono text-sm text-white">
+                                {twoFactor.recoveryCodes.map(c => <span key={c}>{c}</span>)}
+                            </div>
+                        </div>
+                    )}
+
+                    {!twoFactor.enabled && !twoFactor.setup && (
+                        <button
+                            onClick={handleTwoFactorSetup}
+                            className="w-full bg-white/5 hover:bg-white/10 text-white font-black py-4 rounded-2xl border border-white/10 uppercase tracking-widest text-xs transition-all"
+                        >
+                            Set Up Authenticator App
+                        </button>
+                    )}
+
+                    {!twoFactor.enabled && twoFactor.setup && (
+                        <form onSubmit={handleTwoFactorEnable} className="space-y-4">
+                            <p className="text-[11px] text-slate-400 font-medium">Add this key to your authenticator app (or open the link on your phone), then enter the 6-digit code it shows.</p>
+                            <div className="p-4 bg-white/5 rounded-2xl font-mono text-sm text-indigo-300 break-all">{twoFactor.setup.secret}</div>
+                            <a href={twoFactor.setup.uri} className="block text-[10px] font-bold uppercase tracking-widest text-indigo-400 hover:text-indigo-300">Open in authenticator</a>
+                            <input
+                                type="text"
+                                inputMode="numeric"
+                                placeholder="123456"
+                                className="input-field m-0"
+                                value={twoFactor.code}
+                                onChange={e => setTwoFactor({ ...twoFactor, code: e.target.value })}
+                                required
+                            />
+                            <button type="submit" className="w-full bg-indigo-600 hover:bg-indigo-500 text-white font-black py-4 rounded-2xl uppercase tracking-widest text-xs transition-all">
+                                Verify & Enable
+                            </button>
+                        </form>
+                    )}
+
+                    {twoFactor.enabled && (
+                        <form onSubmit={handleTwoFactorDisable} className="space-y-4">
+                            <input
+                                type="password"
+                                placeholder="Current password"
+                                className="input-field m-0"
+                                value={twoFactor.password}
+                                onChange={e => setTwoFactor({ ...twoFactor, password: e.target.value })}
+                                required
+                            />
+                            <input
+                                type="text"
+                                placeholder="Authenticator or recovery code"
+                                className="input-field m-0"
+                                value={twoFactor.code}
+                                onChange={e => setTwoFactor({ ...twoFactor, code: e.target.value })}
+                                required
+                            />
+                            <button type="submit" className="w-full bg-red-500/10 hover:bg-red-500 text-red-500 hover:text-white font-black py-4 rounded-2xl border border-red-500/20 uppercase tracking-widest text-xs transition-all">
+                                Disable Two-Factor
+                            </button>
+                        </form>
+                    )}
+                </div>
             </div>
 
             <div className="glass p-8 border-red-500/10">
@@ -840,7 +979,7 @@ const AdminDashboard = () => {
                     <ShieldAlert size={32} className="text-red-500/20" />
                 </div>
 
-                <div className="p-6 bg-red-500/5 border border-red-500/10 rounded-3xl space-y-4">
+                {can('system.flush') && <div className="p-6 bg-red-500/5 border border-red-500/10 rounded-3xl space-y-4">
                     <h4 className="font-bold text-red-400 flex items-center gap-2">
                         <Trash2 size={18} /> Flush System Activity
                     </h4>
@@ -854,7 +993,7 @@ const AdminDashboard = () => {
                     >
                         Execute Data Flush
                     </button>
-                </div>
+                </div>}
 
                 <div className="mt-8 p-6 bg-white/5 border border-white/5 rounded-3xl">
                     <h4 className="font-bold text-white flex items-center gap-2 mb-4">
@@ -879,9 +1018,9 @@ const AdminDashboard = () => {
         </div>
     );
 
-    const handleLogout = () => {
-        localStorage.removeItem('admin_token');
-        localStorage.removeItem('admin_role');
+    const handleLogout = async () => {
+        await fetch('/api/admin/logout', { method: 'POST', credentials: 'same-origin' }).catch(() => {});
+        clearAdminSession();
         window.location.href = '/admin';
     };
 
@@ -905,6 +1044,12 @@ const AdminDashboard = () => {
                         </div>
                     </header>
 
+                    {mustChangePassword && (
+                        <div className="p-5 rounded-2xl bg-amber-500/10 border border-amber-500/30 text-amber-300 text-sm font-bold">
+                            Please choose a new password before using the dashboard.
+                        </div>
+                    )}
+
                     {activeTab === 'overview' && renderOverview()}
                     {activeTab === 'users' && renderUsers()}
                     {activeTab === 'plans' && renderPricingPlans()}
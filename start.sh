@@ -33,8 +33,6 @@ if ! command -v npm >/dev/null 2>&1; then
     install_dependency "Node.js & NPM" "curl -fsSL https://deb.nodesource.com/setup_20.x | sudo -E bash - && sudo apt install -y nodejs"
 fi
 
-command -v arp-scan >/dev/null 2>&1 || install_dependency "arp-scan" "sudo apt update && sudo apt install -y arp-scan"
-command -v arpspoof >/dev/null 2>&1 || install_dependency "arpspoof" "sudo apt update && sudo apt install -y dsniff"
 command -v conntrack >/dev/null 2>&1 || install_dependency "conntrack" "sudo apt update && sudo apt install -y conntrack"
 command -v fuser >/dev/null 2>&1 || install_dependency "fuser" "sudo apt update && sudo apt install -y psmisc"
 command -v arp >/dev/null 2>&1 || install_dependency "net-tools (arp)" "sudo apt update && sudo apt install -y net-tools"
@@ -78,7 +76,6 @@ cleanup() {
     sudo fuser -k 8080/tcp 53/udp 53/tcp 5353/udp 5353/tcp > /dev/null 2>&1
     sudo systemctl start avahi-daemon.service avahi-daemon.socket > /dev/null 2>&1
     sudo systemctl start systemd-resolved > /dev/null 2>&1
-    sudo pkill arpspoof
     echo "System Stopped."
     exit
 }